@@ -3,19 +3,28 @@ package main
 import (
 	"context"
 	"io"
+	"math"
 	"math/rand"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/richardtsai/thestral2/db"
 	. "github.com/richardtsai/thestral2/lib"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+const relayBufferSize = 32 * 1024
+
+// New requests are delayed for at most bufPressureMaxDelay while the buffer
+// memory limit is exceeded, which is checked every bufPressureCheckInterval.
 const (
-	defaultConnectTimeout = time.Minute * 1
-	relayBufferSize       = 32 * 1024
+	bufPressureMaxDelay      = time.Second
+	bufPressureCheckInterval = time.Millisecond * 10
 )
 
 // Thestral is the main thestral app.
@@ -24,9 +33,18 @@ type Thestral struct {
 	downstreams    map[string]ProxyServer
 	upstreams      map[string]ProxyClient
 	upstreamNames  []string
-	ruleMatcher    *RuleMatcher
+	dialSlots      map[string]chan struct{}
+	rules          atomic.Value // *ruleSet
+	configFile     string       // used to reload the rules
+	dsLabels       map[string]map[string]string
+	dsDefaults     map[string][]string // upstreams overriding the default rule
 	connectTimeout time.Duration
+	maxTunnels     int
+	bufMemLimit    int64 // of GlobalBufPool, 0 for unlimited
+	domainCache    int   // size of the domain cache of the rule matchers
+	denyUnmatched  bool  // reject the requests matching no rule
 	monitor        AppMonitor
+	pendingCount   int32 // requests not yet relaying, used atomically
 }
 
 // NewThestralApp creates a Thestral app object from the given configuration.
@@ -41,6 +59,9 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 	app = &Thestral{
 		downstreams: make(map[string]ProxyServer),
 		upstreams:   make(map[string]ProxyClient),
+		dialSlots:   make(map[string]chan struct{}),
+		dsLabels:    make(map[string]map[string]string),
+		dsDefaults:  make(map[string][]string),
 	}
 
 	// create logger
@@ -48,6 +69,8 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 		app.log, err = CreateLogger(config.Logging)
 		if err != nil {
 			err = errors.WithMessage(err, "failed to create logger")
+		} else {
+			SetTransportLogger(app.log.Named("transport"))
 		}
 	}
 
@@ -66,12 +89,28 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 					err, "failed to create downstream server: "+k)
 				break
 			}
+			if err = ValidateLabels(v.Labels); err != nil {
+				err = errors.WithMessage(err, "invalid labels of downstream: "+k)
+				break
+			}
+			app.dsLabels[k] = v.Labels
 		}
 	}
 
 	// create upstream clients
+	var upstreamConfigs map[string]ProxyConfig
 	if err == nil {
-		for k, v := range config.Upstreams {
+		upstreamConfigs, err = ExpandJumpChains(config.Upstreams)
+	}
+	if err == nil {
+		for k, v := range upstreamConfigs {
+			if v.MaxConcurrentDials < 0 {
+				err = errors.New(
+					"'max_concurrent_dials' should not be negative: " + k)
+				break
+			} else if v.MaxConcurrentDials > 0 { // unlimited if no slots
+				app.dialSlots[k] = make(chan struct{}, v.MaxConcurrentDials)
+			}
 			app.upstreams[k], err = CreateProxyClient(v)
 			if err != nil {
 				err = errors.WithMessage(
@@ -81,21 +120,20 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 			app.upstreamNames = append(app.upstreamNames, k)
 		}
 	}
+	if err == nil {
+		err = app.setDownstreamDefaults(config.Downstreams)
+	}
 
 	// create rule matcher
-	if err == nil {
-		app.ruleMatcher, err = NewRuleMatcher(config.Rules)
-		if err != nil {
-			err = errors.WithMessage(err, "failed to create rule matcher")
-		}
+	if err == nil && config.Misc.DomainCacheSize < 0 {
+		err = errors.New("'domain_cache_size' should not be negative")
 	}
 	if err == nil {
-		for _, ruleUpstream := range app.ruleMatcher.AllUpstreams {
-			if _, ok := app.upstreams[ruleUpstream]; !ok {
-				err = errors.Errorf(
-					"undefined upstream '%s' used in the rule set",
-					ruleUpstream)
-			}
+		app.domainCache = config.Misc.DomainCacheSize
+		var rules *ruleSet
+		if rules, err = app.newRuleSet(config.Rules); err == nil {
+			app.rules.Store(rules)
+			app.logRules(config.Rules)
 		}
 	}
 
@@ -111,16 +149,312 @@ func NewThestralApp(config Config) (app *Thestral, err error) {
 				err = errors.New("'connect_timeout' should be greater than 0")
 			}
 		} else {
-			app.connectTimeout = defaultConnectTimeout
+			app.connectTimeout = DefaultConnectTimeout
+		}
+	}
+	if err == nil {
+		app.denyUnmatched, err = config.Misc.DenyUnmatched()
+	}
+	if err == nil {
+		if config.Misc.MaxTunnels < 0 {
+			err = errors.New("'max_tunnels' should not be negative")
+		}
+		app.maxTunnels = config.Misc.MaxTunnels
+	}
+	if err == nil && config.Misc.BufferMemoryLimit != "" {
+		limit, e := ParseBytes(config.Misc.BufferMemoryLimit)
+		if e != nil || limit == 0 || limit > math.MaxInt64 {
+			err = errors.Errorf("invalid 'buffer_memory_limit': %q",
+				config.Misc.BufferMemoryLimit)
+		}
+		app.bufMemLimit = int64(limit)
+	}
+	monitorInterval := DefaultMonitorUpdateInterval
+	if err == nil && config.Misc.MonitorInterval != "" {
+		monitorInterval, err = time.ParseDuration(config.Misc.MonitorInterval)
+		if err != nil {
+			err = errors.WithStack(err)
+		}
+		if err == nil && monitorInterval <= 0 {
+			err = errors.New("'monitor_interval' should be greater than 0")
+		}
+	}
+	if err == nil && config.Misc.TunnelLog != nil {
+		var sink TunnelSink
+		if sink, err = NewTunnelSink(
+			app.log.Named("tunnel_log"), *config.Misc.TunnelLog); err != nil {
+			err = errors.WithMessage(err, "failed to create tunnel log")
+		} else {
+			app.monitor.SetTunnelSink(sink)
+		}
+	}
+	if err == nil {
+		if config.Misc.HistorySize < 0 {
+			err = errors.New("'history_size' should not be negative")
+		}
+		app.monitor.SetHistorySize(config.Misc.HistorySize)
+	}
+	if err == nil && config.Misc.Stats != nil {
+		err = app.initStats(*config.Misc.Stats)
+	}
+	if err == nil && config.Misc.ValidateUpstreamsOnStart != "" {
+		var target Address
+		target, err = ParseAddress(config.Misc.ValidateUpstreamsOnStart)
+		if err != nil {
+			err = errors.WithMessage(
+				err, "invalid 'validate_upstreams_on_start'")
+		} else {
+			err = app.validateUpstreams(target, upstreamConfigs)
 		}
 	}
 	if err == nil && config.Misc.EnableMonitor {
-		app.monitor.Start(config.Misc.MonitorPath)
+		app.monitor.SetProber(app.probe)
+		app.monitor.SetRuleReloader(app.ReloadRules)
+		app.monitor.SetProcessStats(config.Misc.ProcessStats)
+		app.monitor.Start(config.Misc.MonitorPath, monitorInterval)
 	}
 
 	return
 }
 
+// validateUpstreams probes the target via all the upstreams concurrently,
+// failing if any of the non-optional ones cannot reach it.
+func (t *Thestral) validateUpstreams(
+	target Address, configs map[string]ProxyConfig) error {
+	var wg sync.WaitGroup
+	pErrs := make([]*ProxyError, len(t.upstreamNames))
+	for i, name := range t.upstreamNames {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(
+				context.Background(), t.connectTimeout)
+			defer cancel()
+			pErrs[i] = t.probe(ctx, name, target)
+		}(i, name)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, name := range t.upstreamNames {
+		if pErrs[i] == nil {
+			continue
+		}
+		t.log.Warnw(
+			"upstream failed the validation", "upstream", name,
+			"target", target, "error", pErrs[i].Error,
+			"reason", pErrs[i].Reason, "optional", configs[name].Optional)
+		if !configs[name].Optional {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("upstreams unable to reach %s: %v", target, failed)
+	}
+	return nil
+}
+
+func (t *Thestral) initStats(config StatsConfig) error {
+	if !db.Inited {
+		return errors.New("'stats' requires 'db'")
+	}
+	dao, err := db.NewStatsDAO()
+	if err != nil {
+		return err
+	}
+	err = t.monitor.SetStatsStore(t.log.Named("stats"), dao, config)
+	if err != nil {
+		_ = dao.Close()
+		return errors.WithMessage(err, "failed to set up 'stats'")
+	}
+	return nil
+}
+
+func (t *Thestral) setDownstreamDefaults(
+	downstreams map[string]ProxyConfig) error {
+	for k, v := range downstreams {
+		if len(v.DefaultUpstreams) == 0 {
+			continue
+		}
+		for _, upstream := range v.DefaultUpstreams {
+			if _, ok := t.upstreams[upstream]; !ok {
+				return errors.Errorf(
+					"undefined upstream '%s' used by downstream '%s'",
+					upstream, k)
+			}
+		}
+		t.dsDefaults[k] = v.DefaultUpstreams
+	}
+	return nil
+}
+
+// ruleSet is a snapshot of the rules, which is replaced as a whole when the
+// rules are reloaded.
+type ruleSet struct {
+	matcher    *RuleMatcher
+	labels     map[string]map[string]string
+	rateLimits map[string]uint64 // bytes per second, only the limited ones
+	dscps      map[string]int    // only the marked ones
+	configs    map[string]RuleConfig
+	logLevels  map[string]zapcore.Level // only the overridden ones
+	dataCaps   map[string]dataCap       // only the capped ones
+	resolves   map[string]bool          // only the ones resolving locally
+}
+
+// dataCap limits a tunnel, with 0 for unlimited.
+type dataCap struct {
+	bytes    uint64
+	duration time.Duration
+}
+
+func (t *Thestral) newRuleSet(config map[string]RuleConfig) (*ruleSet, error) {
+	matcher, err := NewRuleMatcher(config)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create rule matcher")
+	}
+	matcher.SetDomainCacheSize(t.domainCache) // a new cache on every reload
+	for _, ruleUpstream := range matcher.AllUpstreams {
+		if _, ok := t.upstreams[ruleUpstream]; !ok {
+			return nil, errors.Errorf(
+				"undefined upstream '%s' used in the rule set", ruleUpstream)
+		}
+	}
+	rules := &ruleSet{
+		matcher:    matcher,
+		labels:     make(map[string]map[string]string),
+		rateLimits: make(map[string]uint64),
+		dscps:      make(map[string]int),
+		configs:    config,
+		logLevels:  make(map[string]zapcore.Level),
+		dataCaps:   make(map[string]dataCap),
+		resolves:   make(map[string]bool),
+	}
+	for k, v := range config {
+		if err = ValidateLabels(v.Labels); err != nil {
+			return nil, errors.WithMessage(err, "invalid labels of rule: "+k)
+		}
+		rules.labels[k] = v.Labels
+		if v.RateLimit != "" {
+			limit, err := ParseBytes(v.RateLimit)
+			if err != nil || limit == 0 {
+				return nil, errors.Errorf(
+					"invalid 'rate_limit' of rule '%s': %q", k, v.RateLimit)
+			}
+			rules.rateLimits[k] = limit
+		}
+		if v.DSCP < 0 || v.DSCP > 63 {
+			return nil, errors.Errorf(
+				"invalid 'dscp' of rule '%s': %d", k, v.DSCP)
+		} else if v.DSCP > 0 {
+			rules.dscps[k] = v.DSCP
+		}
+		if v.LogLevel != "" {
+			if rules.logLevels[k], err = ParseLogLevel(v.LogLevel); err != nil {
+				return nil, errors.WithMessage(err, "invalid rule: "+k)
+			}
+		}
+		var limits dataCap
+		if v.MaxBytes != "" {
+			limits.bytes, err = ParseBytes(v.MaxBytes)
+			if err != nil || limits.bytes == 0 {
+				return nil, errors.Errorf(
+					"invalid 'max_bytes' of rule '%s': %q", k, v.MaxBytes)
+			}
+		}
+		if v.MaxDuration != "" {
+			limits.duration, err = time.ParseDuration(v.MaxDuration)
+			if err != nil || limits.duration <= 0 {
+				return nil, errors.Errorf(
+					"invalid 'max_duration' of rule '%s': %q", k, v.MaxDuration)
+			}
+		}
+		if limits != (dataCap{}) {
+			rules.dataCaps[k] = limits
+		}
+		switch v.Resolve {
+		case "", "auto", "remote": // see logRules for the direct upstreams
+		case "local":
+			rules.resolves[k] = true
+		default:
+			return nil, errors.Errorf(
+				"invalid 'resolve' of rule '%s': %q", k, v.Resolve)
+		}
+	}
+	return rules, nil
+}
+
+// directUpstreamOf returns a direct upstream the rule may use, including the
+// default upstreams of the downstreams for the default rule, or an empty
+// string if there are none.
+func (t *Thestral) directUpstreamOf(rule string, config RuleConfig) string {
+	upstreams := append([]string{}, config.Upstreams...)
+	for _, group := range config.UpstreamGroups {
+		upstreams = append(upstreams, group...)
+	}
+	if rule == DefaultRuleName {
+		for _, dsDefaults := range t.dsDefaults {
+			upstreams = append(upstreams, dsDefaults...)
+		}
+	}
+	for _, upstream := range upstreams {
+		if _, ok := t.upstreams[upstream].(*DirectTCPClient); ok {
+			return upstream
+		}
+	}
+	return ""
+}
+
+func (t *Thestral) getRules() *ruleSet {
+	return t.rules.Load().(*ruleSet)
+}
+
+// ReloadRules re-reads the rules from the configuration file and replaces
+// the current ones. The other parts of the configuration are ignored. The
+// current rules are kept if the new ones are invalid.
+func (t *Thestral) ReloadRules() error {
+	config, err := ParseConfigFile(t.configFile)
+	if err != nil {
+		return errors.WithMessage(err, "failed to read the configuration")
+	}
+	return t.reloadRules(config.Rules)
+}
+
+func (t *Thestral) reloadRules(config map[string]RuleConfig) error {
+	rules, err := t.newRuleSet(config)
+	if err != nil {
+		t.log.Errorw("failed to reload rules", "error", err)
+		return err
+	}
+	t.rules.Store(rules)
+	t.log.Infow("rules reloaded", "count", len(config))
+	t.logRules(config)
+	return nil
+}
+
+// logRules logs the loaded rules with their annotations.
+func (t *Thestral) logRules(config map[string]RuleConfig) {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.log.Infow("rule loaded", "rule", name,
+			"description", config[name].Description,
+			"tags", config[name].Tags)
+		if config[name].Resolve != "remote" {
+			continue
+		}
+		if direct := t.directUpstreamOf(name, config[name]); direct != "" {
+			t.log.Warnw(
+				"direct upstreams always resolve the domain names locally, "+
+					"regardless of 'resolve: remote'",
+				"rule", name, "upstream", direct)
+		}
+	}
+}
+
 // Run starts the thestral app and blocks until the context is canceled.
 func (t *Thestral) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
@@ -147,6 +481,12 @@ func (t *Thestral) Run(ctx context.Context) error {
 
 	t.log.Info("thestral app started")
 	wg.Wait()
+	if err := t.monitor.CloseTunnelSink(); err != nil {
+		t.log.Warnw("failed to close the tunnel log", "error", err)
+	}
+	if err := t.monitor.CloseStatsStore(); err != nil {
+		t.log.Warnw("failed to close the stats store", "error", err)
+	}
 	return nil
 }
 
@@ -165,6 +505,28 @@ func (t *Thestral) processRequests(
 				"clientAddr", req.PeerAddr(),
 				"target", req.TargetAddr(),
 				"userIDs", peerIDs)
+			if t.monitor.Draining() {
+				req.Logger().Warnw(
+					"request rejected as the server is draining")
+				go req.Fail(NewOverloadedError(errors.New("draining")))
+				continue
+			}
+			if !t.waitBufferMemory(ctx) {
+				req.Logger().Warnw(
+					"request rejected as the buffer memory limit is reached",
+					"inUse", GlobalBufPool.InUse(), "limit", t.bufMemLimit)
+				go req.Fail(NewOverloadedError(
+					errors.New("buffer memory limit reached")))
+				continue
+			}
+			if !t.reserveTunnel() {
+				req.Logger().Warnw(
+					"request rejected as the tunnel limit is reached",
+					"maxTunnels", t.maxTunnels)
+				// don't let a slow client block the dispatching
+				go req.Fail(NewOverloadedError(errors.New("too many tunnels")))
+				continue
+			}
 			go t.processOneRequest(ctx, req, dsName)
 		case <-ctx.Done():
 			return
@@ -172,106 +534,417 @@ func (t *Thestral) processRequests(
 	}
 }
 
+// waitBufferMemory delays the dispatching while the buffers in use exceed
+// the limit, so that the downstreams stop accepting for a while. It reports
+// whether the buffers in use fall below the limit in time.
+func (t *Thestral) waitBufferMemory(ctx context.Context) bool {
+	if t.bufMemLimit <= 0 || GlobalBufPool.InUse() < t.bufMemLimit {
+		return true
+	}
+	t.log.Warnw("delaying new tunnels as the buffer memory limit is reached",
+		"inUse", GlobalBufPool.InUse(), "limit", t.bufMemLimit)
+	timer := time.NewTimer(bufPressureMaxDelay)
+	defer timer.Stop()
+	ticker := time.NewTicker(bufPressureCheckInterval)
+	defer ticker.Stop()
+	for GlobalBufPool.InUse() >= t.bufMemLimit {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// reserveTunnel counts a new request as pending if the tunnel limit is not
+// reached. The pending count is only updated if it's unchanged since the
+// check, so that concurrent downstreams cannot overshoot the limit.
+func (t *Thestral) reserveTunnel() bool {
+	for {
+		pending := atomic.LoadInt32(&t.pendingCount)
+		if t.maxTunnels > 0 &&
+			t.monitor.ActiveCount()+int(pending) >= t.maxTunnels {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&t.pendingCount, pending, pending+1) {
+			return true
+		}
+	}
+}
+
 func (t *Thestral) processOneRequest(
 	ctx context.Context, req ProxyRequest, dsName string) {
+	isPending := true
+	defer func() {
+		if isPending {
+			atomic.AddInt32(&t.pendingCount, -1)
+		}
+	}()
+
 	// match against rule set
-	ruleName := ""
-	var upstreams []string
 	switch addr := req.TargetAddr().(type) {
-	case *TCP4Addr:
-		ruleName, upstreams = t.ruleMatcher.MatchIP(addr.IP)
-	case *TCP6Addr:
-		ruleName, upstreams = t.ruleMatcher.MatchIP(addr.IP)
-	case *DomainNameAddr:
-		ruleName, upstreams = t.ruleMatcher.MatchDomain(addr.DomainName)
+	case *TCP4Addr, *TCP6Addr, *DomainNameAddr:
 	default:
 		req.Logger().Errorw("unknown target address", "addr", addr)
 		req.Fail(&ProxyError{Error: nil, ErrType: ProxyAddrUnsupported})
 		return
 	}
-
-	// select an upstream
-	if ruleName == "" { // unmatch and no default rule, allow all
-		upstreams = t.upstreamNames
-	} else if len(upstreams) == 0 { // no upstream, reject
-		req.Logger().Errorw(
+	client := ClientInfo{Addr: req.PeerAddr()}
+	client.IDs, _ = req.GetPeerIdentifiers() // already logged if failed
+	rules := t.getRules()
+	ruleName, groups := t.matchRule(rules, dsName, req.TargetAddr(), client)
+	log := req.Logger()
+	if level, ok := rules.logLevels[ruleName]; ok {
+		log = WithLogLevel(log, level)
+	}
+	if len(groups) == 0 { // no upstream, reject
+		log.Errorw(
 			"request rejected by rule",
 			"rule", ruleName, "addr", req.TargetAddr())
-		req.Fail(&ProxyError{Error: nil, ErrType: ProxyNotAllowed})
+		req.Fail(&ProxyError{
+			Error: nil, ErrType: ProxyNotAllowed, Reason: ReasonNotAllowed})
 		return
 	}
-	//TODO: the selection is not actually uniform, fix it
-	selected := upstreams[rand.Intn(len(upstreams))]
-	req.Logger().Debugw(
-		"upstream selected",
-		"rule", ruleName, "upstream", selected, "addr", req.TargetAddr())
-	upstream := t.upstreams[selected]
-
-	// make request
-	reqCtx, cancelFunc := context.WithTimeout(ctx, t.connectTimeout)
-	defer cancelFunc()
-	startTime := time.Now()
-	upConn, boundAddr, pErr := upstream.Request(reqCtx, req.TargetAddr())
+	if wuh, ok := req.(WithUpstreamHint); ok && wuh.UpstreamHint() != "" {
+		hint := wuh.UpstreamHint()
+		if groups = filterUpstreamGroups(groups, hint); len(groups) == 0 {
+			log.Errorw(
+				"upstream hint not allowed by rule",
+				"rule", ruleName, "addr", req.TargetAddr(), "hint", hint)
+			req.Fail(&ProxyError{
+				Error: nil, ErrType: ProxyNotAllowed, Reason: ReasonNotAllowed})
+			return
+		}
+	}
+
+	// pass the IP address instead if required by the rule
+	origTarget := req.TargetAddr()
+	target := origTarget
+	if rules.resolves[ruleName] {
+		var pErr *ProxyError
+		resolveCtx, cancel := context.WithTimeout(ctx, t.connectTimeout)
+		target, pErr = resolveLocally(resolveCtx, target)
+		cancel()
+		if pErr != nil {
+			log.Errorw(
+				"failed to resolve target", "rule", ruleName,
+				"addr", req.TargetAddr(), "error", pErr.Error)
+			req.Fail(pErr)
+			return
+		}
+		log.Debugw("target resolved", "addr", req.TargetAddr(), "ip", target)
+	}
+
+	// make request, falling back to the next group on failure
+	dialCtx := WithClientAddr(ctx, req.PeerAddr())
+	if dscp, ok := rules.dscps[ruleName]; ok {
+		dialCtx = WithDSCP(dialCtx, dscp)
+	}
+	// the groups of the default rule may be replaced by the downstream's
+	fallback := len(rules.configs[ruleName].UpstreamGroups) > 0 &&
+		!(ruleName == DefaultRuleName && len(t.dsDefaults[dsName]) > 0)
+	selected, upConn, boundAddr, connLatency, pErr := t.requestUpstream(
+		dialCtx, log, target, ruleName, groups, fallback)
 	if pErr != nil {
-		req.Logger().Errorw(
-			"connection failed", "addr", req.TargetAddr(),
-			"error", pErr.Error, "errType", pErr.ErrType, "upstream", selected)
 		req.Fail(pErr)
-		t.monitor.AddError(selected)
 		return
 	}
-	connLatency := time.Since(startTime)
 
 	var peerIDs []*PeerIdentifier
 	if wpi, ok := upConn.(WithPeerIdentifiers); ok {
 		peerIDs, _ = wpi.GetPeerIdentifiers()
 	}
-	req.Logger().Infow(
+	labels := MergeLabels(t.dsLabels[dsName], rules.labels[ruleName])
+	log.Infow(
 		"connection established",
 		"addr", req.TargetAddr(), "boundAddr", boundAddr, "upstream", selected,
-		"serverIDs", peerIDs)
+		"serverIDs", peerIDs, "labels", labels)
 	downRWC := req.Success(boundAddr)
 	relayCtx, cancelFunc := context.WithCancel(ctx)
 	tunnelMonitor := t.monitor.OpenTunnelMonitor(
 		req, ruleName, dsName, selected, peerIDs, boundAddr.String(),
-		connLatency, cancelFunc)
-	t.doRelay(relayCtx, cancelFunc, tunnelMonitor, req, downRWC, upConn) // block
+		labels, connLatency, cancelFunc)
+	if ts, ok := upConn.(TransportStats); ok {
+		tunnelMonitor.SetTransportStats(ts)
+	}
+	if cs, ok := upConn.(CompressionStats); ok {
+		tunnelMonitor.SetCompressionStats(cs)
+	}
+	rateLimit := rules.rateLimits[ruleName]
+	tunnelMonitor.SetRateLimit(rateLimit)
+	if c, ok := rules.configs[ruleName]; ok {
+		tunnelMonitor.SetRuleAnnotations(c.Description, c.Tags)
+	}
+	if addr := t.resolvedAddr(selected, req.TargetAddr(), upConn); addr != "" {
+		tunnelMonitor.SetResolvedAddr(addr)
+	} else if target != origTarget { // resolved locally
+		tunnelMonitor.SetResolvedAddr(target.String())
+	}
+	atomic.AddInt32(&t.pendingCount, -1) // now counted by the monitor
+	isPending = false
+	t.doRelay( // block
+		relayCtx, cancelFunc, tunnelMonitor, log, downRWC, upConn, rateLimit,
+		rules.dataCaps[ruleName])
+}
+
+// resolveLocally resolves a domain name target to its first IP address.
+// The other targets are returned as is.
+func resolveLocally(
+	ctx context.Context, target Address) (Address, *ProxyError) {
+	domain, ok := target.(*DomainNameAddr)
+	if !ok {
+		return target, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, domain.DomainName)
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no address found for " + domain.DomainName)
+	}
+	if err != nil {
+		return nil, &ProxyError{Error: errors.WithStack(err),
+			ErrType: ProxyConnectFailed, Reason: ReasonDNSFailure}
+	}
+	if ip := ips[0].IP.To4(); ip != nil {
+		return &TCP4Addr{IP: ip, Port: domain.Port}, nil
+	}
+	return &TCP6Addr{IP: ips[0].IP, Port: domain.Port}, nil
+}
+
+// resolvedAddr returns the IP address a domain name target was resolved to
+// and connected by a direct upstream, or an empty string if unknown.
+func (t *Thestral) resolvedAddr(
+	upstream string, target Address, upConn io.ReadWriteCloser) string {
+	if _, ok := target.(*DomainNameAddr); !ok {
+		return ""
+	}
+	if _, ok := t.upstreams[upstream].(*DirectTCPClient); !ok {
+		return ""
+	}
+	if conn, ok := upConn.(net.Conn); ok {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// matchRule returns the name of the rule matching the request and the
+// upstream groups to try, which are empty if the request should be rejected.
+// The name is empty if the request is not matched by any rule.
+func (t *Thestral) matchRule(
+	rules *ruleSet, dsName string, target Address, client ClientInfo) (
+	string, [][]string) {
+	unmatched := t.upstreamNames
+	if t.denyUnmatched {
+		unmatched = nil
+	}
+	return rules.matcher.Route(target, client, t.dsDefaults[dsName], unmatched)
+}
+
+// filterUpstreamGroups keeps only the upstream named by the hint in the
+// groups, dropping the groups without it.
+func filterUpstreamGroups(groups [][]string, hint string) [][]string {
+	var filtered [][]string
+	for _, group := range groups {
+		for _, name := range group {
+			if name == hint {
+				filtered = append(filtered, []string{name})
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// requestUpstream requests the target via the given upstream groups. Unless
+// fallback is set, only one member of the first group is picked at random
+// and given the whole connect timeout. Otherwise the members of a group are
+// tried in random order, and the next group is only tried if all the members
+// failed for reasons that lie with the upstreams. Each group has an equal
+// share of the remaining connect timeout, and each attempt may use all that
+// is left of its group's share.
+func (t *Thestral) requestUpstream(
+	ctx context.Context, log *zap.SugaredLogger, target Address,
+	ruleName string, groups [][]string, fallback bool) (
+	selected string, upConn io.ReadWriteCloser, boundAddr Address,
+	connLatency time.Duration, pErr *ProxyError) {
+	deadline := time.Now().Add(t.connectTimeout)
+	if !fallback {
+		group := groups[0]
+		selected = group[rand.Intn(len(group))]
+		log.Debugw(
+			"upstream selected", "rule", ruleName, "upstream", selected,
+			"addr", target)
+		upConn, boundAddr, connLatency, pErr = t.tryUpstream(
+			ctx, log, deadline, selected, target)
+		return
+	}
+	for i, group := range groups {
+		groupDeadline := time.Now().Add(
+			time.Until(deadline) / time.Duration(len(groups)-i))
+		for _, k := range rand.Perm(len(group)) {
+			selected = group[k]
+			log.Debugw(
+				"upstream selected", "rule", ruleName, "group", i,
+				"upstream", selected, "addr", target)
+			upConn, boundAddr, connLatency, pErr = t.tryUpstream(
+				ctx, log, groupDeadline, selected, target)
+			if pErr == nil {
+				return
+			}
+			if !pErr.UpstreamFault() || ctx.Err() != nil {
+				return // other upstreams won't help
+			}
+		}
+	}
+	return
+}
+
+// tryUpstream requests the target via one upstream before the deadline,
+// logging and recording the failure if any.
+func (t *Thestral) tryUpstream(
+	ctx context.Context, log *zap.SugaredLogger, deadline time.Time,
+	upstream string, target Address) (
+	upConn io.ReadWriteCloser, boundAddr Address,
+	connLatency time.Duration, pErr *ProxyError) {
+	reqCtx, cancelFunc := context.WithDeadline(ctx, deadline)
+	if pErr = t.acquireDialSlot(reqCtx, upstream); pErr == nil {
+		startTime := time.Now()
+		upConn, boundAddr, pErr = t.upstreams[upstream].Request(reqCtx, target)
+		connLatency = time.Since(startTime)
+		t.releaseDialSlot(upstream)
+	}
+	cancelFunc()
+	if pErr == nil {
+		return
+	}
+	log.Errorw(
+		"connection failed", "addr", target,
+		"error", pErr.Error, "errType", pErr.ErrType,
+		"reason", pErr.Reason, "upstream", upstream)
+	t.monitor.AddError(upstream, pErr.Reason)
+	return
+}
+
+// acquireDialSlot waits for a slot to dial via the upstream if its
+// concurrent dials are limited.
+func (t *Thestral) acquireDialSlot(
+	ctx context.Context, upstream string) *ProxyError {
+	if slots, ok := t.dialSlots[upstream]; ok {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			reason := ReasonTimeout
+			if ctx.Err() == context.Canceled {
+				reason = ReasonCanceled
+			}
+			return &ProxyError{
+				Error:   errors.WithMessage(ctx.Err(), "no slot to dial"),
+				ErrType: ProxyGeneralErr, Reason: reason}
+		}
+	}
+	t.monitor.AddDialsInFlight(upstream, 1)
+	return nil
+}
+
+func (t *Thestral) releaseDialSlot(upstream string) {
+	t.monitor.AddDialsInFlight(upstream, -1)
+	if slots, ok := t.dialSlots[upstream]; ok {
+		<-slots
+	}
+}
+
+// probe dials to the target via the given upstream and closes the connection
+// immediately. It is served by the monitor. The pre-connect pool of the
+// upstream, if any, is warmed up or drained in the background by the result.
+func (t *Thestral) probe(
+	ctx context.Context, upstream string, target Address) *ProxyError {
+	client, ok := t.upstreams[upstream]
+	if !ok {
+		return &ProxyError{
+			Error:   errors.New("unknown upstream: " + upstream),
+			ErrType: ProxyGeneralErr}
+	}
+	conn, _, pErr := client.Request(ctx, target)
+	if pErr == nil {
+		_ = conn.Close()
+	}
+	// a canceled probe tells nothing about the path
+	pool, ok := client.(WithPreConnPool)
+	if ok && ctx.Err() != context.Canceled {
+		go pool.UpdatePreConn(target, pErr)
+	}
+	return pErr
 }
 
 func (t *Thestral) doRelay(
 	relayCtx context.Context, cancelFunc context.CancelFunc,
-	tunnelMonitor *TunnelMonitor, req ProxyRequest,
-	downRWC io.ReadWriteCloser, upRWC io.ReadWriteCloser) {
+	tunnelMonitor *TunnelMonitor, log *zap.SugaredLogger,
+	downRWC io.ReadWriteCloser, upRWC io.ReadWriteCloser, rateLimit uint64,
+	limits dataCap) {
 	defer tunnelMonitor.Close()
-	relay := func(dst, src io.ReadWriteCloser, srcName string,
+	terminate := func(limit string) {
+		if tunnelMonitor.TerminateBy(limit) {
+			log.Infow("tunnel terminated by limit", "limit", limit)
+		}
+	}
+	var transferred uint64 // in both directions, used atomically
+	countBytes := func(report func(uint32)) func(uint32) {
+		if limits.bytes == 0 {
+			return report
+		}
+		return func(n uint32) {
+			report(n)
+			if atomic.AddUint64(&transferred, uint64(n)) > limits.bytes {
+				terminate("max_bytes")
+			}
+		}
+	}
+	if limits.duration > 0 {
+		timer := time.AfterFunc(
+			limits.duration, func() { terminate("max_duration") })
+		defer timer.Stop()
+	}
+
+	relay := func(dst io.Writer, src io.Reader, srcName string,
 		reportBytesTransfered func(uint32)) {
 		defer cancelFunc()
 		var n int64
 		var err error
 		n, err = t.relayHalf(dst, src, reportBytesTransfered)
 		if err == nil { // src closed
-			req.Logger().Infow(
+			log.Infow(
 				"connection closed", "src", srcName, "bytesTransferred", n)
 		} else if relayCtx.Err() == context.Canceled { // other direction closed
-			req.Logger().Infow(
+			log.Infow(
 				"relay ended", "src", srcName, "bytesTransferred", n)
 		} else { // error
-			req.Logger().Warnw(
+			log.Warnw(
 				"error occurred",
 				"error", err, "src", srcName, "bytesTransferred", n)
 		}
 	}
 
-	go relay(upRWC, downRWC, "downstream", tunnelMonitor.IncBytesUploaded)
-	go relay(downRWC, upRWC, "upstream", tunnelMonitor.IncBytesDownloaded)
+	var downR, upR io.Reader = downRWC, upRWC
+	if rateLimit > 0 { // a limiter for each direction, freed with the tunnel
+		downR = NewRateLimitedReader(
+			relayCtx, downRWC, NewRateLimiter(rateLimit))
+		upR = NewRateLimitedReader(relayCtx, upRWC, NewRateLimiter(rateLimit))
+	}
+	go relay(upRWC, downR, "downstream",
+		countBytes(tunnelMonitor.IncBytesUploaded))
+	go relay(downRWC, upR, "upstream",
+		countBytes(tunnelMonitor.IncBytesDownloaded))
 
 	<-relayCtx.Done() // block until done/canceled
 	if err := upRWC.Close(); err != nil {
-		req.Logger().Warnw(
+		log.Warnw(
 			"error occurred when closing upstream", "error", err)
 	}
 	if err := downRWC.Close(); err != nil {
-		req.Logger().Warnw(
+		log.Warnw(
 			"error occurred when closing downstream", "error", err)
 	}
 }
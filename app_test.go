@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/richardtsai/thestral2/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestReserveTunnel(t *testing.T) {
+	app := &Thestral{maxTunnels: 5}
+	var reserved int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if app.reserveTunnel() {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 5, reserved)
+	assert.EqualValues(t, 5, app.pendingCount)
+
+	atomic.AddInt32(&app.pendingCount, -1) // one request finished
+	assert.True(t, app.reserveTunnel())
+	assert.False(t, app.reserveTunnel())
+
+	unlimited := &Thestral{}
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.reserveTunnel())
+	}
+}
+
+// fakeUpstream fails with the given error, or blocks until the context is
+// done if it's nil.
+type fakeUpstream struct {
+	err      *ProxyError
+	requests int32
+}
+
+func (u *fakeUpstream) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	atomic.AddInt32(&u.requests, 1)
+	if u.err != nil {
+		return nil, nil, u.err
+	}
+	<-ctx.Done()
+	return nil, nil, &ProxyError{
+		Error: ctx.Err(), ErrType: ProxyGeneralErr, Reason: ReasonTimeout}
+}
+
+type okUpstream struct{}
+
+func (okUpstream) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	conn, _ := net.Pipe()
+	return conn, &TCP4Addr{IP: net.IPv4zero}, nil
+}
+
+func TestRequestUpstream(t *testing.T) {
+	upFailed := &ProxyError{ErrType: ProxyGeneralErr, Reason: ReasonTimeout}
+	targetFailed := &ProxyError{
+		ErrType: ProxyConnectFailed, Reason: ReasonRefused}
+	upstreams := map[string]*fakeUpstream{
+		"fail1":   {err: upFailed},
+		"fail2":   {err: upFailed},
+		"refused": {err: targetFailed},
+		"stalled": {},
+	}
+	app := &Thestral{
+		upstreams:      map[string]ProxyClient{"ok": okUpstream{}},
+		connectTimeout: time.Millisecond * 400,
+	}
+	for k, v := range upstreams {
+		app.upstreams[k] = v
+	}
+	request := func(groups ...[]string) (string, *ProxyError) {
+		for _, u := range upstreams {
+			atomic.StoreInt32(&u.requests, 0)
+		}
+		selected, conn, _, _, pErr := app.requestUpstream(
+			context.Background(), zap.NewNop().Sugar(),
+			&TCP4Addr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, "rule", groups,
+			true)
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return selected, pErr
+	}
+
+	// all members of a group are tried before falling back
+	selected, pErr := request([]string{"fail1", "fail2"}, []string{"ok"})
+	require.Nil(t, pErr)
+	assert.Equal(t, "ok", selected)
+	assert.EqualValues(t, 1, upstreams["fail1"].requests)
+	assert.EqualValues(t, 1, upstreams["fail2"].requests)
+
+	// errors of the target are not retried
+	selected, pErr = request([]string{"refused"}, []string{"fail1", "ok"})
+	require.NotNil(t, pErr)
+	assert.Equal(t, "refused", selected)
+	assert.Equal(t, ReasonRefused, pErr.Reason)
+	assert.EqualValues(t, 0, upstreams["fail1"].requests)
+
+	// a stalled group doesn't use up the timeout of the next one
+	startTime := time.Now()
+	selected, pErr = request([]string{"stalled"}, []string{"ok"})
+	require.Nil(t, pErr)
+	assert.Equal(t, "ok", selected)
+	assert.True(t, time.Since(startTime) < app.connectTimeout)
+	assert.EqualValues(t, 1, upstreams["stalled"].requests)
+
+	// but a member may use all that is left of the share of its group
+	startTime = time.Now()
+	selected, pErr = request([]string{"stalled", "ok"})
+	require.Nil(t, pErr)
+	assert.Equal(t, "ok", selected)
+	if upstreams["stalled"].requests > 0 {
+		assert.True(t, time.Since(startTime) >= app.connectTimeout)
+	}
+}
+
+func TestRequestUpstreamWithoutFallback(t *testing.T) {
+	upFailed := &ProxyError{ErrType: ProxyGeneralErr, Reason: ReasonTimeout}
+	failed := &fakeUpstream{err: upFailed}
+	stalled := &fakeUpstream{}
+	app := &Thestral{
+		upstreams: map[string]ProxyClient{
+			"failed": failed, "stalled": stalled},
+		connectTimeout: time.Millisecond * 200,
+	}
+	request := func(group ...string) (string, *ProxyError) {
+		selected, _, _, _, pErr := app.requestUpstream(
+			context.Background(), zap.NewNop().Sugar(),
+			&TCP4Addr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, "rule",
+			[][]string{group}, false)
+		return selected, pErr
+	}
+
+	// only one upstream is tried
+	for i := 0; i < 10; i++ {
+		_, pErr := request("failed", "stalled")
+		require.NotNil(t, pErr)
+	}
+	assert.EqualValues(
+		t, 10, atomic.LoadInt32(&failed.requests)+
+			atomic.LoadInt32(&stalled.requests))
+
+	// with the whole connect timeout
+	startTime := time.Now()
+	selected, pErr := request("stalled")
+	require.NotNil(t, pErr)
+	assert.Equal(t, "stalled", selected)
+	assert.True(t, time.Since(startTime) >= app.connectTimeout)
+}
+
+func TestRequestUpstreamDialSlots(t *testing.T) {
+	stalled := &fakeUpstream{}
+	app := &Thestral{
+		upstreams: map[string]ProxyClient{
+			"stalled": stalled, "ok": okUpstream{}},
+		dialSlots: map[string]chan struct{}{
+			"stalled": make(chan struct{}, 1)},
+		connectTimeout: time.Millisecond * 400,
+	}
+	request := func(groups ...[]string) (string, *ProxyError) {
+		selected, conn, _, _, pErr := app.requestUpstream(
+			context.Background(), zap.NewNop().Sugar(),
+			&TCP4Addr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, "rule", groups,
+			true)
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return selected, pErr
+	}
+	dialsInFlight := func(upstream string) int32 {
+		for _, r := range app.monitor.Report().Upstreams {
+			if r.Name == upstream {
+				return r.DialsInFlight
+			}
+		}
+		return 0
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = request([]string{"stalled"}) // holds the only slot
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	assert.EqualValues(t, 1, dialsInFlight("stalled"))
+
+	// waits for a slot rather than dialing, then falls back
+	selected, pErr := request([]string{"stalled"}, []string{"ok"})
+	require.Nil(t, pErr)
+	assert.Equal(t, "ok", selected)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&stalled.requests))
+	<-done
+	assert.EqualValues(t, 0, dialsInFlight("stalled"))
+	assert.EqualValues(t, 0, dialsInFlight("ok"))
+}
+
+// pooledUpstream records the probe results passed to its pool.
+type pooledUpstream struct {
+	fakeUpstream
+	updates chan *ProxyError
+}
+
+func (u *pooledUpstream) UpdatePreConn(target Address, pErr *ProxyError) {
+	u.updates <- pErr
+}
+
+func TestProbeUpdatesPreConn(t *testing.T) {
+	upFailed := &ProxyError{ErrType: ProxyGeneralErr, Reason: ReasonTimeout}
+	failed := &pooledUpstream{
+		fakeUpstream{err: upFailed}, make(chan *ProxyError, 1)}
+	app := &Thestral{upstreams: map[string]ProxyClient{"failed": failed}}
+	target := &TCP4Addr{IP: net.IPv4(1, 2, 3, 4), Port: 80}
+
+	assert.Equal(t, upFailed, app.probe(context.Background(), "failed", target))
+	select {
+	case pErr := <-failed.updates:
+		assert.Equal(t, upFailed, pErr)
+	case <-time.After(time.Second):
+		assert.Fail(t, "pool not updated")
+	}
+
+	// a canceled probe is not taken as a failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed.err = nil // stalled until canceled
+	assert.NotNil(t, app.probe(ctx, "failed", target))
+	select {
+	case <-failed.updates:
+		assert.Fail(t, "pool updated by a canceled probe")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDownstreamDefaultUpstreams(t *testing.T) {
+	app := &Thestral{
+		upstreams: map[string]ProxyClient{
+			"direct": okUpstream{}, "proxy": okUpstream{}},
+		upstreamNames: []string{"direct", "proxy"},
+		dsDefaults:    make(map[string][]string),
+	}
+	require.NoError(t, app.setDownstreamDefaults(map[string]ProxyConfig{
+		"lan": {DefaultUpstreams: []string{"direct"}},
+		"wan": {},
+	}))
+	assert.Error(t, app.setDownstreamDefaults(map[string]ProxyConfig{
+		"lan": {DefaultUpstreams: []string{"undefined"}},
+	}))
+
+	target := &DomainNameAddr{DomainName: "example.com", Port: 443}
+	blocked := &DomainNameAddr{DomainName: "blocked.com", Port: 443}
+	match := func(config map[string]RuleConfig, ds string,
+		addr Address) (string, [][]string) {
+		rules, err := app.newRuleSet(config)
+		require.NoError(t, err)
+		return app.matchRule(rules, ds, addr, ClientInfo{})
+	}
+
+	// no default rule
+	config := map[string]RuleConfig{
+		"block": {Domains: []string{"blocked.com"}}}
+	rule, groups := match(config, "lan", target)
+	assert.Equal(t, [][]string{{"direct"}}, groups)
+	assert.Empty(t, rule)
+	_, groups = match(config, "wan", target)
+	assert.Equal(t, [][]string{{"direct", "proxy"}}, groups)
+	rule, groups = match(config, "lan", blocked)
+	assert.Equal(t, "block", rule)
+	assert.Empty(t, groups)
+
+	// the upstreams of the default rule are overridden, but not the rule
+	config[DefaultRuleName] = RuleConfig{Upstreams: []string{"proxy"}}
+	rule, groups = match(config, "lan", target)
+	assert.Equal(t, DefaultRuleName, rule)
+	assert.Equal(t, [][]string{{"direct"}}, groups)
+	rule, groups = match(config, "wan", target)
+	assert.Equal(t, DefaultRuleName, rule)
+	assert.Equal(t, [][]string{{"proxy"}}, groups)
+
+	// a default rule denying the requests is kept
+	config[DefaultRuleName] = RuleConfig{}
+	rule, groups = match(config, "lan", target)
+	assert.Equal(t, DefaultRuleName, rule)
+	assert.Empty(t, groups)
+}
+
+func TestDenyUnmatched(t *testing.T) {
+	app := &Thestral{
+		upstreams:     map[string]ProxyClient{"direct": okUpstream{}},
+		upstreamNames: []string{"direct"},
+		dsDefaults:    map[string][]string{"lan": {"direct"}},
+		denyUnmatched: true,
+	}
+	target := &DomainNameAddr{DomainName: "example.com", Port: 443}
+	match := func(config map[string]RuleConfig, ds string) [][]string {
+		rules, err := app.newRuleSet(config)
+		require.NoError(t, err)
+		_, groups := app.matchRule(rules, ds, target, ClientInfo{})
+		return groups
+	}
+
+	config := map[string]RuleConfig{
+		"other": {Domains: []string{"other.com"}, Upstreams: []string{"direct"}}}
+	assert.Empty(t, match(config, "wan"))
+	assert.Equal(t, [][]string{{"direct"}}, match(config, "lan"))
+	config[DefaultRuleName] = RuleConfig{Upstreams: []string{"direct"}}
+	assert.Equal(t, [][]string{{"direct"}}, match(config, "wan"))
+}
+
+func TestFilterUpstreamGroups(t *testing.T) {
+	groups := [][]string{{"a", "b"}, {"c"}, {"b", "d"}}
+	assert.Equal(t, [][]string{{"b"}, {"b"}}, filterUpstreamGroups(groups, "b"))
+	assert.Equal(t, [][]string{{"c"}}, filterUpstreamGroups(groups, "c"))
+	assert.Empty(t, filterUpstreamGroups(groups, "e"))
+}
+
+func TestResolvedAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+
+	app := &Thestral{upstreams: map[string]ProxyClient{
+		"direct": &DirectTCPClient{}, "proxy": okUpstream{}}}
+	domain := &DomainNameAddr{DomainName: "localhost", Port: 80}
+	ip := &TCP4Addr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	assert.Equal(t, l.Addr().String(), app.resolvedAddr("direct", domain, conn))
+	assert.Empty(t, app.resolvedAddr("direct", ip, conn))
+	assert.Empty(t, app.resolvedAddr("proxy", domain, conn))
+}
+
+func TestResolveLocally(t *testing.T) {
+	app := &Thestral{upstreams: map[string]ProxyClient{
+		"direct": &DirectTCPClient{}, "proxy": okUpstream{}}}
+	rules, err := app.newRuleSet(map[string]RuleConfig{
+		"local": {Domains: []string{"a.com"}, Resolve: "local",
+			Upstreams: []string{"direct"}},
+		"remote": {Domains: []string{"b.com"}, Resolve: "remote",
+			Upstreams: []string{"proxy"}},
+		"auto": {Domains: []string{"c.com"}, Upstreams: []string{"direct"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"local": true}, rules.resolves)
+	_, err = app.newRuleSet(map[string]RuleConfig{
+		"invalid": {Domains: []string{"a.com"}, Resolve: "upstream"}})
+	assert.Error(t, err)
+
+	// the direct upstreams still resolve the domain names, with a warning
+	core, logs := observer.New(zap.WarnLevel)
+	app.log = zap.New(core).Sugar()
+	config := map[string]RuleConfig{
+		"remote": {Domains: []string{"b.com"}, Resolve: "remote",
+			Upstreams: []string{"proxy", "direct"}},
+		"proxied": {Domains: []string{"d.com"}, Resolve: "remote",
+			Upstreams: []string{"proxy"}},
+	}
+	rules, err = app.newRuleSet(config)
+	require.NoError(t, err)
+	assert.Empty(t, rules.resolves)
+	app.logRules(config)
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "remote", entries[0].ContextMap()["rule"])
+	assert.Equal(t, "direct", entries[0].ContextMap()["upstream"])
+
+	app.dsDefaults = map[string][]string{"lan": {"direct"}}
+	app.logRules(map[string]RuleConfig{
+		DefaultRuleName: {Resolve: "remote", Upstreams: []string{"proxy"}}})
+	assert.Len(t, logs.AllUntimed(), 2)
+
+	ctx := context.Background()
+	resolved, pErr := resolveLocally(
+		ctx, &DomainNameAddr{DomainName: "localhost", Port: 80})
+	require.Nil(t, pErr)
+	switch addr := resolved.(type) {
+	case *TCP4Addr:
+		assert.True(t, addr.IP.IsLoopback())
+		assert.EqualValues(t, 80, addr.Port)
+	case *TCP6Addr:
+		assert.True(t, addr.IP.IsLoopback())
+		assert.EqualValues(t, 80, addr.Port)
+	default:
+		assert.Fail(t, "unexpected address", "%v", resolved)
+	}
+	ip := &TCP4Addr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	resolved, pErr = resolveLocally(ctx, ip)
+	assert.Nil(t, pErr)
+	assert.Equal(t, ip, resolved)
+	_, pErr = resolveLocally(
+		ctx, &DomainNameAddr{DomainName: "nonexistent.invalid", Port: 80})
+	require.NotNil(t, pErr)
+	assert.Equal(t, ReasonDNSFailure, pErr.Reason)
+}
+
+func TestRuleLogLevel(t *testing.T) {
+	app := &Thestral{upstreams: map[string]ProxyClient{"direct": okUpstream{}}}
+	rules, err := app.newRuleSet(map[string]RuleConfig{
+		"verbose": {Domains: []string{"a.com"}, LogLevel: "debug"},
+		"normal":  {Domains: []string{"b.com"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t,
+		map[string]zapcore.Level{"verbose": zap.DebugLevel}, rules.logLevels)
+	_, err = app.newRuleSet(map[string]RuleConfig{
+		"verbose": {Domains: []string{"a.com"}, LogLevel: "verbose"}})
+	assert.Error(t, err)
+
+	core, logs := observer.New(zap.InfoLevel)
+	log := zap.New(core).Sugar().With("reqID", "ID")
+	log.Debug("dropped")
+	WithLogLevel(log, zap.DebugLevel).Debug("debug")
+	WithLogLevel(log, zap.ErrorLevel).Warn("dropped")
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "debug", entries[0].Message)
+	assert.Equal(t, "ID", entries[0].ContextMap()["reqID"])
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	failed := &fakeUpstream{
+		err: &ProxyError{ErrType: ProxyGeneralErr, Reason: ReasonRefused}}
+	app := &Thestral{
+		log: zap.NewNop().Sugar(),
+		upstreams: map[string]ProxyClient{
+			"ok": okUpstream{}, "failed": failed, "blocked": &fakeUpstream{}},
+		upstreamNames:  []string{"ok", "failed", "blocked"},
+		connectTimeout: time.Millisecond * 50,
+	}
+	target := &DomainNameAddr{DomainName: "example.com", Port: 80}
+
+	err := app.validateUpstreams(target, map[string]ProxyConfig{})
+	assert.EqualError(t, err,
+		"upstreams unable to reach example.com:80: [blocked failed]")
+	assert.EqualValues(t, 1, failed.requests)
+
+	assert.NoError(t, app.validateUpstreams(target, map[string]ProxyConfig{
+		"failed": {Optional: true}, "blocked": {Optional: true}}))
+}
+
+type relayTestRequest struct {
+	ProxyRequest // only the methods used by the reports are implemented
+}
+
+func (relayTestRequest) ID() string {
+	return "relay"
+}
+
+func (relayTestRequest) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	return nil, nil
+}
+
+func (relayTestRequest) PeerAddr() string {
+	return "127.0.0.1:1080"
+}
+
+func (relayTestRequest) TargetAddr() Address {
+	return &DomainNameAddr{DomainName: "example.com", Port: 80}
+}
+
+func TestDataCaps(t *testing.T) {
+	app := &Thestral{upstreams: map[string]ProxyClient{"direct": okUpstream{}}}
+	rules, err := app.newRuleSet(map[string]RuleConfig{
+		"capped": {Domains: []string{"a.com"}, MaxBytes: "1K",
+			MaxDuration: "1m"},
+		"normal": {Domains: []string{"b.com"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]dataCap{"capped": {1024, time.Minute}},
+		rules.dataCaps)
+	for _, c := range []RuleConfig{
+		{MaxBytes: "0"}, {MaxBytes: "1x"}, {MaxDuration: "0s"},
+		{MaxDuration: "1"},
+	} {
+		_, err = app.newRuleSet(map[string]RuleConfig{"invalid": c})
+		assert.Error(t, err, "%v", c)
+	}
+
+	relay := func(limits dataCap, send int) TunnelMonitorReport {
+		cli, downRWC := net.Pipe()
+		upRWC, svr := net.Pipe()
+		go func() { _, _ = io.Copy(ioutil.Discard, svr) }()
+		go func() { _, _ = cli.Write(make([]byte, send)) }()
+		ctx, cancel := context.WithCancel(context.Background())
+		tm := app.monitor.OpenTunnelMonitor(
+			relayTestRequest{}, "capped", "", "", nil, "", nil, 0, cancel)
+		done := make(chan struct{})
+		go func() {
+			app.doRelay(ctx, cancel, tm, zap.NewNop().Sugar(), downRWC, upRWC,
+				0, limits)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			_ = cli.Close() // not terminated
+			<-done
+		}
+		return tm.Report()
+	}
+
+	report := relay(dataCap{bytes: 1024}, 2048)
+	assert.Equal(t, "max_bytes", report.TerminatedBy)
+	assert.True(t, report.BytesUploaded > 1024)
+	report = relay(dataCap{bytes: 1024}, 1024)
+	assert.Empty(t, report.TerminatedBy)
+	report = relay(dataCap{duration: time.Millisecond * 100}, 0)
+	assert.Equal(t, "max_duration", report.TerminatedBy)
+}
+
+func TestDebugServerTLS(t *testing.T) {
+	server, err := newDebugServer("127.0.0.1:0", &TLSConfig{
+		Cert:         "test_files/test.server.pem",
+		Key:          "test_files/test.server.key.pem",
+		VerifyClient: true,
+		ClientCAs:    []string{"test_files/ca.pem"},
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", server.Addr)
+	require.NoError(t, err)
+	go func() { _ = server.ServeTLS(l, "", "") }()
+	defer server.Close() // nolint: errcheck
+
+	get := func(withCert bool) error {
+		pem, err := ioutil.ReadFile("test_files/ca.pem")
+		require.NoError(t, err)
+		tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+		require.True(t, tlsConfig.RootCAs.AppendCertsFromPEM(pem))
+		if withCert {
+			cert, err := tls.LoadX509KeyPair(
+				"test_files/test.pem", "test_files/test.key.pem")
+			require.NoError(t, err)
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   time.Second * 5,
+		}
+		resp, err := client.Get(
+			"https://" + l.Addr().String() + "/debug/pprof/cmdline")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	assert.NoError(t, get(true))
+	assert.Error(t, get(false))
+
+	server, err = newDebugServer("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	assert.Nil(t, server.TLSConfig)
+	_, err = newDebugServer("127.0.0.1:0", &TLSConfig{Cert: "x"})
+	assert.Error(t, err)
+}
+
+func TestWaitBufferMemory(t *testing.T) {
+	app := &Thestral{log: zap.NewNop().Sugar()}
+	assert.True(t, app.waitBufferMemory(context.Background())) // unlimited
+
+	app.bufMemLimit = GlobalBufPool.InUse() + 64*1024
+	buf := GlobalBufPool.Get(128 * 1024)
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		GlobalBufPool.Free(buf)
+	}()
+	start := time.Now()
+	assert.True(t, app.waitBufferMemory(context.Background()))
+	assert.True(t, time.Since(start) >= time.Millisecond*50)
+
+	buf = GlobalBufPool.Get(128 * 1024)
+	defer GlobalBufPool.Free(buf)
+	ctx, cancel := context.WithTimeout(
+		context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.False(t, app.waitBufferMemory(ctx))
+	assert.False(t, app.waitBufferMemory(context.Background()))
+}
@@ -28,7 +28,7 @@ func InitDB(config Config) error {
 		if err != nil {
 			return err
 		}
-		err = db.AutoMigrate(&User{}).Error // create tables when necessary
+		err = migrate(db) // create or upgrade the tables when necessary
 		Inited = err == nil
 		return errors.Wrap(err, "failed to initialize database")
 	}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// schemaVersion records a migration applied to the database. It is stored
+// as table `schema_versions`.
+type schemaVersion struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	AppliedAt time.Time
+}
+
+// migration upgrades the database schema to its version. It must tolerate
+// the changes already made by AutoMigrate before the versions were recorded.
+type migration struct {
+	version int
+	up      func(db *gorm.DB) error
+}
+
+// migrations are applied in order, each at most once. Released ones must not
+// be changed, so the models are frozen as they were at each version, rather
+// than the current ones.
+var migrations = []migration{
+	{1, func(db *gorm.DB) error {
+		type User struct {
+			gorm.Model
+			Scope  string `gorm:"unique_index:idx_scope_name"`
+			Name   string `gorm:"unique_index:idx_scope_name"`
+			PWHash *[]byte
+		}
+		return db.AutoMigrate(&User{}).Error
+	}},
+	{2, func(db *gorm.DB) error {
+		type UpstreamStats struct {
+			ID              uint      `gorm:"primary_key"`
+			Upstream        string    `gorm:"unique_index:idx_upstream_bucket"`
+			Bucket          time.Time `gorm:"unique_index:idx_upstream_bucket"`
+			BytesUploaded   uint64
+			BytesDownloaded uint64
+			Errors          uint64
+		}
+		return db.AutoMigrate(&UpstreamStats{}).Error
+	}},
+	{3, func(db *gorm.DB) error {
+		type User struct {
+			ExpiresAt *time.Time
+		}
+		return db.AutoMigrate(&User{}).Error // only adds the new column
+	}},
+}
+
+// migrate applies the pending migrations in order, each in a transaction
+// along with its version record if the driver supports transactional DDL.
+func migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&schemaVersion{}).Error; err != nil {
+		return errors.Wrap(err, "failed to create schema_versions")
+	}
+	var applied []schemaVersion
+	if err := db.Find(&applied).Error; err != nil {
+		return errors.Wrap(err, "failed to read schema_versions")
+	}
+	done := make(map[int]bool, len(applied))
+	latest := migrations[len(migrations)-1].version
+	for _, v := range applied {
+		if v.Version > latest {
+			return errors.Errorf(
+				"database schema version %d is newer than supported: %d",
+				v.Version, latest)
+		}
+		done[v.Version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.version] {
+			continue
+		}
+		tx := db.Begin()
+		err := m.up(tx)
+		if err == nil {
+			err = tx.Create(
+				&schemaVersion{Version: m.version, AppliedAt: time.Now()}).Error
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			_ = tx.Rollback()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate to version %d", m.version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrationsTestSuite struct {
+	suite.Suite
+
+	tmpDir string
+	config Config
+}
+
+func (s *MigrationsTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "thestral2_MigrationsTestSuite")
+	s.Require().NoError(err)
+	s.config = Config{Driver: "sqlite3", DSN: path.Join(s.tmpDir, "test.db")}
+}
+
+func (s *MigrationsTestSuite) TearDownTest() {
+	_ = os.RemoveAll(s.tmpDir)
+}
+
+func (s *MigrationsTestSuite) open() *gorm.DB {
+	db, err := gorm.Open(s.config.Driver, s.config.DSN)
+	s.Require().NoError(err)
+	return db
+}
+
+func (s *MigrationsTestSuite) versions(db *gorm.DB) []int {
+	var versions []int
+	s.Require().NoError(
+		db.Model(&schemaVersion{}).Order("version").Pluck("version", &versions).
+			Error)
+	return versions
+}
+
+func (s *MigrationsTestSuite) TestFresh() {
+	s.Require().NoError(InitDB(s.config))
+	s.Require().NoError(InitDB(s.config)) // nothing to do the second time
+
+	db := s.open()
+	defer func() { _ = db.Close() }()
+	s.Equal([]int{1, 2, 3}, s.versions(db))
+	s.True(db.HasTable(&User{}))
+	s.True(db.HasTable(&UpstreamStats{}))
+}
+
+func (s *MigrationsTestSuite) TestUnversioned() {
+	// as created before the versions were recorded, without users.expires_at
+	type User struct {
+		gorm.Model
+		Scope  string `gorm:"unique_index:idx_scope_name"`
+		Name   string `gorm:"unique_index:idx_scope_name"`
+		PWHash *[]byte
+	}
+	db := s.open()
+	defer func() { _ = db.Close() }()
+	s.Require().NoError(db.AutoMigrate(&User{}).Error)
+	s.Require().NoError(db.Create(&User{Scope: "test", Name: "user"}).Error)
+
+	s.Require().NoError(InitDB(s.config))
+	s.Equal([]int{1, 2, 3}, s.versions(db))
+	s.True(db.Dialect().HasColumn("users", "expires_at"))
+
+	dao, err := NewUserDAO()
+	s.Require().NoError(err)
+	defer func() { _ = dao.Close() }()
+	s.True(dao.CheckExists("test", "user"))
+}
+
+func (s *MigrationsTestSuite) TestNewer() {
+	db := s.open()
+	defer func() { _ = db.Close() }()
+	s.Require().NoError(db.AutoMigrate(&schemaVersion{}).Error)
+	s.Require().NoError(db.Create(&schemaVersion{Version: 999}).Error)
+
+	s.Error(InitDB(s.config))
+	s.False(db.HasTable(&User{}))
+}
+
+func TestMigrationsTestSuite(t *testing.T) {
+	if CheckDriver("sqlite3") {
+		suite.Run(t, new(MigrationsTestSuite))
+	} else {
+		t.Skip("sqlite3 is not enabled")
+	}
+}
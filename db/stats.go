@@ -0,0 +1,90 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// UpstreamStats contains the traffic of an upstream in a time bucket. It is
+// stored in the database as table `upstream_stats`.
+type UpstreamStats struct {
+	ID              uint      `gorm:"primary_key"`
+	Upstream        string    `gorm:"unique_index:idx_upstream_bucket"`
+	Bucket          time.Time `gorm:"unique_index:idx_upstream_bucket"`
+	BytesUploaded   uint64
+	BytesDownloaded uint64
+	Errors          uint64
+}
+
+// StatsDAO is the DAO for UpstreamStats.
+type StatsDAO struct {
+	db *gorm.DB
+}
+
+// NewStatsDAO creates a StatsDAO.
+func NewStatsDAO() (*StatsDAO, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDAO{db}, nil
+}
+
+// Close the db connection of this DAO.
+func (d *StatsDAO) Close() error {
+	return errors.WithStack(d.db.Close())
+}
+
+// Add accumulates the statistics into those of the same upstream and bucket.
+func (d *StatsDAO) Add(stats *UpstreamStats) error {
+	q := d.db.Model(&UpstreamStats{}).
+		Where("upstream = ? AND bucket = ?", stats.Upstream, stats.Bucket).
+		Updates(map[string]interface{}{
+			"bytes_uploaded": gorm.Expr(
+				"bytes_uploaded + ?", stats.BytesUploaded),
+			"bytes_downloaded": gorm.Expr(
+				"bytes_downloaded + ?", stats.BytesDownloaded),
+			"errors": gorm.Expr("errors + ?", stats.Errors),
+		})
+	if q.Error == nil && q.RowsAffected == 0 { // first time in this bucket
+		s := *stats
+		s.ID = 0
+		q = d.db.Create(&s)
+	}
+	if q.Error != nil {
+		return errors.Wrapf(
+			q.Error, "failed to add stats of upstream '%s'", stats.Upstream)
+	}
+	return nil
+}
+
+// List returns the statistics of an upstream in the buckets within
+// [from, to), ordered by the bucket.
+func (d *StatsDAO) List(
+	upstream string, from, to time.Time) ([]*UpstreamStats, error) {
+	results := []*UpstreamStats{}
+	query := d.db.Where(
+		"upstream = ? AND bucket >= ? AND bucket < ?", upstream, from, to).
+		Order("bucket").Find(&results)
+	if query.Error != nil {
+		return nil, errors.Wrap(query.Error, "error occurred when querying db")
+	}
+	return results, nil
+}
+
+// Totals returns the statistics of each upstream summed over all the
+// buckets, ordered by the upstream. The buckets of the results are zero.
+func (d *StatsDAO) Totals() ([]*UpstreamStats, error) {
+	results := []*UpstreamStats{}
+	query := d.db.Model(&UpstreamStats{}).Select(
+		"upstream, SUM(bytes_uploaded) AS bytes_uploaded, " +
+			"SUM(bytes_downloaded) AS bytes_downloaded, " +
+			"SUM(errors) AS errors").
+		Group("upstream").Order("upstream").Scan(&results)
+	if query.Error != nil {
+		return nil, errors.Wrap(query.Error, "error occurred when querying db")
+	}
+	return results, nil
+}
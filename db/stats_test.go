@@ -0,0 +1,84 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StatsTestSuite struct {
+	suite.Suite
+
+	tmpDir string
+	dao    *StatsDAO
+}
+
+func (s *StatsTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "thestral2_StatsTestSuite")
+	s.Require().NoError(err)
+
+	s.Require().NoError(InitDB(Config{
+		Driver: "sqlite3",
+		DSN:    path.Join(s.tmpDir, "test.db"),
+	}))
+	s.dao, err = NewStatsDAO()
+	s.Require().NoError(err)
+}
+
+func (s *StatsTestSuite) TearDownTest() {
+	_ = os.RemoveAll(s.tmpDir)
+	s.NoError(s.dao.Close())
+}
+
+func (s *StatsTestSuite) TestAddList() {
+	b0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	b1 := b0.Add(time.Hour)
+	for _, stats := range []*UpstreamStats{
+		{Upstream: "up1", Bucket: b0, BytesUploaded: 1, BytesDownloaded: 2},
+		{Upstream: "up1", Bucket: b0, BytesUploaded: 10, Errors: 1},
+		{Upstream: "up1", Bucket: b1, BytesDownloaded: 100},
+		{Upstream: "up2", Bucket: b0, BytesUploaded: 1000},
+	} {
+		s.Require().NoError(s.dao.Add(stats))
+	}
+
+	results, err := s.dao.List("up1", b0, b1.Add(time.Hour))
+	if s.NoError(err) && s.Len(results, 2) {
+		s.True(b0.Equal(results[0].Bucket))
+		s.Equal(uint64(11), results[0].BytesUploaded)
+		s.Equal(uint64(2), results[0].BytesDownloaded)
+		s.Equal(uint64(1), results[0].Errors)
+		s.True(b1.Equal(results[1].Bucket))
+		s.Equal(uint64(100), results[1].BytesDownloaded)
+	}
+	results, err = s.dao.List("up1", b1, b1.Add(time.Hour))
+	if s.NoError(err) {
+		s.Len(results, 1)
+	}
+	results, err = s.dao.List("not_exists", b0, b1)
+	s.NoError(err)
+	s.Empty(results)
+
+	totals, err := s.dao.Totals()
+	if s.NoError(err) && s.Len(totals, 2) {
+		s.Equal("up1", totals[0].Upstream)
+		s.Equal(uint64(11), totals[0].BytesUploaded)
+		s.Equal(uint64(102), totals[0].BytesDownloaded)
+		s.Equal(uint64(1), totals[0].Errors)
+		s.Equal("up2", totals[1].Upstream)
+		s.Equal(uint64(1000), totals[1].BytesUploaded)
+	}
+}
+
+func TestStatsTestSuite(t *testing.T) {
+	if CheckDriver("sqlite3") {
+		suite.Run(t, new(StatsTestSuite))
+	} else {
+		t.Skip("sqlite3 is not enabled")
+	}
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
@@ -21,9 +23,16 @@ func HashUserPass(password string) []byte {
 // as table `users`.
 type User struct {
 	gorm.Model
-	Scope  string `gorm:"unique_index:idx_scope_name"`
-	Name   string `gorm:"unique_index:idx_scope_name"`
-	PWHash *[]byte
+	Scope     string `gorm:"unique_index:idx_scope_name"`
+	Name      string `gorm:"unique_index:idx_scope_name"`
+	PWHash    *[]byte
+	ExpiresAt *time.Time // never expires if nil
+}
+
+// Expired tells whether the user has expired, after which the password is
+// not accepted any more.
+func (u *User) Expired() bool {
+	return u.ExpiresAt != nil && !time.Now().Before(*u.ExpiresAt)
 }
 
 // UserDAO is the DAO for User.
@@ -53,6 +62,47 @@ func (d *UserDAO) Add(user *User) error {
 	return nil
 }
 
+// AddBatch adds the users in a transaction, skipping the existing ones. It
+// returns the error of each user, which is nil if the user is added. If the
+// transaction fails, no user is added and all of them get the error.
+func (d *UserDAO) AddBatch(users []*User) []error {
+	errs := make([]error, len(users))
+	tx := d.db.Begin()
+	if tx.Error != nil {
+		err := errors.Wrap(tx.Error, "failed to begin transaction")
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	var err error
+	for i, user := range users {
+		var count int
+		if err = tx.Model(&User{}).Where(
+			"scope = ? AND name = ?", user.Scope, user.Name).
+			Count(&count).Error; err != nil {
+			break
+		} else if count > 0 {
+			errs[i] = errors.Errorf(
+				"user '%s/%s' already exists", user.Scope, user.Name)
+		} else if err = tx.Create(user).Error; err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		_ = tx.Rollback()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to add users")
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
 // Delete a user of the given scope and name.
 func (d *UserDAO) Delete(scope, name string) error {
 	q := d.db.Delete(&User{}, "scope = ? AND name = ?", scope, name)
@@ -116,10 +166,11 @@ func (d *UserDAO) CheckExists(scope, name string) bool {
 	return err == nil
 }
 
-// CheckPassword checks if the given password is correct for the user.
+// CheckPassword checks if the given password is correct for the user, who
+// must not have expired.
 func (d *UserDAO) CheckPassword(scope, name, password string) bool {
 	u, err := d.Get(scope, name)
-	if err != nil || u.PWHash == nil {
+	if err != nil || u.PWHash == nil || u.Expired() {
 		return false
 	}
 	err = bcrypt.CompareHashAndPassword(*u.PWHash, []byte(password))
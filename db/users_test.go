@@ -6,6 +6,7 @@ import (
 	"path"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -146,6 +147,36 @@ func (s *UsersTestSuite) TestCheckUser() {
 	s.False(s.dao.CheckPassword("haspass", "not_exists", "password"))
 }
 
+func (s *UsersTestSuite) TestAddBatch() {
+	s.Require().NoError(s.dao.Add(&User{Scope: "test", Name: "user1"}))
+	errs := s.dao.AddBatch([]*User{
+		{Scope: "test", Name: "user1"},
+		{Scope: "test", Name: "user2"},
+		{Scope: "test", Name: "user3"},
+	})
+	if s.Len(errs, 3) {
+		s.Error(errs[0])
+		s.NoError(errs[1])
+		s.NoError(errs[2])
+	}
+	users, err := s.dao.List("test")
+	s.NoError(err)
+	s.Len(users, 3)
+}
+
+func (s *UsersTestSuite) TestExpiry() {
+	pwhash := HashUserPass("password")
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "expired", PWHash: &pwhash, ExpiresAt: &past}))
+	s.Require().NoError(s.dao.Add(&User{
+		Scope: "test", Name: "valid", PWHash: &pwhash, ExpiresAt: &future}))
+
+	s.True(s.dao.CheckExists("test", "expired"))
+	s.False(s.dao.CheckPassword("test", "expired", "password"))
+	s.True(s.dao.CheckPassword("test", "valid", "password"))
+}
+
 func TestUsersTestSuite(t *testing.T) {
 	if CheckDriver("sqlite3") {
 		suite.Run(t, new(UsersTestSuite))
@@ -241,6 +241,25 @@ func (s *E2ETestSuite) TestRejectByRule() {
 	s.Assert().Error(pErr.Error)
 }
 
+func (s *E2ETestSuite) TestReloadRules() {
+	addr := &DomainNameAddr{DomainName: "will.be.rejected", Port: 12345}
+	s.Require().NoError(s.svrApp.reloadRules(nil))
+	_, _, pErr := s.cli.Request(context.Background(), addr)
+	s.Require().NotNil(pErr)
+	s.Assert().EqualValues(ProxyConnectFailed, pErr.ErrType)
+
+	s.Assert().Error(s.svrApp.reloadRules(map[string]RuleConfig{
+		"reject": {Domains: []string{"will.be.rejected"}},
+		"other":  {Domains: []string{"other"}, Upstreams: []string{"none"}},
+	}))
+	s.Require().NoError(s.svrApp.reloadRules(map[string]RuleConfig{
+		"reject": {Domains: []string{"will.be.rejected"}},
+	}))
+	_, _, pErr = s.cli.Request(context.Background(), addr)
+	s.Require().NotNil(pErr)
+	s.Assert().EqualValues(ProxyNotAllowed, pErr.ErrType)
+}
+
 func (s *E2ETestSuite) TestConnectFailed() {
 	addr := &DomainNameAddr{DomainName: "does.not.exist", Port: 80}
 	_, _, pErr := s.cli.Request(context.Background(), addr)
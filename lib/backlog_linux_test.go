@@ -0,0 +1,34 @@
+// +build linux
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPTransportBacklog(t *testing.T) {
+	trans, err := CreateTransport(&TransportConfig{
+		TCP: &TCPConfig{Backlog: 7}})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+
+	// Linux reports the max backlog of a listening socket in tcpi_sacked
+	c, err := listener.(tcpListener).TCPListener.SyscallConn()
+	require.NoError(t, err)
+	var info *unix.TCPInfo
+	require.NoError(t, c.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(
+			int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}))
+	require.NoError(t, err)
+	assert.EqualValues(t, 7, info.Sacked)
+
+	_, err = CreateTransport(&TransportConfig{TCP: &TCPConfig{Backlog: -1}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lib
+
+import "net"
+
+// setListenBacklog is not supported on this platform.
+var setListenBacklog func(l *net.TCPListener, backlog int) error
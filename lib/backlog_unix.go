@@ -0,0 +1,26 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenBacklog replaces the backlog of a listening socket by calling
+// listen(2) again, which is capped by the system, e.g. somaxconn on Linux.
+var setListenBacklog = func(l *net.TCPListener, backlog int) error {
+	c, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = c.Control(func(fd uintptr) {
+		sockErr = unix.Listen(int(fd), backlog)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return err
+}
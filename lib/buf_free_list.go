@@ -1,13 +1,18 @@
 package lib
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 // GlobalBufPool is a globally available BufFreeList for buffers of sizes
 // between 16B and 16K.
 var GlobalBufPool = NewBufFreeList(4, 16) // 16B -> 64K
 
-// BufFreeList is a bucketing free list for byte buffers.
+// BufFreeList is a bucketing free list for byte buffers. It also counts the
+// bytes of the buffers got but not yet freed.
 type BufFreeList struct {
+	inUse int64 // used atomically, first for the alignment
 	minN  uint
 	maxN  uint
 	pools []*sync.Pool
@@ -42,16 +47,21 @@ func (l *BufFreeList) Get(size uint) []byte {
 	if size == 0 {
 		return nil
 	}
+	var buf []byte
 	if size > (1 << l.maxN) {
-		return make([]byte, size)
+		buf = make([]byte, size)
+	} else {
+		buf = l.pools[l.getBucketIdx(size)].Get().([]byte)[:size]
 	}
-	p := l.pools[l.getBucketIdx(size)]
-	return p.Get().([]byte)[:size]
+	atomic.AddInt64(&l.inUse, int64(cap(buf)))
+	return buf
 }
 
-// Free puts back the given byte slice to the free list.
+// Free puts back the given byte slice to the free list. It must have been
+// got from the same list.
 func (l *BufFreeList) Free(buf []byte) {
 	size := cap(buf)
+	atomic.AddInt64(&l.inUse, -int64(size))
 	if size > 0 && size <= (1<<l.maxN) {
 		idx := l.getBucketIdx(uint(size))
 		l.pools[idx].Put(buf)
@@ -67,3 +77,9 @@ func (l *BufFreeList) getBucketIdx(size uint) uint {
 	}
 	return idx
 }
+
+// InUse returns the total bytes of the buffers got but not yet freed,
+// including those too large to be pooled.
+func (l *BufFreeList) InUse() int64 {
+	return atomic.LoadInt64(&l.inUse)
+}
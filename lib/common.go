@@ -6,11 +6,15 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/idna"
 )
 
 // ThestralVersion is an external string variable identifying the version
@@ -36,6 +40,43 @@ type WithPeerIdentifiers interface {
 	GetPeerIdentifiers() ([]*PeerIdentifier, error)
 }
 
+// WithServerName is an interface for server side connections that know the
+// server name requested by the client, i.e. the SNI of TLS.
+type WithServerName interface {
+	ServerName() (string, error)
+}
+
+// CloseWriter is an interface for connections that can be half-closed, i.e.
+// shutting down the writing side while the reading side remains open. The
+// peer reads an EOF after the data sent before.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+var errCloseWriteUnsupported = errors.New(
+	"half-close is not supported by the connection")
+
+// closeWrite half-closes the given connection if it is a CloseWriter.
+func closeWrite(conn interface{}) error {
+	if cw, ok := conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+// TransportStats is an interface for connections that can report
+// transport-specific statistics, e.g. retransmissions of a KCP session.
+// A nil map is returned if no statistics are available.
+type TransportStats interface {
+	TransportStats() map[string]interface{}
+}
+
+// CompressionStats is an interface for compressed connections that can
+// report the bytes before and after the compression, in both directions.
+type CompressionStats interface {
+	CompressionStats() (raw, compressed uint64)
+}
+
 // Address is the interface of all the supported address types.
 type Address interface {
 	isAddress()
@@ -78,6 +119,67 @@ func (a *DomainNameAddr) String() string {
 	return net.JoinHostPort(a.DomainName, strconv.Itoa(int(a.Port)))
 }
 
+// DefaultMaxDomainNameLen is the default limit of the length of the domain
+// names accepted by the servers, which is also the limit of DNS.
+const DefaultMaxDomainNameLen = 253
+
+// domainNameDots are the label separators mapped to '.' as IDNA does.
+var domainNameDots = strings.NewReplacer(
+	"\u3002", ".", "\uff0e", ".", "\uff61", ".")
+
+// domainNameProfile is idna.Lookup with '_' allowed, which is common in the
+// service names. The other ASCII characters are checked by NormalizeDomainName.
+var domainNameProfile = idna.New(idna.MapForLookup(), idna.Transitional(true),
+	idna.BidiRule(), idna.StrictDomainName(false))
+
+// NormalizeDomainName validates a domain name and returns its canonical form
+// by IDNA2008 lookup (UTS #46), i.e. in lowercase ASCII, with the
+// international labels normalized into NFC and encoded in punycode. A name is
+// rejected if it is longer than maxLen in the canonical form, or has an empty
+// label, a label longer than 63 or a character other than letters, digits,
+// '-' and '_' (plus marks in international labels). IP addresses are returned
+// as they are.
+func NormalizeDomainName(name string, maxLen int) (string, error) {
+	if net.ParseIP(name) != nil {
+		return name, nil
+	}
+	for _, r := range domainNameDots.Replace(name) {
+		if r >= utf8.RuneSelf && !unicode.IsLetter(r) &&
+			!unicode.IsDigit(r) && !unicode.IsMark(r) {
+			return "", errors.Errorf(
+				"invalid character in domain name %q", name)
+		}
+	}
+	normalized, err := domainNameProfile.ToASCII(strings.ToLower(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid domain name %q", name)
+	}
+	labels := strings.Split(normalized, ".")
+	if len(labels) > 1 && labels[len(labels)-1] == "" {
+		labels = labels[:len(labels)-1] // the root label
+	}
+	length := len(labels) - 1
+	for _, label := range labels {
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+				c == '-' || c == '_') {
+				return "", errors.Errorf(
+					"invalid character in domain name %q", name)
+			}
+		}
+		if n := len(label); n == 0 || n > 63 {
+			return "", errors.Errorf("invalid label in domain name %q", name)
+		}
+		length += len(label)
+	}
+	if length > maxLen {
+		return "", errors.Errorf(
+			"domain name longer than %d: %q", maxLen, name)
+	}
+	return normalized, nil
+}
+
 // FromNetAddr parses a net.Addr into an Address.
 func FromNetAddr(netAddr net.Addr) (Address, error) {
 	if netAddr.Network() != "tcp" {
@@ -118,6 +220,38 @@ func ParseAddress(s string) (Address, error) {
 	return &DomainNameAddr{h, uint16(port)}, nil
 }
 
+// ExpandAddressRange expands an address with a port range, such as
+// "127.0.0.1:8000-8100", into a list of addresses. An address without a port
+// range is returned as is.
+func ExpandAddressRange(address string) ([]string, error) {
+	h, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	idx := strings.IndexByte(p, '-')
+	if idx < 0 {
+		return []string{address}, nil
+	}
+
+	begin, err := strconv.ParseUint(p[:idx], 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid port range: "+p)
+	}
+	end, err := strconv.ParseUint(p[idx+1:], 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid port range: "+p)
+	}
+	if begin == 0 || begin > end {
+		return nil, errors.New("invalid port range: " + p)
+	}
+	addrs := make([]string, 0, end-begin+1)
+	for port := begin; port <= end; port++ {
+		addrs = append(
+			addrs, net.JoinHostPort(h, strconv.FormatUint(port, 10)))
+	}
+	return addrs, nil
+}
+
 // CreateLogger creates a zap SugaredLogger from given configuration.
 func CreateLogger(config LoggingConfig) (*zap.SugaredLogger, error) {
 	zapCfg := zap.NewProductionConfig()
@@ -136,27 +270,69 @@ func CreateLogger(config LoggingConfig) (*zap.SugaredLogger, error) {
 	if zapCfg.Encoding == "console" {
 		zapCfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	}
-	switch config.Level {
-	case "": // no-op
+	if config.Level != "" {
+		level, err := ParseLogLevel(config.Level)
+		if err != nil {
+			return nil, err
+		}
+		zapCfg.Level.SetLevel(level)
+	}
+
+	logger, err := zapCfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Sugar(), nil
+}
+
+// ParseLogLevel parses a logging level, e.g. "debug" or "warn".
+func ParseLogLevel(level string) (zapcore.Level, error) {
+	switch level {
 	case "debug":
-		zapCfg.Level.SetLevel(zap.DebugLevel)
+		return zap.DebugLevel, nil
 	case "info":
-		zapCfg.Level.SetLevel(zap.InfoLevel)
+		return zap.InfoLevel, nil
 	case "warn":
-		zapCfg.Level.SetLevel(zap.WarnLevel)
+		return zap.WarnLevel, nil
 	case "error":
-		zapCfg.Level.SetLevel(zap.ErrorLevel)
+		return zap.ErrorLevel, nil
 	case "fatal":
-		zapCfg.Level.SetLevel(zap.FatalLevel)
+		return zap.FatalLevel, nil
 	default:
-		return nil, errors.New("unknown logging level: " + config.Level)
+		return 0, errors.New("unknown logging level: " + level)
 	}
+}
 
-	logger, err := zapCfg.Build()
-	if err != nil {
-		return nil, err
+// WithLogLevel derives a logger writing to the same outputs at the given
+// level, which overrides that of the original logger in both directions.
+func WithLogLevel(
+	logger *zap.SugaredLogger, level zapcore.Level) *zap.SugaredLogger {
+	return logger.Desugar().WithOptions(zap.WrapCore(
+		func(core zapcore.Core) zapcore.Core {
+			return &levelCore{core, level}
+		})).Sugar()
+}
+
+// levelCore gates the entries by its own level rather than the inner one's.
+type levelCore struct {
+	zapcore.Core
+	level zapcore.Level
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{c.Core.With(fields), c.level}
+}
+
+func (c *levelCore) Check(
+	ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c) // written by the inner core regardless
 	}
-	return logger.Sugar(), nil
+	return ce
 }
 
 // GetHomePath returns the home path of the current user.
@@ -195,6 +371,31 @@ func BytesHumanized(bytes uint64) string {
 	return fmt.Sprintf(format, number)
 }
 
+// ParseBytes parses a byte count like "512", "64KiB" or "1.5MiB". The units
+// are the ones used by BytesHumanized, and "K", "M", "G" and "T" are
+// accepted as their shorthands.
+func ParseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	number, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || number < 0 {
+		return 0, errors.Errorf("invalid byte count: %q", s)
+	}
+	unit := strings.TrimSuffix(strings.TrimSpace(s[i:]), "iB")
+	scale := map[string]float64{
+		"": 1, "B": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40,
+	}[unit]
+	if scale == 0 {
+		return 0, errors.Errorf("invalid byte count: %q", s)
+	}
+	return uint64(number * scale), nil
+}
+
 // SpinMutex is a spin mutex as its name suggests.
 type SpinMutex struct {
 	locked uint32
@@ -1,35 +1,73 @@
 package lib
 
 import (
+	"bytes"
 	"compress/flate"
 	"context"
+	"crypto/sha256"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 )
 
+// compDictDigestSize is the length of the digest of the preset dictionary
+// sent ahead of the compressed stream.
+const compDictDigestSize = 8
+
 // WrapTransCompression wraps a Transport with a given compression method.
 func WrapTransCompression(inner Transport, method string) (Transport, error) {
+	return WrapTransCompressionDict(inner, method, nil)
+}
+
+// WrapTransCompressionDict is like WrapTransCompression, but with a preset
+// dictionary, which is only supported by deflate. The peers exchange the
+// digests of their dictionaries, and the connections fail on mismatch.
+func WrapTransCompressionDict(
+	inner Transport, method string, dict []byte) (Transport, error) {
 	switch method {
 	case "snappy", "deflate":
-		return &compTransWrapper{inner, method}, nil
 	default:
 		return nil, errors.New("unknown compression method: " + method)
 	}
+	if dict != nil && method != "deflate" {
+		return nil, errors.New(
+			"compression dictionary is not supported by " + method)
+	}
+	return &compTransWrapper{inner, method, dict}, nil
+}
+
+func wrapTransCompressionConfig(
+	inner Transport, config TransportConfig) (Transport, error) {
+	if config.CompressionDict == "" {
+		return WrapTransCompression(inner, config.Compression)
+	}
+	dict, err := ioutil.ReadFile(config.CompressionDict)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load compression dictionary")
+	}
+	if len(dict) == 0 {
+		return nil, errors.New(
+			"empty compression dictionary: " + config.CompressionDict)
+	}
+	return WrapTransCompressionDict(inner, config.Compression, dict)
 }
 
 type compTransWrapper struct {
 	inner  Transport
 	method string
+	dict   []byte
 }
 
 func (w *compTransWrapper) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
 	conn, err := w.inner.Dial(ctx, address)
 	if err == nil {
-		conn, err = compWrapConn(conn, w.method)
+		conn, err = compWrapConn(conn, w.method, w.dict)
 	}
 	return conn, err
 }
@@ -37,15 +75,20 @@ func (w *compTransWrapper) Dial(
 func (w *compTransWrapper) Listen(address string) (net.Listener, error) {
 	listener, err := w.inner.Listen(address)
 	if err == nil {
-		listener = &compListenerWrapper{Listener: listener, method: w.method}
+		listener = &compListenerWrapper{
+			Listener: listener, method: w.method, dict: w.dict}
 	}
 	return listener, err
 }
 
 type compConnWrapper struct {
+	rawBytes uint64 // used atomically, first for the 64-bit alignment
 	net.Conn
 	compReader io.Reader
 	compWriter writeCloseFlusher
+	wrClosed   sync.Once // the compressor can only be closed once
+	wrCloseErr error
+	wire       *countingReadWriter // the inner conn, counting the bytes
 }
 
 type compConnWithPeerIDs struct {
@@ -56,21 +99,32 @@ func (w *compConnWithPeerIDs) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
 	return w.Conn.(WithPeerIdentifiers).GetPeerIdentifiers()
 }
 
-func compWrapConn(inner net.Conn, method string) (net.Conn, error) {
+func compWrapConn(
+	inner net.Conn, method string, dict []byte) (net.Conn, error) {
 	var wrapper *compConnWrapper
+	wire := &countingReadWriter{inner: inner}
+	var stream io.ReadWriter = wire
+	if dict != nil {
+		digest := sha256.Sum256(dict)
+		stream = &dictCheckingRW{
+			inner: wire, digest: digest[:compDictDigestSize]}
+	}
 	switch method {
 	case "snappy":
-		wrapper = &compConnWrapper{
-			inner, snappy.NewReader(inner), snappy.NewBufferedWriter(inner)}
+		wrapper = &compConnWrapper{Conn: inner,
+			compReader: snappy.NewReader(wire),
+			compWriter: snappy.NewBufferedWriter(wire)}
 	case "deflate":
-		w, e := flate.NewWriter(inner, flate.DefaultCompression)
+		w, e := flate.NewWriterDict(stream, flate.DefaultCompression, dict)
 		if e != nil {
 			return nil, errors.WithStack(e)
 		}
-		wrapper = &compConnWrapper{inner, flate.NewReader(inner), w}
+		wrapper = &compConnWrapper{Conn: inner,
+			compReader: flate.NewReaderDict(stream, dict), compWriter: w}
 	default:
 		return nil, errors.New("unknown compression method: " + method)
 	}
+	wrapper.wire = wire
 
 	if _, withPIDs := inner.(WithPeerIdentifiers); withPIDs {
 		return &compConnWithPeerIDs{wrapper}, nil
@@ -78,8 +132,24 @@ func compWrapConn(inner net.Conn, method string) (net.Conn, error) {
 	return wrapper, nil
 }
 
+// TransportStats forwards the statistics of the inner connection.
+func (w *compConnWrapper) TransportStats() map[string]interface{} {
+	if ts, ok := w.Conn.(TransportStats); ok {
+		return ts.TransportStats()
+	}
+	return nil
+}
+
+// CompressionStats reports the bytes read and written by the users, and
+// those actually transferred by the inner connection.
+func (w *compConnWrapper) CompressionStats() (raw, compressed uint64) {
+	return atomic.LoadUint64(&w.rawBytes), atomic.LoadUint64(&w.wire.n)
+}
+
 func (w *compConnWrapper) Read(b []byte) (int, error) {
-	return w.compReader.Read(b)
+	n, err := w.compReader.Read(b)
+	atomic.AddUint64(&w.rawBytes, uint64(n))
+	return n, err
 }
 
 func (w *compConnWrapper) Write(b []byte) (int, error) {
@@ -87,11 +157,28 @@ func (w *compConnWrapper) Write(b []byte) (int, error) {
 	if err == nil {
 		err = w.compWriter.Flush()
 	}
+	atomic.AddUint64(&w.rawBytes, uint64(n))
 	return n, err
 }
 
+func (w *compConnWrapper) closeCompWriter() error {
+	w.wrClosed.Do(func() {
+		w.wrCloseErr = w.compWriter.Close()
+	})
+	return w.wrCloseErr
+}
+
+// CloseWrite flushes and closes the compressor, and then half-closes the
+// inner connection.
+func (w *compConnWrapper) CloseWrite() error {
+	if err := w.closeCompWriter(); err != nil {
+		return err
+	}
+	return closeWrite(w.Conn)
+}
+
 func (w *compConnWrapper) Close() (err error) {
-	err = w.compWriter.Close()
+	err = w.closeCompWriter()
 	if err == nil {
 		err = w.Conn.Close()
 	} else {
@@ -103,16 +190,74 @@ func (w *compConnWrapper) Close() (err error) {
 type compListenerWrapper struct {
 	net.Listener
 	method string
+	dict   []byte
 }
 
 func (w *compListenerWrapper) Accept() (net.Conn, error) {
 	conn, err := w.Listener.Accept()
 	if err == nil {
-		conn, err = compWrapConn(conn, w.method)
+		conn, err = compWrapConn(conn, w.method, w.dict)
 	}
 	return conn, err
 }
 
+// dictCheckingRW prefixes the stream written with the digest of the
+// dictionary, and checks the one of the stream read, so that the peers with
+// different dictionaries fail instead of decoding garbage. Reading and
+// writing may happen concurrently, as the states are separated.
+type dictCheckingRW struct {
+	inner    io.ReadWriter
+	digest   []byte
+	rdErr    error
+	rdDone   bool
+	wrTagged bool
+}
+
+func (c *dictCheckingRW) Read(b []byte) (int, error) {
+	if !c.rdDone {
+		c.rdDone = true
+		digest := make([]byte, len(c.digest))
+		if _, err := io.ReadFull(c.inner, digest); err != nil {
+			c.rdErr = errors.Wrap(err, "failed to read dictionary digest")
+		} else if !bytes.Equal(digest, c.digest) {
+			c.rdErr = errors.New("compression dictionary mismatch")
+		}
+	}
+	if c.rdErr != nil {
+		return 0, c.rdErr
+	}
+	return c.inner.Read(b)
+}
+
+func (c *dictCheckingRW) Write(b []byte) (int, error) {
+	if !c.wrTagged {
+		c.wrTagged = true
+		if err := writeFull(c.inner, c.digest); err != nil {
+			return 0, err
+		}
+	}
+	return c.inner.Write(b)
+}
+
+// countingReadWriter counts the bytes read from and written to the inner
+// one.
+type countingReadWriter struct {
+	n     uint64 // used atomically
+	inner io.ReadWriter
+}
+
+func (c *countingReadWriter) Read(b []byte) (int, error) {
+	n, err := c.inner.Read(b)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+func (c *countingReadWriter) Write(b []byte) (int, error) {
+	n, err := c.inner.Write(b)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
 type writeCloseFlusher interface {
 	io.WriteCloser
 	Flush() error
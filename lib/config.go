@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/richardtsai/thestral2/db"
@@ -26,19 +27,72 @@ type Config struct {
 }
 
 // ProxyConfig describes a proxy protocol.
+//
+// Labels only apply to downstreams, and are attached to all of their tunnels.
+// DefaultUpstreams also only apply to downstreams, used for the requests from
+// them that no other rule matches. They replace the upstreams of the default
+// rule, whose other settings still apply, unless it rejects the requests.
+// Jump only applies to upstreams, listing the upstreams to chain through in
+// order before reaching it, which is a shorthand for nested proxied
+// transports.
 type ProxyConfig struct {
-	Protocol  string                 `yaml:"protocol"`
-	Transport *TransportConfig       `yaml:"transport"`
-	Settings  map[string]interface{} `yaml:",inline"`
+	Protocol         string                 `yaml:"protocol"`
+	Transport        *TransportConfig       `yaml:"transport"`
+	Labels           map[string]string      `yaml:"labels"`
+	DefaultUpstreams []string               `yaml:"default_upstreams"`
+	Jump             []string               `yaml:"jump"`
+	Settings         map[string]interface{} `yaml:",inline"`
+	// MaxConcurrentDials bounds the in-flight dials of an upstream, with
+	// the other requests waiting for a slot. 0 for unlimited.
+	MaxConcurrentDials int `yaml:"max_concurrent_dials"`
+	// Optional upstreams may fail 'validate_upstreams_on_start'.
+	Optional bool `yaml:"optional"`
+}
+
+// DecodeSettings decodes the protocol specific settings into out, a pointer
+// to a struct with yaml tags. Unknown keys and mistyped values are rejected.
+func (c ProxyConfig) DecodeSettings(out interface{}) error {
+	data, err := yaml.Marshal(c.Settings)
+	if err == nil {
+		err = yaml.UnmarshalStrict(data, out)
+	}
+	return errors.Wrapf(err, "invalid settings for '%s'", c.Protocol)
 }
 
 // TransportConfig describes a transport layer.
 type TransportConfig struct {
-	Compression string         `yaml:"compression"`
-	TLS         *TLSConfig     `yaml:"tls"`
-	KCP         *KCPConfig     `yaml:"kcp"`
-	Proxied     *ProxyConfig   `yaml:"proxied"`
-	PreConn     *PreConnConfig `yaml:"pre_conn"`
+	Compression string `yaml:"compression"`
+	// CompressionDict is the path to a preset dictionary of deflate, which
+	// must be the same on both ends.
+	CompressionDict string         `yaml:"compression_dict"`
+	TLS             *TLSConfig     `yaml:"tls"`
+	KCP             *KCPConfig     `yaml:"kcp"`
+	Proxied         *ProxyConfig   `yaml:"proxied"`
+	PreConn         *PreConnConfig `yaml:"pre_conn"`
+	TCP             *TCPConfig     `yaml:"tcp"`
+	Exec            *ExecConfig    `yaml:"exec"`
+	// Custom selects the inner most layer among those registered by
+	// RegisterTransport.
+	Custom *CustomTransportConfig `yaml:"custom"`
+	// FamilyPreference ("ipv4" or "ipv6") is the address family tried first
+	// when dialing the upstream by a host name. The order of the system
+	// resolver is kept if empty.
+	FamilyPreference string `yaml:"family_preference"`
+	// ProxyProtocol makes the listeners expect a PROXY protocol header
+	// before anything else, including the TLS handshake.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Layers is the order of the layers from the inner to the outer, e.g.
+	// [tcp, compression, tls]. It defaults to [<inner>, tls, compression].
+	Layers []string `yaml:"layers"`
+}
+
+// TCPConfig contains the socket options of a TCP transport. The buffer sizes
+// are in bytes, e.g. "4MiB", and the OS defaults are used if empty.
+type TCPConfig struct {
+	RecvBuf string `yaml:"so_rcvbuf"`
+	SendBuf string `yaml:"so_sndbuf"`
+	TFO     bool   `yaml:"tfo"`     // TCP Fast Open, Linux only
+	Backlog int    `yaml:"backlog"` // of the listeners, 0 for the default
 }
 
 // TLSConfig contains the TLS configuration on some transport.
@@ -51,6 +105,61 @@ type TLSConfig struct {
 	ClientCAs        []string `yaml:"client_cas"`
 	SessionCacheSize int      `yaml:"session_cache_size"`
 	HandshakeTimeout string   `yaml:"handshake_timeout"`
+	// ConnectTimeout bounds the dial of the inner transport on the client
+	// side, which is only bounded by the request otherwise.
+	ConnectTimeout string `yaml:"connect_timeout"`
+	// PinSHA256 are the base64 encoded SHA-256 digests of the public keys
+	// (SPKI) accepted from the server on the client side, besides a valid
+	// chain. Any of them may match, and any key is accepted if empty.
+	PinSHA256 []string `yaml:"pin_sha256"`
+	// ClientCerts are the alternatives to Cert and Key on the client side.
+	// Among them, the first one issued by a CA acceptable to the server is
+	// presented.
+	ClientCerts []CertKeyPair `yaml:"client_certs"`
+	// ACME obtains and renews the server certificate automatically, in
+	// place of Cert and Key.
+	ACME *ACMEConfig `yaml:"acme"`
+}
+
+// CertKeyPair is a certificate and its private key.
+type CertKeyPair struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// ACMEConfig describes how to obtain certificates from an ACME CA, e.g.
+// Let's Encrypt, whose terms of service are accepted by using it.
+//
+// The certificates are cached in CacheDir, and are only issued for the Hosts.
+// The challenges are answered with TLS-ALPN-01 on the listeners, which must
+// be reachable on port 443, or with HTTP-01 on HTTPAddr (port 80) if set.
+type ACMEConfig struct {
+	Hosts        []string `yaml:"hosts"`
+	CacheDir     string   `yaml:"cache_dir"`
+	Email        string   `yaml:"email"`
+	HTTPAddr     string   `yaml:"http_addr"`
+	DirectoryURL string   `yaml:"directory_url"` // Let's Encrypt if empty
+}
+
+// ExecConfig describes an external helper process providing a client-side
+// transport, like the pluggable transports of Tor. The helper is started with
+// Command and Env, and should serve SOCKS5 on SOCKSAddr, via which the
+// connections are dialed. Username and Password are sent to the helper on
+// every connection, usually carrying the arguments of the transport.
+type ExecConfig struct {
+	Command      []string `yaml:"command"`
+	Env          []string `yaml:"env"` // KEY=VALUE, added to the current ones
+	SOCKSAddr    string   `yaml:"socks_addr"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	RestartDelay string   `yaml:"restart_delay"` // 1s if empty
+}
+
+// CustomTransportConfig names a registered transport, to whose factory the
+// other settings are passed.
+type CustomTransportConfig struct {
+	Name     string                 `yaml:"name"`
+	Settings map[string]interface{} `yaml:",inline"`
 }
 
 // KCPConfig contains configuration about the KCP protocol.
@@ -61,19 +170,91 @@ type KCPConfig struct {
 	FECDist           string `yaml:"fec_dist"`
 	KeepAliveInterval string `yaml:"keep_alive_interval"`
 	KeepAliveTimeout  string `yaml:"keep_alive_timeout"`
+	// PSK enables encryption and mutual authentication with a pre-shared key.
+	PSK string `yaml:"psk"`
+	// LocalAddr binds the client UDP sockets to a fixed local address, e.g.
+	// for UDP hole punching. With ReuseLocalAddr, sessions to different
+	// remote hosts can share the same local address. Either way, only one
+	// session to each remote host can be open at a time, including the 10
+	// seconds it lingers after being closed, as the server can't tell apart
+	// the sessions from the same address. Dialing another one fails. So it
+	// is rejected in the transports of the upstreams, which need concurrent
+	// tunnels, and is only for the transports dialed by the library users.
+	LocalAddr      string `yaml:"local_addr"`
+	ReuseLocalAddr bool   `yaml:"reuse_local_addr"`
 }
 
 // PreConnConfig contains configuration for pre-connect transport wrapper.
 type PreConnConfig struct {
 	MaxPoolSize int    `yaml:"max_pool_size"`
 	Lifetime    string `yaml:"lifetime"`
+	// HotThreshold makes only the addresses dialed at least this many times
+	// pre-connected, which are forgotten after idling for a lifetime. It is
+	// meant for clients dialing many different targets, e.g. 'direct', where
+	// it is 3 by default.
+	HotThreshold int `yaml:"hot_threshold"`
+	// MinIdle is the number of connections kept in the pool of a target
+	// even if it is not dialed, 2 by default.
+	MinIdle int `yaml:"min_idle"`
+	// MaxTargets bounds the number of targets pre-connected to, with the
+	// least recently dialed one evicted. 0 for unlimited, except for 'direct'
+	// where it is 64 by default.
+	MaxTargets int `yaml:"max_targets"`
 }
 
 // RuleConfig describes how to dispatch proxy requests.
+//
+// A rule with ClientIPs, ClientUsers or ClientAttrs only applies to the
+// matching clients, and both the client and the target conditions must be
+// met. Such rules take precedence over the others and are tried in the
+// lexical order of names.
+// An entry of ClientUsers is either "scope/name" or just "name" to match
+// users in any scope. A request is sent via one of the Upstreams picked at
+// random, which has the whole connect timeout. UpstreamGroups can be used
+// instead to try the groups in order, falling back to the next one if all the
+// upstreams of a group fail for reasons other than the target itself, e.g. a
+// refused connection. Each group has an equal share of the connect timeout.
+// Labels of a rule are attached to the tunnels matching it, overriding the
+// ones of the downstream with the same names. RateLimit caps the bandwidth of
+// each direction of every single tunnel matching the rule, e.g. "1MiB" for
+// 1 MiB/s. DSCP (0-63) marks the packets of the connections dialed to the
+// upstreams, where the transports and the platform support it. Description
+// and Tags are only annotations for the operators, which are shown in the
+// logs, the monitor reports and the explain tool.
 type RuleConfig struct {
-	Upstreams []string `yaml:"upstreams"`
-	IPs       []string `yaml:"ips"`
-	Domains   []string `yaml:"domains"`
+	Upstreams      []string          `yaml:"upstreams"`
+	UpstreamGroups [][]string        `yaml:"upstream_groups"`
+	IPs            []string          `yaml:"ips"`
+	Domains        []string          `yaml:"domains"`
+	ClientIPs      []string          `yaml:"client_ips"`
+	ClientUsers    []string          `yaml:"client_users"`
+	Labels         map[string]string `yaml:"labels"`
+	RateLimit      string            `yaml:"rate_limit"`
+	DSCP           int               `yaml:"dscp"`
+	Description    string            `yaml:"description"`
+	Tags           []string          `yaml:"tags"`
+	// ClientAttrs is met if one of the identifiers of the client has all the
+	// attributes, keyed by the camelCase names in its ExtraInfo. Those of a
+	// TLS client certificate are "issuedBy", the common name of the issuer,
+	// which must equal the value, and "organizations", "organizationalUnits"
+	// and "uris" (the URI SANs), which are lists that match if they contain
+	// the value, e.g. {organizationalUnits: ops}. The other attributes, such
+	// as "validUntil", never match.
+	ClientAttrs map[string]string `yaml:"client_attrs"`
+	// LogLevel overrides the logging level of the matching requests, e.g.
+	// "debug" for troubleshooting a few targets.
+	LogLevel string `yaml:"log_level"`
+	// MaxBytes and MaxDuration cap each of the matching tunnels, which is
+	// torn down once it transfers more bytes in total, or lives longer.
+	MaxBytes    string `yaml:"max_bytes"`
+	MaxDuration string `yaml:"max_duration"`
+	// Resolve is where the domain names are resolved. It is "auto" (default)
+	// to pass them to the upstreams, except that the direct ones resolve them
+	// locally, "local" to pass the resolved IP addresses instead, or "remote"
+	// to pass them on wherever possible. The direct upstreams always resolve
+	// them locally, so "remote" only differs from "auto" in the warning
+	// logged for the rules that may use them.
+	Resolve string `yaml:"resolve"`
 }
 
 // LoggingConfig contains configuration about logging.
@@ -83,13 +264,72 @@ type LoggingConfig struct {
 	Format string `yaml:"format"`
 }
 
+// DefaultConnectTimeout is used if 'connect_timeout' is not specified.
+const DefaultConnectTimeout = time.Minute
+
 // MiscConfig contains configuration that doesn't fall into any of above.
 type MiscConfig struct {
-	ConnectTimeout string `yaml:"connect_timeout"`
-	MonitorPath    string `yaml:"monitor_path"`
-	EnableMonitor  bool   `yaml:"enable_monitor"`
-	PProfAddr      string `yaml:"pprof_addr"` // deprecated
-	DebugAddr      string `yaml:"debug_addr"` // in favor of this
+	ConnectTimeout  string `yaml:"connect_timeout"`
+	MonitorPath     string `yaml:"monitor_path"`
+	MonitorInterval string `yaml:"monitor_interval"`
+	MaxTunnels      int    `yaml:"max_tunnels"`       // 0 for unlimited
+	DomainCacheSize int    `yaml:"domain_cache_size"` // 0 for disabled
+	HistorySize     int    `yaml:"history_size"`      // closed tunnels kept
+	EnableMonitor   bool   `yaml:"enable_monitor"`
+	PProfAddr       string `yaml:"pprof_addr"` // deprecated
+	DebugAddr       string `yaml:"debug_addr"` // in favor of this
+	// DebugTLS serves the monitor and the others at DebugAddr over TLS,
+	// requiring client certificates if 'verify_client' is set.
+	DebugTLS *TLSConfig `yaml:"debug_tls"`
+
+	// BufferMemoryLimit is a soft cap of the relay buffers in use, e.g.
+	// "512MiB". New tunnels are delayed while it's exceeded, and rejected if
+	// it's still exceeded after a while. Empty for unlimited.
+	BufferMemoryLimit string `yaml:"buffer_memory_limit"`
+
+	// ProcessStats adds the goroutines, memory and file descriptors to the
+	// monitor reports, which stops the world briefly for each report.
+	ProcessStats bool `yaml:"process_stats"`
+
+	// DefaultAction is what to do with the requests matching no rule, if
+	// there is neither a "default" rule nor a downstream default overriding
+	// it. It is either "allow" (default) or "deny".
+	DefaultAction string `yaml:"default_action"`
+
+	// ValidateUpstreamsOnStart is a HOST:PORT requested via every upstream
+	// on startup, which fails if any non-optional upstream cannot reach it.
+	// Empty for no validation.
+	ValidateUpstreamsOnStart string `yaml:"validate_upstreams_on_start"`
+
+	TunnelLog *TunnelLogConfig `yaml:"tunnel_log"`
+	Stats     *StatsConfig     `yaml:"stats"` // requires 'db'
+}
+
+// DenyUnmatched parses DefaultAction, telling whether the requests matching
+// no rule should be rejected.
+func (c MiscConfig) DenyUnmatched() (bool, error) {
+	switch c.DefaultAction {
+	case "", "allow":
+		return false, nil
+	case "deny":
+		return true, nil
+	default:
+		return false, errors.New("invalid 'default_action': " + c.DefaultAction)
+	}
+}
+
+// TunnelLogConfig describes where the summaries of completed tunnels go.
+type TunnelLogConfig struct {
+	File   string `yaml:"file"`
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"` // json (default) or influx
+}
+
+// StatsConfig describes how the per-upstream statistics are persisted in
+// the database.
+type StatsConfig struct {
+	FlushInterval string `yaml:"flush_interval"` // 1m by default
+	Bucket        string `yaml:"bucket"`         // 1h by default
 }
 
 // ParseConfigFile parses a given configuration file into a Config struct.
@@ -0,0 +1,17 @@
+package lib
+
+import "context"
+
+type dscpContextKey struct{}
+
+// WithDSCP returns a context making the transports mark the packets of the
+// connections dialed with it by the given DSCP value (0-63), where supported.
+func WithDSCP(ctx context.Context, dscp int) context.Context {
+	return context.WithValue(ctx, dscpContextKey{}, dscp)
+}
+
+// dscpFromContext returns the DSCP value set by WithDSCP, if any.
+func dscpFromContext(ctx context.Context) (int, bool) {
+	dscp, ok := ctx.Value(dscpContextKey{}).(int)
+	return dscp, ok
+}
@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lib
+
+import "syscall"
+
+// setDSCPControl is not supported on this platform.
+var setDSCPControl func(network string, c syscall.RawConn, dscp int) error
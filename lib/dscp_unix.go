@@ -0,0 +1,28 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDSCPControl sets IP_TOS or IPV6_TCLASS on an IP socket.
+var setDSCPControl = func(network string, c syscall.RawConn, dscp int) error {
+	level, opt := unix.IPPROTO_IP, unix.IP_TOS
+	if strings.HasSuffix(network, "6") {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	} else if !strings.HasSuffix(network, "4") { // e.g. unix sockets
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,37 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDirectTCPClientDSCP(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	addr, err := FromNetAddr(listener.Addr())
+	require.NoError(t, err)
+
+	getTOS := func(ctx context.Context) int {
+		conn, _, pErr := DirectTCPClient{}.Request(ctx, addr)
+		require.Nil(t, pErr)
+		defer conn.Close() // nolint: errcheck
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		require.NoError(t, err)
+		var tos int
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			tos, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		}))
+		require.NoError(t, err)
+		return tos
+	}
+	assert.Equal(t, 0, getTOS(context.Background()))
+	assert.Equal(t, 46<<2, getTOS(WithDSCP(context.Background(), 46)))
+}
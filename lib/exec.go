@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultExecRestartDelay = time.Second
+	execReadyPollInterval   = 50 * time.Millisecond
+)
+
+// ExecTransport is a client-only Transport provided by an external helper
+// process, via whose SOCKS5 server the connections are dialed. The helper is
+// started on the first Dial, and restarted whenever it exits until Close is
+// called. On Linux, it is also terminated when the current process exits.
+type ExecTransport struct {
+	command      []string
+	env          []string
+	socksAddr    string
+	restartDelay time.Duration
+	proxied      *ProxiedTransport
+	started      sync.Once
+	ready        int32 // 1 if the helper accepts connections, used atomically
+	cmdMtx       sync.Mutex
+	cmd          *exec.Cmd // the running helper, guarded by cmdMtx
+	closed       bool      // guarded by cmdMtx
+}
+
+// NewExecTransport creates an ExecTransport from the given configuration.
+func NewExecTransport(config ExecConfig) (*ExecTransport, error) {
+	if len(config.Command) == 0 {
+		return nil, errors.New("'command' is required for 'exec'")
+	}
+	if config.SOCKSAddr == "" {
+		return nil, errors.New("'socks_addr' is required for 'exec'")
+	}
+	t := &ExecTransport{
+		command:      config.Command,
+		env:          config.Env,
+		socksAddr:    config.SOCKSAddr,
+		restartDelay: defaultExecRestartDelay,
+		proxied: &ProxiedTransport{&SOCKS5Client{
+			Transport: TCPTransport{},
+			Addr:      config.SOCKSAddr,
+			Username:  config.Username,
+			Password:  config.Password,
+		}},
+	}
+	if config.RestartDelay != "" {
+		d, err := time.ParseDuration(config.RestartDelay)
+		if err != nil || d < 0 {
+			return nil, errors.New("invalid value for 'restart_delay'")
+		}
+		t.restartDelay = d
+	}
+	return t, nil
+}
+
+// Listen is not implemented for ExecTransport.
+func (t *ExecTransport) Listen(address string) (net.Listener, error) {
+	panic("ExecTransport can not be used as a server-side transport")
+}
+
+// Dial creates a connection to a remote host via the helper process, waiting
+// for it to be ready if it is (re)starting.
+func (t *ExecTransport) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	t.started.Do(func() { go t.supervise() })
+	if err := t.waitReady(ctx); err != nil {
+		return nil, errors.WithMessage(err, "exec transport not ready")
+	}
+	return t.proxied.Dial(ctx, address)
+}
+
+func (t *ExecTransport) waitReady(ctx context.Context) error {
+	for atomic.LoadInt32(&t.ready) == 0 {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", t.socksAddr)
+		if err == nil {
+			_ = conn.Close()
+			atomic.StoreInt32(&t.ready, 1)
+			break
+		}
+		select {
+		case <-time.After(execReadyPollInterval):
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Close stops the helper process, which is not restarted any more.
+func (t *ExecTransport) Close() error {
+	t.cmdMtx.Lock()
+	defer t.cmdMtx.Unlock()
+	t.closed = true
+	if t.cmd != nil {
+		return errors.WithStack(t.cmd.Process.Kill())
+	}
+	return nil
+}
+
+// supervise keeps the helper process running.
+func (t *ExecTransport) supervise() {
+	for {
+		err := t.run()
+		atomic.StoreInt32(&t.ready, 0)
+		t.cmdMtx.Lock()
+		t.cmd = nil
+		closed := t.closed
+		t.cmdMtx.Unlock()
+		if closed {
+			transportLog.Infow("exec transport closed", "command", t.command)
+			return
+		}
+		transportLog.Warnw(
+			"exec transport exited, restarting", "command", t.command,
+			"error", err, "delay", t.restartDelay)
+		time.Sleep(t.restartDelay)
+	}
+}
+
+func (t *ExecTransport) run() error {
+	cmd := exec.Command(t.command[0], t.command[1:]...)
+	cmd.Env = append(os.Environ(), t.env...)
+	cmd.SysProcAttr = execSysProcAttr()
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.cmdMtx.Lock()
+	if !t.closed {
+		err = cmd.Start()
+	} else {
+		err = errors.New("closed")
+	}
+	if err == nil {
+		t.cmd = cmd
+	}
+	t.cmdMtx.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to start")
+	}
+	transportLog.Infow(
+		"exec transport started", "command", t.command, "pid", cmd.Process.Pid)
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() { // until the helper exits
+		transportLog.Infow(
+			"exec transport output", "pid", cmd.Process.Pid,
+			"line", scanner.Text())
+	}
+	return errors.WithStack(cmd.Wait())
+}
@@ -0,0 +1,10 @@
+// +build linux
+
+package lib
+
+import "syscall"
+
+// execSysProcAttr makes the helper processes terminated along with us.
+var execSysProcAttr = func() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
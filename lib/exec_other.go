@@ -0,0 +1,10 @@
+// +build !linux
+
+package lib
+
+import "syscall"
+
+// execSysProcAttr is not needed on this platform.
+var execSysProcAttr = func() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const execHelperEnv = "THESTRAL_EXEC_HELPER_ADDR"
+
+// TestExecTransportHelper is not a real test, but the helper process started
+// by TestExecTransport, which serves SOCKS5 on the given address.
+func TestExecTransportHelper(t *testing.T) {
+	addr := os.Getenv(execHelperEnv)
+	if addr == "" {
+		return
+	}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), TCPTransport{}, addr, false, nil, time.Minute)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	for req := range reqCh {
+		go func(req ProxyRequest) {
+			upConn, boundAddr, pErr := DirectTCPClient{}.Request(
+				context.Background(), req.TargetAddr())
+			if pErr != nil {
+				req.Fail(pErr)
+				return
+			}
+			downConn := req.Success(boundAddr)
+			go io.Copy(upConn, downConn) // nolint: errcheck
+			_, _ = io.Copy(downConn, upConn)
+			_ = downConn.Close()
+		}(req)
+	}
+}
+
+func TestExecTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	socksAddr := l.Addr().String()
+	require.NoError(t, l.Close())
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	helper := []string{os.Args[0], "-test.run=^TestExecTransportHelper$"}
+	trans, err := CreateTransport(&TransportConfig{Exec: &ExecConfig{
+		Command:      helper,
+		Env:          []string{execHelperEnv + "=" + socksAddr},
+		SOCKSAddr:    socksAddr,
+		RestartDelay: "100ms",
+	}})
+	require.NoError(t, err)
+	execTrans := trans.(*ExecTransport)
+	defer execTrans.Close() // nolint: errcheck
+	echoOnce := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		conn, err := trans.Dial(ctx, echo.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close() // nolint: errcheck
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	}
+	echoOnce()
+
+	// restarted after being killed
+	execTrans.cmdMtx.Lock()
+	require.NoError(t, execTrans.cmd.Process.Kill())
+	execTrans.cmdMtx.Unlock()
+	for atomic.LoadInt32(&execTrans.ready) != 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	echoOnce()
+
+	for _, config := range []*TransportConfig{
+		{Exec: &ExecConfig{SOCKSAddr: socksAddr}},
+		{Exec: &ExecConfig{Command: []string{"helper"}}},
+		{Exec: &ExecConfig{Command: []string{"helper"}, SOCKSAddr: socksAddr,
+			RestartDelay: "soon"}},
+		{Exec: &ExecConfig{Command: []string{"helper"}, SOCKSAddr: socksAddr},
+			KCP: gKCPClientConfig},
+	} {
+		_, err = CreateTransport(config)
+		assert.Error(t, err)
+	}
+}
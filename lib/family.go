@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// WrapTransFamilyPreference wraps a Transport so that a host name dialed is
+// resolved first, and its addresses of the preferred family ("ipv4" or
+// "ipv6") are tried before the others, one after another. Listening is not
+// affected.
+func WrapTransFamilyPreference(
+	inner Transport, family string) (Transport, error) {
+	if family != "ipv4" && family != "ipv6" {
+		return nil, errors.Errorf("invalid 'family_preference': %q", family)
+	}
+	return &familyTransWrapper{
+		inner:    inner,
+		preferV6: family == "ipv6",
+		lookup:   net.DefaultResolver.LookupIPAddr,
+	}, nil
+}
+
+type familyTransWrapper struct {
+	inner    Transport
+	preferV6 bool
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func (w *familyTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if net.ParseIP(host) != nil {
+		return w.inner.Dial(ctx, address)
+	}
+	addrs, err := w.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no address found")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %s", host)
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return w.preferred(addrs[i].IP) && !w.preferred(addrs[j].IP)
+	})
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = w.inner.Dial(ctx, net.JoinHostPort(addr.String(), port))
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return conn, err
+}
+
+func (w *familyTransWrapper) Listen(address string) (net.Listener, error) {
+	return w.inner.Listen(address)
+}
+
+func (w *familyTransWrapper) preferred(ip net.IP) bool {
+	return (ip.To4() == nil) == w.preferV6
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ForwardServer is a ProxyServer that forwards every accepted connection to
+// a fixed target, just like port forwarding. No proxy protocol is spoken with
+// the clients.
+//
+// With a TLS transport, the target can also be chosen by the SNI of the
+// clients, like virtual hosts. The fixed target, if any, is used for the
+// server names not listed.
+type ForwardServer struct {
+	transport  Transport
+	addr       string
+	target     Address            // nil if only the SNI targets are used
+	sniTargets map[string]Address // keyed by lower case server names
+	isRunning  uint32             // should be used with atomic operations
+	listeners  []net.Listener
+	reqCh      chan ProxyRequest
+	log        *zap.SugaredLogger
+}
+
+// forwardServerSettings are the settings of a ForwardServer, where either
+// 'target' or 'sni_targets' is required.
+type forwardServerSettings struct {
+	Address    string            `yaml:"address"`
+	Target     string            `yaml:"target"`
+	SNITargets map[string]string `yaml:"sni_targets"`
+}
+
+// NewForwardServer creates a ForwardServer from the given configuration.
+func NewForwardServer(
+	logger *zap.SugaredLogger, config ProxyConfig) (*ForwardServer, error) {
+	var settings forwardServerSettings
+	if err := config.DecodeSettings(&settings); err != nil {
+		return nil, err
+	}
+	if settings.Address == "" ||
+		(settings.Target == "" && len(settings.SNITargets) == 0) {
+		return nil, errors.New("'address' and either 'target' or " +
+			"'sni_targets' must be specified for forward")
+	}
+	if len(settings.SNITargets) > 0 &&
+		(config.Transport == nil || config.Transport.TLS == nil) {
+		return nil, errors.New("'sni_targets' requires a TLS transport")
+	}
+	sniTargets := make(map[string]Address)
+	for name, target := range settings.SNITargets {
+		addr, err := ParseAddress(target)
+		if err != nil {
+			return nil, errors.WithMessage(
+				err, "invalid target of server name: "+name)
+		}
+		sniTargets[strings.ToLower(name)] = addr
+	}
+	var targetAddr Address
+	if settings.Target != "" {
+		var err error
+		if targetAddr, err = ParseAddress(settings.Target); err != nil {
+			return nil, errors.WithMessage(err, "invalid 'target'")
+		}
+	}
+
+	transport, err := CreateTransport(config.Transport)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create forward server")
+	}
+	return &ForwardServer{
+		transport:  transport,
+		addr:       settings.Address,
+		target:     targetAddr,
+		sniTargets: sniTargets,
+		log:        logger,
+	}, nil
+}
+
+// Start fires up the ForwardServer and returns a channel of client requests.
+// Like SOCKS5Server, the address may contain a port range.
+func (s *ForwardServer) Start() (<-chan ProxyRequest, error) {
+	s.reqCh = make(chan ProxyRequest, 1)
+
+	var err error
+	if s.listeners, err = ListenAll(s.transport, s.addr); err != nil {
+		s.log.Errorw(
+			"failed to start forward server", "addr", s.addr, "error", err)
+		return nil, errors.WithMessage(err, "failed to start forward server")
+	}
+	s.log.Infow("forward server started", "addr", s.addr, "target", s.target)
+
+	atomic.StoreUint32(&s.isRunning, 1)
+	for _, l := range s.listeners {
+		go s.acceptLoop(l)
+	}
+
+	return s.reqCh, nil
+}
+
+func (s *ForwardServer) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if atomic.LoadUint32(&s.isRunning) > 0 { // still running
+				s.log.Warnw("accept error", "error", err)
+			}
+			break
+		}
+
+		reqID := GetNextRequestID()
+		cliLogger := s.log.With("reqID", reqID).Named("client")
+		cliLogger.Debugw(
+			"client connection accepted", "addr", conn.RemoteAddr())
+		req := &forwardRequest{
+			id: reqID, conn: conn, log: cliLogger, target: s.target}
+		if len(s.sniTargets) > 0 {
+			go s.routeBySNI(req) // don't wait for the handshake here
+		} else {
+			s.reqCh <- req
+		}
+	}
+	s.log.Infow("forward server exited", "addr", listener.Addr())
+}
+
+func (s *ForwardServer) routeBySNI(req *forwardRequest) {
+	var name string
+	var err error
+	if wsn, ok := req.conn.(WithServerName); ok {
+		name, err = wsn.ServerName()
+	}
+	if err != nil {
+		req.log.Warnw("failed to get the server name", "error", err)
+		req.Fail(nil)
+		return
+	}
+	if target, ok := s.sniTargets[strings.ToLower(name)]; ok {
+		req.target = target
+	}
+	if req.target == nil {
+		req.log.Warnw("no target for the server name", "serverName", name)
+		req.Fail(nil)
+		return
+	}
+	req.log.Debugw(
+		"target selected by server name",
+		"serverName", name, "target", req.target)
+	s.reqCh <- req
+}
+
+// Stop kill the server.
+func (s *ForwardServer) Stop() {
+	s.log.Infow("stopping forward server")
+	atomic.StoreUint32(&s.isRunning, 0)
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			s.log.Warnw("error occurred when closing listener", "error", err)
+		}
+	}
+}
+
+type forwardRequest struct {
+	id     string
+	log    *zap.SugaredLogger
+	conn   net.Conn
+	target Address
+}
+
+// GetPeerIdentifiers returns a list of peer identifiers of this client.
+func (r *forwardRequest) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	if withID, ok := r.conn.(WithPeerIdentifiers); ok {
+		ids, err := withID.GetPeerIdentifiers()
+		return ids, errors.WithMessage(err, "failed to get peerIDs")
+	}
+	return nil, nil
+}
+
+// PeerAddr returns the address of the client.
+func (r *forwardRequest) PeerAddr() string {
+	return r.conn.RemoteAddr().String()
+}
+
+// TargetAddr returns the fixed target of the server, or the one selected by
+// the SNI of the client.
+func (r *forwardRequest) TargetAddr() Address {
+	return r.target
+}
+
+// Success returns the client connection as is.
+func (r *forwardRequest) Success(addr Address) io.ReadWriteCloser {
+	return r.conn
+}
+
+// Fail closes the client connection as there is no way to report the error.
+func (r *forwardRequest) Fail(proxyErr *ProxyError) {
+	if err := r.conn.Close(); err != nil {
+		r.log.Warnw("failed to close client connection", "error", err)
+	}
+}
+
+// Logger returns a logger of this client.
+func (r *forwardRequest) Logger() *zap.SugaredLogger {
+	return r.log
+}
+
+// ID returns the identifier of this client.
+func (r *forwardRequest) ID() string {
+	return r.id
+}
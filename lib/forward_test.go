@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestForwardServer(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	svr, err := NewForwardServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "forward",
+		Settings: map[string]interface{}{
+			"address": address, "target": "db.internal:5432"},
+	})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	for i := 0; i < 3; i++ {
+		cli, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		select {
+		case req := <-reqCh:
+			assert.Equal(t, "db.internal:5432", req.TargetAddr().String())
+			assert.Equal(t, cli.LocalAddr().String(), req.PeerAddr())
+			conn := req.Success(&TCP4Addr{net.IPv4zero, 0})
+			_, err = conn.Write([]byte("hello"))
+			assert.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(cli, buf)
+			assert.NoError(t, err)
+			assert.EqualValues(t, "hello", buf)
+			assert.NoError(t, conn.Close())
+		case <-time.After(time.Second):
+			t.Fatal("no request received")
+		}
+		_ = cli.Close()
+	}
+}
+
+func TestForwardServerConfig(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	for _, settings := range []map[string]interface{}{
+		{"address": "127.0.0.1:0"},
+		{"target": "127.0.0.1:80"},
+		{"address": "127.0.0.1:0", "target": "no port"},
+		{"address": "127.0.0.1:0", "target": "127.0.0.1:80", "unknown": 1},
+		{"address": "127.0.0.1:0", "sni_targets": map[interface{}]interface{}{
+			"a.example.com": "127.0.0.1:80"}}, // TLS is required
+	} {
+		_, err := NewForwardServer(
+			logger, ProxyConfig{Protocol: "forward", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+}
+
+func TestForwardServerSNI(t *testing.T) {
+	svr, err := NewForwardServer(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "forward",
+		Transport: &TransportConfig{TLS: &TLSConfig{
+			Cert: "../test_files/test.server.pem",
+			Key:  "../test_files/test.server.key.pem",
+		}},
+		Settings: map[string]interface{}{
+			"address": "127.0.0.1:0",
+			"sni_targets": map[interface{}]interface{}{
+				"A.example.com": "a.internal:443",
+				"b.example.com": "b.internal:443",
+			},
+		},
+	})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	address := svr.listeners[0].Addr().String()
+
+	dial := func(serverName string) *tls.Conn {
+		cli := tls.Client(mustDial(t, address), &tls.Config{
+			ServerName: serverName, InsecureSkipVerify: true}) // nolint: gosec
+		go cli.Handshake() // nolint: errcheck
+		return cli
+	}
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		cli := dial(name)
+		select {
+		case req := <-reqCh:
+			assert.Equal(t,
+				name[:1]+".internal:443", req.TargetAddr().String())
+			_ = req.Success(nil).Close()
+		case <-time.After(time.Second):
+			t.Fatal("no request received")
+		}
+		_ = cli.Close()
+	}
+
+	// unknown server names are rejected without a fallback target
+	cli := dial("c.example.com")
+	defer cli.Close() // nolint: errcheck
+	select {
+	case <-reqCh:
+		t.Fatal("unexpected request")
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func mustDial(t *testing.T, address string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	return conn
+}
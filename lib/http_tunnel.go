@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"runtime"
 	"strconv"
@@ -22,9 +23,59 @@ func init() {
 		runtime.GOOS, runtime.GOARCH, runtime.Version(), ThestralVersion)
 }
 
-// HTTPTunnelClient is a proxy client for HTTP tunnel protocol.
+// The default limits on the status lines and the headers of the responses
+// to a request, including the informational ones.
+const (
+	defaultHTTPMaxHeaderSize  = 64 * 1024
+	defaultHTTPMaxHeaderLines = 100
+)
+
+// HTTPTunnelClient is a proxy client for HTTP tunnel protocol. The limits on
+// the responses are the defaults if they are 0. ForwardedFor makes it send
+// the IP address of the client set by WithClientAddr to the proxy, in both
+// X-Forwarded-For and Forwarded headers.
 type HTTPTunnelClient struct {
-	Addr string
+	Addr           string
+	MaxHeaderSize  int // in bytes
+	MaxHeaderLines int
+	ForwardedFor   bool
+}
+
+type httpTunnelSettings struct {
+	Address        string `yaml:"address"`
+	MaxHeaderSize  string `yaml:"max_header_size"`
+	MaxHeaderLines int    `yaml:"max_header_lines"`
+	ForwardedFor   bool   `yaml:"forwarded_for"`
+}
+
+// NewHTTPTunnelClient creates a HTTPTunnelClient from the given configuration.
+func NewHTTPTunnelClient(config ProxyConfig) (*HTTPTunnelClient, error) {
+	if config.Transport != nil {
+		return nil, errors.New(
+			"'http' protocol should not have any transport setting")
+	}
+	var settings httpTunnelSettings
+	if err := config.DecodeSettings(&settings); err != nil {
+		return nil, err
+	}
+	if settings.Address == "" {
+		return nil, errors.New("a valid 'address' must be supplied")
+	}
+	client := &HTTPTunnelClient{Addr: settings.Address,
+		MaxHeaderLines: settings.MaxHeaderLines,
+		ForwardedFor:   settings.ForwardedFor}
+	if settings.MaxHeaderSize != "" {
+		size, err := ParseBytes(settings.MaxHeaderSize)
+		if err != nil || size == 0 || size > math.MaxInt32 {
+			return nil, errors.Errorf(
+				"invalid 'max_header_size': %q", settings.MaxHeaderSize)
+		}
+		client.MaxHeaderSize = int(size)
+	}
+	if settings.MaxHeaderLines < 0 {
+		return nil, errors.New("'max_header_lines' should not be negative")
+	}
+	return client, nil
 }
 
 // Request establish a connection via the HTTP tunnel proxy.
@@ -38,10 +89,14 @@ func (c HTTPTunnelClient) Request(ctx context.Context, addr Address) (
 		_ = conn.SetDeadline(ddl.Add(-time.Millisecond))
 	}
 
+	var clientAddr string
+	if c.ForwardedFor {
+		clientAddr, _ = clientAddrFromContext(ctx)
+	}
 	brc := &bufReadRWC{conn, bufio.NewReader(conn)}
 	errCh := make(chan *ProxyError, 1)
 	go func() {
-		if err := c.sendRequest(brc, addr); err != nil {
+		if err := c.sendRequest(brc, addr, clientAddr); err != nil {
 			errCh <- err
 		} else if err := c.readResponse(brc); err != nil {
 			errCh <- err
@@ -65,7 +120,10 @@ func (c HTTPTunnelClient) Request(ctx context.Context, addr Address) (
 	}
 }
 
-func (c HTTPTunnelClient) sendRequest(w io.Writer, addr Address) *ProxyError {
+// sendRequest sends the CONNECT request, with the forwarding headers if the
+// client address is not empty.
+func (c HTTPTunnelClient) sendRequest(
+	w io.Writer, addr Address, clientAddr string) *ProxyError {
 	addrStr := addr.String()
 	var buf bytes.Buffer
 	_, _ = buf.WriteString("CONNECT ")
@@ -74,6 +132,20 @@ func (c HTTPTunnelClient) sendRequest(w io.Writer, addr Address) *ProxyError {
 	_, _ = buf.WriteString(addrStr)
 	_, _ = buf.WriteString("\r\nProxy-Connection: keep-alive\r\nUser-Agent: ")
 	_, _ = buf.WriteString(httpUserAgent)
+	if clientAddr != "" {
+		ip := clientAddr
+		if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+			ip = host
+		}
+		forwarded := ip
+		if strings.Contains(ip, ":") { // IPv6 must be quoted in RFC 7239
+			forwarded = `"[` + ip + `]"`
+		}
+		_, _ = buf.WriteString("\r\nX-Forwarded-For: ")
+		_, _ = buf.WriteString(ip)
+		_, _ = buf.WriteString("\r\nForwarded: for=")
+		_, _ = buf.WriteString(forwarded)
+	}
 	_, _ = buf.WriteString("\r\n\r\n")
 	_, err := buf.WriteTo(w)
 	return wrapAsProxyError(
@@ -81,50 +153,174 @@ func (c HTTPTunnelClient) sendRequest(w io.Writer, addr Address) *ProxyError {
 		ProxyGeneralErr)
 }
 
+// readResponse skips the informational responses, and fails unless the
+// final one is 200.
 func (c HTTPTunnelClient) readResponse(brc *bufReadRWC) *ProxyError {
-	var err error
-	errType := ProxyGeneralErr // default error type
-	line, _, err := brc.b.ReadLine()
-	if err != nil {
+	maxSize, maxLines := c.MaxHeaderSize, c.MaxHeaderLines
+	if maxSize == 0 {
+		maxSize = defaultHTTPMaxHeaderSize
+	}
+	if maxLines == 0 {
+		maxLines = defaultHTTPMaxHeaderLines
+	}
+	budget := &httpHeadBudget{maxSize, maxLines}
+	readFailed := func(err error) *ProxyError {
+		if errors.Cause(err) == errHTTPHeadTooLarge {
+			err = errors.Errorf("response header from proxy server "+
+				"exceeds %d bytes or %d lines", maxSize, maxLines)
+			return &ProxyError{
+				Error: err, ErrType: ProxyGeneralErr, Reason: ReasonProtocolError}
+		}
 		err = errors.WithMessage(err, "failed to read from proxy server")
-		return wrapAsProxyError(err, errType)
+		return wrapAsProxyError(err, ProxyGeneralErr)
 	}
 
-	heading := string(line)
-	hFields := strings.Fields(string(line))
-	if len(hFields) < 2 {
-		err = errors.WithMessage(err, "invalid heading from proxy server")
-		return wrapAsProxyError(err, errType)
-	}
+	for {
+		line, err := readHTTPLine(brc.b, budget)
+		if err != nil {
+			return readFailed(err)
+		}
 
-	code, err := strconv.Atoi(hFields[1])
-	if err != nil {
-		err = errors.WithMessage(err, "invalid response code: "+hFields[1])
-		return wrapAsProxyError(err, errType)
-	}
+		heading := string(line)
+		hFields := strings.Fields(heading)
+		if len(hFields) < 2 {
+			err = errors.New("invalid heading from proxy server: " + heading)
+			return &ProxyError{
+				Error: err, ErrType: ProxyGeneralErr, Reason: ReasonProtocolError}
+		}
+		code, err := strconv.Atoi(hFields[1])
+		if err != nil {
+			err = errors.WithMessage(err, "invalid response code: "+hFields[1])
+			return &ProxyError{
+				Error: err, ErrType: ProxyGeneralErr, Reason: ReasonProtocolError}
+		}
+
+		header, contentLength, err := readHTTPHeader(brc.b, budget)
+		if err != nil {
+			return readFailed(err)
+		}
+		switch {
+		case code == 200:
+			return nil
+		case code/100 == 1:
+			continue // e.g. 100 Continue, followed by the final one
+		}
 
-	if code != 200 {
+		errType := ProxyGeneralErr
 		if code/100 == 4 {
 			errType = ProxyCmdUnsupported // maybe...
 		} else if code/100 == 5 {
 			errType = ProxyConnectFailed
 		}
-		err = errors.New("proxy server responses: " + heading)
-		return wrapAsProxyError(err, errType)
+		err = errors.WithStack(&HTTPTunnelError{
+			StatusLine: heading, StatusCode: code, Header: header,
+			Body: readHTTPErrorBody(brc.b, contentLength)})
+		return &ProxyError{
+			Error: err, ErrType: errType, Reason: ReasonProxyRejected}
+	}
+}
+
+// httpErrorDetailSize bounds the header and the body of a failure response
+// kept in an HTTPTunnelError respectively.
+const httpErrorDetailSize = 512
+
+// HTTPTunnelError is a failure response from an HTTP tunnel proxy, keeping
+// the header and the beginning of the body, which often tell the reason,
+// e.g. X-Squid-Error.
+type HTTPTunnelError struct {
+	StatusLine string
+	StatusCode int
+	Header     []string // the lines as received, up to httpErrorDetailSize
+	Body       []byte   // up to httpErrorDetailSize bytes
+}
+
+func (e *HTTPTunnelError) Error() string {
+	msg := "proxy server responses: " + e.StatusLine
+	if len(e.Header) > 0 {
+		msg += " [" + strings.Join(e.Header, "; ") + "]"
+	}
+	if len(e.Body) > 0 {
+		msg += fmt.Sprintf(" %q", e.Body)
+	}
+	return msg
+}
+
+// httpHeadBudget is what remains of the limits on the status lines and the
+// headers, which fail the reading with errHTTPHeadTooLarge once exceeded.
+type httpHeadBudget struct {
+	size  int // in bytes
+	lines int
+}
+
+var errHTTPHeadTooLarge = errors.New("HTTP header too large")
+
+// readHTTPLine reads a line, dropping what exceeds httpErrorDetailSize.
+func readHTTPLine(r *bufio.Reader, budget *httpHeadBudget) ([]byte, error) {
+	if budget.lines--; budget.lines < 0 {
+		return nil, errHTTPHeadTooLarge
+	}
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if budget.size -= len(part); budget.size < 0 {
+			return nil, errHTTPHeadTooLarge
+		}
+		if room := httpErrorDetailSize - len(line); len(part) > room {
+			part = part[:room]
+		}
+		line = append(line, part...)
+		if !isPrefix {
+			return line, nil
+		}
 	}
+}
 
-	for { // drop headers
-		line, _, err = brc.b.ReadLine()
+// readHTTPHeader reads until the empty line, keeping the header lines within
+// httpErrorDetailSize bytes in total. The content length is -1 if unknown.
+func readHTTPHeader(r *bufio.Reader, budget *httpHeadBudget) (
+	header []string, contentLength int, err error) {
+	size := 0
+	contentLength = -1
+	for {
+		line, err := readHTTPLine(r, budget)
 		if err != nil {
-			err = errors.WithMessage(err, "failed to read from proxy server")
-			return wrapAsProxyError(err, errType)
+			return nil, -1, err
 		}
 		if len(line) == 0 {
-			return nil // done
+			return header, contentLength, nil
+		}
+		if size += len(line); size <= httpErrorDetailSize {
+			header = append(header, string(line))
+		}
+		kv := strings.SplitN(string(line), ":", 2)
+		if len(kv) == 2 && strings.EqualFold(
+			strings.TrimSpace(kv[0]), "Content-Length") {
+			n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err == nil && n >= 0 {
+				contentLength = n
+			}
 		}
 	}
 }
 
+// readHTTPErrorBody reads the beginning of the body, if its length is known,
+// or what has been received otherwise, so that it never blocks for long.
+func readHTTPErrorBody(r *bufio.Reader, contentLength int) []byte {
+	size := contentLength
+	if size < 0 {
+		size = r.Buffered()
+	}
+	if size > httpErrorDetailSize {
+		size = httpErrorDetailSize
+	}
+	body := make([]byte, size)
+	n, _ := io.ReadFull(r, body)
+	return body[:n]
+}
+
 type bufReadRWC struct {
 	net.Conn
 	b *bufio.Reader
@@ -134,6 +330,10 @@ func (b *bufReadRWC) Read(p []byte) (int, error) {
 	return b.b.Read(p)
 }
 
+func (b *bufReadRWC) CloseWrite() error {
+	return closeWrite(b.Conn)
+}
+
 func (b *bufReadRWC) WriteTo(w io.Writer) (int64, error) {
 	return b.b.WriteTo(w)
 }
@@ -1,14 +1,19 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -141,6 +146,170 @@ func (s *HTTPTunnelTestSuite) TestOtherError() {
 	s.doTest(304, false)
 }
 
+// requestResp requests with the client via a mock server sending the given
+// response.
+func (s *HTTPTunnelTestSuite) requestResp(
+	cli HTTPTunnelClient, resp string) *ProxyError {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer l.Close() // nolint: errcheck
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() // nolint: errcheck
+		_, _ = io.ReadFull(conn, make([]byte, len(s.expReq)))
+		_, _ = io.WriteString(conn, resp)
+	}()
+
+	cli.Addr = l.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	rwc, _, pErr := cli.Request(ctx, s.targetAddr)
+	if rwc != nil {
+		_ = rwc.Close()
+	}
+	return pErr
+}
+
+func (s *HTTPTunnelTestSuite) TestInformational() {
+	s.Nil(s.requestResp(HTTPTunnelClient{},
+		"HTTP/1.1 100 Continue\r\n\r\n"+
+			"HTTP/1.1 102 Processing\r\nExtra: header\r\n\r\n"+
+			"HTTP/1.1 200 Connection established\r\n\r\n"))
+	pErr := s.requestResp(HTTPTunnelClient{},
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 403 Forbidden\r\n\r\n")
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyCmdUnsupported, pErr.ErrType)
+}
+
+func (s *HTTPTunnelTestSuite) TestErrorDetails() {
+	pErr := s.requestResp(HTTPTunnelClient{}, "HTTP/1.1 403 Forbidden\r\n"+
+		"X-Squid-Error: ERR_ACCESS_DENIED 0\r\nContent-Length: 13\r\n\r\n"+
+		"access denied and more")
+	s.Require().NotNil(pErr)
+	s.Equal(ReasonProxyRejected, pErr.Reason)
+	tunnelErr, ok := errors.Cause(pErr.Error).(*HTTPTunnelError)
+	s.Require().True(ok)
+	s.Equal(403, tunnelErr.StatusCode)
+	s.Equal([]string{"X-Squid-Error: ERR_ACCESS_DENIED 0",
+		"Content-Length: 13"}, tunnelErr.Header)
+	s.Equal("access denied", string(tunnelErr.Body))
+	s.Equal("proxy server responses: HTTP/1.1 403 Forbidden "+
+		"[X-Squid-Error: ERR_ACCESS_DENIED 0; Content-Length: 13] "+
+		`"access denied"`, tunnelErr.Error())
+
+	// the header and the body are bounded
+	long := strings.Repeat("x", httpErrorDetailSize*2)
+	pErr = s.requestResp(HTTPTunnelClient{},
+		"HTTP/1.1 502 Bad Gateway\r\nA: "+long+
+			"\r\nB: b\r\nContent-Length: 1024\r\n\r\n"+long)
+	s.Require().NotNil(pErr)
+	s.EqualValues(ProxyConnectFailed, pErr.ErrType)
+	tunnelErr = errors.Cause(pErr.Error).(*HTTPTunnelError)
+	s.Equal([]string{"A: " + long[:httpErrorDetailSize-3]}, tunnelErr.Header)
+	s.Len(tunnelErr.Body, httpErrorDetailSize)
+}
+
+func (s *HTTPTunnelTestSuite) TestHeaderLimits() {
+	headers := strings.Repeat("Extra: header\r\n", 10)
+	resp := "HTTP/1.1 200 Connection established\r\n" + headers + "\r\n"
+	s.Nil(s.requestResp(HTTPTunnelClient{}, resp))
+	pErr := s.requestResp(HTTPTunnelClient{MaxHeaderLines: 11}, resp)
+	s.Require().NotNil(pErr)
+	s.Equal(ReasonProtocolError, pErr.Reason)
+	s.Nil(s.requestResp(HTTPTunnelClient{MaxHeaderLines: 12}, resp))
+	pErr = s.requestResp(HTTPTunnelClient{MaxHeaderSize: 100}, resp)
+	s.Require().NotNil(pErr)
+	s.Equal(ReasonProtocolError, pErr.Reason)
+	s.EqualError(pErr.Error, "response header from proxy server "+
+		"exceeds 100 bytes or 100 lines")
+
+	// the informational responses are counted as well
+	pErr = s.requestResp(HTTPTunnelClient{}, strings.Repeat(
+		"HTTP/1.1 100 Continue\r\n\r\n", defaultHTTPMaxHeaderLines))
+	s.Require().NotNil(pErr)
+	s.Equal(ReasonProtocolError, pErr.Reason)
+
+	cli, err := NewHTTPTunnelClient(ProxyConfig{
+		Protocol: "http", Settings: map[string]interface{}{
+			"address": "127.0.0.1:8080", "max_header_size": "1K",
+			"max_header_lines": 10}})
+	s.Require().NoError(err)
+	s.Equal(&HTTPTunnelClient{Addr: "127.0.0.1:8080", MaxHeaderSize: 1024,
+		MaxHeaderLines: 10}, cli)
+}
+
+func (s *HTTPTunnelTestSuite) TestForwardedFor() {
+	head := strings.TrimSuffix(s.expReq, "\r\n")
+	for clientAddr, exp := range map[string]string{
+		"": s.expReq,
+		"10.0.0.1:1080": head +
+			"X-Forwarded-For: 10.0.0.1\r\nForwarded: for=10.0.0.1\r\n\r\n",
+		"[2001:db8::1]:1080": head + "X-Forwarded-For: 2001:db8::1\r\n" +
+			"Forwarded: for=\"[2001:db8::1]\"\r\n\r\n",
+	} {
+		var buf bytes.Buffer
+		s.Nil(HTTPTunnelClient{}.sendRequest(&buf, s.targetAddr, clientAddr))
+		s.Equal(exp, buf.String())
+	}
+
+	// the address is taken from the context only if enabled
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer l.Close() // nolint: errcheck
+	reqCh := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var req []string
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+				req = append(req, line)
+			}
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+			reqCh <- strings.Join(req, "")
+			_ = conn.Close()
+		}
+	}()
+	ctx := WithClientAddr(context.Background(), "10.0.0.1:1080")
+	for _, enabled := range []bool{true, false} {
+		cli := HTTPTunnelClient{Addr: l.Addr().String(), ForwardedFor: enabled}
+		rwc, _, pErr := cli.Request(ctx, s.targetAddr)
+		s.Require().Nil(pErr)
+		_ = rwc.Close()
+		s.Equal(enabled,
+			strings.Contains(<-reqCh, "X-Forwarded-For: 10.0.0.1\r\n"))
+	}
+}
+
+func (s *HTTPTunnelTestSuite) TestInvalidSettings() {
+	for _, settings := range []map[string]interface{}{
+		nil,
+		{"address": ""},
+		{"address": []string{"127.0.0.1:8080"}},
+		{"address": "127.0.0.1:8080", "username": "user"},
+		{"address": "127.0.0.1:8080", "max_header_size": "0"},
+		{"address": "127.0.0.1:8080", "max_header_size": "1x"},
+		{"address": "127.0.0.1:8080", "max_header_lines": -1},
+	} {
+		_, err := CreateProxyClient(
+			ProxyConfig{Protocol: "http", Settings: settings})
+		s.Error(err, "%v", settings)
+	}
+}
+
 func TestHTTPTunnelSuite(t *testing.T) {
 	suite.Run(t, new(HTTPTunnelTestSuite))
 }
@@ -1,8 +1,11 @@
 package lib
 
 import (
-	"container/list"
+	"container/heap"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 // KCPTransport is a connection-aware Transport based on the KCP protocol.
@@ -29,9 +33,47 @@ type KCPTransport struct {
 	parityShards      int
 	keepAliveInterval time.Duration
 	keepAliveTimeout  time.Duration
+	block             kcp.BlockCrypt // nil if no PSK is set
+	authKey           []byte         // nil if no PSK is set
+	localAddr         *net.UDPAddr   // nil if not bound
+	reuseLocalAddr    bool
+	// the remote addresses with a socket bound to localAddr, as the peer
+	// can't tell apart the sessions from the same address
+	boundRemotes map[string]struct{}
+	boundMtx     sync.Mutex
+
+	// nil if keep-alive is disabled
+	keepAliveQueue *kcpKeepAliveQueue
+}
+
+// kcpKeepAliveQueue holds the connections managed by the keep-alive manager
+// ordered by the time they need to be checked next, so that a scan only
+// visits the ones due.
+type kcpKeepAliveQueue struct {
+	items kcpKeepAliveHeap
+	mtx   sync.Mutex
+}
+
+type kcpKeepAliveItem struct {
+	conn *kcpConnWrapper
+	due  int64 // UNIX ns time
+}
+
+type kcpKeepAliveHeap []kcpKeepAliveItem
+
+func (h kcpKeepAliveHeap) Len() int           { return len(h) }
+func (h kcpKeepAliveHeap) Less(i, j int) bool { return h[i].due < h[j].due }
+func (h kcpKeepAliveHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *kcpKeepAliveHeap) Push(x interface{}) {
+	*h = append(*h, x.(kcpKeepAliveItem))
+}
 
-	conns    *list.List
-	connsMtx sync.Mutex
+func (h *kcpKeepAliveHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
 }
 
 // kcpCloseSendTimeout is the timeout for sending the kcpClose signal
@@ -41,9 +83,18 @@ var kcpCloseSendTimeout = time.Second * 10
 
 var kcpCloseLingerTimeout = time.Second * 10
 
+// kcpHandshakeTimeout is the timeout of the PSK handshake.
+var kcpHandshakeTimeout = time.Second * 10
+
+const (
+	kcpPSKIterations = 4096
+	kcpNonceSize     = 16
+)
+
 // NewKCPTransport creates KCPTransport with a given configuration.
 func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 	// var transport *KCPTransport
+	atomic.StoreInt32(&kcpInUse, 1)
 	t := new(KCPTransport)
 	switch config.Mode {
 	case "", "normal":
@@ -84,6 +135,37 @@ func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 		}
 	}
 
+	if config.PSK != "" {
+		cryptKey := pbkdf2.Key([]byte(config.PSK), []byte("thestral2-kcp-crypt"),
+			kcpPSKIterations, 32, sha256.New)
+		var err error
+		if t.block, err = kcp.NewAESBlockCrypt(cryptKey); err != nil {
+			return nil, errors.Wrap(err, "failed to create KCP block crypt")
+		}
+		t.authKey = pbkdf2.Key([]byte(config.PSK), []byte("thestral2-kcp-auth"),
+			kcpPSKIterations, 32, sha256.New)
+	}
+
+	if config.LocalAddr != "" {
+		var err error
+		if t.localAddr, err = net.ResolveUDPAddr(
+			"udp", config.LocalAddr); err != nil {
+			return nil, errors.Wrap(err, "invalid 'local_addr'")
+		}
+		t.boundRemotes = make(map[string]struct{})
+	}
+	if config.ReuseLocalAddr {
+		if t.localAddr == nil {
+			return nil, errors.New(
+				"'reuse_local_addr' must be used with 'local_addr'")
+		}
+		if reuseAddrControl == nil {
+			return nil, errors.New(
+				"'reuse_local_addr' is not supported on this platform")
+		}
+		t.reuseLocalAddr = true
+	}
+
 	if (config.KeepAliveInterval == "") != (config.KeepAliveTimeout == "") {
 		return nil, errors.New(
 			"'keep_alive_interval' must be used with 'keep_alive_timeout'")
@@ -98,10 +180,8 @@ func NewKCPTransport(config KCPConfig) (*KCPTransport, error) {
 		if err != nil || t.keepAliveTimeout <= 0 {
 			return nil, errors.New("invalid 'keep_alive_timeout'")
 		}
-		t.conns = list.New()
+		t.keepAliveQueue = new(kcpKeepAliveQueue)
 		go t.runKeepAliveManager()
-	} else {
-		t.conns = nil
 	}
 
 	return t, nil
@@ -118,8 +198,22 @@ func (t *KCPTransport) Dial(
 	resultCh := make(chan result, 1)
 
 	go func() {
-		kcpConn, err := kcp.DialWithOptions(
-			address, nil, t.dataShards, t.parityShards)
+		kcpConn, err := t.dialSession(address)
+		if err == nil {
+			t.setupSession(kcpConn)
+			if dscp, ok := dscpFromContext(ctx); ok {
+				_ = kcpConn.SetDSCP(dscp) // best effort
+			}
+			if t.authKey != nil {
+				deadline := time.Now().Add(kcpHandshakeTimeout)
+				if ddl, ok := ctx.Deadline(); ok && ddl.Before(deadline) {
+					deadline = ddl
+				}
+				if err = t.clientHandshake(kcpConn, deadline); err != nil {
+					_ = kcpConn.Close()
+				}
+			}
+		}
 		if err != nil {
 			resultCh <- result{nil, err}
 		} else {
@@ -138,16 +232,158 @@ func (t *KCPTransport) Dial(
 	}
 }
 
+func (t *KCPTransport) dialSession(address string) (*kcp.UDPSession, error) {
+	if t.localAddr == nil {
+		return kcp.DialWithOptions(
+			address, t.block, t.dataShards, t.parityShards)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	// the listener of kcp-go keys the sessions by the source address, so a
+	// second one from the same local address would be taken as the first one
+	remote := remoteAddr.String()
+	t.boundMtx.Lock()
+	if _, ok := t.boundRemotes[remote]; ok {
+		t.boundMtx.Unlock()
+		return nil, errors.Errorf(
+			"a KCP session from 'local_addr' %s to %s is still open",
+			t.localAddr, remote)
+	}
+	t.boundRemotes[remote] = struct{}{}
+	t.boundMtx.Unlock()
+	release := func() {
+		t.boundMtx.Lock()
+		delete(t.boundRemotes, remote)
+		t.boundMtx.Unlock()
+	}
+
+	dialer := net.Dialer{LocalAddr: t.localAddr}
+	if t.reuseLocalAddr {
+		dialer.Control = reuseAddrControl
+	}
+	// a connected socket only receives packets from its own peer, so that
+	// sockets sharing the local address won't steal packets from each other
+	conn, err := dialer.Dial("udp", remote)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	sess, err := kcp.NewConn(remote, t.block, t.dataShards, t.parityShards,
+		&connectedPacketConn{UDPConn: conn.(*net.UDPConn), onClose: release})
+	if err != nil {
+		_ = conn.Close()
+		release()
+	}
+	return sess, err
+}
+
+// connectedPacketConn adapts a connected UDP socket to the PacketConn
+// interface required by kcp-go.
+type connectedPacketConn struct {
+	*net.UDPConn
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *connectedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *connectedPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *connectedPacketConn) Close() error {
+	err := c.UDPConn.Close()
+	c.closeOnce.Do(c.onClose)
+	return err
+}
+
 // Listen creates a KCP listener on a given address.
 func (t *KCPTransport) Listen(address string) (net.Listener, error) {
 	listener, err := kcp.ListenWithOptions(
-		address, nil, t.dataShards, t.parityShards)
+		address, t.block, t.dataShards, t.parityShards)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &kcpListenerWrapper{listener, t}, nil
+	wrapper := &kcpListenerWrapper{Listener: listener, kcpTransport: t}
+	if t.authKey != nil {
+		wrapper.authedCh = make(chan *kcp.UDPSession)
+		wrapper.errCh = make(chan error, 1)
+		wrapper.closeCh = make(chan struct{})
+		go wrapper.acceptLoop()
+	}
+	return wrapper, nil
+}
+
+func (t *KCPTransport) authMAC(
+	role string, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, t.authKey)
+	_, _ = mac.Write([]byte(role))
+	_, _ = mac.Write(clientNonce)
+	_, _ = mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// clientHandshake proves that the client holds the PSK, and verifies that
+// so does the server, with a challenge-response on both sides.
+func (t *KCPTransport) clientHandshake(
+	conn *kcp.UDPSession, deadline time.Time) error {
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{}) // nolint: errcheck
+
+	clientNonce := make([]byte, kcpNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := conn.Write(clientNonce); err != nil {
+		return errors.Wrap(err, "KCP handshake failed")
+	}
+	resp := make([]byte, kcpNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.Wrap(err, "KCP handshake failed")
+	}
+	serverNonce := resp[:kcpNonceSize]
+	if !hmac.Equal(
+		resp[kcpNonceSize:], t.authMAC("server", clientNonce, serverNonce)) {
+		return errors.New("KCP handshake failed: server is not authenticated")
+	}
+	_, err := conn.Write(t.authMAC("client", clientNonce, serverNonce))
+	return errors.Wrap(err, "KCP handshake failed")
+}
+
+func (t *KCPTransport) serverHandshake(conn *kcp.UDPSession) error {
+	_ = conn.SetDeadline(time.Now().Add(kcpHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // nolint: errcheck
+
+	clientNonce := make([]byte, kcpNonceSize)
+	if _, err := io.ReadFull(conn, clientNonce); err != nil {
+		return errors.Wrap(err, "KCP handshake failed")
+	}
+	serverNonce := make([]byte, kcpNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return errors.WithStack(err)
+	}
+	resp := append(
+		serverNonce, t.authMAC("server", clientNonce, serverNonce)...)
+	if _, err := conn.Write(resp); err != nil {
+		return errors.Wrap(err, "KCP handshake failed")
+	}
+	clientMAC := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, clientMAC); err != nil {
+		return errors.Wrap(err, "KCP handshake failed")
+	}
+	if !hmac.Equal(
+		clientMAC, t.authMAC("client", clientNonce, serverNonce[:kcpNonceSize])) {
+		return errors.New("KCP handshake failed: client is not authenticated")
+	}
+	return nil
 }
 
+// runKeepAliveManager periodically checks the connections that are due.
 func (t *KCPTransport) runKeepAliveManager() {
 	// kill the process if this goroutine panics to avoid misbehaviour
 	defer func() {
@@ -158,41 +394,78 @@ func (t *KCPTransport) runKeepAliveManager() {
 		}
 	}()
 
+	queue := t.keepAliveQueue
 	ticker := time.NewTicker(t.keepAliveInterval / 4)
-	timeout := t.keepAliveTimeout.Nanoseconds()
-	interval := t.keepAliveInterval.Nanoseconds()
+	var due []kcpKeepAliveItem
 	for {
 		now := (<-ticker.C).UnixNano()
-		t.connsMtx.Lock()
-		for e := t.conns.Front(); e != nil; {
-			next := e.Next()
-			conn := e.Value.(*kcpConnWrapper)
-			lastSend := atomic.LoadInt64(&conn.lastSend)
-			lastReadStart := atomic.LoadInt64(&conn.lastReadStart)
-			lastWriteStart := atomic.LoadInt64(&conn.lastWriteStart)
-			if lastSend == 0 { // closed
-				t.conns.Remove(e)
-			} else if lastReadStart > 0 && now-lastReadStart > timeout {
-				// read time out, lost
-				t.conns.Remove(e)
-				go conn.Close() // nolint: errcheck
-			} else if lastWriteStart > 0 && now-lastWriteStart > timeout {
-				// write time out, lost
-				t.conns.Remove(e)
-				go conn.Close() // nolint: errcheck
-			} else if now-lastSend > interval { // long idle
-				go conn.sendKeepAlive()
+		due = due[:0]
+		queue.mtx.Lock()
+		for queue.items.Len() > 0 && queue.items[0].due <= now {
+			due = append(due, heap.Pop(&queue.items).(kcpKeepAliveItem))
+		}
+		queue.mtx.Unlock()
+
+		// check the connections without holding the lock
+		for i := range due {
+			if next, alive := t.checkKeepAlive(due[i].conn, now); alive {
+				due[i].due = next
+			} else {
+				due[i].conn = nil
+			}
+		}
+
+		queue.mtx.Lock()
+		for _, item := range due {
+			if item.conn != nil {
+				heap.Push(&queue.items, item)
 			}
-			e = next
 		}
-		t.connsMtx.Unlock()
+		queue.mtx.Unlock()
+	}
+}
+
+// checkKeepAlive closes the connection if it is lost, or sends a keep-alive
+// signal if it has been idle for long. It returns when the connection should
+// be checked next, or false if it is closed.
+func (t *KCPTransport) checkKeepAlive(
+	conn *kcpConnWrapper, now int64) (int64, bool) {
+	timeout := t.keepAliveTimeout.Nanoseconds()
+	interval := t.keepAliveInterval.Nanoseconds()
+	lastSend := atomic.LoadInt64(&conn.lastSend)
+	lastReadStart := atomic.LoadInt64(&conn.lastReadStart)
+	lastWriteStart := atomic.LoadInt64(&conn.lastWriteStart)
+	if lastSend == 0 { // closed
+		return 0, false
+	} else if lastReadStart > 0 && now-lastReadStart > timeout {
+		// read time out, lost
+		go conn.Close() // nolint: errcheck
+		return 0, false
+	} else if lastWriteStart > 0 && now-lastWriteStart > timeout {
+		// write time out, lost
+		go conn.Close() // nolint: errcheck
+		return 0, false
+	} else if now-lastSend > interval { // long idle
+		go conn.sendKeepAlive()
+		lastSend = now
+	}
+
+	next := lastSend + interval
+	if lastReadStart > 0 && lastReadStart+timeout < next {
+		next = lastReadStart + timeout
+	}
+	if lastWriteStart > 0 && lastWriteStart+timeout < next {
+		next = lastWriteStart + timeout
 	}
+	return next, true
 }
 
 type kcpConnWrapper struct {
 	*kcp.UDPSession
 	rdMtx      sync.Mutex
 	rdDataLeft uint32
+	rdClosed   bool  // kcpClose received, guarded by rdMtx
+	wrClosed   int32 // kcpClose sent, used atomically
 
 	// UNIX ns time of last send time, 0 indicates the conn was closed
 	lastSend int64
@@ -208,10 +481,14 @@ const (
 	kcpKeepAlive  = 2
 )
 
-func (t *KCPTransport) wrapKCPConn(kcpConn *kcp.UDPSession) *kcpConnWrapper {
+func (t *KCPTransport) setupSession(kcpConn *kcp.UDPSession) {
 	kcpConn.SetNoDelay(t.noDelay, t.interval, t.resend, t.nc)
 	kcpConn.SetStreamMode(true)
 	kcpConn.SetWindowSize(t.sndWnd, t.rcvWnd)
+}
+
+// wrapKCPConn wraps a session that has been set up by setupSession.
+func (t *KCPTransport) wrapKCPConn(kcpConn *kcp.UDPSession) *kcpConnWrapper {
 	wrapped := new(kcpConnWrapper)
 	wrapped.UDPSession = kcpConn
 	wrapped.rdDataLeft = 0
@@ -219,10 +496,11 @@ func (t *KCPTransport) wrapKCPConn(kcpConn *kcp.UDPSession) *kcpConnWrapper {
 	wrapped.lastReadStart = 0
 	wrapped.lastWriteStart = 0
 
-	if t.conns != nil {
-		t.connsMtx.Lock()
-		defer t.connsMtx.Unlock()
-		t.conns.PushBack(wrapped)
+	if queue := t.keepAliveQueue; queue != nil {
+		queue.mtx.Lock()
+		defer queue.mtx.Unlock()
+		heap.Push(&queue.items, kcpKeepAliveItem{
+			wrapped, wrapped.lastSend + t.keepAliveInterval.Nanoseconds()})
 	}
 	return wrapped
 }
@@ -231,13 +509,16 @@ func (c *kcpConnWrapper) Read(b []byte) (int, error) {
 	c.rdMtx.Lock()
 	defer c.rdMtx.Unlock()
 	for c.rdDataLeft == 0 {
+		if c.rdClosed {
+			return 0, io.EOF
+		}
 		var header [4]byte
 		if _, err := c.read(header[:1]); err != nil {
 			return 0, err
 		}
 		switch header[0] {
-		case kcpClose:
-			atomic.StoreInt64(&c.lastSend, 0)
+		case kcpClose: // the peer may still read if it is half-closed
+			c.rdClosed = true
 			return 0, io.EOF
 		case kcpDataPacket:
 			if _, err := c.read(header[:]); err != nil {
@@ -267,6 +548,9 @@ func (c *kcpConnWrapper) Write(b []byte) (int, error) {
 	if len(b) > 0xffffffff {
 		return 0, errors.New("send buffer size exceeds limitation")
 	}
+	if atomic.LoadInt32(&c.wrClosed) != 0 {
+		return 0, errors.New("write on a half-closed KCP connection")
+	}
 	n := uint32(len(b))
 	buf := GlobalBufPool.Get(uint(n + 5))
 	defer GlobalBufPool.Free(buf)
@@ -277,13 +561,33 @@ func (c *kcpConnWrapper) Write(b []byte) (int, error) {
 	atomic.StoreInt64(&c.lastSend, time.Now().UnixNano())
 	atomic.StoreInt64(&c.lastWriteStart, time.Now().UnixNano())
 	defer atomic.StoreInt64(&c.lastWriteStart, 0)
-	return c.UDPSession.Write(buf)
+	written, err := c.UDPSession.Write(buf)
+	// exclude the header, so that the count never exceeds len(b)
+	if written -= 5; written < 0 {
+		written = 0
+	}
+	return written, err
+}
+
+// CloseWrite sends the kcpClose signal, after which the peer reads an EOF,
+// while the connection can still be read from.
+func (c *kcpConnWrapper) CloseWrite() error {
+	if !atomic.CompareAndSwapInt32(&c.wrClosed, 0, 1) {
+		return nil
+	}
+	_ = c.UDPSession.SetWriteDeadline(time.Now().Add(kcpCloseSendTimeout))
+	_, err := c.UDPSession.Write([]byte{kcpClose})
+	_ = c.UDPSession.SetWriteDeadline(time.Time{})
+	return errors.WithStack(err)
 }
 
 func (c *kcpConnWrapper) Close() error {
 	atomic.StoreInt64(&c.lastSend, 0) // indicate the conn is closed
-	_ = c.UDPSession.SetWriteDeadline(time.Now().Add(kcpCloseSendTimeout))
-	_, _ = c.UDPSession.Write([]byte{kcpClose})
+	if atomic.CompareAndSwapInt32(&c.wrClosed, 0, 1) {
+		_ = c.UDPSession.SetWriteDeadline(
+			time.Now().Add(kcpCloseSendTimeout))
+		_, _ = c.UDPSession.Write([]byte{kcpClose})
+	}
 	go func() {
 		time.Sleep(kcpCloseLingerTimeout)
 		c.UDPSession.Close()
@@ -304,17 +608,109 @@ func (c *kcpConnWrapper) read(b []byte) (int, error) {
 	return c.UDPSession.Read(b)
 }
 
+// KCPStats contains the statistics of a KCP session.
+type KCPStats struct {
+	Conv     uint32
+	IdleSecs float64
+}
+
+// KCPStats returns the statistics of the underlying KCP session.
+func (c *kcpConnWrapper) KCPStats() KCPStats {
+	stats := KCPStats{Conv: c.GetConv()}
+	if lastSend := atomic.LoadInt64(&c.lastSend); lastSend > 0 {
+		stats.IdleSecs = time.Since(time.Unix(0, lastSend)).Seconds()
+	}
+	return stats
+}
+
+// TransportStats implements the TransportStats interface.
+func (c *kcpConnWrapper) TransportStats() map[string]interface{} {
+	stats := c.KCPStats()
+	return map[string]interface{}{
+		"kcp.conv":      stats.Conv,
+		"kcp.idle_secs": stats.IdleSecs,
+	}
+}
+
+// KCPGlobalStats contains the retransmission and FEC counters, which kcp-go
+// only maintains process-wide.
+type KCPGlobalStats struct {
+	RetransSegs     uint64
+	FastRetransSegs uint64
+	LostSegs        uint64
+	FECRecovered    uint64
+	FECErrs         uint64
+}
+
+// kcpInUse is set once a KCPTransport is created.
+var kcpInUse int32
+
+// GetKCPGlobalStats returns the process-wide KCP statistics, or nil if KCP
+// is not used.
+func GetKCPGlobalStats() *KCPGlobalStats {
+	if atomic.LoadInt32(&kcpInUse) == 0 {
+		return nil
+	}
+	snmp := kcp.DefaultSnmp.Copy()
+	return &KCPGlobalStats{
+		RetransSegs:     snmp.RetransSegs,
+		FastRetransSegs: snmp.FastRetransSegs,
+		LostSegs:        snmp.LostSegs,
+		FECRecovered:    snmp.FECRecovered,
+		FECErrs:         snmp.FECErrs,
+	}
+}
+
 type kcpListenerWrapper struct {
 	*kcp.Listener
 	kcpTransport *KCPTransport
+	// the followings are used only if PSK is set, in which case the sessions
+	// are authenticated in the background and sent to authedCh
+	authedCh  chan *kcp.UDPSession
+	errCh     chan error
+	closeCh   chan struct{}
+	closeOnce sync.Once
 }
 
 func (l *kcpListenerWrapper) Accept() (net.Conn, error) {
-	conn, err := l.Listener.AcceptKCP()
-	if err != nil {
+	if l.authedCh == nil {
+		conn, err := l.Listener.AcceptKCP()
+		if err != nil {
+			return nil, err
+		}
+		l.kcpTransport.setupSession(conn)
+		return l.kcpTransport.wrapKCPConn(conn), nil
+	}
+
+	select {
+	case conn := <-l.authedCh:
+		return l.kcpTransport.wrapKCPConn(conn), nil
+	case err := <-l.errCh:
+		l.errCh <- err // for the subsequent calls
 		return nil, err
 	}
-	return l.kcpTransport.wrapKCPConn(conn), nil
+}
+
+func (l *kcpListenerWrapper) acceptLoop() {
+	for {
+		conn, err := l.Listener.AcceptKCP()
+		if err != nil {
+			l.errCh <- err
+			return
+		}
+		go func() {
+			l.kcpTransport.setupSession(conn)
+			if err := l.kcpTransport.serverHandshake(conn); err != nil {
+				_ = conn.Close() // drop silently
+				return
+			}
+			select {
+			case l.authedCh <- conn:
+			case <-l.closeCh:
+				_ = conn.Close()
+			}
+		}()
+	}
 }
 
 func (l *kcpListenerWrapper) AcceptKCP() (*kcp.UDPSession, error) {
@@ -322,6 +718,9 @@ func (l *kcpListenerWrapper) AcceptKCP() (*kcp.UDPSession, error) {
 }
 
 func (l *kcpListenerWrapper) Close() error {
+	if l.closeCh != nil {
+		l.closeOnce.Do(func() { close(l.closeCh) })
+	}
 	err := l.Listener.Close()
 	return err
 }
@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lib
+
+import "syscall"
+
+// reuseAddrControl is not supported on this platform.
+var reuseAddrControl func(network, address string, c syscall.RawConn) error
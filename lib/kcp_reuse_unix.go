@@ -0,0 +1,26 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reuseAddrControl sets SO_REUSEADDR and SO_REUSEPORT on a socket.
+var reuseAddrControl = func(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(
+			int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(
+				int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
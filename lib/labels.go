@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Label names are restricted so that they can also be used as tag names of
+// the metrics systems. Label values should be taken from a small set, or
+// the cardinality of the exported series will blow up.
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames are taken by the tags exported along with the labels.
+var reservedLabelNames = map[string]bool{
+	"rule": true, "downstream": true, "upstream": true, "terminated_by": true,
+	"time": true,
+}
+
+// ValidateLabels checks if all the label names are valid.
+func ValidateLabels(labels map[string]string) error {
+	for k := range labels {
+		if !labelNameRegex.MatchString(k) {
+			return errors.New("invalid label name: " + k)
+		} else if reservedLabelNames[k] {
+			return errors.New("reserved label name: " + k)
+		}
+	}
+	return nil
+}
+
+// MergeLabels merges several label sets into a new one. A label in a later
+// set overrides the one with the same name in the former sets.
+func MergeLabels(labelSets ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, labels := range labelSets {
+		for k, v := range labels {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// SortedLabelKeys returns the label names in lexical order.
+func SortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
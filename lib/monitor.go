@@ -5,50 +5,131 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-)
 
-// monitorUpdateInterval is the interval at which the monitor update its
-// internal state. This is a variable only for testing and should be considered
-// as a constant in other cases.
-var monitorUpdateInterval = time.Second * 1
+	"github.com/pkg/errors"
+)
 
-const connLatencyEmaAlpha = 0.8
+const (
+	// DefaultMonitorUpdateInterval is the default interval at which the
+	// monitor updates its internal state.
+	DefaultMonitorUpdateInterval = time.Second * 1
+	connLatencyEmaAlpha          = 0.8
+	probeTimeout                 = time.Second * 10
+)
 
 // AppMonitor records and reports runtime statistics of an thestral app.
 type AppMonitor struct {
 	transferMeter    transferMeter
 	tunnelMonitors   sync.Map // ReqID (string) -> *TunnelMonitor
 	upstreamMonitors sync.Map // upstream (string) -> *UpstreamMonitor
+	tunnelSink       TunnelSink
+	history          *tunnelHistory // nil if disabled
+	stats            *statsFlusher  // nil if disabled
+	prober           ProbeFunc
+	ruleReloader     func() error
+	activeCount      int32 // should be used with atomic operations
+	maintenance      int32 // 1 if in maintenance mode, 2 if also draining
+	processStats     bool
+}
+
+// ProbeFunc dials to the target via the named upstream, and closes the
+// connection as soon as it is established.
+type ProbeFunc func(
+	ctx context.Context, upstream string, target Address) *ProxyError
+
+// ProbeReport is the result of a probe.
+type ProbeReport struct {
+	Upstream  string
+	Target    string
+	Success   bool
+	LatencyMs float32
+	Error     string
+	Reason    string
 }
 
 // AppMonitorReport is the statistics report generated by AppMonitor.
 type AppMonitorReport struct {
+	AppMonitorSummary
+	// process-wide KCP statistics, nil if KCP is not used
+	KCP *KCPGlobalStats
+	// resource usage of the process, nil if not enabled
+	Process *ProcessStats
+	// per-tunnel report, possibly only a page of all the tunnels
+	TunnelCount int
+	Tunnels     []*TunnelMonitorReport
+	// per-upstream report
+	Upstreams []*UpstreamMonitorReport
+}
+
+// AppMonitorSummary contains the aggregated statistics of an AppMonitor,
+// which are maintained incrementally and thus cheap to report.
+type AppMonitorSummary struct {
 	// service information
 	ThestralVersion string
 	Runtime         string
+	Maintenance     bool
+	Draining        bool
 	// global transfer statistics
+	ActiveTunnels    int
 	AvgConnLatencyMs float32
 	ErrorCount       uint32
-	UploadSpeed      float32
-	DownloadSpeed    float32
-	BytesUploaded    uint64
-	BytesDownloaded  uint64
-	// per-tunnel report
-	Tunnels []*TunnelMonitorReport
-	// per-upstream report
-	Upstreams []*UpstreamMonitorReport
+	ErrorReasons     map[string]uint32
+	// number of tunnel summaries failed to be written to the tunnel log
+	DroppedTunnelSummaries uint64
+	UploadSpeed            float32
+	DownloadSpeed          float32
+	BytesUploaded          uint64
+	BytesDownloaded        uint64
 }
 
-// Start the AppMonitor.
-func (m *AppMonitor) Start(path string) {
+// ProcessStats is the resource usage of the process.
+type ProcessStats struct {
+	Goroutines     int
+	HeapAlloc      uint64
+	NumGC          uint32
+	GCPauseTotalMs float32
+	LastGCPauseMs  float32
+	OpenFDs        int // -1 if unknown
+}
+
+// GetProcessStats collects the resource usage of the process. It stops the
+// world briefly to read the memory statistics.
+func GetProcessStats() *ProcessStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := &ProcessStats{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      mem.HeapAlloc,
+		NumGC:          mem.NumGC,
+		GCPauseTotalMs: float32(mem.PauseTotalNs) / 1e6,
+		OpenFDs:        -1,
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPauseMs = float32(mem.PauseNs[(mem.NumGC+255)%256]) / 1e6
+	}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		stats.OpenFDs = len(fds) - 1 // excluding the one reading the dir
+	}
+	return stats
+}
+
+// Start the AppMonitor. The internal state, e.g. the transfer speeds, is
+// updated every updateInterval.
+func (m *AppMonitor) Start(path string, updateInterval time.Duration) {
+	if updateInterval <= 0 {
+		updateInterval = DefaultMonitorUpdateInterval
+	}
 	go func() {
-		tickCh := time.Tick(monitorUpdateInterval)
+		tickCh := time.Tick(updateInterval)
 		for {
 			<-tickCh
 			m.updateEpoch()
@@ -68,12 +149,69 @@ func (m *AppMonitor) Start(path string) {
 	m.registerRPCHandlers(path)
 }
 
+// SetTunnelSink sets the sink to which the summaries of completed tunnels are
+// emitted. It must be called before any tunnel is opened.
+func (m *AppMonitor) SetTunnelSink(sink TunnelSink) {
+	m.tunnelSink = sink
+}
+
+// SetHistorySize makes the monitor keep the summaries of at most size most
+// recently closed tunnels. It must be called before any tunnel is opened.
+func (m *AppMonitor) SetHistorySize(size int) {
+	if size > 0 {
+		m.history = newTunnelHistory(size)
+	}
+}
+
+// History returns the summaries of the recently closed tunnels, the newest
+// first. It is empty if the history is disabled.
+func (m *AppMonitor) History() []*TunnelSummary {
+	if m.history == nil {
+		return nil
+	}
+	return m.history.List()
+}
+
+// CloseTunnelSink flushes and closes the tunnel sink if there is one.
+func (m *AppMonitor) CloseTunnelSink() error {
+	if m.tunnelSink == nil {
+		return nil
+	}
+	return m.tunnelSink.Close()
+}
+
+// SetProber sets the function used to serve the probe requests. It must be
+// called before the monitor is started.
+func (m *AppMonitor) SetProber(prober ProbeFunc) {
+	m.prober = prober
+}
+
+// SetProcessStats enables the resource usage of the process in the reports.
+// It must be called before the monitor is started.
+func (m *AppMonitor) SetProcessStats(enabled bool) {
+	m.processStats = enabled
+}
+
+// SetRuleReloader sets the function used to serve the requests of reloading
+// the rules. It must be called before the monitor is started.
+func (m *AppMonitor) SetRuleReloader(reloader func() error) {
+	m.ruleReloader = reloader
+}
+
 func (m *AppMonitor) registerRPCHandlers(path string) {
 	// full report
+	// ?offset=N&limit=M: only include a page of the tunnels
+	// ?summary=1: leave out the tunnels
 	http.HandleFunc("/debug/monitor"+path,
 		func(w http.ResponseWriter, r *http.Request) {
-			if reportJSONBytes, err :=
-				json.MarshalIndent(m.Report(), "", "  "); err != nil {
+			offset, limit, err := parsePageQuery(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("Invalid request: " + err.Error()))
+				return
+			}
+			if reportJSONBytes, err := json.MarshalIndent(
+				m.ReportPage(offset, limit), "", "  "); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				_, _ = w.Write([]byte(fmt.Sprintf(
 					"Failed to generate monitor report: %s", err.Error())))
@@ -82,6 +220,20 @@ func (m *AppMonitor) registerRPCHandlers(path string) {
 				_, _ = w.Write(reportJSONBytes)
 			}
 		})
+	// aggregated statistics only
+	http.HandleFunc("/debug/monitor"+path+"summary",
+		func(w http.ResponseWriter, r *http.Request) {
+			summaryJSONBytes, _ := json.MarshalIndent(m.Summary(), "", "  ")
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			_, _ = w.Write(summaryJSONBytes)
+		})
+	// recently closed tunnels, the newest first
+	http.HandleFunc("/debug/monitor"+path+"history",
+		func(w http.ResponseWriter, r *http.Request) {
+			historyJSONBytes, _ := json.MarshalIndent(m.History(), "", "  ")
+			w.Header().Set("Content-Type", "text/json; charset=utf-8")
+			_, _ = w.Write(historyJSONBytes)
+		})
 	// single tunnel
 	// HTTP DELETE: kill the tunnel
 	// Other methods: report the tunnel report
@@ -110,6 +262,151 @@ func (m *AppMonitor) registerRPCHandlers(path string) {
 				_, _ = w.Write(reportJSONBytes)
 			}
 		})
+	// probe an upstream: probe?upstream=UPSTREAM&target=HOST:PORT
+	http.HandleFunc("/debug/monitor"+path+"probe", m.handleProbe)
+	// maintenance mode
+	// HTTP POST: {"on": true|false}
+	// Other methods: report the current state
+	http.HandleFunc("/debug/monitor"+path+"maintenance", m.handleMaintenance)
+	// reload the rules, HTTP POST only
+	http.HandleFunc("/debug/monitor"+path+"reload-rules", m.handleReloadRules)
+	// reset the cumulative statistics, HTTP POST only
+	http.HandleFunc("/debug/monitor"+path+"reset",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			m.ResetCounters()
+		})
+}
+
+func parsePageQuery(r *http.Request) (offset int, limit int, err error) {
+	query := r.URL.Query()
+	limit = -1
+	if query.Get("summary") != "" {
+		return 0, 0, nil
+	}
+	if s := query.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	return
+}
+
+func (m *AppMonitor) handleReloadRules(
+	w http.ResponseWriter, r *http.Request) {
+	if m.ruleReloader == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Reloading rules is not supported"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.ruleReloader(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			"Failed to reload rules: %s", err.Error())))
+	}
+}
+
+// SetMaintenance turns the maintenance mode on or off. In maintenance mode
+// the readiness check fails so that load balancers stop sending new
+// traffic, while the existing tunnels are left intact. If drain is also set,
+// the new requests are refused as well, so that only the existing tunnels
+// are served until they finish.
+func (m *AppMonitor) SetMaintenance(on, drain bool) {
+	var v int32
+	if on && drain {
+		v = 2
+	} else if on {
+		v = 1
+	}
+	atomic.StoreInt32(&m.maintenance, v)
+}
+
+// InMaintenance returns whether the maintenance mode is on.
+func (m *AppMonitor) InMaintenance() bool {
+	return atomic.LoadInt32(&m.maintenance) != 0
+}
+
+// Draining returns whether the new requests should be refused.
+func (m *AppMonitor) Draining() bool {
+	return atomic.LoadInt32(&m.maintenance) == 2
+}
+
+// HandleReadiness serves the readiness check, which fails with 503 in the
+// maintenance mode.
+func (m *AppMonitor) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	if m.InMaintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("maintenance"))
+	} else {
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+func (m *AppMonitor) handleMaintenance(
+	w http.ResponseWriter, r *http.Request) {
+	var state struct {
+		On    bool `json:"on"`
+		Drain bool `json:"drain"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Invalid request: " + err.Error()))
+			return
+		}
+		m.SetMaintenance(state.On, state.Drain)
+	}
+	state.On, state.Drain = m.InMaintenance(), m.Draining()
+	stateJSONBytes, _ := json.Marshal(state)
+	w.Header().Set("Content-Type", "text/json; charset=utf-8")
+	_, _ = w.Write(stateJSONBytes)
+}
+
+func (m *AppMonitor) handleProbe(w http.ResponseWriter, r *http.Request) {
+	if m.prober == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Probing is not supported"))
+		return
+	}
+	upstream := r.URL.Query().Get("upstream")
+	target, err := ParseAddress(r.URL.Query().Get("target"))
+	if upstream == "" || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Invalid upstream or target"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	startTime := time.Now()
+	pErr := m.prober(ctx, upstream, target)
+	report := ProbeReport{
+		Upstream:  upstream,
+		Target:    target.String(),
+		Success:   pErr == nil,
+		LatencyMs: float32(time.Since(startTime).Seconds() * 1e3),
+	}
+	if pErr != nil {
+		report.Reason = pErr.Reason
+		if pErr.Error != nil {
+			report.Error = pErr.Error.Error()
+		}
+	}
+	reportJSONBytes, _ := json.MarshalIndent(report, "", "  ")
+	w.Header().Set("Content-Type", "text/json; charset=utf-8")
+	_, _ = w.Write(reportJSONBytes)
 }
 
 func (m *AppMonitor) getUpstreamMonitor(upstream string) (um *UpstreamMonitor) {
@@ -128,21 +425,45 @@ func (m *AppMonitor) getUpstreamMonitor(upstream string) (um *UpstreamMonitor) {
 func (m *AppMonitor) OpenTunnelMonitor(
 	req ProxyRequest, rule string, downstream string,
 	upstream string, serverIDs []*PeerIdentifier, boundAddr string,
-	connLatency time.Duration, cancelFunc context.CancelFunc) *TunnelMonitor {
+	labels map[string]string, connLatency time.Duration,
+	cancelFunc context.CancelFunc) *TunnelMonitor {
 	um := m.getUpstreamMonitor(upstream)
 	tm := newTunnelMonitor(
-		m, um, req, rule, downstream, upstream, serverIDs, boundAddr, cancelFunc)
+		m, um, req, rule, downstream, upstream, serverIDs, boundAddr, labels,
+		cancelFunc)
 	tm.transferMeter.AddConnLatency(connLatency)
 	um.transferMeter.AddConnLatency(connLatency)
 	m.transferMeter.AddConnLatency(connLatency)
 	m.tunnelMonitors.Store(req.ID(), tm)
+	atomic.AddInt32(&m.activeCount, 1)
 	return tm
 }
 
-// AddError increases the error count of the monitor.
-func (m *AppMonitor) AddError(upstream string) {
-	m.getUpstreamMonitor(upstream).transferMeter.AddError()
-	m.transferMeter.AddError()
+// ActiveCount returns the number of tunnels that are not closed yet.
+func (m *AppMonitor) ActiveCount() int {
+	return int(atomic.LoadInt32(&m.activeCount))
+}
+
+// AddError increases the error count of the monitor. The reason is used to
+// break down the errors, and may be empty if it is unknown.
+func (m *AppMonitor) AddError(upstream string, reason string) {
+	m.getUpstreamMonitor(upstream).transferMeter.AddError(reason)
+	m.transferMeter.AddError(reason)
+}
+
+// AddDialsInFlight adjusts the number of in-flight dials to the upstream.
+func (m *AppMonitor) AddDialsInFlight(upstream string, delta int32) {
+	atomic.AddInt32(&m.getUpstreamMonitor(upstream).dialsInFlight, delta)
+}
+
+// ResetCounters zeroes the cumulative statistics of the app and the
+// upstreams, leaving the tunnels intact.
+func (m *AppMonitor) ResetCounters() {
+	m.transferMeter.ResetCounters()
+	m.upstreamMonitors.Range(func(key interface{}, value interface{}) bool {
+		value.(*UpstreamMonitor).transferMeter.ResetCounters()
+		return true
+	})
 }
 
 func (m *AppMonitor) updateEpoch() {
@@ -153,27 +474,68 @@ func (m *AppMonitor) updateEpoch() {
 	})
 }
 
-// Report generates a AppMonitorReport.
-func (m *AppMonitor) Report() (report AppMonitorReport) {
-	report.ThestralVersion = ThestralVersion
-	report.Runtime = fmt.Sprintf("%s on %s/%s",
+// Summary generates a AppMonitorSummary without visiting the tunnels.
+func (m *AppMonitor) Summary() (summary AppMonitorSummary) {
+	summary.ThestralVersion = ThestralVersion
+	summary.Runtime = fmt.Sprintf("%s on %s/%s",
 		runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	summary.Maintenance = m.InMaintenance()
+	summary.Draining = m.Draining()
 
-	report.AvgConnLatencyMs = m.transferMeter.emaConnLatencyMs
-	report.ErrorCount = m.transferMeter.errorCount
-	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
-	report.BytesUploaded, report.BytesDownloaded =
+	summary.ActiveTunnels = m.ActiveCount()
+	summary.AvgConnLatencyMs = m.transferMeter.emaConnLatencyMs
+	summary.ErrorCount = m.transferMeter.errorCount
+	summary.ErrorReasons = m.transferMeter.ErrorReasons()
+	if m.tunnelSink != nil {
+		summary.DroppedTunnelSummaries = m.tunnelSink.Dropped()
+	}
+	summary.UploadSpeed, summary.DownloadSpeed = m.transferMeter.Speed()
+	summary.BytesUploaded, summary.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
+	return
+}
 
-	m.tunnelMonitors.Range(func(key interface{}, value interface{}) bool {
-		tunnelReport := value.(*TunnelMonitor).Report()
-		report.Tunnels = append(report.Tunnels, &tunnelReport)
-		return true
-	})
-	sort.Slice(report.Tunnels, func(i, j int) bool {
-		return report.Tunnels[i].EstablishedSince.After(
-			report.Tunnels[j].EstablishedSince)
-	})
+// Report generates a AppMonitorReport including all the tunnels.
+func (m *AppMonitor) Report() AppMonitorReport {
+	return m.ReportPage(0, -1)
+}
+
+// ReportPage generates a AppMonitorReport including at most limit tunnels
+// from the offset-th newest one. A negative limit means no limit, and a zero
+// limit leaves out the tunnels. Only the included tunnels are reported, so
+// this is much cheaper than Report if there are many tunnels.
+func (m *AppMonitor) ReportPage(
+	offset int, limit int) (report AppMonitorReport) {
+	report.AppMonitorSummary = m.Summary()
+	report.KCP = GetKCPGlobalStats()
+	if m.processStats {
+		report.Process = GetProcessStats()
+	}
+
+	report.TunnelCount = m.ActiveCount()
+	if limit != 0 {
+		var tunnels []*TunnelMonitor
+		m.tunnelMonitors.Range(func(key interface{}, value interface{}) bool {
+			tunnels = append(tunnels, value.(*TunnelMonitor))
+			return true
+		})
+		sort.Slice(tunnels, func(i, j int) bool {
+			return tunnels[i].establishedSince.After(
+				tunnels[j].establishedSince)
+		})
+		report.TunnelCount = len(tunnels)
+		if offset > len(tunnels) {
+			offset = len(tunnels)
+		}
+		tunnels = tunnels[offset:]
+		if limit > 0 && limit < len(tunnels) {
+			tunnels = tunnels[:limit]
+		}
+		for _, tunnel := range tunnels {
+			tunnelReport := tunnel.Report()
+			report.Tunnels = append(report.Tunnels, &tunnelReport)
+		}
+	}
 
 	m.upstreamMonitors.Range(func(key interface{}, value interface{}) bool {
 		upReport := value.(*UpstreamMonitor).Report()
@@ -203,9 +565,24 @@ type TunnelMonitor struct {
 	upstream         string
 	serverIDs        []*PeerIdentifier
 	boundAddr        string
+	labels           map[string]string
 	establishedSince time.Time
 	transferMeter    transferMeter
 	cancelFunc       context.CancelFunc
+	transportStats   atomic.Value // TransportStats
+	compStats        atomic.Value // CompressionStats
+	compMtx          sync.Mutex
+	compPushed       [2]uint64    // raw and compressed, guarded by compMtx
+	rateLimit        uint64       // used atomically
+	ruleAnnotations  atomic.Value // ruleAnnotations
+	resolvedAddr     atomic.Value // string
+	terminated       int32        // used atomically
+	terminatedBy     atomic.Value // string
+}
+
+type ruleAnnotations struct {
+	description string
+	tags        []string
 }
 
 // TunnelMonitorReport is the report generated by TunnelMonitor.
@@ -213,6 +590,9 @@ type TunnelMonitorReport struct {
 	// basic
 	RequestID        string
 	Rule             string
+	RuleDescription  string
+	RuleTags         []string
+	Labels           map[string]string
 	EstablishedSince time.Time
 	ElapsedTimeSecs  float64
 	// downstream info
@@ -220,6 +600,8 @@ type TunnelMonitorReport struct {
 	ClientIDs  []*PeerIdentifier
 	ClientAddr string
 	TargetAddr string
+	// the address actually connected to for a domain name target, if known
+	ResolvedAddr string
 	// upstream info
 	Upstream  string
 	ServerIDs []*PeerIdentifier
@@ -230,12 +612,19 @@ type TunnelMonitorReport struct {
 	DownloadSpeed   float32
 	BytesUploaded   uint64
 	BytesDownloaded uint64
+	// bytes per second of each direction, 0 for unlimited
+	RateLimit uint64
+	// why the tunnel was torn down by thestral, e.g. "max_bytes", or empty
+	// if it was closed normally
+	TerminatedBy string
+	// transport-specific statistics of the upstream connection, if any
+	TransportStats map[string]interface{}
 }
 
 func newTunnelMonitor(
 	appMonitor *AppMonitor, upstreamMonitor *UpstreamMonitor, req ProxyRequest,
 	rule string, downstream string, upstream string,
-	serverIDs []*PeerIdentifier, boundAddr string,
+	serverIDs []*PeerIdentifier, boundAddr string, labels map[string]string,
 	cancelFunc context.CancelFunc) *TunnelMonitor {
 	return &TunnelMonitor{
 		appMonitor:       appMonitor,
@@ -246,6 +635,7 @@ func newTunnelMonitor(
 		upstream:         upstream,
 		serverIDs:        serverIDs,
 		boundAddr:        boundAddr,
+		labels:           labels,
 		establishedSince: time.Now(),
 		cancelFunc:       cancelFunc,
 	}
@@ -253,6 +643,23 @@ func newTunnelMonitor(
 
 func (m *TunnelMonitor) updateEpoch() {
 	m.transferMeter.PushHistory()
+	m.pushCompressionStats()
+}
+
+// pushCompressionStats adds the compression statistics since the last push
+// to the upstream.
+func (m *TunnelMonitor) pushCompressionStats() {
+	s, ok := m.compStats.Load().(CompressionStats)
+	if !ok {
+		return
+	}
+	m.compMtx.Lock()
+	defer m.compMtx.Unlock()
+	raw, compressed := s.CompressionStats()
+	atomic.AddUint64(&m.upstreamMonitor.compRawBytes, raw-m.compPushed[0])
+	atomic.AddUint64(
+		&m.upstreamMonitor.compWireBytes, compressed-m.compPushed[1])
+	m.compPushed = [2]uint64{raw, compressed}
 }
 
 // IncBytesUploaded records the number of bytes in a trunk uploaded.
@@ -269,6 +676,50 @@ func (m *TunnelMonitor) IncBytesDownloaded(n uint32) {
 	m.transferMeter.IncDownloaded(n)
 }
 
+// SetTransportStats sets the source of the transport-specific statistics
+// included in the reports, usually the upstream connection.
+func (m *TunnelMonitor) SetTransportStats(s TransportStats) {
+	if s != nil {
+		m.transportStats.Store(s)
+	}
+}
+
+// SetCompressionStats sets the source of the compression statistics
+// accumulated into the upstream, usually the upstream connection.
+func (m *TunnelMonitor) SetCompressionStats(s CompressionStats) {
+	if s != nil {
+		m.compStats.Store(s)
+	}
+}
+
+// SetRateLimit records the bandwidth cap of the tunnel for the reports.
+func (m *TunnelMonitor) SetRateLimit(bytesPerSec uint64) {
+	atomic.StoreUint64(&m.rateLimit, bytesPerSec)
+}
+
+// SetRuleAnnotations records the annotations of the matching rule for the
+// reports.
+func (m *TunnelMonitor) SetRuleAnnotations(description string, tags []string) {
+	m.ruleAnnotations.Store(ruleAnnotations{description, tags})
+}
+
+// SetResolvedAddr records the address the target domain name resolved to.
+func (m *TunnelMonitor) SetResolvedAddr(addr string) {
+	m.resolvedAddr.Store(addr)
+}
+
+// TerminateBy tears down the tunnel due to a reason recorded in the
+// reports, e.g. a limit exceeded. It returns false if it has been
+// terminated, in which case the first reason is kept.
+func (m *TunnelMonitor) TerminateBy(reason string) bool {
+	if !atomic.CompareAndSwapInt32(&m.terminated, 0, 1) {
+		return false
+	}
+	m.terminatedBy.Store(reason)
+	m.cancelFunc()
+	return true
+}
+
 // ForceKillTunnel forcely kill the tunnel.
 func (m *TunnelMonitor) ForceKillTunnel() {
 	m.cancelFunc()
@@ -276,19 +727,37 @@ func (m *TunnelMonitor) ForceKillTunnel() {
 
 // Close the tunnel monitor. This must be called at the end of the tunnel.
 func (m *TunnelMonitor) Close() {
+	m.pushCompressionStats()
 	m.appMonitor.tunnelMonitors.Delete(m.request.ID())
+	atomic.AddInt32(&m.appMonitor.activeCount, -1)
+	sink, history := m.appMonitor.tunnelSink, m.appMonitor.history
+	if sink != nil || history != nil {
+		summary := &TunnelSummary{
+			TunnelMonitorReport: m.Report(), ClosedAt: time.Now()}
+		if sink != nil {
+			sink.Emit(summary)
+		}
+		if history != nil {
+			history.Add(summary)
+		}
+	}
 }
 
 // Report the statistics of the tunnel.
 func (m *TunnelMonitor) Report() (report TunnelMonitorReport) {
 	report.RequestID = m.request.ID()
 	report.Rule = m.rule
+	if a, ok := m.ruleAnnotations.Load().(ruleAnnotations); ok {
+		report.RuleDescription, report.RuleTags = a.description, a.tags
+	}
+	report.Labels = m.labels
 	report.EstablishedSince = m.establishedSince
 	report.ElapsedTimeSecs = time.Since(m.establishedSince).Seconds()
 	report.Downstream = m.downstream
 	report.ClientIDs, _ = m.request.GetPeerIdentifiers()
 	report.ClientAddr = m.request.PeerAddr()
 	report.TargetAddr = m.request.TargetAddr().String()
+	report.ResolvedAddr, _ = m.resolvedAddr.Load().(string)
 	report.Upstream = m.upstream
 	report.ServerIDs = m.serverIDs
 	report.BoundAddr = m.boundAddr
@@ -296,6 +765,11 @@ func (m *TunnelMonitor) Report() (report TunnelMonitorReport) {
 	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
 	report.BytesUploaded, report.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
+	report.RateLimit = atomic.LoadUint64(&m.rateLimit)
+	report.TerminatedBy, _ = m.terminatedBy.Load().(string)
+	if s, ok := m.transportStats.Load().(TransportStats); ok {
+		report.TransportStats = s.TransportStats()
+	}
 	return
 }
 
@@ -306,6 +780,16 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 	}
 	_, _ = fmt.Fprintf(f, "RequestID: %s\n", r.RequestID)
 	_, _ = fmt.Fprintf(f, "Rule: %s\n", r.Rule)
+	if r.RuleDescription != "" {
+		_, _ = fmt.Fprintf(f, "  Description: %s\n", r.RuleDescription)
+	}
+	if len(r.RuleTags) > 0 {
+		_, _ = fmt.Fprintf(f, "  Tags: %s\n", strings.Join(r.RuleTags, ", "))
+	}
+	_, _ = fmt.Fprintf(f, "Labels:\n")
+	for _, k := range SortedLabelKeys(r.Labels) {
+		_, _ = fmt.Fprintf(f, "  %s: %s\n", k, r.Labels[k])
+	}
 	_, _ = fmt.Fprintf(f, "EstablishedSince: %s\n",
 		r.EstablishedSince.Local().Format(time.RFC1123))
 	elspsed := time.Duration(int64(r.ElapsedTimeSecs) * int64(time.Second))
@@ -317,6 +801,9 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 	}
 	_, _ = fmt.Fprintf(f, "ClientAddr: %s\n", r.ClientAddr)
 	_, _ = fmt.Fprintf(f, "TargetAddr: %s\n", r.TargetAddr)
+	if r.ResolvedAddr != "" {
+		_, _ = fmt.Fprintf(f, "  ResolvedAddr: %s\n", r.ResolvedAddr)
+	}
 	_, _ = fmt.Fprintf(f, "Upstream: %s\n", r.Upstream)
 	_, _ = fmt.Fprintf(f, "ServerIDs:\n")
 	for _, id := range r.ServerIDs {
@@ -332,12 +819,31 @@ func (r TunnelMonitorReport) Format(f fmt.State, c rune) {
 		BytesHumanized(r.BytesUploaded))
 	_, _ = fmt.Fprintf(f, "BytesDownloaded: %s\n",
 		BytesHumanized(r.BytesDownloaded))
+	if r.RateLimit > 0 {
+		_, _ = fmt.Fprintf(f, "RateLimit: %s/s\n", BytesHumanized(r.RateLimit))
+	}
+	if len(r.TransportStats) > 0 {
+		_, _ = fmt.Fprintf(f, "TransportStats:\n")
+		keys := make([]string, 0, len(r.TransportStats))
+		for k := range r.TransportStats {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(f, "  %s: %v\n", k, r.TransportStats[k])
+		}
+	}
 }
 
 // UpstreamMonitor records statistics of an upstream.
 type UpstreamMonitor struct {
+	// the compressed traffic before and after the compression, used
+	// atomically and kept first for the 64-bit alignment
+	compRawBytes  uint64
+	compWireBytes uint64
 	name          string
 	transferMeter transferMeter
+	dialsInFlight int32 // should be used with atomic operations
 }
 
 // UpstreamMonitorReport is the report of an UpstreamMonitor.
@@ -345,10 +851,15 @@ type UpstreamMonitorReport struct {
 	Name             string
 	AvgConnLatencyMs float32
 	ErrorCount       uint32
+	ErrorReasons     map[string]uint32
 	UploadSpeed      float32
 	DownloadSpeed    float32
 	BytesUploaded    uint64
 	BytesDownloaded  uint64
+	DialsInFlight    int32
+	// compressed bytes per byte before the compression, 0 if there is no
+	// compressed traffic
+	CompressionRatio float32
 }
 
 // Report generates a report for the UpstreamMonitor.
@@ -356,9 +867,15 @@ func (m *UpstreamMonitor) Report() (report UpstreamMonitorReport) {
 	report.Name = m.name
 	report.AvgConnLatencyMs = m.transferMeter.emaConnLatencyMs
 	report.ErrorCount = m.transferMeter.errorCount
+	report.ErrorReasons = m.transferMeter.ErrorReasons()
 	report.UploadSpeed, report.DownloadSpeed = m.transferMeter.Speed()
 	report.BytesUploaded, report.BytesDownloaded =
 		m.transferMeter.BytesTransferred()
+	report.DialsInFlight = atomic.LoadInt32(&m.dialsInFlight)
+	if raw := atomic.LoadUint64(&m.compRawBytes); raw > 0 {
+		report.CompressionRatio =
+			float32(atomic.LoadUint64(&m.compWireBytes)) / float32(raw)
+	}
 	return
 }
 
@@ -379,10 +896,13 @@ func printPeerID(w io.Writer, indent string, i *PeerIdentifier) {
 type transferMeter struct {
 	bytesUploaded          uint64
 	bytesDownloaded        uint64
+	bytesUploadedBase      uint64 // bytesUploaded on the last reset
+	bytesDownloadedBase    uint64 // bytesDownloaded on the last reset
 	bytesUploadedHistory   uint64 // high, low = bytes[t - 2], bytes[t - 1]
 	bytesDownloadedHistory uint64 // high, low = bytes[t - 2], bytes[t - 1]
 	emaConnLatencyMs       float32
 	errorCount             uint32
+	errorReasons           sync.Map // reason (string) -> *uint32
 	// gap between the lastest two consecutive lastPushTimes
 	lastPushGapNs int64
 	// last time we pushed bytesXxx to bytesXxxHistory
@@ -412,8 +932,28 @@ func (m *transferMeter) AddConnLatency(connLatency time.Duration) {
 	}
 }
 
-func (m *transferMeter) AddError() {
+func (m *transferMeter) AddError(reason string) {
 	atomic.AddUint32(&m.errorCount, 1)
+	if reason == "" {
+		reason = "unknown"
+	}
+	cnt, found := m.errorReasons.Load(reason)
+	if !found {
+		cnt, _ = m.errorReasons.LoadOrStore(reason, new(uint32))
+	}
+	atomic.AddUint32(cnt.(*uint32), 1)
+}
+
+func (m *transferMeter) ErrorReasons() map[string]uint32 {
+	var reasons map[string]uint32
+	m.errorReasons.Range(func(key interface{}, value interface{}) bool {
+		if reasons == nil {
+			reasons = make(map[string]uint32)
+		}
+		reasons[key.(string)] = atomic.LoadUint32(value.(*uint32))
+		return true
+	})
+	return reasons
 }
 
 // PushHistory records the current transferred statistics.
@@ -437,12 +977,44 @@ func (m *transferMeter) PushHistory() {
 	m.lastPushTime = now
 }
 
+// Restore adds the statistics of a previous run to the cumulative ones. The
+// bases are decreased, wrapping around, rather than increasing the raw byte
+// counts, so that the speeds are not affected.
+func (m *transferMeter) Restore(up uint64, down uint64, errorCount uint32) {
+	atomic.AddUint64(&m.bytesUploadedBase, -up)
+	atomic.AddUint64(&m.bytesDownloadedBase, -down)
+	atomic.AddUint32(&m.errorCount, errorCount)
+}
+
+// BytesTransferred returns the number of bytes transferred since the last
+// reset.
 func (m *transferMeter) BytesTransferred() (up uint64, down uint64) {
-	up = atomic.LoadUint64(&m.bytesUploaded)
-	down = atomic.LoadUint64(&m.bytesDownloaded)
+	up = atomic.LoadUint64(&m.bytesUploaded) -
+		atomic.LoadUint64(&m.bytesUploadedBase)
+	down = atomic.LoadUint64(&m.bytesDownloaded) -
+		atomic.LoadUint64(&m.bytesDownloadedBase)
 	return
 }
 
+// ResetCounters zeroes the cumulative statistics, i.e. the bytes transferred,
+// the errors and the average latency. The speeds are not affected, as the
+// raw byte counts are kept and only the reported ones are rebased.
+// Concurrent increments of the error reasons being reset may be lost.
+func (m *transferMeter) ResetCounters() {
+	atomic.StoreUint64(
+		&m.bytesUploadedBase, atomic.LoadUint64(&m.bytesUploaded))
+	atomic.StoreUint64(
+		&m.bytesDownloadedBase, atomic.LoadUint64(&m.bytesDownloaded))
+	atomic.StoreUint32(&m.errorCount, 0)
+	m.errorReasons.Range(func(key interface{}, value interface{}) bool {
+		m.errorReasons.Delete(key)
+		return true
+	})
+	m.mtx.Lock()
+	m.emaConnLatencyMs = 0
+	m.mtx.Unlock()
+}
+
 // speed calculates the number of bytes transferred per second.
 func (m *transferMeter) Speed() (uploadSpeed float32, downloadSpeed float32) {
 	lastPushGapNs := atomic.LoadInt64(&m.lastPushGapNs)
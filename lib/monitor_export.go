@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	tunnelLogQueueSize   = 1024
+	tunnelLogHTTPTimeout = time.Second * 10
+)
+
+// TunnelSummary is the final report of a tunnel, emitted when it is closed.
+type TunnelSummary struct {
+	TunnelMonitorReport
+	ClosedAt time.Time
+}
+
+// tunnelHistory is a ring buffer of the most recent tunnel summaries.
+type tunnelHistory struct {
+	summaries []*TunnelSummary
+	next      int // index of the oldest summary once the buffer is full
+	mtx       sync.Mutex
+}
+
+func newTunnelHistory(size int) *tunnelHistory {
+	return &tunnelHistory{summaries: make([]*TunnelSummary, 0, size)}
+}
+
+func (h *tunnelHistory) Add(summary *TunnelSummary) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.summaries) < cap(h.summaries) {
+		h.summaries = append(h.summaries, summary)
+	} else {
+		h.summaries[h.next] = summary
+		h.next = (h.next + 1) % len(h.summaries)
+	}
+}
+
+// List returns the summaries in the buffer, the newest first.
+func (h *tunnelHistory) List() []*TunnelSummary {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	n := len(h.summaries)
+	list := make([]*TunnelSummary, n)
+	for i := range list {
+		list[i] = h.summaries[(h.next+n-1-i)%n]
+	}
+	return list
+}
+
+// TunnelSink receives the summaries of completed tunnels.
+type TunnelSink interface {
+	Emit(summary *TunnelSummary)
+	// Dropped returns the number of summaries that were not written.
+	Dropped() uint64
+	// Close flushes the pending summaries and closes the sink. Summaries
+	// emitted afterwards are dropped.
+	Close() error
+}
+
+// NewTunnelSink creates a TunnelSink from the given configuration.
+// Summaries are written asynchronously, and are dropped if the sink cannot
+// keep up with the rate at which tunnels are closed.
+func NewTunnelSink(
+	logger *zap.SugaredLogger, config TunnelLogConfig) (TunnelSink, error) {
+	var encode func(w io.Writer, summary *TunnelSummary) error
+	switch config.Format {
+	case "", "json":
+		encode = encodeTunnelSummaryJSON
+	case "influx":
+		encode = encodeTunnelSummaryInflux
+	default:
+		return nil, errors.New("unknown tunnel log format: " + config.Format)
+	}
+
+	sink := &asyncTunnelSink{
+		log:    logger,
+		encode: encode,
+		ch:     make(chan *TunnelSummary, tunnelLogQueueSize),
+		done:   make(chan struct{}),
+		close:  func() error { return nil },
+	}
+	if config.File != "" && config.URL != "" {
+		return nil, errors.New("'file' and 'url' cannot be used together")
+	} else if config.File != "" {
+		f, err := os.OpenFile(
+			config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open tunnel log file")
+		}
+		sink.write = func(data []byte) error {
+			_, err := f.Write(data)
+			return err
+		}
+		sink.close = f.Close
+	} else if config.URL != "" {
+		client := &http.Client{Timeout: tunnelLogHTTPTimeout}
+		url := config.URL
+		contentType := "application/json"
+		if config.Format == "influx" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		sink.write = func(data []byte) error {
+			resp, err := client.Post(url, contentType, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return errors.New("collector responses: " + resp.Status)
+			}
+			return nil
+		}
+	} else {
+		return nil, errors.New("either 'file' or 'url' must be specified")
+	}
+
+	go sink.run()
+	return sink, nil
+}
+
+type asyncTunnelSink struct {
+	log     *zap.SugaredLogger
+	encode  func(w io.Writer, summary *TunnelSummary) error
+	write   func(data []byte) error
+	close   func() error
+	ch      chan *TunnelSummary
+	done    chan struct{} // closed when run returns
+	dropped uint64
+	mtx     sync.RWMutex // protects ch from being closed during sending
+	closed  bool
+}
+
+func (s *asyncTunnelSink) Emit(summary *TunnelSummary) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	select {
+	case s.ch <- summary:
+	default:
+		if atomic.AddUint64(&s.dropped, 1) == 1 {
+			s.log.Warn("tunnel log queue is full, dropping summaries")
+		}
+	}
+}
+
+func (s *asyncTunnelSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *asyncTunnelSink) Close() error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.ch)
+	s.mtx.Unlock()
+
+	<-s.done
+	if dropped := s.Dropped(); dropped > 0 {
+		s.log.Warnw("some tunnel summaries were dropped", "count", dropped)
+	}
+	return errors.WithStack(s.close())
+}
+
+func (s *asyncTunnelSink) run() {
+	defer close(s.done)
+	var buf bytes.Buffer
+	for summary := range s.ch {
+		buf.Reset()
+		if err := s.encode(&buf, summary); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			s.log.Errorw("failed to encode tunnel summary", "error", err)
+			continue
+		}
+		if err := s.write(buf.Bytes()); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			s.log.Errorw("failed to write tunnel summary", "error", err)
+		}
+	}
+}
+
+func encodeTunnelSummaryJSON(w io.Writer, summary *TunnelSummary) error {
+	return json.NewEncoder(w).Encode(summary) // one object per line
+}
+
+var (
+	influxTagEscaper = strings.NewReplacer(
+		",", `\,`, "=", `\=`, " ", `\ `)
+	influxStrEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func encodeTunnelSummaryInflux(w io.Writer, summary *TunnelSummary) error {
+	var buf bytes.Buffer
+	buf.WriteString("tunnel")
+	tags := [][2]string{
+		{"rule", summary.Rule},
+		{"downstream", summary.Downstream},
+		{"upstream", summary.Upstream},
+		{"terminated_by", summary.TerminatedBy},
+	}
+	// the label names never collide with the tags above, as they are reserved
+	for _, k := range SortedLabelKeys(summary.Labels) {
+		tags = append(tags, [2]string{k, summary.Labels[k]})
+	}
+	for _, tag := range tags {
+		if tag[1] != "" { // empty tag values are not allowed
+			fmt.Fprintf(
+				&buf, ",%s=%s", tag[0], influxTagEscaper.Replace(tag[1]))
+		}
+	}
+	fmt.Fprintf(&buf,
+		` request_id="%s",client_addr="%s",target_addr="%s",bound_addr="%s",`+
+			"conn_latency_ms=%g,elapsed_secs=%g,"+
+			"bytes_uploaded=%di,bytes_downloaded=%di %d\n",
+		influxStrEscaper.Replace(summary.RequestID),
+		influxStrEscaper.Replace(summary.ClientAddr),
+		influxStrEscaper.Replace(summary.TargetAddr),
+		influxStrEscaper.Replace(summary.BoundAddr),
+		summary.ConnLatencyMs,
+		summary.ClosedAt.Sub(summary.EstablishedSince).Seconds(),
+		summary.BytesUploaded, summary.BytesDownloaded,
+		summary.ClosedAt.UnixNano())
+	_, err := buf.WriteTo(w)
+	return err
+}
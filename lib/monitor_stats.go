@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/db"
+	"go.uber.org/zap"
+)
+
+// The defaults of StatsConfig.
+const (
+	DefaultStatsFlushInterval = time.Minute
+	DefaultStatsBucket        = time.Hour
+)
+
+// StatsStore persists the cumulative statistics of the upstreams, e.g.
+// *db.StatsDAO.
+type StatsStore interface {
+	// Add accumulates the statistics of an upstream in a time bucket.
+	Add(stats *db.UpstreamStats) error
+	// Totals returns the statistics of each upstream over all the buckets.
+	Totals() ([]*db.UpstreamStats, error)
+	Close() error
+}
+
+// statsFlusher writes the statistics of the upstreams gathered since the
+// last flush to a StatsStore.
+type statsFlusher struct {
+	log     *zap.SugaredLogger
+	store   StatsStore
+	bucket  time.Duration
+	flushed map[string]upstreamCounters // counters on the last flush
+	closed  bool
+	mtx     sync.Mutex
+}
+
+type upstreamCounters struct {
+	bytesUploaded   uint64
+	bytesDownloaded uint64
+	errors          uint32
+}
+
+// SetStatsStore restores the cumulative statistics of the upstreams from the
+// store, and then flushes the new statistics to it periodically. The traffic
+// between two flushes is accounted to the time bucket of the latter one. It
+// must be called before any tunnel is opened.
+func (m *AppMonitor) SetStatsStore(
+	log *zap.SugaredLogger, store StatsStore, config StatsConfig) error {
+	interval, bucket := DefaultStatsFlushInterval, DefaultStatsBucket
+	var err error
+	if config.FlushInterval != "" {
+		interval, err = time.ParseDuration(config.FlushInterval)
+		if err != nil || interval <= 0 {
+			return errors.New("invalid value for 'flush_interval'")
+		}
+	}
+	if config.Bucket != "" {
+		bucket, err = time.ParseDuration(config.Bucket)
+		if err != nil || bucket <= 0 {
+			return errors.New("invalid value for 'bucket'")
+		}
+	}
+
+	totals, err := store.Totals()
+	if err != nil {
+		return errors.WithMessage(err, "failed to restore the statistics")
+	}
+	f := &statsFlusher{
+		log: log, store: store, bucket: bucket,
+		flushed: make(map[string]upstreamCounters)}
+	for _, t := range totals {
+		errorCount := uint32(t.Errors)
+		m.getUpstreamMonitor(t.Upstream).transferMeter.Restore(
+			t.BytesUploaded, t.BytesDownloaded, errorCount)
+		m.transferMeter.Restore(t.BytesUploaded, t.BytesDownloaded, errorCount)
+		f.flushed[t.Upstream] = upstreamCounters{errors: errorCount}
+	}
+	m.stats = f
+
+	go func() {
+		tickCh := time.Tick(interval)
+		for {
+			<-tickCh
+			if !f.Flush(m) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// CloseStatsStore flushes the statistics and closes the stats store if there
+// is one.
+func (m *AppMonitor) CloseStatsStore() error {
+	if m.stats == nil {
+		return nil
+	}
+	m.stats.Flush(m)
+	m.stats.mtx.Lock()
+	m.stats.closed = true
+	m.stats.mtx.Unlock()
+	return m.stats.store.Close()
+}
+
+// Flush writes the statistics of the upstreams to the store. It returns false
+// if the store is closed. Failed writes are retried on the next flush.
+func (f *statsFlusher) Flush(m *AppMonitor) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return false
+	}
+	bucket := time.Now().Truncate(f.bucket).UTC()
+	m.upstreamMonitors.Range(func(key interface{}, value interface{}) bool {
+		um := value.(*UpstreamMonitor)
+		cur := upstreamCounters{
+			bytesUploaded: atomic.LoadUint64(
+				&um.transferMeter.bytesUploaded),
+			bytesDownloaded: atomic.LoadUint64(
+				&um.transferMeter.bytesDownloaded),
+			errors: atomic.LoadUint32(&um.transferMeter.errorCount),
+		}
+		last := f.flushed[um.name]
+		if cur.errors < last.errors { // reset since the last flush
+			last.errors = 0
+		}
+		stats := &db.UpstreamStats{
+			Upstream:        um.name,
+			Bucket:          bucket,
+			BytesUploaded:   cur.bytesUploaded - last.bytesUploaded,
+			BytesDownloaded: cur.bytesDownloaded - last.bytesDownloaded,
+			Errors:          uint64(cur.errors - last.errors),
+		}
+		if stats.BytesUploaded == 0 && stats.BytesDownloaded == 0 &&
+			stats.Errors == 0 {
+			return true
+		}
+		if err := f.store.Add(stats); err != nil {
+			f.log.Warnw("failed to flush the statistics",
+				"upstream", um.name, "error", err)
+		} else {
+			f.flushed[um.name] = cur
+		}
+		return true
+	})
+	return true
+}
@@ -1,13 +1,25 @@
 package lib
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/richardtsai/thestral2/db"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -23,14 +35,10 @@ func TestMonitor(t *testing.T) {
 	const readRepeat = 10
 	const readInterval = 400 * time.Millisecond
 
-	oldMonitorUpdateInterval := monitorUpdateInterval
-	monitorUpdateInterval = 200 * time.Millisecond
-	defer func() { monitorUpdateInterval = oldMonitorUpdateInterval }()
-
 	var tunnelWg sync.WaitGroup
 	var tunnelStartWg sync.WaitGroup
 	var monitor AppMonitor
-	monitor.Start("test_monitor")
+	monitor.Start("test_monitor", 200*time.Millisecond)
 	tickers := make([]*time.Ticker, numberTunnels)
 	cancelFuncs := make([]func(), numberTunnels)
 	tunnelStartWg.Add(numberTunnels)
@@ -45,7 +53,8 @@ func TestMonitor(t *testing.T) {
 			latency := time.Millisecond * time.Duration(i)
 			tunnelMonitor := monitor.OpenTunnelMonitor(
 				testProxyRequest(i), name("Rule"), name("Downstream"),
-				name("Upstream"), nil, name("BoundAddr"), latency, cancelFuncs[i])
+				name("Upstream"), nil, name("BoundAddr"), nil, latency,
+				cancelFuncs[i])
 			defer tunnelMonitor.Close()
 			tunnelStartWg.Done()
 			for {
@@ -130,27 +139,43 @@ func TestMonitor(t *testing.T) {
 
 func TestAppMonitorAvgLatErrCnt(t *testing.T) {
 	var monitor AppMonitor
-	monitor.Start("test_monitor_TestAppMonitorAvgLatErrCnt")
+	monitor.Start("test_monitor_TestAppMonitorAvgLatErrCnt", 0)
 	const errCnt = 10
 	for i := 0; i < errCnt; i++ {
-		monitor.AddError("")
+		monitor.AddError("", "")
 	}
 	for i := 0; i < 100; i++ {
 		name := func(pfx string) string { return pfx + strconv.Itoa(i) }
 		latency := time.Millisecond * time.Duration(i)
 		tunnelMonitor := monitor.OpenTunnelMonitor(
 			testProxyRequest(i), name("Rule"), name("Downstream"),
-			name("Upstream"), nil, name("BoundAddr"), latency, func() {})
+			name("Upstream"), nil, name("BoundAddr"), nil, latency, func() {})
 		defer tunnelMonitor.Close()
 	}
 	report := monitor.Report()
 	assert.Equal(t, uint32(errCnt), report.ErrorCount)
+	assert.Equal(t, map[string]uint32{"unknown": errCnt}, report.ErrorReasons)
 	assert.InEpsilon(t, 98.75, report.AvgConnLatencyMs, 1e-3)
 }
 
+func TestAppMonitorActiveCount(t *testing.T) {
+	var monitor AppMonitor
+	var tunnels []*TunnelMonitor
+	for i := 0; i < 10; i++ {
+		tunnels = append(tunnels, monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", nil, time.Millisecond, func() {}))
+		assert.Equal(t, i+1, monitor.ActiveCount())
+	}
+	for i, tunnel := range tunnels {
+		tunnel.Close()
+		assert.Equal(t, len(tunnels)-i-1, monitor.ActiveCount())
+	}
+}
+
 func TestUpstreamMonitor(t *testing.T) {
 	var monitor AppMonitor
-	monitor.Start("test_monitor_TestUpstreamMonitor")
+	monitor.Start("test_monitor_TestUpstreamMonitor", 0)
 	wg := sync.WaitGroup{}
 	upName := func(i int) string { return "upstream_" + strconv.Itoa(i) }
 	for i := 1; i <= 5; i++ {
@@ -158,7 +183,7 @@ func TestUpstreamMonitor(t *testing.T) {
 			wg.Add(1)
 			go func(upstream string) {
 				defer wg.Done()
-				monitor.AddError(upstream)
+				monitor.AddError(upstream, ReasonTimeout)
 			}(upName(j))
 		}
 	}
@@ -169,7 +194,7 @@ func TestUpstreamMonitor(t *testing.T) {
 		latency := time.Millisecond * time.Duration(i)
 		tunnelMonitor := monitor.OpenTunnelMonitor(
 			testProxyRequest(i), name("Rule"), name("Downstream"),
-			upstream, nil, name("BoundAddr"), latency, func() {})
+			upstream, nil, name("BoundAddr"), nil, latency, func() {})
 		defer tunnelMonitor.Close()
 	}
 	expectedErrCnts := map[string]uint32{
@@ -189,11 +214,199 @@ func TestUpstreamMonitor(t *testing.T) {
 	reports := monitor.Report().Upstreams
 	for _, report := range reports {
 		require.Equal(t, expectedErrCnts[report.Name], report.ErrorCount)
+		require.Equal(t, expectedErrCnts[report.Name],
+			report.ErrorReasons[ReasonTimeout])
 		require.InEpsilon(
 			t, expectedAvgLats[report.Name], report.AvgConnLatencyMs, 1e-3)
 	}
 }
 
+func TestTunnelSink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2_TestTunnelSink")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir) // nolint: errcheck
+	logFile := filepath.Join(tmpDir, "tunnels.log")
+
+	logger := zap.NewNop().Sugar()
+	sink, err := NewTunnelSink(logger, TunnelLogConfig{File: logFile})
+	require.NoError(t, err)
+	var monitor AppMonitor
+	monitor.SetTunnelSink(sink)
+	for i := 0; i < 3; i++ {
+		tunnelMonitor := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", map[string]string{"team": "infra"}, time.Millisecond,
+			func() {})
+		tunnelMonitor.IncBytesUploaded(uint32(i))
+		tunnelMonitor.Close()
+	}
+	require.NoError(t, monitor.CloseTunnelSink()) // flush the summaries
+	assert.Zero(t, monitor.Report().DroppedTunnelSummaries)
+
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		var summary TunnelSummary
+		require.NoError(t, json.Unmarshal([]byte(line), &summary))
+		assert.Equal(t, strconv.Itoa(i), summary.RequestID)
+		assert.Equal(t, "Upstream", summary.Upstream)
+		assert.EqualValues(t, i, summary.BytesUploaded)
+		assert.Equal(t, map[string]string{"team": "infra"}, summary.Labels)
+		assert.False(t, summary.ClosedAt.Before(summary.EstablishedSince))
+	}
+
+	// emitted after closed
+	monitor.OpenTunnelMonitor(
+		testProxyRequest(3), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {}).Close()
+	assert.EqualValues(t, 1, monitor.Report().DroppedTunnelSummaries)
+	assert.NoError(t, sink.Close())
+
+	_, err = NewTunnelSink(logger, TunnelLogConfig{})
+	assert.Error(t, err)
+	_, err = NewTunnelSink(
+		logger, TunnelLogConfig{File: logFile, Format: "xml"})
+	assert.Error(t, err)
+}
+
+type testTransportStats map[string]interface{}
+
+func (s testTransportStats) TransportStats() map[string]interface{} {
+	return s
+}
+
+func TestTunnelMonitorTransportStats(t *testing.T) {
+	var monitor AppMonitor
+	tunnelMonitor := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {})
+	defer tunnelMonitor.Close()
+	assert.Nil(t, tunnelMonitor.Report().TransportStats)
+
+	tunnelMonitor.SetTransportStats(testTransportStats{"rtt": 42})
+	report := tunnelMonitor.Report()
+	assert.Equal(t, map[string]interface{}{"rtt": 42}, report.TransportStats)
+	assert.Contains(t, fmt.Sprintf("%v", report), "TransportStats:\n  rtt: 42\n")
+}
+
+type testCompressionStats [2]uint64
+
+func (s *testCompressionStats) CompressionStats() (uint64, uint64) {
+	return s[0], s[1]
+}
+
+func TestTunnelMonitorCompressionStats(t *testing.T) {
+	var monitor AppMonitor
+	open := func(s CompressionStats) *TunnelMonitor {
+		m := monitor.OpenTunnelMonitor(
+			testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", nil, time.Millisecond, func() {})
+		m.SetCompressionStats(s)
+		return m
+	}
+	upstreamReport := func() UpstreamMonitorReport {
+		return monitor.getUpstreamMonitor("Upstream").Report()
+	}
+
+	m1 := open(&testCompressionStats{100, 50})
+	assert.Zero(t, upstreamReport().CompressionRatio)
+	monitor.updateEpoch()
+	assert.Equal(t, float32(0.5), upstreamReport().CompressionRatio)
+
+	// pushed again on every epoch and on closing, without double counting
+	s2 := &testCompressionStats{100, 10}
+	m2 := open(s2)
+	monitor.updateEpoch()
+	s2[0], s2[1] = 200, 50
+	m2.Close()
+	assert.Equal(t, float32(100)/300, upstreamReport().CompressionRatio)
+	m1.Close()
+	assert.Equal(t, float32(100)/300, upstreamReport().CompressionRatio)
+	open(nil).Close()
+}
+
+func TestEncodeTunnelSummaryInflux(t *testing.T) {
+	since := time.Unix(100, 0)
+	summary := &TunnelSummary{
+		TunnelMonitorReport: TunnelMonitorReport{
+			RequestID: "ID", Rule: "some rule", Upstream: "up,1",
+			Labels:           map[string]string{"team": "a b", "env": "prod"},
+			EstablishedSince: since, TargetAddr: `a"b:80`,
+			BytesUploaded: 12, BytesDownloaded: 34,
+		},
+		ClosedAt: since.Add(2 * time.Second),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, encodeTunnelSummaryInflux(&buf, summary))
+	assert.Equal(t,
+		`tunnel,rule=some\ rule,upstream=up\,1,env=prod,team=a\ b `+
+			`request_id="ID",`+
+			`client_addr="",target_addr="a\"b:80",bound_addr="",`+
+			`conn_latency_ms=0,elapsed_secs=2,`+
+			`bytes_uploaded=12i,bytes_downloaded=34i 102000000000`+"\n",
+		buf.String())
+}
+
+func TestLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(nil))
+	assert.NoError(t, ValidateLabels(map[string]string{"env": "", "_a1": "x"}))
+	assert.Error(t, ValidateLabels(map[string]string{"1a": "x"}))
+	assert.Error(t, ValidateLabels(map[string]string{"a-b": "x"}))
+	for _, name := range []string{"rule", "upstream", "time"} {
+		assert.Error(t, ValidateLabels(map[string]string{name: "x"}), name)
+	}
+
+	assert.Nil(t, MergeLabels(nil, map[string]string{}))
+	assert.Equal(t,
+		map[string]string{"env": "prod", "team": "b", "zone": "z"},
+		MergeLabels(
+			map[string]string{"env": "prod", "team": "a"},
+			map[string]string{"team": "b", "zone": "z"}))
+	assert.Equal(t, []string{"a", "b", "c"},
+		SortedLabelKeys(map[string]string{"c": "", "a": "", "b": ""}))
+}
+
+func TestMonitorProbe(t *testing.T) {
+	var monitor AppMonitor
+	doProbe := func(query string) (int, ProbeReport) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/probe?"+query, nil)
+		monitor.handleProbe(w, r)
+		var report ProbeReport
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		}
+		return w.Code, report
+	}
+
+	code, _ := doProbe("upstream=up&target=host:80")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	monitor.SetProber(func(
+		ctx context.Context, upstream string, target Address) *ProxyError {
+		if upstream == "bad" {
+			return &ProxyError{Error: errors.New("boom"),
+				ErrType: ProxyConnectFailed, Reason: ReasonRefused}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	code, report := doProbe("upstream=up&target=host:80")
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Success)
+	assert.Equal(t, "host:80", report.Target)
+	assert.True(t, report.LatencyMs >= 10)
+	code, report = doProbe("upstream=bad&target=host:80")
+	require.Equal(t, http.StatusOK, code)
+	assert.False(t, report.Success)
+	assert.Equal(t, ReasonRefused, report.Reason)
+	assert.Equal(t, "boom", report.Error)
+	code, _ = doProbe("upstream=up&target=no_port")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
 type testProxyRequest int
 
 func (r testProxyRequest) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
@@ -223,3 +436,315 @@ func (r testProxyRequest) ID() string {
 func (r testProxyRequest) Logger() *zap.SugaredLogger {
 	panic("not implemented")
 }
+
+func TestMonitorMaintenance(t *testing.T) {
+	var monitor AppMonitor
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		monitor.HandleReadiness(w, httptest.NewRequest(
+			http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	setMaintenance := func(body string) (int, string) {
+		w := httptest.NewRecorder()
+		monitor.handleMaintenance(w, httptest.NewRequest(
+			http.MethodPost, "/maintenance", strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+
+	assert.Equal(t, http.StatusOK, readyz())
+	code, body := setMaintenance(`{"on":true}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"on":true,"drain":false}`, body)
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+	assert.True(t, monitor.Report().Maintenance)
+	assert.False(t, monitor.Draining())
+
+	_, body = setMaintenance(`{"on":true,"drain":true}`)
+	assert.JSONEq(t, `{"on":true,"drain":true}`, body)
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+	assert.True(t, monitor.Report().Draining)
+
+	code, _ = setMaintenance("not json")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, monitor.InMaintenance())
+	_, body = setMaintenance(`{"on":false,"drain":true}`) // not draining
+	assert.JSONEq(t, `{"on":false,"drain":false}`, body)
+	assert.Equal(t, http.StatusOK, readyz())
+}
+
+func TestMonitorReloadRules(t *testing.T) {
+	var monitor AppMonitor
+	reload := func(method string) int {
+		w := httptest.NewRecorder()
+		monitor.handleReloadRules(
+			w, httptest.NewRequest(method, "/reload-rules", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, reload(http.MethodPost))
+	var reloadErr error
+	reloaded := 0
+	monitor.SetRuleReloader(func() error {
+		reloaded++
+		return reloadErr
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, reload(http.MethodGet))
+	assert.Equal(t, http.StatusOK, reload(http.MethodPost))
+	reloadErr = errors.New("invalid rules")
+	assert.Equal(t, http.StatusInternalServerError, reload(http.MethodPost))
+	assert.Equal(t, 2, reloaded)
+}
+
+func TestAppMonitorReportPage(t *testing.T) {
+	var monitor AppMonitor
+	baseTime := time.Now()
+	for i := 0; i < 10; i++ {
+		tunnel := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", nil, time.Millisecond, func() {})
+		tunnel.establishedSince = baseTime.Add(time.Second * time.Duration(i))
+		defer tunnel.Close()
+	}
+	reqIDs := func(report AppMonitorReport) (ids []string) {
+		for _, r := range report.Tunnels {
+			ids = append(ids, r.RequestID)
+		}
+		return
+	}
+
+	report := monitor.ReportPage(2, 3)
+	assert.Equal(t, 10, report.TunnelCount)
+	assert.Equal(t, []string{"7", "6", "5"}, reqIDs(report))
+	assert.Equal(t, []string{"1", "0"}, reqIDs(monitor.ReportPage(8, 5)))
+	assert.Empty(t, monitor.ReportPage(20, 5).Tunnels)
+	assert.Len(t, monitor.Report().Tunnels, 10)
+	report = monitor.ReportPage(0, 0)
+	assert.Equal(t, 10, report.TunnelCount)
+	assert.Empty(t, report.Tunnels)
+
+	for query, expected := range map[string][2]int{
+		"":                  {0, -1},
+		"?offset=5":         {5, -1},
+		"?offset=5&limit=2": {5, 2},
+		"?summary=1":        {0, 0},
+	} {
+		offset, limit, err := parsePageQuery(
+			httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, [2]int{offset, limit}, query)
+	}
+	for _, query := range []string{"?offset=-1", "?limit=x"} {
+		_, _, err := parsePageQuery(
+			httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		assert.Error(t, err, query)
+	}
+}
+
+func TestAppMonitorSummary(t *testing.T) {
+	var monitor AppMonitor
+	for i := 0; i < 3; i++ {
+		tunnel := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", nil, time.Millisecond, func() {})
+		tunnel.IncBytesUploaded(100)
+		defer tunnel.Close()
+	}
+	monitor.AddError("Upstream", ReasonTimeout)
+
+	summary := monitor.Summary()
+	assert.Equal(t, ThestralVersion, summary.ThestralVersion)
+	assert.Equal(t, 3, summary.ActiveTunnels)
+	assert.EqualValues(t, 300, summary.BytesUploaded)
+	assert.EqualValues(t, 1, summary.ErrorCount)
+
+	// the fields of the summary are at the top level of the full report
+	reportJSON, err := json.Marshal(monitor.Report())
+	require.NoError(t, err)
+	var report map[string]interface{}
+	require.NoError(t, json.Unmarshal(reportJSON, &report))
+	assert.EqualValues(t, 3, report["ActiveTunnels"])
+	assert.EqualValues(t, 300, report["BytesUploaded"])
+}
+
+func TestAppMonitorProcessStats(t *testing.T) {
+	var monitor AppMonitor
+	assert.Nil(t, monitor.Report().Process)
+
+	monitor.SetProcessStats(true)
+	runtime.GC()
+	stats := monitor.Report().Process
+	require.NotNil(t, stats)
+	assert.True(t, stats.Goroutines > 0)
+	assert.True(t, stats.HeapAlloc > 0)
+	assert.True(t, stats.NumGC > 0)
+	if runtime.GOOS == "linux" {
+		assert.True(t, stats.OpenFDs > 0)
+	}
+}
+
+func TestAppMonitorHistory(t *testing.T) {
+	var monitor AppMonitor
+	assert.Empty(t, monitor.History())
+
+	monitor.SetHistorySize(3)
+	for i := 0; i < 5; i++ {
+		tunnel := monitor.OpenTunnelMonitor(
+			testProxyRequest(i), "Rule", "Downstream", "Upstream", nil,
+			"BoundAddr", nil, time.Millisecond, func() {})
+		tunnel.IncBytesUploaded(uint32(i))
+		tunnel.Close()
+		if i == 1 {
+			assert.Len(t, monitor.History(), 2)
+		}
+	}
+
+	history := monitor.History()
+	require.Len(t, history, 3)
+	for i, summary := range history {
+		assert.Equal(t, testProxyRequest(4-i).ID(), summary.RequestID)
+		assert.EqualValues(t, 4-i, summary.BytesUploaded)
+		assert.False(t, summary.ClosedAt.IsZero())
+	}
+	assert.Equal(t, 0, monitor.ActiveCount())
+}
+
+func TestAppMonitorResetCounters(t *testing.T) {
+	var monitor AppMonitor
+	tunnel := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {})
+	defer tunnel.Close()
+	tunnel.IncBytesUploaded(100)
+	tunnel.IncBytesDownloaded(200)
+	monitor.AddError("Upstream", ReasonTimeout)
+
+	monitor.ResetCounters()
+	report := monitor.Report()
+	assert.Equal(t, 1, report.ActiveTunnels)
+	assert.Zero(t, report.BytesUploaded)
+	assert.Zero(t, report.BytesDownloaded)
+	assert.Zero(t, report.ErrorCount)
+	assert.Empty(t, report.ErrorReasons)
+	assert.Zero(t, report.AvgConnLatencyMs)
+	require.Len(t, report.Upstreams, 1)
+	assert.Zero(t, report.Upstreams[0].BytesUploaded)
+	assert.Zero(t, report.Upstreams[0].ErrorCount)
+	require.Len(t, report.Tunnels, 1)
+	assert.EqualValues(t, 100, report.Tunnels[0].BytesUploaded)
+
+	tunnel.IncBytesUploaded(10)
+	monitor.AddError("Upstream", ReasonRefused)
+	report = monitor.Report()
+	assert.EqualValues(t, 10, report.BytesUploaded)
+	assert.EqualValues(t, 10, report.Upstreams[0].BytesUploaded)
+	assert.Equal(t, map[string]uint32{ReasonRefused: 1}, report.ErrorReasons)
+}
+
+func TestTunnelMonitorRuleAnnotations(t *testing.T) {
+	var monitor AppMonitor
+	tunnel := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {})
+	defer tunnel.Close()
+	report := tunnel.Report()
+	assert.Empty(t, report.RuleDescription)
+	assert.Empty(t, report.RuleTags)
+
+	tunnel.SetRuleAnnotations("Some rule", []string{"a", "b"})
+	report = tunnel.Report()
+	assert.Equal(t, "Some rule", report.RuleDescription)
+	assert.Equal(t, []string{"a", "b"}, report.RuleTags)
+	formatted := fmt.Sprintf("%v", report)
+	assert.Contains(t, formatted, "Description: Some rule\n")
+	assert.Contains(t, formatted, "Tags: a, b\n")
+}
+
+func TestTunnelMonitorResolvedAddr(t *testing.T) {
+	var monitor AppMonitor
+	tunnel := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {})
+	defer tunnel.Close()
+	report := tunnel.Report()
+	assert.Empty(t, report.ResolvedAddr)
+	assert.NotContains(t, fmt.Sprintf("%v", report), "ResolvedAddr")
+
+	tunnel.SetResolvedAddr("1.2.3.4:443")
+	report = tunnel.Report()
+	assert.Equal(t, "1.2.3.4:443", report.ResolvedAddr)
+	assert.Contains(t, fmt.Sprintf("%v", report), "ResolvedAddr: 1.2.3.4:443\n")
+}
+
+type fakeStatsStore struct {
+	totals []*db.UpstreamStats
+	added  []*db.UpstreamStats
+	fail   bool
+	closed bool
+}
+
+func (s *fakeStatsStore) Add(stats *db.UpstreamStats) error {
+	if s.fail {
+		return errors.New("failed")
+	}
+	s.added = append(s.added, stats)
+	return nil
+}
+
+func (s *fakeStatsStore) Totals() ([]*db.UpstreamStats, error) {
+	return s.totals, nil
+}
+
+func (s *fakeStatsStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAppMonitorStatsStore(t *testing.T) {
+	var monitor AppMonitor
+	store := &fakeStatsStore{totals: []*db.UpstreamStats{
+		{Upstream: "Upstream", BytesUploaded: 1000, BytesDownloaded: 2000,
+			Errors: 3}}}
+	for _, bucket := range []string{"soon", "-1h"} {
+		assert.Error(t, monitor.SetStatsStore(
+			zap.NewNop().Sugar(), store, StatsConfig{Bucket: bucket}))
+	}
+	require.NoError(t, monitor.SetStatsStore(
+		zap.NewNop().Sugar(), store, StatsConfig{FlushInterval: "1h"}))
+	report := monitor.Report()
+	assert.EqualValues(t, 1000, report.BytesUploaded)
+	assert.EqualValues(t, 2000, report.BytesDownloaded)
+	assert.EqualValues(t, 3, report.ErrorCount)
+	require.Len(t, report.Upstreams, 1)
+	assert.EqualValues(t, 1000, report.Upstreams[0].BytesUploaded)
+
+	tunnel := monitor.OpenTunnelMonitor(
+		testProxyRequest(0), "Rule", "Downstream", "Upstream", nil,
+		"BoundAddr", nil, time.Millisecond, func() {})
+	defer tunnel.Close()
+	tunnel.IncBytesUploaded(100)
+	monitor.AddError("Upstream", ReasonTimeout)
+	assert.EqualValues(t, 1100, monitor.Summary().BytesUploaded)
+	store.fail = true // retried on the next flush
+	assert.True(t, monitor.stats.Flush(&monitor))
+	assert.Empty(t, store.added)
+	store.fail = false
+	assert.True(t, monitor.stats.Flush(&monitor))
+	require.Len(t, store.added, 1)
+	stats := store.added[0]
+	assert.Equal(t, "Upstream", stats.Upstream)
+	assert.Equal(t, time.UTC, stats.Bucket.Location())
+	assert.Equal(t, stats.Bucket, stats.Bucket.Truncate(time.Hour))
+	assert.EqualValues(t, 100, stats.BytesUploaded)
+	assert.Zero(t, stats.BytesDownloaded)
+	assert.EqualValues(t, 1, stats.Errors)
+	assert.True(t, monitor.stats.Flush(&monitor)) // nothing new
+	assert.Len(t, store.added, 1)
+
+	tunnel.IncBytesDownloaded(10)
+	require.NoError(t, monitor.CloseStatsStore())
+	assert.True(t, store.closed)
+	require.Len(t, store.added, 2)
+	assert.EqualValues(t, 10, store.added[1].BytesDownloaded)
+	assert.False(t, monitor.stats.Flush(&monitor))
+}
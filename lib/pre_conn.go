@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,7 +12,7 @@ import (
 
 const (
 	preConnTimeout              = 30000 * time.Millisecond
-	idlePreConnPoolSize         = 2
+	idlePreConnPoolSize         = 2 // the default of min_idle
 	maxPreConnEpochInterval     = 30 * time.Second
 	preConnEpochsDuringLifetime = 20
 	defaultMaxPreConnPoolSize   = 5
@@ -25,6 +26,11 @@ type PreConnTransWrapper struct {
 	preConnMgrs     sync.Map
 	maxPoolSize     int
 	preConnLifetime time.Duration
+	hotThreshold    uint32
+	minIdle         int
+	maxTargets      int
+	numTargets      int32      // of preConnMgrs, used atomically
+	evictMtx        sync.Mutex // serializes the evictions of maxTargets
 }
 
 // WrapAsPreConnTransport wraps a transport into a PreConnTransWrapper.
@@ -52,6 +58,25 @@ func WrapAsPreConnTransport(
 		w.preConnLifetime = d
 	}
 
+	if config.HotThreshold < 0 {
+		return nil, errors.New("hot_threshold must not be negative")
+	}
+	w.hotThreshold = uint32(config.HotThreshold)
+
+	if config.MinIdle < 0 || config.MinIdle > w.maxPoolSize {
+		return nil, errors.New("min_idle must be in [0, max_pool_size]")
+	} else if config.MinIdle > 0 {
+		w.minIdle = config.MinIdle
+	} else if w.maxPoolSize < idlePreConnPoolSize {
+		w.minIdle = w.maxPoolSize
+	} else {
+		w.minIdle = idlePreConnPoolSize
+	}
+	if config.MaxTargets < 0 {
+		return nil, errors.New("max_targets must not be negative")
+	}
+	w.maxTargets = config.MaxTargets
+
 	epochInterval := w.preConnLifetime / preConnEpochsDuringLifetime
 	if epochInterval > maxPreConnEpochInterval {
 		epochInterval = maxPreConnEpochInterval
@@ -59,8 +84,13 @@ func WrapAsPreConnTransport(
 	go func() {
 		ticker := time.Tick(epochInterval)
 		for range ticker {
-			w.preConnMgrs.Range(func(_ interface{}, value interface{}) bool {
-				value.(*preConnMgr).Epoch(w.preConnLifetime)
+			w.preConnMgrs.Range(func(key interface{}, value interface{}) bool {
+				m := value.(*preConnMgr)
+				if w.hotThreshold > 0 && m.idleFor(w.preConnLifetime) {
+					w.retire(key.(string), m) // cold again
+				} else {
+					m.Epoch(w.preConnLifetime)
+				}
 				return true
 			})
 		}
@@ -73,12 +103,83 @@ func WrapAsPreConnTransport(
 // pre-connect pool, otherwise delegates the call to the wrapped transport.
 func (t *PreConnTransWrapper) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
+	return t.getPreConnMgr(address).Dial(ctx)
+}
+
+// Warm fills the pre-connect pool of the given address up to min_idle and
+// resumes the background pre-connecting if it was drained before. It blocks
+// until the connections are established or failed.
+func (t *PreConnTransWrapper) Warm(address string) {
+	m := t.getPreConnMgr(address)
+	atomic.CompareAndSwapUint32(&m.drained, preConnDrained, preConnActive)
+	if m.poolCap < t.minIdle {
+		m.runPreConn(m.poolCap)
+	} else {
+		m.runPreConn(t.minIdle)
+	}
+}
+
+// Drain closes all the pooled connections to the given address, and stops
+// pre-connecting to it until Warm is called or a dial to it succeeds again.
+// It is meant to be called when the path to the address is known to be
+// broken.
+func (t *PreConnTransWrapper) Drain(address string) {
+	m := t.getPreConnMgr(address)
+	atomic.CompareAndSwapUint32(&m.drained, preConnActive, preConnDrained)
+	for _, conn := range m.popAll() {
+		_ = conn.Close()
+	}
+}
+
+func (t *PreConnTransWrapper) getPreConnMgr(address string) *preConnMgr {
 	m, found := t.preConnMgrs.Load(address)
 	if !found {
-		m, _ = t.preConnMgrs.LoadOrStore(
+		m, found = t.preConnMgrs.LoadOrStore(
 			address, newPreConnMgr(t, address, t.maxPoolSize))
+		if !found {
+			n := int(atomic.AddInt32(&t.numTargets, 1))
+			if t.maxTargets > 0 && n > t.maxTargets {
+				t.evictLRU(address)
+			}
+		}
+	}
+	return m.(*preConnMgr)
+}
+
+// evictLRU retires the least recently dialed targets other than the given
+// one, until there are no more than maxTargets.
+func (t *PreConnTransWrapper) evictLRU(except string) {
+	t.evictMtx.Lock()
+	defer t.evictMtx.Unlock()
+	for int(atomic.LoadInt32(&t.numTargets)) > t.maxTargets {
+		var lruKey string
+		var lru *preConnMgr
+		t.preConnMgrs.Range(func(key interface{}, value interface{}) bool {
+			m := value.(*preConnMgr)
+			if key.(string) != except && (lru == nil ||
+				atomic.LoadInt64(&m.lastDial) <
+					atomic.LoadInt64(&lru.lastDial)) {
+				lruKey, lru = key.(string), m
+			}
+			return true
+		})
+		if lru == nil {
+			return
+		}
+		t.retire(lruKey, lru)
+	}
+}
+
+// retire forgets a target, closing its pooled connections.
+func (t *PreConnTransWrapper) retire(address string, m *preConnMgr) {
+	if _, loaded := t.preConnMgrs.LoadAndDelete(address); !loaded {
+		return // retired by someone else
+	}
+	atomic.AddInt32(&t.numTargets, -1)
+	atomic.StoreUint32(&m.drained, preConnRetired)
+	for _, conn := range m.popAll() {
+		_ = conn.Close()
 	}
-	return m.(*preConnMgr).Dial(ctx)
 }
 
 // Listen is not implemented for this transport.
@@ -91,6 +192,14 @@ type preConn struct {
 	establishedTime time.Time
 }
 
+// The states of a preConnMgr. A drained one resumes pre-connecting once the
+// target is found reachable again, but a retired one is forgotten for good.
+const (
+	preConnActive uint32 = iota
+	preConnDrained
+	preConnRetired
+)
+
 type preConnMgr struct {
 	wrapper *PreConnTransWrapper
 	target  string
@@ -102,18 +211,32 @@ type preConnMgr struct {
 	poolMtx   SpinMutex
 	// guarding mutex of runPreConn()
 	preConnMtx sync.Mutex
+	drained    uint32 // one of preConnActive etc., used atomically
+	hits       uint32 // should be used with atomic operations
+	lastDial   int64  // should be used with atomic operations
 }
 
 func newPreConnMgr(
 	wrapper *PreConnTransWrapper, target string, capacity int) *preConnMgr {
 	return &preConnMgr{
-		wrapper: wrapper,
-		target:  target,
-		pool:    make([]*preConn, capacity+1),
-		poolCap: capacity,
+		wrapper:  wrapper,
+		target:   target,
+		pool:     make([]*preConn, capacity+1),
+		poolCap:  capacity,
+		lastDial: time.Now().UnixNano(),
 	}
 }
 
+// hot reports whether the target has been dialed often enough to be
+// pre-connected.
+func (m *preConnMgr) hot() bool {
+	return atomic.LoadUint32(&m.hits) >= m.wrapper.hotThreshold
+}
+
+func (m *preConnMgr) idleFor(d time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&m.lastDial))) > d
+}
+
 func (m *preConnMgr) poolSizeUnsafe() int {
 	size := m.poolNext - m.poolBegin
 	if size < 0 { // we require poolCap < cap(pool), so 0 always means empty
@@ -137,6 +260,9 @@ func (m *preConnMgr) runPreConn(expectedPoolSize int) {
 	// guarded by preConnMtx, this is the only goroutine pushing elements
 	// into the ring buffer, so we won't accidentally overflow
 	for i := poolSize; i < expectedPoolSize; i++ {
+		if atomic.LoadUint32(&m.drained) > 0 {
+			break
+		}
 		ctx, cancel := context.WithTimeout(
 			context.Background(), preConnTimeout)
 		conn, err := m.wrapper.transport.Dial(ctx, m.target)
@@ -144,19 +270,28 @@ func (m *preConnMgr) runPreConn(expectedPoolSize int) {
 		if err != nil {
 			break
 		}
+		// checked under poolMtx, so that a concurrent popAll after draining
+		// either sees the pushed conn or makes us close it
 		m.poolMtx.Lock()
-		m.pool[m.poolNext] = &preConn{
-			conn:            conn,
-			establishedTime: time.Now(),
+		drained := atomic.LoadUint32(&m.drained) > 0
+		if !drained {
+			m.pool[m.poolNext] = &preConn{
+				conn:            conn,
+				establishedTime: time.Now(),
+			}
+			m.poolNext = (m.poolNext + 1) % cap(m.pool)
 		}
-		m.poolNext = (m.poolNext + 1) % cap(m.pool)
 		m.poolMtx.Unlock()
+		if drained { // possibly retired, no Epoch would ever close it
+			_ = conn.Close()
+			break
+		}
 	}
 }
 
 // Epoch cleanups the preConnMgr asynchronously.
 // Preliminary connections that last longer than preConnLifetime are dropped,
-// and the pool size is increased to at least idlePreConnPoolSize.
+// and the pool size is increased to at least min_idle.
 func (m *preConnMgr) Epoch(preConnLifetime time.Duration) {
 	// pop expired connections
 	shouldAfter := time.Now().Add(-preConnLifetime)
@@ -172,6 +307,10 @@ func (m *preConnMgr) Epoch(preConnLifetime time.Duration) {
 	}
 	poolSize := m.poolSizeUnsafe()
 	m.poolMtx.Unlock()
+	// drop all if drained, in case a runPreConn was still in progress
+	if atomic.LoadUint32(&m.drained) > 0 {
+		connsToDrop = append(connsToDrop, m.popAll()...)
+	}
 	// close expired connections asynchronously
 	if len(connsToDrop) > 0 {
 		go func() {
@@ -181,13 +320,19 @@ func (m *preConnMgr) Epoch(preConnLifetime time.Duration) {
 		}()
 	}
 	// increase pool size if needed
-	// note that poolSize might be less than idlePreConnPoolSize
-	if poolSize < idlePreConnPoolSize && poolSize < m.poolCap {
-		go m.runPreConn(idlePreConnPoolSize)
+	// note that poolSize might be less than min_idle
+	active := atomic.LoadUint32(&m.drained) == preConnActive
+	if minIdle := m.wrapper.minIdle; active &&
+		m.hot() && poolSize < minIdle && poolSize < m.poolCap {
+		go m.runPreConn(minIdle)
 	}
 }
 
 func (m *preConnMgr) Dial(ctx context.Context) (conn net.Conn, err error) {
+	atomic.StoreInt64(&m.lastDial, time.Now().UnixNano())
+	if !m.hot() && atomic.AddUint32(&m.hits, 1) < m.wrapper.hotThreshold {
+		return m.wrapper.transport.Dial(ctx, m.target)
+	}
 	m.poolMtx.Lock()
 	if m.poolBegin != m.poolNext {
 		conn = m.pool[m.poolBegin].conn
@@ -197,8 +342,26 @@ func (m *preConnMgr) Dial(ctx context.Context) (conn net.Conn, err error) {
 	m.poolMtx.Unlock()
 	// starved, trigger a runPreConn and delegate to the underlying transport
 	if conn == nil {
-		go m.runPreConn(m.poolCap)
+		if atomic.LoadUint32(&m.drained) == preConnActive {
+			go m.runPreConn(m.poolCap)
+		}
 		conn, err = m.wrapper.transport.Dial(ctx, m.target)
+		// the path works again, so resume pre-connecting from the next dial
+		if err == nil {
+			atomic.CompareAndSwapUint32(
+				&m.drained, preConnDrained, preConnActive)
+		}
+	}
+	return
+}
+
+func (m *preConnMgr) popAll() (conns []net.Conn) {
+	m.poolMtx.Lock()
+	for m.poolBegin != m.poolNext {
+		conns = append(conns, m.pool[m.poolBegin].conn)
+		m.pool[m.poolBegin] = nil
+		m.poolBegin = (m.poolBegin + 1) % cap(m.pool)
 	}
+	m.poolMtx.Unlock()
 	return
 }
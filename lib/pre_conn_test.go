@@ -2,11 +2,13 @@ package lib
 
 import (
 	"context"
+	"io"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -148,3 +150,185 @@ func TestPreConnLifetime(t *testing.T) {
 		require.True(t, isStillOpen(dial))
 	}
 }
+
+func TestPreConnWarmDrain(t *testing.T) {
+	preConnTrans, mockTrans, err := makePreConnWithMock(5, "")
+	require.NoError(t, err)
+	preConnTrans.Warm("addr") // blocks until established
+	require.Len(t, mockTrans.mockDialCh, idlePreConnPoolSize)
+	var dials []*mockDial
+	for i := 0; i < idlePreConnPoolSize; i++ {
+		dials = append(dials, <-mockTrans.mockDialCh)
+	}
+
+	preConnTrans.Drain("addr")
+	for _, dial := range dials {
+		_, err := dial.svrConn.Read(make([]byte, 1))
+		assert.Error(t, err, "pooled conn not closed")
+	}
+	// no pre-connecting after drained
+	conn, err := preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, mockTrans.mockDialCh, 1)
+	<-mockTrans.mockDialCh
+
+	preConnTrans.Warm("addr")
+	require.Len(t, mockTrans.mockDialCh, idlePreConnPoolSize)
+	conn, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Len(t, mockTrans.mockDialCh, idlePreConnPoolSize) // from the pool
+}
+
+func TestPreConnRecoverAfterDrain(t *testing.T) {
+	preConnTrans, mockTrans, err := makePreConnWithMock(5, "")
+	require.NoError(t, err)
+	preConnTrans.Drain("addr")
+
+	// still drained while the dials fail
+	mockTrans.dialErrCh <- errors.New("unreachable")
+	_, err = preConnTrans.Dial(context.Background(), "addr")
+	require.Error(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, mockTrans.mockDialCh, 0)
+
+	// a successful dial resumes pre-connecting from the next one
+	conn, err := preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, mockTrans.mockDialCh, 1)
+	<-mockTrans.mockDialCh
+	conn, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, mockTrans.mockDialCh, 1+5) // starved, pre-connected
+}
+
+func TestPreConnHotThreshold(t *testing.T) {
+	mockTrans := newMockTransForPreConn()
+	preConnTrans, err := WrapAsPreConnTransport(mockTrans,
+		PreConnConfig{MaxPoolSize: 2, Lifetime: "400ms", HotThreshold: 2})
+	require.NoError(t, err)
+
+	// cold addresses are dialed on demand only
+	conn, err := preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, mockTrans.mockDialCh, 1)
+	<-mockTrans.mockDialCh
+
+	conn, err = preConnTrans.Dial(context.Background(), "addr")
+	require.NoError(t, err)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, mockTrans.mockDialCh, 3) // starved, pre-connected
+	for len(mockTrans.mockDialCh) > 0 {
+		<-mockTrans.mockDialCh
+	}
+
+	// forgotten after idling for a lifetime
+	time.Sleep(600 * time.Millisecond)
+	_, found := preConnTrans.preConnMgrs.Load("addr")
+	assert.False(t, found)
+}
+
+func TestPreConnMinIdle(t *testing.T) {
+	mockTrans := newMockTransForPreConn()
+	preConnTrans, err := WrapAsPreConnTransport(
+		mockTrans, PreConnConfig{MaxPoolSize: 5, MinIdle: 4})
+	require.NoError(t, err)
+	preConnTrans.Warm("addr")
+	assert.Len(t, mockTrans.mockDialCh, 4)
+
+	preConnTrans, err = WrapAsPreConnTransport(
+		mockTrans, PreConnConfig{MaxPoolSize: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 1, preConnTrans.minIdle) // capped by the default
+
+	for _, config := range []PreConnConfig{
+		{MaxPoolSize: 2, MinIdle: 3}, {MinIdle: -1}, {MaxTargets: -1}} {
+		_, err = WrapAsPreConnTransport(mockTrans, config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+func TestPreConnMaxTargets(t *testing.T) {
+	mockTrans := newMockTransForPreConn()
+	preConnTrans, err := WrapAsPreConnTransport(
+		mockTrans, PreConnConfig{MaxPoolSize: 2, MaxTargets: 2})
+	require.NoError(t, err)
+
+	preConnTrans.Warm("addr1")
+	var pooled []*mockDial
+	for i := 0; i < idlePreConnPoolSize; i++ {
+		pooled = append(pooled, <-mockTrans.mockDialCh)
+	}
+	for _, addr := range []string{"addr2", "addr3"} {
+		time.Sleep(10 * time.Millisecond) // dialed later than addr1
+		preConnTrans.Warm(addr)
+	}
+
+	_, found := preConnTrans.preConnMgrs.Load("addr1")
+	assert.False(t, found, "the least recently dialed one not evicted")
+	for _, addr := range []string{"addr2", "addr3"} {
+		_, found = preConnTrans.preConnMgrs.Load(addr)
+		assert.True(t, found, addr)
+	}
+	assert.EqualValues(t, 2, preConnTrans.numTargets)
+	for _, dial := range pooled {
+		_, err := dial.svrConn.Read(make([]byte, 1))
+		assert.Error(t, err, "pooled conn not closed")
+	}
+}
+
+// gatedTransForPreConn blocks every dial until the gate is opened.
+type gatedTransForPreConn struct {
+	*mockTransForPreConn
+	dialing chan struct{}
+	gate    chan struct{}
+}
+
+func (t *gatedTransForPreConn) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	t.dialing <- struct{}{}
+	<-t.gate
+	return t.mockTransForPreConn.Dial(ctx, address)
+}
+
+func TestPreConnRetireDuringPreConn(t *testing.T) {
+	mockTrans := &gatedTransForPreConn{
+		mockTransForPreConn: newMockTransForPreConn(),
+		dialing:             make(chan struct{}, 100),
+		gate:                make(chan struct{}),
+	}
+	preConnTrans, err := WrapAsPreConnTransport(
+		mockTrans, PreConnConfig{MaxPoolSize: 2, MaxTargets: 1})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		preConnTrans.Warm("addr1")
+		close(done)
+	}()
+	<-mockTrans.dialing
+	m1, found := preConnTrans.preConnMgrs.Load("addr1")
+	require.True(t, found)
+	time.Sleep(10 * time.Millisecond)   // dialed later than addr1
+	preConnTrans.getPreConnMgr("addr2") // evicts addr1
+	_, found = preConnTrans.preConnMgrs.Load("addr1")
+	require.False(t, found)
+
+	close(mockTrans.gate) // the pending dial completes after the eviction
+	<-done
+	dial := <-mockTrans.mockDialCh
+	_ = dial.svrConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = dial.svrConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "conn of a retired target not closed")
+	assert.Empty(t, m1.(*preConnMgr).popAll())
+	assert.Len(t, mockTrans.mockDialCh, 0, "kept dialing a retired target")
+}
@@ -50,26 +50,126 @@ func (t *ProxiedTransport) Dial(
 	return &proxiedConn{rwc}, nil
 }
 
+// ExpandJumpChains returns a copy of the given upstream configurations, with
+// the 'jump' lists expanded into nested proxied transports. For example,
+// 'jump: [a, b]' on upstream c makes c proxied via b, which is in turn
+// proxied via a. Undefined upstreams and cycles are reported as errors.
+func ExpandJumpChains(
+	upstreams map[string]ProxyConfig) (map[string]ProxyConfig, error) {
+	expanded := make(map[string]ProxyConfig, len(upstreams))
+	visiting := make(map[string]bool)
+	var expand func(name string) (ProxyConfig, error)
+	expand = func(name string) (ProxyConfig, error) {
+		if config, ok := expanded[name]; ok {
+			return config, nil
+		}
+		config, ok := upstreams[name]
+		if !ok {
+			return config, errors.New("undefined upstream: " + name)
+		}
+		if visiting[name] {
+			return config, errors.New("jump cycle detected at: " + name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		var via *ProxyConfig
+		for _, hop := range config.Jump {
+			hopConfig, err := expand(hop)
+			if err == nil && via != nil {
+				hopConfig, err = proxiedVia(hopConfig, via)
+			}
+			if err != nil {
+				return config, errors.WithMessage(
+					err, "invalid jump of upstream: "+name)
+			}
+			via = &hopConfig
+		}
+		if via != nil {
+			var err error
+			if config, err = proxiedVia(config, via); err != nil {
+				return config, errors.WithMessage(
+					err, "invalid jump of upstream: "+name)
+			}
+			config.Jump = nil
+		}
+		expanded[name] = config
+		return config, nil
+	}
+
+	for name := range upstreams {
+		if _, err := expand(name); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+func proxiedVia(config ProxyConfig, via *ProxyConfig) (ProxyConfig, error) {
+	var transport TransportConfig
+	if config.Transport != nil {
+		if config.Transport.Proxied != nil {
+			return config, errors.New(
+				"'jump' cannot be used along with 'proxied'")
+		}
+		transport = *config.Transport
+	}
+	transport.Proxied = via
+	config.Transport = &transport
+	return config, nil
+}
+
+// proxiedConn adapts a non-Conn ReadWriteCloser returned by a proxy client
+// into a net.Conn. Deadlines and addresses are delegated to the wrapped
+// object if it supports them.
 type proxiedConn struct {
 	io.ReadWriteCloser
 }
 
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+var errDeadlineUnsupported = errors.New(
+	"deadline is not supported by the proxied connection")
+
 func (c *proxiedConn) LocalAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(interface{ LocalAddr() net.Addr }); ok {
+		return a.LocalAddr()
+	}
 	return nil
 }
 
 func (c *proxiedConn) RemoteAddr() net.Addr {
+	if a, ok := c.ReadWriteCloser.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
 	return nil
 }
 
 func (c *proxiedConn) SetDeadline(t time.Time) error {
-	return errors.New("not implemented")
+	if d, ok := c.ReadWriteCloser.(deadlineSetter); ok {
+		return d.SetDeadline(t)
+	}
+	return errDeadlineUnsupported
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	return closeWrite(c.ReadWriteCloser)
 }
 
 func (c *proxiedConn) SetReadDeadline(t time.Time) error {
-	return errors.New("not implemented")
+	if d, ok := c.ReadWriteCloser.(deadlineSetter); ok {
+		return d.SetReadDeadline(t)
+	}
+	return errDeadlineUnsupported
 }
 
 func (c *proxiedConn) SetWriteDeadline(t time.Time) error {
-	return errors.New("not implemented")
+	if d, ok := c.ReadWriteCloser.(deadlineSetter); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return errDeadlineUnsupported
 }
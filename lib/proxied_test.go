@@ -6,7 +6,9 @@ import (
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -60,3 +62,100 @@ func TestProxiedTransport(t *testing.T) {
 		GlobalBufPool.Free(data)
 	}
 }
+
+type testRWCProxyClient struct {
+	wrap func(conn net.Conn) io.ReadWriteCloser
+}
+
+func (c testRWCProxyClient) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	conn, boundAddr, pErr := DirectTCPClient{}.Request(ctx, addr)
+	if pErr != nil {
+		return nil, nil, pErr
+	}
+	return c.wrap(conn.(net.Conn)), boundAddr, nil
+}
+
+func TestProxiedConnDeadline(t *testing.T) {
+	targetSvr, err := startEchoServer()
+	require.NoError(t, err)
+	defer targetSvr.Close() // nolint: errcheck
+	addr := targetSvr.Addr().String()
+
+	// deadlines are delegated to the wrapped object
+	trans := &ProxiedTransport{testRWCProxyClient{
+		func(conn net.Conn) io.ReadWriteCloser {
+			return struct {
+				io.ReadWriteCloser
+				deadlineSetter
+			}{conn, conn}
+		}}}
+	cli, err := trans.Dial(context.Background(), addr)
+	require.NoError(t, err)
+	require.IsType(t, &proxiedConn{}, cli)
+	require.NoError(t, cli.SetReadDeadline(time.Now()))
+	_, err = cli.Read(make([]byte, 1))
+	netErr, ok := errors.Cause(err).(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+	require.NoError(t, cli.Close())
+
+	// or reported as unsupported
+	trans = &ProxiedTransport{testRWCProxyClient{
+		func(conn net.Conn) io.ReadWriteCloser {
+			return struct{ io.ReadWriteCloser }{conn}
+		}}}
+	cli, err = trans.Dial(context.Background(), addr)
+	require.NoError(t, err)
+	require.Error(t, cli.SetDeadline(time.Now()))
+	require.Nil(t, cli.RemoteAddr())
+	require.NoError(t, cli.Close())
+}
+
+func TestExpandJumpChains(t *testing.T) {
+	socks5 := func(addr string, jump ...string) ProxyConfig {
+		return ProxyConfig{
+			Protocol: "socks5",
+			Jump:     jump,
+			Settings: map[string]interface{}{"address": addr},
+		}
+	}
+	upstreams := map[string]ProxyConfig{
+		"bastion": socks5("bastion:1080"),
+		"edge":    socks5("edge:1080"),
+		"exit":    socks5("exit:1080", "bastion", "edge"),
+		"outer":   socks5("outer:1080", "exit"),
+	}
+	expanded, err := ExpandJumpChains(upstreams)
+	require.NoError(t, err)
+	require.Len(t, expanded, 4)
+	require.Nil(t, expanded["bastion"].Transport)
+	require.Nil(t, upstreams["exit"].Transport) // not modified
+
+	exit := expanded["exit"]
+	require.Empty(t, exit.Jump)
+	edge := exit.Transport.Proxied
+	require.Equal(t, "edge:1080", edge.Settings["address"])
+	bastion := edge.Transport.Proxied
+	require.Equal(t, "bastion:1080", bastion.Settings["address"])
+	require.Nil(t, bastion.Transport)
+	require.Equal(t, exit, *expanded["outer"].Transport.Proxied)
+	for _, config := range expanded {
+		_, err = CreateProxyClient(config)
+		require.NoError(t, err)
+	}
+
+	for _, invalid := range []map[string]ProxyConfig{
+		{"a": socks5("a:1", "b")},
+		{"a": socks5("a:1", "a")},
+		{"a": socks5("a:1", "b"), "b": socks5("b:1", "c"),
+			"c": socks5("c:1", "a")},
+		{"a": socks5("a:1"), "b": socks5("b:1", "a"),
+			"c": socks5("c:1", "a", "b")},
+	} {
+		_, err = ExpandJumpChains(invalid)
+		require.Error(t, err)
+	}
+	_, err = CreateProxyClient(upstreams["exit"])
+	require.Error(t, err)
+}
@@ -3,9 +3,13 @@ package lib
 import (
 	"context"
 	"io"
+	"net"
+	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -41,16 +45,106 @@ func GetNextRequestID() string {
 }
 
 // ProxyError is a wrapper of a normal error along with a proxy error type code.
+// Reason is a machine-readable refinement of the error type, which is only
+// used for observability and never sent to the clients.
 type ProxyError struct {
 	Error   error
 	ErrType ProxyErrorType
+	Reason  string
 }
 
+// UpstreamFault reports whether the error is likely caused by the upstream
+// rather than the target, so that another upstream may succeed.
+func (e *ProxyError) UpstreamFault() bool {
+	switch e.ErrType {
+	// connection failed, network or host unreachable and TTL expired
+	case ProxyConnectFailed, 0x03, 0x04, 0x06:
+		return false
+	default:
+		return true
+	}
+}
+
+// NewOverloadedError creates a ProxyError for the requests rejected because
+// the server is overloaded. The servers may handle it specially, e.g. asking
+// the clients to retry later.
+func NewOverloadedError(err error) *ProxyError {
+	return &ProxyError{
+		Error: err, ErrType: ProxyGeneralErr, Reason: ReasonOverloaded}
+}
+
+// Overloaded reports whether the request is rejected due to overloading.
+func (e *ProxyError) Overloaded() bool {
+	return e.Reason == ReasonOverloaded
+}
+
+// Reasons of proxy errors.
+// nolint: golint
+const (
+	ReasonTimeout       = "timeout"
+	ReasonCanceled      = "canceled"
+	ReasonDNSFailure    = "dns_failure"
+	ReasonRefused       = "connection_refused"
+	ReasonUnreachable   = "unreachable"
+	ReasonAuthFailed    = "auth_failed"
+	ReasonProxyRejected = "proxy_rejected"
+	ReasonProtocolError = "protocol_error"
+	ReasonNotAllowed    = "not_allowed"
+	ReasonOverloaded    = "overloaded"
+)
+
 func wrapAsProxyError(err error, errType ProxyErrorType) *ProxyError {
 	if err == nil {
 		return nil
 	}
-	return &ProxyError{err, errType}
+	return &ProxyError{Error: err, ErrType: errType, Reason: errorReason(err)}
+}
+
+// errorReason guesses the reason of an error returned by the network
+// functions. An empty string is returned if the reason is unknown.
+func errorReason(err error) string {
+	cause := errors.Cause(err)
+	if opErr, ok := cause.(*net.OpError); ok {
+		if opErr.Timeout() {
+			return ReasonTimeout
+		}
+		cause = opErr.Err
+	}
+	if sysErr, ok := cause.(*os.SyscallError); ok {
+		cause = sysErr.Err
+	}
+
+	switch cause {
+	case context.DeadlineExceeded:
+		return ReasonTimeout
+	case context.Canceled:
+		return ReasonCanceled
+	case syscall.ECONNREFUSED:
+		return ReasonRefused
+	case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return ReasonUnreachable
+	}
+	if _, ok := cause.(*net.DNSError); ok {
+		return ReasonDNSFailure
+	}
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return ReasonTimeout
+	}
+	return ""
+}
+
+type clientAddrContextKey struct{}
+
+// WithClientAddr returns a context telling the proxy clients requesting with
+// it the address of the client, which some protocols can pass on.
+func WithClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrContextKey{}, addr)
+}
+
+// clientAddrFromContext returns the address set by WithClientAddr, if any.
+func clientAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(clientAddrContextKey{}).(string)
+	return addr, ok
 }
 
 // ProxyRequest represents a proxy request sent by the client.
@@ -70,17 +164,108 @@ type ProxyServer interface {
 	Stop()
 }
 
+// WithUpstreamHint is an interface for requests in which the clients can
+// tell which upstream they prefer. The hint only narrows down the upstreams
+// allowed by the rules.
+type WithUpstreamHint interface {
+	UpstreamHint() string
+}
+
+// WithPreConnPool is an interface for clients pre-connecting to the servers,
+// whose pools follow the results of probing the targets via them. The pool
+// is warmed up if the target is reachable, or drained if pErr tells that the
+// path to it is broken.
+type WithPreConnPool interface {
+	UpdatePreConn(target Address, pErr *ProxyError)
+}
+
 // ProxyClient is the client of some proxy protocol.
 type ProxyClient interface {
 	Request(ctx context.Context, addr Address) (
 		io.ReadWriteCloser, Address, *ProxyError)
 }
 
-// DirectTCPClient is a ProxyClient without any proxy protocol.
-type DirectTCPClient struct{}
+// DirectTCPClient is a ProxyClient without any proxy protocol. Network
+// restricts the network to dial on, i.e. "tcp4", "tcp6" or "unix", and is
+// "tcp" if empty. If Address is set, it is dialed instead of the requested
+// addresses, which is required for "unix". TFO enables TCP Fast Open where
+// supported.
+type DirectTCPClient struct {
+	Network string
+	Address string
+	TFO     bool
+	pool    *PreConnTransWrapper // nil if pre-connecting is disabled
+}
+
+// directClientSettings are the settings of a DirectTCPClient.
+type directClientSettings struct {
+	Address string `yaml:"address"`
+	Network string `yaml:"network"`
+	TFO     bool   `yaml:"tfo"`
+}
+
+// The defaults of 'hot_threshold' and 'max_targets' of the pre-connect pool
+// of a DirectTCPClient, which can't be unlimited.
+const (
+	defaultDirectHotThreshold = 3
+	defaultDirectMaxTargets   = 64
+)
+
+// NewDirectTCPClient creates a DirectTCPClient from the given configuration.
+func NewDirectTCPClient(config ProxyConfig) (*DirectTCPClient, error) {
+	var preConn *PreConnConfig
+	if config.Transport != nil {
+		others := *config.Transport
+		preConn, others.PreConn = others.PreConn, nil
+		if preConn == nil || !reflect.DeepEqual(others, TransportConfig{}) {
+			return nil, errors.New(
+				"'direct' protocol supports no transport setting but 'pre_conn'")
+		}
+	}
+	var settings directClientSettings
+	if err := config.DecodeSettings(&settings); err != nil {
+		return nil, err
+	}
+	client := &DirectTCPClient{Network: settings.Network,
+		Address: settings.Address, TFO: settings.TFO}
+	switch client.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	case "unix":
+		if client.Address == "" {
+			return nil, errors.New("'address' is required for 'unix' network")
+		}
+	default:
+		return nil, errors.New("unsupported network: " + client.Network)
+	}
+	if preConn != nil { // already connected, so TFO doesn't help
+		// only pre-connect to a bounded set of hot targets, or every target
+		// ever dialed would keep idle connections forever
+		config := *preConn
+		if config.HotThreshold == 0 {
+			config.HotThreshold = defaultDirectHotThreshold
+		}
+		if config.MaxTargets == 0 {
+			config.MaxTargets = defaultDirectMaxTargets
+		}
+		var err error
+		client.pool, err = WrapAsPreConnTransport(
+			directTransport{client.network(), false}, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (c DirectTCPClient) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
 
 // Request establishes a direct connection to the given address.
-func (DirectTCPClient) Request(ctx context.Context, addr Address) (
+func (c DirectTCPClient) Request(ctx context.Context, addr Address) (
 	io.ReadWriteCloser, Address, *ProxyError) {
 	var reqAddr string
 	switch a := addr.(type) {
@@ -95,63 +280,112 @@ func (DirectTCPClient) Request(ctx context.Context, addr Address) (
 			errors.Errorf("unsupported address for DirectTCPClient: %s", addr),
 			ProxyAddrUnsupported)
 	}
+	if c.Address != "" {
+		reqAddr = c.Address
+	}
+	network := c.network()
 
-	conn, err := TCPTransport{}.Dial(ctx, reqAddr)
+	var conn net.Conn
+	var err error
+	// pooled connections are not marked, so DSCP requests are never pooled
+	if _, hasDSCP := dscpFromContext(ctx); c.pool != nil && !hasDSCP {
+		conn, err = c.pool.Dial(ctx, reqAddr)
+	} else {
+		conn, err = directTransport{network, c.TFO}.Dial(ctx, reqAddr)
+	}
 	var boundAddr Address
 	if err == nil {
-		boundAddr, err = FromNetAddr(conn.LocalAddr())
+		if network == "unix" { // no meaningful bound address
+			boundAddr = &TCP4Addr{IP: net.IPv4zero}
+		} else {
+			boundAddr, err = FromNetAddr(conn.LocalAddr())
+		}
 	}
 	pErr := wrapAsProxyError(errors.WithStack(err), ProxyConnectFailed)
 	return conn, boundAddr, pErr
 }
 
+// UpdatePreConn implements WithPreConnPool. The target itself is the path,
+// so its pool is drained on any failure.
+func (c DirectTCPClient) UpdatePreConn(target Address, pErr *ProxyError) {
+	if c.pool == nil {
+		return
+	}
+	addr := c.Address
+	if addr == "" {
+		addr = target.String()
+	}
+	if pErr == nil {
+		c.pool.Warm(addr)
+	} else {
+		c.pool.Drain(addr)
+	}
+}
+
+// directTransport dials the targets directly for DirectTCPClient.
+type directTransport struct {
+	network string
+	tfo     bool
+}
+
+func (t directTransport) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Control: dialControl(ctx, t.tfo)}
+	return dialer.DialContext(ctx, t.network, address)
+}
+
+func (t directTransport) Listen(address string) (net.Listener, error) {
+	panic("directTransport is a client-only transport")
+}
+
 // CreateProxyServer creates a ProxyServer from the given configuration.
 func CreateProxyServer(
 	logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error) {
-	switch config.Protocol {
-	case "socks5":
-		return NewSOCKS5Server(logger, config)
-	case "direct":
-		return nil, errors.New("'direct' cannot be used as a proxy server")
-	default:
+	if len(config.Jump) > 0 {
+		return nil, errors.New("'jump' cannot be used in a proxy server")
+	}
+	if config.MaxConcurrentDials != 0 {
+		return nil, errors.New(
+			"'max_concurrent_dials' cannot be used in a proxy server")
+	}
+	factory, ok := lookupProxyServer(config.Protocol)
+	if !ok {
+		if _, ok = lookupProxyClient(config.Protocol); ok {
+			return nil, errors.Errorf(
+				"'%s' cannot be used as a proxy server", config.Protocol)
+		}
 		return nil, errors.New("unknown proxy protocol: " + config.Protocol)
 	}
+	return factory(logger, config)
 }
 
 // CreateProxyClient creates a ProxyClient from the given configuration.
 func CreateProxyClient(config ProxyConfig) (ProxyClient, error) {
-	switch config.Protocol {
-	case "direct":
-		if config.Transport != nil {
-			return nil, errors.New(
-				"'direct' protocol should not have any transport setting")
-		}
-		if len(config.Settings) > 0 {
-			return nil, errors.New(
-				"'direct' protocol should not have any extra setting")
-		}
-		return DirectTCPClient{}, nil
-
-	case "http":
-		if config.Transport != nil {
-			return nil, errors.New(
-				"'http' protocol should not have any transport setting")
-		}
-		addr, ok := config.Settings["address"]
-		if !ok || len(config.Settings) != 1 {
-			return nil, errors.New(
-				"'http' protocol should have one and only one" +
-					" extra setting 'address'")
-		}
-		if addrStr, ok := addr.(string); ok {
-			return HTTPTunnelClient{addrStr}, nil
+	if len(config.Jump) > 0 {
+		return nil, errors.New(
+			"'jump' should have been expanded by ExpandJumpChains")
+	}
+	if len(config.Labels) > 0 {
+		return nil, errors.New("'labels' cannot be used in a proxy client")
+	}
+	if len(config.DefaultUpstreams) > 0 {
+		return nil, errors.New(
+			"'default_upstreams' cannot be used in a proxy client")
+	}
+	// the tunnels of a client can't share the only session to the server
+	if t := config.Transport; t != nil &&
+		t.KCP != nil && t.KCP.LocalAddr != "" {
+		return nil, errors.New(
+			"KCP 'local_addr' cannot be used in a proxy client, " +
+				"as it allows only one tunnel to the server at a time")
+	}
+	factory, ok := lookupProxyClient(config.Protocol)
+	if !ok {
+		if _, ok = lookupProxyServer(config.Protocol); ok {
+			return nil, errors.Errorf(
+				"'%s' cannot be used as a proxy client", config.Protocol)
 		}
-		return nil, errors.New("a valid 'address' must be supplied")
-
-	case "socks5":
-		return NewSOCKS5Client(config)
-
-	default:
 		return nil, errors.New("unknown proxy protocol: " + config.Protocol)
 	}
+	return factory(config)
 }
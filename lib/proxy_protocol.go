@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyProtoHeaderTimeout is the timeout for receiving the PROXY protocol
+// header from a newly accepted connection.
+var proxyProtoHeaderTimeout = time.Second * 10
+
+const proxyProtoV1MaxLen = 107
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WrapTransProxyProtocol wraps a Transport so that the connections accepted
+// by its listeners are prefixed by a PROXY protocol (v1 or v2) header, e.g.
+// from a TCP load balancer. The client address carried by the header is
+// reported as the remote address of the connections. Dialing is not
+// affected.
+func WrapTransProxyProtocol(inner Transport) Transport {
+	return &proxyProtoTransWrapper{inner}
+}
+
+type proxyProtoTransWrapper struct {
+	inner Transport
+}
+
+func (w *proxyProtoTransWrapper) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	return w.inner.Dial(ctx, address)
+}
+
+func (w *proxyProtoTransWrapper) Listen(address string) (net.Listener, error) {
+	listener, err := w.inner.Listen(address)
+	if err == nil {
+		listener = &proxyProtoListener{listener}
+	}
+	return listener, err
+}
+
+type proxyProtoListener struct {
+	net.Listener
+}
+
+// Accept does not wait for the header, which is read on the first Read, so
+// that a slow client won't block the others.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader       *bufio.Reader
+	inited       sync.Once
+	initErr      error
+	parsed       int32    // set atomically once remoteAddr is ready
+	remoteAddr   net.Addr // nil if the header doesn't carry an address
+	readDeadline time.Time
+	ddlMtx       sync.Mutex // guards readDeadline
+}
+
+func (c *proxyProtoConn) init() error {
+	c.inited.Do(func() {
+		// the caller's deadline is applied if it is earlier, and restored
+		// after the header is read
+		c.ddlMtx.Lock()
+		ddl := time.Now().Add(proxyProtoHeaderTimeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(ddl) {
+			ddl = c.readDeadline
+		}
+		_ = c.Conn.SetReadDeadline(ddl)
+		c.ddlMtx.Unlock()
+
+		c.remoteAddr, c.initErr = readProxyProtoHeader(c.reader)
+		atomic.StoreInt32(&c.parsed, 1)
+
+		c.ddlMtx.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.ddlMtx.Unlock()
+	})
+	return c.initErr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.ddlMtx.Lock()
+	defer c.ddlMtx.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.ddlMtx.Lock()
+	defer c.ddlMtx.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr never blocks. It returns the address of the underlying
+// connection until the header has been read.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if atomic.LoadInt32(&c.parsed) != 0 && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtoHeader reads a PROXY protocol header and returns the source
+// address in it, or nil if the address is unknown or not applicable.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyProtoV2Header(r)
+	}
+	if len(sig) >= 6 && string(sig[:6]) == "PROXY " {
+		return readProxyProtoV1Header(r)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyProtoV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) <= proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header is too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtoV2Header(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.Errorf(
+			"unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.Errorf(
+			"unknown PROXY protocol command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("truncated PROXY protocol v2 header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("truncated PROXY protocol v2 header")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default: // unspecified or unix sockets
+		return nil, nil
+	}
+}
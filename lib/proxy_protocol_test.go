@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	v2Header := func(cmd, fam byte, payload ...byte) string {
+		return string(proxyProtoV2Sig) +
+			string([]byte{0x20 | cmd, fam, 0, byte(len(payload))}) +
+			string(payload)
+	}
+	cases := []struct {
+		header string
+		addr   string // empty if no address is expected
+		valid  bool
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n", "1.2.3.4:1234", true},
+		{"PROXY TCP6 2001:db8::1 ::1 1234 443\r\n", "[2001:db8::1]:1234", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{v2Header(1, 0x11, 1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0xd2, 0, 80),
+			"1.2.3.4:1234", true},
+		{v2Header(0, 0x00), "", true},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234\r\n", "", false},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\n", "", false},
+		{"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", false},
+		{v2Header(1, 0x11, 1, 2, 3, 4), "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "payload"))
+		addr, err := readProxyProtoHeader(r)
+		if !c.valid {
+			assert.Error(t, err, "%q", c.header)
+			continue
+		}
+		require.NoError(t, err, "%q", c.header)
+		if c.addr == "" {
+			assert.Nil(t, addr)
+		} else {
+			require.NotNil(t, addr)
+			assert.Equal(t, c.addr, addr.String())
+		}
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "payload", string(rest))
+	}
+}
+
+// proxyProtoClientTrans sends a PROXY protocol header after dialing.
+type proxyProtoClientTrans struct {
+	TCPTransport
+	header string
+}
+
+func (t proxyProtoClientTrans) Dial(
+	ctx context.Context, address string) (net.Conn, error) {
+	conn, err := t.TCPTransport.Dial(ctx, address)
+	if err == nil {
+		_, err = conn.Write([]byte(t.header))
+	}
+	return conn, err
+}
+
+func TestTLSInProxyProtocol(t *testing.T) {
+	svrTrans, err := CreateTransport(
+		&TransportConfig{TLS: gTLSServerConfig, ProxyProtocol: true})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+
+	cliTrans, err := NewTLSTransport(*gTLSClientConfig, proxyProtoClientTrans{
+		header: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"})
+	require.NoError(t, err)
+	go func() {
+		cli, err := cliTrans.Dial(
+			context.Background(), listener.Addr().String())
+		if err == nil {
+			_, _ = cli.Write([]byte("hello"))
+			_ = cli.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	peerIDs, err := conn.(WithPeerIdentifiers).GetPeerIdentifiers()
+	require.NoError(t, err)
+	require.Len(t, peerIDs, 1)
+	assert.NotNil(t, peerIDs[0])
+	assert.Equal(t, "1.2.3.4:1234", conn.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = CreateTransport(
+		&TransportConfig{KCP: &KCPConfig{}, ProxyProtocol: true})
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolIdleClient(t *testing.T) {
+	trans, err := CreateTransport(&TransportConfig{ProxyProtocol: true})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close() // nolint: errcheck
+	conn1, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn1.Close() // nolint: errcheck
+	// doesn't wait for the header of the idle client
+	assert.Equal(t, idle.LocalAddr().String(), conn1.RemoteAddr().String())
+
+	cli, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer cli.Close() // nolint: errcheck
+	_, err = cli.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nhello"))
+	require.NoError(t, err)
+	conn2, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn2.Close() // nolint: errcheck
+
+	// the deadline of the caller is kept after reading the header
+	require.NoError(t, conn2.SetDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn2, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, "1.2.3.4:1234", conn2.RemoteAddr().String())
+	_, err = conn2.Read(buf)
+	if assert.Error(t, err) {
+		nErr, ok := err.(net.Error)
+		assert.True(t, ok && nErr.Timeout(), "%v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorReason(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr, err := FromNetAddr(l.Addr())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	_, _, pErr := DirectTCPClient{}.Request(context.Background(), addr)
+	require.NotNil(t, pErr)
+	assert.Equal(t, ProxyConnectFailed, pErr.ErrType)
+	assert.Equal(t, ReasonRefused, pErr.Reason)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, _, pErr = DirectTCPClient{}.Request(ctx, addr)
+	require.NotNil(t, pErr)
+	assert.Equal(t, ReasonTimeout, pErr.Reason)
+
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "does.not.exist"}}
+	assert.Equal(t, ReasonDNSFailure,
+		errorReason(errors.WithMessage(errors.WithStack(dnsErr), "failed")))
+	assert.Equal(t, ReasonCanceled, errorReason(context.Canceled))
+	assert.Empty(t, errorReason(errors.New("other")))
+	assert.Nil(t, wrapAsProxyError(nil, ProxyGeneralErr))
+}
+
+func TestDirectTCPClientNetwork(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "thestral2-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir) // nolint: errcheck
+	sockFile := filepath.Join(tmpDir, "test.sock")
+	l, err := net.Listen("unix", sockFile)
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{
+			"network": "unix", "address": sockFile},
+	})
+	require.NoError(t, err)
+	addr := &DomainNameAddr{DomainName: "ignored", Port: 80}
+	conn, boundAddr, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	assert.NotNil(t, boundAddr)
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	_ = conn.Close()
+
+	cli, err = CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Settings: map[string]interface{}{"network": "tcp6"},
+	})
+	require.NoError(t, err)
+	ipv4Addr := &TCP4Addr{IP: net.ParseIP("127.0.0.1"), Port: 80}
+	_, _, pErr = cli.Request(context.Background(), ipv4Addr)
+	assert.NotNil(t, pErr)
+
+	for _, settings := range []map[string]interface{}{
+		{"network": "udp"},
+		{"network": "unix"},
+		{"network": 4},
+		{"other": "x"},
+		{"tfo": "yes"},
+	} {
+		_, err = CreateProxyClient(
+			ProxyConfig{Protocol: "direct", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+}
+
+func TestDirectTCPClientPreConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close() // nolint: errcheck
+		}
+	}()
+	addr, err := FromNetAddr(l.Addr())
+	require.NoError(t, err)
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Transport: &TransportConfig{PreConn: &PreConnConfig{
+			MaxPoolSize: 2, Lifetime: "1h", HotThreshold: 1}},
+	})
+	require.NoError(t, err)
+	conn, _, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 3, atomic.LoadInt32(&accepted))
+
+	// served from the pool
+	conn, _, pErr = cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&accepted))
+
+	// DSCP requests are never pooled
+	conn, _, pErr = cli.Request(WithDSCP(context.Background(), 0x2e), addr)
+	require.Nil(t, pErr)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 4, atomic.LoadInt32(&accepted))
+
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Transport: &TransportConfig{
+			PreConn: &PreConnConfig{}, Compression: "snappy"},
+	})
+	assert.Error(t, err)
+}
+
+func TestDirectTCPClientPreConnDefaults(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // nolint: errcheck
+		}
+	}()
+	addr, err := FromNetAddr(l.Addr())
+	require.NoError(t, err)
+
+	cli, err := NewDirectTCPClient(ProxyConfig{
+		Transport: &TransportConfig{PreConn: &PreConnConfig{
+			MaxPoolSize: 2, Lifetime: "400ms"}},
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, defaultDirectHotThreshold, cli.pool.hotThreshold)
+	assert.EqualValues(t, defaultDirectMaxTargets, cli.pool.maxTargets)
+
+	for i := 0; i < defaultDirectHotThreshold; i++ {
+		conn, _, pErr := cli.Request(context.Background(), addr)
+		require.Nil(t, pErr)
+		_ = conn.Close()
+	}
+	_, found := cli.pool.preConnMgrs.Load(addr.String())
+	require.True(t, found)
+
+	// a cold target is retired
+	time.Sleep(time.Second)
+	_, found = cli.pool.preConnMgrs.Load(addr.String())
+	assert.False(t, found)
+}
+
+func TestDirectTCPClientUpdatePreConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer conn.Close() // nolint: errcheck
+		}
+	}()
+	addr, err := FromNetAddr(l.Addr())
+	require.NoError(t, err)
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct",
+		Transport: &TransportConfig{PreConn: &PreConnConfig{
+			MaxPoolSize: 3, MinIdle: 2, HotThreshold: 1}},
+	})
+	require.NoError(t, err)
+	pool := cli.(WithPreConnPool)
+
+	pool.UpdatePreConn(addr, nil)
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&accepted))
+
+	// dialed rather than served from the pool once drained
+	pool.UpdatePreConn(addr, &ProxyError{
+		ErrType: ProxyConnectFailed, Reason: ReasonRefused})
+	conn, _, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&accepted))
+}
+
+func TestCreateProxyClientLabels(t *testing.T) {
+	_, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct", Labels: map[string]string{"env": "prod"}})
+	assert.Error(t, err)
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol: "direct", DefaultUpstreams: []string{"direct"}})
+	assert.Error(t, err)
+}
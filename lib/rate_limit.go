@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimiter is a token bucket limiting the rate of bytes. It allows a
+// burst of one second, and a request larger than the available tokens is
+// served by going into debt, which is paid off by the next requests.
+type RateLimiter struct {
+	rate     float64 // bytes per second
+	tokens   float64
+	lastTime time.Time
+	mtx      sync.Mutex
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate bytes per second.
+func NewRateLimiter(rate uint64) *RateLimiter {
+	return &RateLimiter{
+		rate: float64(rate), tokens: float64(rate), lastTime: time.Now()}
+}
+
+// WaitN takes n tokens from the bucket, blocking until they are paid off or
+// the context is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mtx.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.lastTime).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.lastTime = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mtx.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(debt / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// NewRateLimitedReader limits the rate of reading from r with the limiter.
+// The reads fail once the context is done.
+func NewRateLimitedReader(
+	ctx context.Context, r io.Reader, limiter *RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx, r, limiter}
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		if wErr := r.limiter.WaitN(r.ctx, n); wErr != nil && err == nil {
+			err = wErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]uint64{
+		"512":    512,
+		"512B":   512,
+		"64KiB":  64 * 1024,
+		"64K":    64 * 1024,
+		"1.5MiB": 3 * 512 * 1024,
+		"2 GiB":  2 * 1024 * 1024 * 1024,
+		"1T":     1024 * 1024 * 1024 * 1024,
+	}
+	for s, expected := range cases {
+		n, err := ParseBytes(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, n, s)
+	}
+	for _, s := range []string{"", "KiB", "-1", "1KB", "1 PiB", "1.2.3"} {
+		_, err := ParseBytes(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(10000)
+	startTime := time.Now()
+	require.NoError(t, limiter.WaitN(context.Background(), 5000)) // burst
+	assert.True(t, time.Since(startTime) < time.Millisecond*100)
+	require.NoError(t, limiter.WaitN(context.Background(), 10000)) // in debt
+	assert.InDelta(t, 0.5, time.Since(startTime).Seconds(), 0.2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	startTime = time.Now()
+	assert.Error(t, limiter.WaitN(ctx, 10000))
+	assert.True(t, time.Since(startTime) < time.Millisecond*100)
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := make([]byte, 30000)
+	r := NewRateLimitedReader(
+		context.Background(), bytes.NewReader(data), NewRateLimiter(20000))
+	startTime := time.Now()
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	assert.InDelta(t, 0.5, time.Since(startTime).Seconds(), 0.2)
+}
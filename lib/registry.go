@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ProxyClientFactory creates a ProxyClient of a registered protocol.
+type ProxyClientFactory func(config ProxyConfig) (ProxyClient, error)
+
+// ProxyServerFactory creates a ProxyServer of a registered protocol.
+type ProxyServerFactory func(
+	logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error)
+
+// TransportFactory creates the inner most Transport selected by 'custom',
+// given the rest of its settings.
+type TransportFactory func(settings map[string]interface{}) (Transport, error)
+
+// builtinTransports are the names which cannot be taken by RegisterTransport.
+var builtinTransports = []string{
+	"tcp", "kcp", "proxied", "exec", "tls", "compression", "pre_conn"}
+
+var (
+	registryMtx         sync.RWMutex
+	proxyClientFactory  = make(map[string]ProxyClientFactory)
+	proxyServerFactory  = make(map[string]ProxyServerFactory)
+	transportFactory    = make(map[string]TransportFactory)
+	proxyClientSettings = make(map[string][]SettingInfo)
+	proxyServerSettings = make(map[string][]SettingInfo)
+)
+
+// SettingInfo describes a protocol specific setting.
+type SettingInfo struct {
+	Name     string
+	Type     string // e.g. "string", "bool", "int", "map" or "list"
+	Required bool
+}
+
+// ProtocolInfo describes a registered proxy protocol. The settings are nil
+// if the protocol is not described by DescribeProxyClient or
+// DescribeProxyServer.
+type ProtocolInfo struct {
+	Name           string
+	Client         bool
+	Server         bool
+	ClientSettings []SettingInfo
+	ServerSettings []SettingInfo
+}
+
+// TransportInfo describes an available transport layer. The custom ones are
+// those registered by RegisterTransport.
+type TransportInfo struct {
+	Name   string
+	Custom bool
+}
+
+func init() {
+	// built-in ones are registered first, so they can never be overridden
+	for name, factory := range map[string]ProxyClientFactory{
+		"direct": func(config ProxyConfig) (ProxyClient, error) {
+			return NewDirectTCPClient(config)
+		},
+		"http": func(config ProxyConfig) (ProxyClient, error) {
+			return NewHTTPTunnelClient(config)
+		},
+		"socks5": func(config ProxyConfig) (ProxyClient, error) {
+			return NewSOCKS5Client(config)
+		},
+	} {
+		if err := RegisterProxyClient(name, factory); err != nil {
+			panic(err)
+		}
+	}
+	for name, factory := range map[string]ProxyServerFactory{
+		"socks5": func(
+			logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error) {
+			return NewSOCKS5Server(logger, config)
+		},
+		"forward": func(
+			logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error) {
+			return NewForwardServer(logger, config)
+		},
+	} {
+		if err := RegisterProxyServer(name, factory); err != nil {
+			panic(err)
+		}
+	}
+
+	for name, settings := range map[string][]SettingInfo{
+		"direct": DescribeSettings(directClientSettings{}),
+		"http":   DescribeSettings(httpTunnelSettings{}, "address"),
+		"socks5": DescribeSettings(socks5ClientSettings{}, "address"),
+	} {
+		if err := DescribeProxyClient(name, settings); err != nil {
+			panic(err)
+		}
+	}
+	for name, settings := range map[string][]SettingInfo{
+		"socks5":  DescribeSettings(socks5ServerSettings{}, "address"),
+		"forward": DescribeSettings(forwardServerSettings{}, "address"),
+	} {
+		if err := DescribeProxyServer(name, settings); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterProxyClient makes a proxy protocol available to the upstreams. It
+// fails if a client of the same protocol has been registered.
+func RegisterProxyClient(name string, factory ProxyClientFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("invalid proxy client registration")
+	}
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := proxyClientFactory[name]; ok {
+		return errors.Errorf("proxy client already registered: %s", name)
+	}
+	proxyClientFactory[name] = factory
+	return nil
+}
+
+// RegisterProxyServer makes a proxy protocol available to the downstreams. It
+// fails if a server of the same protocol has been registered.
+func RegisterProxyServer(name string, factory ProxyServerFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("invalid proxy server registration")
+	}
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := proxyServerFactory[name]; ok {
+		return errors.Errorf("proxy server already registered: %s", name)
+	}
+	proxyServerFactory[name] = factory
+	return nil
+}
+
+// RegisterTransport makes a transport available as the inner most layer via
+// 'custom'. It fails if the name has been registered or is a built-in one.
+func RegisterTransport(name string, factory TransportFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("invalid transport registration")
+	}
+	for _, builtin := range builtinTransports {
+		if name == builtin {
+			return errors.Errorf("transport is built-in: %s", name)
+		}
+	}
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := transportFactory[name]; ok {
+		return errors.Errorf("transport already registered: %s", name)
+	}
+	transportFactory[name] = factory
+	return nil
+}
+
+// DescribeProxyClient records the settings of a registered proxy client,
+// which are reported by ListProxyProtocols.
+func DescribeProxyClient(name string, settings []SettingInfo) error {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := proxyClientFactory[name]; !ok {
+		return errors.Errorf("proxy client not registered: %s", name)
+	}
+	proxyClientSettings[name] = settings
+	return nil
+}
+
+// DescribeProxyServer records the settings of a registered proxy server,
+// which are reported by ListProxyProtocols.
+func DescribeProxyServer(name string, settings []SettingInfo) error {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := proxyServerFactory[name]; !ok {
+		return errors.Errorf("proxy server not registered: %s", name)
+	}
+	proxyServerSettings[name] = settings
+	return nil
+}
+
+// DescribeSettings lists the settings decoded by DecodeSettings into a
+// struct like prototype, following its yaml tags. The named ones are marked
+// as required.
+func DescribeSettings(
+	prototype interface{}, required ...string) []SettingInfo {
+	var settings []SettingInfo
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")
+			if len(tag) > 1 && tag[1] == "inline" {
+				walk(field.Type)
+				continue
+			}
+			if tag[0] == "" || tag[0] == "-" {
+				continue
+			}
+			info := SettingInfo{Name: tag[0], Type: settingType(field.Type)}
+			for _, name := range required {
+				info.Required = info.Required || name == info.Name
+			}
+			settings = append(settings, info)
+		}
+	}
+	walk(reflect.TypeOf(prototype))
+	return settings
+}
+
+func settingType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	default:
+		return t.Kind().String() // e.g. string, bool, map or struct
+	}
+}
+
+// ListProxyProtocols describes the registered proxy protocols, in the order
+// of their names.
+func ListProxyProtocols() []ProtocolInfo {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	infos := make(map[string]*ProtocolInfo)
+	get := func(name string) *ProtocolInfo {
+		if infos[name] == nil {
+			infos[name] = &ProtocolInfo{Name: name}
+		}
+		return infos[name]
+	}
+	for name := range proxyClientFactory {
+		info := get(name)
+		info.Client, info.ClientSettings = true, proxyClientSettings[name]
+	}
+	for name := range proxyServerFactory {
+		info := get(name)
+		info.Server, info.ServerSettings = true, proxyServerSettings[name]
+	}
+	list := make([]ProtocolInfo, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ListTransports describes the available transport layers, the built-in
+// ones first, and then the custom ones in the order of their names.
+func ListTransports() []TransportInfo {
+	list := make([]TransportInfo, 0, len(builtinTransports))
+	for _, name := range builtinTransports {
+		list = append(list, TransportInfo{Name: name})
+	}
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	var custom []string
+	for name := range transportFactory {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		list = append(list, TransportInfo{Name: name, Custom: true})
+	}
+	return list
+}
+
+func lookupProxyClient(name string) (ProxyClientFactory, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	factory, ok := proxyClientFactory[name]
+	return factory, ok
+}
+
+func lookupProxyServer(name string) (ProxyServerFactory, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	factory, ok := proxyServerFactory[name]
+	return factory, ok
+}
+
+func lookupTransport(name string) (TransportFactory, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	factory, ok := transportFactory[name]
+	return factory, ok
+}
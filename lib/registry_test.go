@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeProxyClient struct {
+	settings map[string]interface{}
+}
+
+func (fakeProxyClient) Request(ctx context.Context, addr Address) (
+	io.ReadWriteCloser, Address, *ProxyError) {
+	return nil, nil, &ProxyError{ErrType: ProxyGeneralErr}
+}
+
+type fakeTransport struct {
+	TCPTransport
+	settings map[string]interface{}
+}
+
+func TestRegisterProxyClient(t *testing.T) {
+	factory := func(config ProxyConfig) (ProxyClient, error) {
+		return fakeProxyClient{config.Settings}, nil
+	}
+	require.NoError(t, RegisterProxyClient("test-client", factory))
+	assert.Error(t, RegisterProxyClient("test-client", factory))
+	assert.Error(t, RegisterProxyClient("socks5", factory))
+	assert.Error(t, RegisterProxyClient("", factory))
+	assert.Error(t, RegisterProxyClient("test-nil", nil))
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "test-client", Settings: map[string]interface{}{"a": 1}})
+	require.NoError(t, err)
+	assert.Equal(t, fakeProxyClient{map[string]interface{}{"a": 1}}, cli)
+	_, err = CreateProxyServer(
+		zap.NewNop().Sugar(), ProxyConfig{Protocol: "test-client"})
+	assert.EqualError(t, err, "'test-client' cannot be used as a proxy server")
+}
+
+func TestRegisterProxyServer(t *testing.T) {
+	factory := func(
+		logger *zap.SugaredLogger, config ProxyConfig) (ProxyServer, error) {
+		return nil, nil
+	}
+	require.NoError(t, RegisterProxyServer("test-server", factory))
+	assert.Error(t, RegisterProxyServer("test-server", factory))
+	assert.Error(t, RegisterProxyServer("forward", factory))
+
+	_, err := CreateProxyServer(
+		zap.NewNop().Sugar(), ProxyConfig{Protocol: "test-server"})
+	assert.NoError(t, err)
+	_, err = CreateProxyClient(ProxyConfig{Protocol: "test-server"})
+	assert.EqualError(t, err, "'test-server' cannot be used as a proxy client")
+	_, err = CreateProxyClient(ProxyConfig{Protocol: "forward"})
+	assert.EqualError(t, err, "'forward' cannot be used as a proxy client")
+}
+
+func TestRegisterTransport(t *testing.T) {
+	factory := func(settings map[string]interface{}) (Transport, error) {
+		return fakeTransport{settings: settings}, nil
+	}
+	require.NoError(t, RegisterTransport("test-trans", factory))
+	assert.Error(t, RegisterTransport("test-trans", factory))
+	assert.Error(t, RegisterTransport("kcp", factory))
+
+	trans, err := CreateTransport(&TransportConfig{Custom: &CustomTransportConfig{
+		Name: "test-trans", Settings: map[string]interface{}{"a": 1}}})
+	require.NoError(t, err)
+	assert.Equal(t,
+		fakeTransport{settings: map[string]interface{}{"a": 1}}, trans)
+
+	trans, err = CreateTransport(&TransportConfig{
+		Custom:      &CustomTransportConfig{Name: "test-trans"},
+		Compression: "snappy",
+		Layers:      []string{"test-trans", "compression"},
+	})
+	require.NoError(t, err)
+	assert.IsType(t, &compTransWrapper{}, trans)
+
+	for _, config := range []*TransportConfig{
+		{Custom: &CustomTransportConfig{}},
+		{Custom: &CustomTransportConfig{Name: "test-unknown"}},
+		{Custom: &CustomTransportConfig{Name: "test-trans"},
+			TCP: &TCPConfig{}},
+		{Custom: &CustomTransportConfig{Name: "test-trans"},
+			ProxyProtocol: true},
+	} {
+		_, err = CreateTransport(config)
+		assert.Error(t, err)
+	}
+}
+
+func TestListProxyProtocols(t *testing.T) {
+	infos := make(map[string]ProtocolInfo)
+	for _, info := range ListProxyProtocols() {
+		infos[info.Name] = info
+	}
+	socks5 := infos["socks5"]
+	assert.True(t, socks5.Client && socks5.Server)
+	assert.Contains(t, socks5.ClientSettings,
+		SettingInfo{Name: "address", Type: "string", Required: true})
+	assert.Contains(t, socks5.ClientSettings,
+		SettingInfo{Name: "username", Type: "string"})
+	assert.NotContains(t, socks5.ClientSettings,
+		SettingInfo{Name: "check_users", Type: "bool"})
+	assert.Contains(t, socks5.ServerSettings,
+		SettingInfo{Name: "check_users", Type: "bool"})
+	assert.Contains(t, socks5.ServerSettings,
+		SettingInfo{Name: "accept_loops", Type: "int"})
+	assert.Equal(t, SettingInfo{"address", "string", true},
+		infos["http"].ClientSettings[0])
+	assert.True(t, infos["forward"].Server)
+	assert.False(t, infos["forward"].Client)
+	assert.Contains(t, infos["forward"].ServerSettings,
+		SettingInfo{Name: "sni_targets", Type: "map"})
+	assert.True(t, infos["direct"].Client)
+	assert.False(t, infos["direct"].Server)
+	assert.Contains(t, infos["direct"].ClientSettings,
+		SettingInfo{Name: "tfo", Type: "bool"})
+
+	factory := func(config ProxyConfig) (ProxyClient, error) {
+		return fakeProxyClient{config.Settings}, nil
+	}
+	require.NoError(t, RegisterProxyClient("test-described", factory))
+	settings := []SettingInfo{{"a", "int", true}}
+	assert.NoError(t, DescribeProxyClient("test-described", settings))
+	assert.Error(t, DescribeProxyClient("test-unregistered", settings))
+	assert.Error(t, DescribeProxyServer("test-described", settings))
+	for _, info := range ListProxyProtocols() {
+		if info.Name == "test-described" {
+			assert.Equal(t, settings, info.ClientSettings)
+		}
+	}
+
+	transports := ListTransports()
+	assert.Equal(t, TransportInfo{Name: "tcp"}, transports[0])
+}
@@ -2,20 +2,30 @@ package lib
 
 import (
 	"bytes"
+	"container/list"
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
 
-const defaultRuleName = "default"
+// DefaultRuleName is the name of the rule matching the requests that no other
+// rule matches.
+const DefaultRuleName = "default"
 
 // RuleMatcher match an address (IP or domain name) against a set of rules.
 type RuleMatcher struct {
 	domainMatcher   *domainMatcher
+	domainCache     *domainCache // nil if disabled
 	ipMatcher       *ipMatcher
+	clientRules     []*clientRule // ordered by name
 	ruleToUpstreams map[string][]string
+	ruleToGroups    map[string][][]string
 
 	AllUpstreams []string
 }
@@ -24,23 +34,46 @@ type RuleMatcher struct {
 func NewRuleMatcher(config map[string]RuleConfig) (*RuleMatcher, error) {
 	m := &RuleMatcher{}
 	m.ruleToUpstreams = make(map[string][]string)
+	m.ruleToGroups = make(map[string][][]string)
 	domainRules := make(map[string][]string)
 	ipRules := make(map[string][]string)
 
 	for name, c := range config {
-		if name == defaultRuleName {
-			if len(c.Domains) > 0 || len(c.IPs) > 0 {
+		hasClientCond := len(c.ClientIPs) > 0 || len(c.ClientUsers) > 0 ||
+			len(c.ClientAttrs) > 0
+		if name == DefaultRuleName {
+			if len(c.Domains) > 0 || len(c.IPs) > 0 || hasClientCond {
 				return nil, errors.Errorf(
 					"default rule '%s' should not have actual rules", name)
 			}
+		} else if hasClientCond {
+			cr, err := newClientRule(name, c)
+			if err != nil {
+				return nil, errors.WithMessage(
+					err, "invalid client conditions in rule "+name)
+			}
+			m.clientRules = append(m.clientRules, cr)
 		} else {
 			domainRules[name] = append([]string{}, c.Domains...)
 			ipRules[name] = append([]string{}, c.IPs...)
 		}
-		m.ruleToUpstreams[name] = append([]string{}, c.Upstreams...)
-		m.AllUpstreams = append(m.AllUpstreams, c.Upstreams...)
+		groups, err := upstreamGroupsOf(c)
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid upstreams in rule "+name)
+		}
+		m.ruleToGroups[name] = groups
+		upstreams := []string{} // kept even if empty, e.g. a denying default
+		for _, group := range groups {
+			upstreams = append(upstreams, group...)
+		}
+		m.ruleToUpstreams[name] = upstreams
+		m.AllUpstreams = append(m.AllUpstreams, m.ruleToUpstreams[name]...)
 	}
 
+	sort.Slice(m.clientRules, func(i, j int) bool {
+		return m.clientRules[i].name < m.clientRules[j].name
+	})
+
 	var err error
 	m.domainMatcher, err = newDomainMatcher(domainRules)
 	if err == nil {
@@ -49,16 +82,115 @@ func NewRuleMatcher(config map[string]RuleConfig) (*RuleMatcher, error) {
 	return m, err
 }
 
+func upstreamGroupsOf(c RuleConfig) ([][]string, error) {
+	if len(c.UpstreamGroups) == 0 {
+		if len(c.Upstreams) == 0 {
+			return nil, nil
+		}
+		return [][]string{append([]string{}, c.Upstreams...)}, nil
+	}
+	if len(c.Upstreams) > 0 {
+		return nil, errors.New(
+			"'upstreams' cannot be used along with 'upstream_groups'")
+	}
+	groups := make([][]string, len(c.UpstreamGroups))
+	for i, group := range c.UpstreamGroups {
+		if len(group) == 0 {
+			return nil, errors.Errorf("upstream group %d is empty", i)
+		}
+		groups[i] = append([]string{}, group...)
+	}
+	return groups, nil
+}
+
+// SetDomainCacheSize enables caching the results of matching the given number
+// of most recently used domain names, including the unmatched ones. It should
+// be called before the matcher is used.
+func (m *RuleMatcher) SetDomainCacheSize(size int) {
+	if size > 0 {
+		m.domainCache = newDomainCache(size)
+	} else {
+		m.domainCache = nil
+	}
+}
+
+// UpstreamGroups returns the upstream groups of a rule in the order they
+// should be tried. A rule with plain upstreams has only one group.
+func (m *RuleMatcher) UpstreamGroups(rule string) [][]string {
+	return m.ruleToGroups[rule]
+}
+
+// ClientInfo describes the client sending a request.
+type ClientInfo struct {
+	Addr string // in host:port form
+	IDs  []*PeerIdentifier
+}
+
+// MatchRequest returns the matching rule and associated upstreams of a request
+// to the given target from the given client. Rules with client conditions are
+// considered first.
+func (m *RuleMatcher) MatchRequest(
+	target Address, client ClientInfo) (string, []string) {
+	for _, cr := range m.clientRules {
+		if cr.MatchClient(client) && cr.MatchTarget(target) {
+			return cr.name, m.ruleToUpstreams[cr.name]
+		}
+	}
+	switch addr := target.(type) {
+	case *TCP4Addr:
+		return m.MatchIP(addr.IP)
+	case *TCP6Addr:
+		return m.MatchIP(addr.IP)
+	case *DomainNameAddr:
+		return m.MatchDomain(addr.DomainName)
+	default:
+		return m.matchDefault()
+	}
+}
+
+// Route decides the upstreams of a request like MatchRequest, but with the
+// defaults applied. It returns the name of the matching rule and the upstream
+// groups to try, which are empty if the request should be rejected. The name
+// is empty if no rule matches. dsDefaults is used if it is not empty and no
+// explicit rule matches, replacing the upstreams of the default rule unless
+// it rejects the request, while the other settings of that rule still apply.
+// unmatched is used if neither of them applies.
+func (m *RuleMatcher) Route(target Address, client ClientInfo,
+	dsDefaults []string, unmatched []string) (string, [][]string) {
+	ruleName, upstreams := m.MatchRequest(target, client)
+	if ruleName == "" {
+		if len(dsDefaults) > 0 {
+			return "", [][]string{dsDefaults}
+		} else if len(unmatched) == 0 {
+			return "", nil
+		}
+		return "", [][]string{unmatched}
+	} else if len(upstreams) == 0 {
+		return ruleName, nil
+	} else if ruleName == DefaultRuleName && len(dsDefaults) > 0 {
+		return ruleName, [][]string{dsDefaults}
+	}
+	return ruleName, m.UpstreamGroups(ruleName)
+}
+
 // MatchDomain returns the matching rule and associated upstreams of a domain.
 func (m *RuleMatcher) MatchDomain(domain string) (string, []string) {
-	rule, matched := m.domainMatcher.Match(domain)
+	var rule string
+	var matched bool
+	if m.domainCache == nil {
+		rule, matched = m.domainMatcher.Match(domain)
+	} else {
+		key := strings.ToLower(domain) // the patterns are case insensitive
+		var cached bool
+		if rule, matched, cached = m.domainCache.Get(key); !cached {
+			rule, matched = m.domainMatcher.Match(domain)
+			m.domainCache.Put(key, rule, matched)
+		}
+	}
 	if matched { // match
 		return rule, m.ruleToUpstreams[rule]
-	} else if ups, ok := m.ruleToUpstreams[defaultRuleName]; ok { // has default
-		return defaultRuleName, ups
-	} else { // no default
-		return "", nil
 	}
+	return m.matchDefault()
 }
 
 // MatchIP returns the matching rule and associated upstreams of an IP.
@@ -66,11 +198,141 @@ func (m *RuleMatcher) MatchIP(ip net.IP) (string, []string) {
 	rule, matched := m.ipMatcher.Match(ip)
 	if matched { // match
 		return rule, m.ruleToUpstreams[rule]
-	} else if ups, ok := m.ruleToUpstreams[defaultRuleName]; ok { // has default
-		return defaultRuleName, ups
-	} else { // no default
-		return "", nil
 	}
+	return m.matchDefault()
+}
+
+func (m *RuleMatcher) matchDefault() (string, []string) {
+	if ups, ok := m.ruleToUpstreams[DefaultRuleName]; ok { // has default
+		return DefaultRuleName, ups
+	}
+	return "", nil // no default
+}
+
+// clientRule is a rule that only applies to some clients.
+type clientRule struct {
+	name          string
+	clientIPs     *ipMatcher // nil if there is no condition on client IPs
+	clientUsers   []string
+	clientAttrs   map[string]string
+	domainMatcher *domainMatcher
+	ipMatcher     *ipMatcher
+	anyTarget     bool
+}
+
+func newClientRule(name string, c RuleConfig) (*clientRule, error) {
+	r := &clientRule{
+		name:        name,
+		clientUsers: append([]string{}, c.ClientUsers...),
+		clientAttrs: c.ClientAttrs,
+		anyTarget:   len(c.Domains) == 0 && len(c.IPs) == 0,
+	}
+	var err error
+	if len(c.ClientIPs) > 0 {
+		r.clientIPs, err = newIPMatcher(map[string][]string{name: c.ClientIPs})
+	}
+	if err == nil {
+		r.domainMatcher, err = newDomainMatcher(
+			map[string][]string{name: c.Domains})
+	}
+	if err == nil {
+		r.ipMatcher, err = newIPMatcher(map[string][]string{name: c.IPs})
+	}
+	return r, err
+}
+
+func (r *clientRule) MatchClient(client ClientInfo) bool {
+	if r.clientIPs != nil {
+		host, _, err := net.SplitHostPort(client.Addr)
+		if err != nil {
+			host = client.Addr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		if _, matched := r.clientIPs.Match(ip); !matched {
+			return false
+		}
+	}
+	if len(r.clientAttrs) > 0 {
+		matched := false
+		for _, id := range client.IDs {
+			if matched = matchClientAttrs(r.clientAttrs, id); matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.clientUsers) > 0 {
+		for _, user := range r.clientUsers {
+			for _, id := range client.IDs {
+				if matchClientUser(user, id) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *clientRule) MatchTarget(target Address) bool {
+	if r.anyTarget {
+		return true
+	}
+	var matched bool
+	switch addr := target.(type) {
+	case *TCP4Addr:
+		_, matched = r.ipMatcher.Match(addr.IP)
+	case *TCP6Addr:
+		_, matched = r.ipMatcher.Match(addr.IP)
+	case *DomainNameAddr:
+		_, matched = r.domainMatcher.Match(addr.DomainName)
+	}
+	return matched
+}
+
+func matchClientUser(user string, id *PeerIdentifier) bool {
+	if id == nil {
+		return false
+	}
+	if idx := strings.IndexByte(user, '/'); idx >= 0 {
+		return user[:idx] == id.Scope && user[idx+1:] == id.Name
+	}
+	return user == id.Name
+}
+
+// matchClientAttrs tells whether all the attributes are found in the
+// ExtraInfo of the identifier, either equal to the value or, for a list,
+// containing it.
+func matchClientAttrs(attrs map[string]string, id *PeerIdentifier) bool {
+	if id == nil {
+		return false
+	}
+	for k, v := range attrs {
+		switch info := id.ExtraInfo[k].(type) {
+		case string:
+			if info != v {
+				return false
+			}
+		case []string:
+			found := false
+			for _, s := range info {
+				if found = s == v; found {
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 type domainMatcher struct {
@@ -81,7 +343,11 @@ type domainMatcher struct {
 func newDomainMatcher(rules map[string][]string) (*domainMatcher, error) {
 	m := &domainMatcher{}
 
-	if len(rules) == 0 {
+	hasPatterns := false
+	for _, patterns := range rules {
+		hasPatterns = hasPatterns || len(patterns) > 0
+	}
+	if !hasPatterns {
 		m.pattern = regexp.MustCompile("^$")
 		return m, nil
 	}
@@ -91,6 +357,10 @@ func newDomainMatcher(rules map[string][]string) (*domainMatcher, error) {
 		if len(patterns) > 0 {
 			fmt.Fprintf(buf, "(?P<%s>", name)
 			for _, pattern := range patterns {
+				pattern, err := normalizeDomainPattern(pattern)
+				if err != nil {
+					return nil, err
+				}
 				fmt.Fprintf(buf, "(^%s$)|", pattern)
 			}
 			buf.Truncate(buf.Len() - 1)
@@ -113,7 +383,49 @@ func newDomainMatcher(rules map[string][]string) (*domainMatcher, error) {
 	return m, nil
 }
 
+// normalizeDomainPattern converts the international labels in a domain
+// pattern into punycode as NormalizeDomainName does, so that they match the
+// normalized domain names. Such labels, separated by escaped dots, must be
+// literal, though unescaped dots are tolerated.
+func normalizeDomainPattern(pattern string) (string, error) {
+	if isASCII(pattern) {
+		return pattern, nil
+	}
+	labels := strings.Split(pattern, `\.`)
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		literal := strings.Replace(label, ".", "", -1)
+		if regexp.QuoteMeta(literal) != literal {
+			return "", errors.Errorf(
+				"international label in domain pattern is not literal: %s",
+				label)
+		}
+		normalized, err := NormalizeDomainName(label, 255)
+		if err != nil {
+			return "", errors.WithMessage(err, "invalid domain pattern")
+		}
+		labels[i] = normalized
+	}
+	return strings.Join(labels, `\.`), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 func (m *domainMatcher) Match(domain string) (string, bool) {
+	if !isASCII(domain) { // the patterns are in punycode
+		if normalized, err := NormalizeDomainName(domain, 255); err == nil {
+			domain = normalized
+		}
+	}
 	matches := m.pattern.FindStringSubmatchIndex(domain)
 	if matches == nil {
 		return "", false
@@ -160,3 +472,48 @@ func (m *ipMatcher) Match(ip net.IP) (string, bool) {
 	rule, valid := m.brt.FindPrefix(query).(string)
 	return rule, valid
 }
+
+// domainCache is a concurrency-safe LRU cache of domain matching results.
+type domainCache struct {
+	size    int
+	entries map[string]*list.Element
+	lru     list.List // of *domainCacheEntry, most recently used first
+	mtx     sync.Mutex
+}
+
+type domainCacheEntry struct {
+	domain  string
+	rule    string
+	matched bool
+}
+
+func newDomainCache(size int) *domainCache {
+	return &domainCache{size: size, entries: make(map[string]*list.Element)}
+}
+
+func (c *domainCache) Get(domain string) (rule string, matched, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.entries[domain]; ok {
+		c.lru.MoveToFront(elem)
+		entry := elem.Value.(*domainCacheEntry)
+		return entry.rule, entry.matched, true
+	}
+	return "", false, false
+}
+
+func (c *domainCache) Put(domain, rule string, matched bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.entries[domain]; ok { // added by another goroutine
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[domain] = c.lru.PushFront(
+		&domainCacheEntry{domain, rule, matched})
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*domainCacheEntry).domain)
+	}
+}
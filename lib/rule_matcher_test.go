@@ -2,6 +2,7 @@ package lib
 
 import (
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -87,6 +88,35 @@ func TestDomainMatcher(t *testing.T) {
 	}
 }
 
+func TestDomainMatcherIDN(t *testing.T) {
+	m, err := newDomainMatcher(map[string][]string{
+		"unicode":  {`.*\.Bücher\.example`, `例子.测试`},
+		"punycode": {`xn--mnchen-3ya\.example`},
+	})
+	require.NoError(t, err)
+	for query, expected := range map[string]string{
+		"www.xn--bcher-kva.example": "unicode",
+		"www.bücher.example":        "unicode",
+		"WWW.BÜCHER.EXAMPLE":        "unicode",
+		"xn--fsqu00a.xn--0zwm56d":   "unicode",
+		"例子。测试":                     "unicode",
+		"münchen.example":           "punycode",
+		"xn--mnchen-3ya.example":    "punycode",
+		"mu\u0308nchen.example":     "punycode",
+		"bucher.example":            "",
+		"m\u00fcnchen.example.com":  "",
+	} {
+		rule, matched := m.Match(query)
+		assert.Equal(t, expected != "", matched, query)
+		assert.Equal(t, expected, rule, query)
+	}
+
+	for _, pattern := range []string{`Bü.*\.example`, `例 子\.com`} {
+		_, err = newDomainMatcher(map[string][]string{"r": {pattern}})
+		assert.Error(t, err, pattern)
+	}
+}
+
 func TestIPMatcher(t *testing.T) {
 	m, err := newIPMatcher(ipRules)
 	require.NoError(t, err)
@@ -141,3 +171,158 @@ func TestRuleMatcher(t *testing.T) {
 			"%s mismatch, expected %s got %s(%v)", q[0], exp, name, upstreams)
 	}
 }
+
+func TestRuleMatcherDomainCache(t *testing.T) {
+	m, err := NewRuleMatcher(config)
+	require.NoError(t, err)
+	m.SetDomainCacheSize(2)
+
+	for i := 0; i < 2; i++ { // the second round hits or refills the cache
+		for _, q := range domainQueries {
+			name, _ := m.MatchDomain(q[0])
+			if q[1] == "" {
+				assert.Equal(t, "default", name, q[0])
+			} else {
+				assert.Equal(t, q[1], name, q[0])
+			}
+		}
+	}
+	assert.Equal(t, 2, m.domainCache.lru.Len())
+	assert.Len(t, m.domainCache.entries, 2)
+
+	last := domainQueries[len(domainQueries)-1]
+	_, _, ok := m.domainCache.Get(strings.ToUpper(last[0]))
+	assert.False(t, ok, "the keys should be lower case")
+	rule, _, ok := m.domainCache.Get(strings.ToLower(last[0]))
+	assert.True(t, ok)
+	assert.Equal(t, last[1], rule)
+}
+
+func TestRuleMatcherClientRules(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"alice": {
+			Upstreams:   []string{"aliceUps"},
+			Domains:     []string{`.*\.example\.com`},
+			ClientUsers: []string{"alice"},
+		},
+		"lan": {
+			Upstreams: []string{"lanUps"},
+			ClientIPs: []string{"192.168.0.0/16"},
+		},
+		"bob_lan": {
+			Upstreams:   []string{"bob_lanUps"},
+			IPs:         []string{"10.0.0.0/8"},
+			ClientIPs:   []string{"192.168.1.0/24"},
+			ClientUsers: []string{"proxy.socks5/bob"},
+		},
+		"r1":      {Upstreams: []string{"r1Ups"}, IPs: []string{"10.0.0.0/8"}},
+		"default": {Upstreams: []string{"defaultUps"}},
+	})
+	require.NoError(t, err)
+
+	alice := []*PeerIdentifier{{Scope: "proxy.socks5", Name: "alice"}}
+	bob := []*PeerIdentifier{{Scope: "proxy.socks5", Name: "bob"}}
+	otherBob := []*PeerIdentifier{{Scope: "other", Name: "bob"}}
+	domain := &DomainNameAddr{DomainName: "www.example.com", Port: 80}
+	ip := &TCP4Addr{IP: net.ParseIP("10.1.2.3"), Port: 80}
+	queries := []struct {
+		target Address
+		client ClientInfo
+		rule   string
+	}{
+		{domain, ClientInfo{"1.2.3.4:1234", alice}, "alice"},
+		{domain, ClientInfo{"1.2.3.4:1234", bob}, "default"},
+		{domain, ClientInfo{"192.168.0.1:1234", alice}, "alice"},
+		{domain, ClientInfo{"192.168.0.1:1234", bob}, "lan"},
+		{ip, ClientInfo{"192.168.1.1:1234", bob}, "bob_lan"},
+		{ip, ClientInfo{"192.168.1.1:1234", otherBob}, "lan"},
+		{ip, ClientInfo{"192.168.2.1:1234", bob}, "lan"},
+		{ip, ClientInfo{"1.2.3.4:1234", bob}, "r1"},
+		{ip, ClientInfo{"invalid", nil}, "r1"},
+	}
+	for _, q := range queries {
+		rule, upstreams := m.MatchRequest(q.target, q.client)
+		assert.Equal(t, q.rule, rule, "%s from %v", q.target, q.client)
+		assert.Equal(t, []string{q.rule + "Ups"}, upstreams)
+	}
+
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"default": {ClientIPs: []string{"127.0.0.1"}},
+	})
+	assert.Error(t, err)
+	_, err = NewRuleMatcher(map[string]RuleConfig{
+		"r": {ClientIPs: []string{"not an ip"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestRuleMatcherClientAttrs(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"ops": {
+			Upstreams:   []string{"opsUps"},
+			ClientAttrs: map[string]string{"organizationalUnits": "ops"},
+		},
+		"bob": {
+			Upstreams:   []string{"bobUps"},
+			ClientUsers: []string{"bob"},
+			ClientAttrs: map[string]string{
+				"organizations": "Example", "issuedBy": "CA"},
+		},
+		"default": {Upstreams: []string{"defaultUps"}},
+	})
+	require.NoError(t, err)
+
+	id := func(name string, info map[string]interface{}) *PeerIdentifier {
+		return &PeerIdentifier{
+			Scope: "transport.tls", Name: name, ExtraInfo: info}
+	}
+	target := &DomainNameAddr{DomainName: "www.example.com", Port: 80}
+	for _, c := range []struct {
+		ids  []*PeerIdentifier
+		rule string
+	}{
+		{[]*PeerIdentifier{id("alice", map[string]interface{}{
+			"organizationalUnits": []string{"dev", "ops"}})}, "ops"},
+		{[]*PeerIdentifier{id("alice", map[string]interface{}{
+			"organizationalUnits": []string{"dev"}})}, "default"},
+		{[]*PeerIdentifier{id("alice", map[string]interface{}{
+			"organizationalUnits": "ops"})}, "ops"},
+		{[]*PeerIdentifier{{Name: "bob"}, id("bob", map[string]interface{}{
+			"organizations": []string{"Example"}, "issuedBy": "CA"})}, "bob"},
+		{[]*PeerIdentifier{id("bob", map[string]interface{}{
+			"organizations": []string{"Example"}})}, "default"},
+		{[]*PeerIdentifier{id("carol", map[string]interface{}{
+			"organizations": []string{"Example"}, "issuedBy": "CA"})},
+			"default"},
+		{nil, "default"},
+	} {
+		rule, _ := m.MatchRequest(target, ClientInfo{IDs: c.ids})
+		assert.Equal(t, c.rule, rule, "%v", c.ids)
+	}
+}
+
+func TestRuleMatcherUpstreamGroups(t *testing.T) {
+	m, err := NewRuleMatcher(map[string]RuleConfig{
+		"tiered": {
+			Domains:        []string{`(.*\.)?example\.com`},
+			UpstreamGroups: [][]string{{"a1", "a2"}, {"b"}},
+		},
+		"default": {Upstreams: []string{"d"}},
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a1", "a2", "b", "d"}, m.AllUpstreams)
+
+	rule, upstreams := m.MatchDomain("www.example.com")
+	assert.Equal(t, "tiered", rule)
+	assert.Equal(t, []string{"a1", "a2", "b"}, upstreams)
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"b"}}, m.UpstreamGroups(rule))
+	rule, _ = m.MatchDomain("other.org")
+	assert.Equal(t, [][]string{{"d"}}, m.UpstreamGroups(rule))
+
+	_, err = NewRuleMatcher(map[string]RuleConfig{"r": {
+		Upstreams: []string{"a"}, UpstreamGroups: [][]string{{"b"}}}})
+	assert.Error(t, err)
+	_, err = NewRuleMatcher(map[string]RuleConfig{"r": {
+		UpstreamGroups: [][]string{{"a"}, {}}}})
+	assert.Error(t, err)
+}
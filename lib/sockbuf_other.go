@@ -0,0 +1,8 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lib
+
+import "net"
+
+// getSockBufs is not supported on this platform.
+var getSockBufs func(conn *net.TCPConn) (recvBuf, sendBuf int, err error)
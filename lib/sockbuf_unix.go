@@ -0,0 +1,31 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// getSockBufs returns the actual socket buffer sizes of a TCP connection.
+// Note that Linux reports twice the sizes set, for the bookkeeping overhead.
+var getSockBufs = func(conn *net.TCPConn) (recvBuf, sendBuf int, err error) {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = c.Control(func(fd uintptr) {
+		recvBuf, sockErr = unix.GetsockoptInt(
+			int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		if sockErr == nil {
+			sendBuf, sockErr = unix.GetsockoptInt(
+				int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return
+}
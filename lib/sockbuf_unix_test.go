@@ -0,0 +1,50 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package lib
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPTransportSockBufs(t *testing.T) {
+	trans, err := CreateTransport(&TransportConfig{
+		TCP: &TCPConfig{RecvBuf: "96KiB", SendBuf: "80KiB"}})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	cli, err := trans.Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer cli.Close() // nolint: errcheck
+	svr := <-accepted
+	require.NotNil(t, svr)
+	defer svr.Close() // nolint: errcheck
+
+	for _, conn := range []net.Conn{cli, svr} {
+		recvBuf, sendBuf, err := getSockBufs(conn.(*net.TCPConn))
+		require.NoError(t, err)
+		assert.True(t, recvBuf >= 96*1024, "so_rcvbuf: %d", recvBuf)
+		assert.True(t, sendBuf >= 80*1024, "so_sndbuf: %d", sendBuf)
+	}
+
+	for _, config := range []*TCPConfig{
+		{RecvBuf: "0"}, {SendBuf: "-1"}, {RecvBuf: "4GiB"}} {
+		_, err = CreateTransport(&TransportConfig{TCP: config})
+		assert.Error(t, err, "%+v", config)
+	}
+	_, err = CreateTransport(&TransportConfig{
+		TCP: &TCPConfig{}, KCP: gKCPClientConfig})
+	assert.Error(t, err)
+}
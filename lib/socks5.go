@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,49 +26,109 @@ const (
 type CheckUserFunc func(user, password string) bool
 
 // SOCKS5Server is a proxy server on SOCKS5 protocol.
+//
+// If hintDelim is set, a username like "user+hint" (with "+" as the
+// delimiter) is authenticated as "user", and "hint" is taken as the name of
+// the upstream that the client prefers.
+//
+// As SOCKS5 cannot tell the clients when to retry, the rejections due to
+// overloading are delayed by overloadDelay to slow down the retries.
+//
+// probeResist decides what to do with the clients not speaking SOCKS, which
+// are probably scanners: "" to close the connection, "hold" to hold it
+// silently for a random delay, or "decoy" to relay it to decoyAddr.
+//
+// The target domain names are normalized by NormalizeDomainName, and those
+// invalid or longer than maxDomainLen are rejected.
+//
+// If fakeBoundAddr is set, it is reported to the clients as the bound
+// address in place of the real one of the upstream connection.
+//
+// If pskGate is set, the clients must send a valid PSK token before the
+// hello, or they are handled like the probes.
+//
+// The users are authenticated in the given scope of the user database, which
+// is also the scope of their peer identifiers.
+//
+// Each listener is served by acceptLoops goroutines, for the high connection
+// rates which a single one cannot keep up with.
 type SOCKS5Server struct {
-	transport  Transport
-	addr       string
-	checkUser  CheckUserFunc
-	simplified bool
-	isRunning  uint32 // should be used with atomic operations
-	listener   net.Listener
-	reqCh      chan ProxyRequest
-	log        *zap.SugaredLogger
-	hsTimeout  time.Duration
-}
-
-func parseSOCKS5Config(config ProxyConfig) (
-	address string, simplified bool, hsTimeout time.Duration, err error) {
+	transport     Transport
+	addr          string
+	checkUser     CheckUserFunc
+	hintDelim     string
+	simplified    bool
+	isRunning     uint32 // should be used with atomic operations
+	listeners     []net.Listener
+	reqCh         chan ProxyRequest
+	log           *zap.SugaredLogger
+	hsTimeout     time.Duration
+	overloadDelay time.Duration
+	probeResist   string
+	decoyAddr     string
+	maxDomainLen  int
+	fakeBoundAddr Address
+	pskGate       *socksPSKGate
+	scope         string
+	acceptLoops   int
+}
+
+// socks5Settings are the settings shared by SOCKS5 servers and clients.
+type socks5Settings struct {
+	Address          string `yaml:"address"`
+	Simplified       bool   `yaml:"simplified"`
+	HandshakeTimeout string `yaml:"handshake_timeout"`
+	PSK              string `yaml:"psk"` // sends a token before the hello
+}
+
+func (s *socks5Settings) shared() *socks5Settings {
+	return s
+}
+
+// socks5ServerSettings are the settings of a SOCKS5 server. The optional
+// ones are pointers, so that invalid empty values can be told from absence.
+type socks5ServerSettings struct {
+	socks5Settings        `yaml:",inline"`
+	CheckUsers            bool    `yaml:"check_users"`
+	UpstreamHintDelimiter *string `yaml:"upstream_hint_delimiter"`
+	OverloadRejectDelay   *string `yaml:"overload_reject_delay"`
+	ProbeResist           *string `yaml:"probe_resist"`
+	MaxDomainLength       *int    `yaml:"max_domain_length"`
+	ReplyBoundAddr        *string `yaml:"reply_bound_addr"`
+	Scope                 *string `yaml:"scope"`
+	AcceptLoops           *int    `yaml:"accept_loops"`
+}
+
+// socks5ClientSettings are the settings of a SOCKS5 client.
+type socks5ClientSettings struct {
+	socks5Settings `yaml:",inline"`
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+}
+
+// parseSOCKS5Config decodes the settings into out, which embeds
+// socks5Settings, and validates the shared ones.
+func parseSOCKS5Config(
+	config ProxyConfig, out interface{ shared() *socks5Settings }) (
+	hsTimeout time.Duration, err error) {
 	if config.Protocol != "socks5" {
 		panic("protocol should be 'socks5' rather than: " + config.Protocol)
 	}
+	if err = config.DecodeSettings(out); err != nil {
+		return
+	}
 
-	var ok bool
-	for k, v := range config.Settings {
-		switch k {
-		case "address":
-			if address, ok = v.(string); !ok {
-				err = errors.Errorf("invalid value for 'address': %v", v)
-			}
-		case "simplified":
-			if simplified, ok = v.(bool); !ok {
-				err = errors.Errorf("invalid value for 'simplified': %v", v)
-			}
-		case "handshake_timeout":
-			s, ok := v.(string)
-			if !ok {
-				err = errors.New("invalid value for 'handshake_timeout'")
-			} else if hsTimeout, err = time.ParseDuration(s); err != nil {
-				err = errors.Wrap(err, "invalid value for 'handshake_timeout'")
-			} else if hsTimeout <= 0 {
-				err = errors.New("'handshake_timeout' must be > 0")
-			}
+	settings := out.shared()
+	if settings.HandshakeTimeout != "" {
+		if hsTimeout, err = time.ParseDuration(
+			settings.HandshakeTimeout); err != nil {
+			return 0, errors.Wrap(err, "invalid value for 'handshake_timeout'")
+		} else if hsTimeout <= 0 {
+			return 0, errors.New("'handshake_timeout' must be > 0")
 		}
 	}
-
-	if address == "" {
-		err = errors.New(
+	if settings.Address == "" {
+		return 0, errors.New(
 			"a valid 'address' must be specified for socks5 protocol")
 	}
 	if hsTimeout == 0 {
@@ -77,17 +141,80 @@ func parseSOCKS5Config(config ProxyConfig) (
 func NewSOCKS5Server(
 	logger *zap.SugaredLogger,
 	config ProxyConfig) (*SOCKS5Server, error) {
-	address, simplified, hsTimeout, err := parseSOCKS5Config(config)
+	var settings socks5ServerSettings
+	hsTimeout, err := parseSOCKS5Config(config, &settings)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 server")
 	}
 
-	checkUser := false
-	if c, ok := config.Settings["check_users"]; ok {
-		if checkUser, ok = c.(bool); !ok {
-			return nil, errors.New("invalid value for 'check_users'")
-		} else if checkUser && !db.Inited {
-			return nil, errors.New("user checking requires a database specified")
+	checkUser := settings.CheckUsers
+	if checkUser && !db.Inited {
+		return nil, errors.New("user checking requires a database specified")
+	}
+
+	var hintDelim string
+	if d := settings.UpstreamHintDelimiter; d != nil {
+		if hintDelim = *d; hintDelim == "" {
+			return nil, errors.New(
+				"invalid value for 'upstream_hint_delimiter'")
+		} else if !checkUser {
+			return nil, errors.New(
+				"'upstream_hint_delimiter' requires 'check_users'")
+		}
+	}
+
+	var overloadDelay time.Duration
+	if d := settings.OverloadRejectDelay; d != nil {
+		if overloadDelay, err = time.ParseDuration(*d); err != nil {
+			return nil, errors.Wrap(
+				err, "invalid value for 'overload_reject_delay'")
+		} else if overloadDelay < 0 {
+			return nil, errors.New("'overload_reject_delay' must be >= 0")
+		}
+	}
+
+	var probeResist, decoyAddr string
+	if p := settings.ProbeResist; p != nil {
+		switch fields := strings.Fields(*p); {
+		case len(fields) == 1 && fields[0] == "close":
+		case len(fields) == 1 && fields[0] == "hold":
+			probeResist = "hold"
+		case len(fields) == 2 && fields[0] == "decoy":
+			probeResist, decoyAddr = "decoy", fields[1]
+		default:
+			return nil, errors.New("invalid value for 'probe_resist'")
+		}
+	}
+
+	maxDomainLen := DefaultMaxDomainNameLen
+	if m := settings.MaxDomainLength; m != nil {
+		if maxDomainLen = *m; maxDomainLen <= 0 || maxDomainLen > 255 {
+			return nil, errors.New("invalid value for 'max_domain_length'")
+		}
+	}
+
+	scope := socks5Scope
+	if sc := settings.Scope; sc != nil {
+		if scope = *sc; scope == "" || strings.Contains(scope, "/") {
+			return nil, errors.New("invalid value for 'scope'")
+		} else if !checkUser {
+			return nil, errors.New("'scope' requires 'check_users'")
+		}
+	}
+
+	acceptLoops := 1
+	if n := settings.AcceptLoops; n != nil {
+		if acceptLoops = *n; acceptLoops <= 0 {
+			return nil, errors.New("invalid value for 'accept_loops'")
+		}
+	}
+
+	var fakeBoundAddr Address
+	if b := settings.ReplyBoundAddr; b != nil && *b == "zero" {
+		fakeBoundAddr = &TCP4Addr{IP: net.IPv4zero.To4()}
+	} else if b != nil {
+		if fakeBoundAddr, err = ParseAddress(*b); err != nil {
+			return nil, errors.New("invalid value for 'reply_bound_addr'")
 		}
 	}
 
@@ -104,12 +231,26 @@ func NewSOCKS5Server(
 				return false
 			} else { // nolint: golint
 				defer dao.Close() // nolint: errcheck
-				return dao.CheckPassword(socks5Scope, user, password)
+				return dao.CheckPassword(scope, user, password)
 			}
 		}
 	}
-	return newSOCKS5Server(
-		logger, transport, address, simplified, checkUserFunc, hsTimeout)
+	server, err := newSOCKS5Server(
+		logger, transport, settings.Address, settings.Simplified,
+		checkUserFunc, hsTimeout)
+	if err == nil {
+		server.hintDelim = hintDelim
+		server.overloadDelay = overloadDelay
+		server.probeResist, server.decoyAddr = probeResist, decoyAddr
+		server.maxDomainLen = maxDomainLen
+		server.fakeBoundAddr = fakeBoundAddr
+		server.scope = scope
+		server.acceptLoops = acceptLoops
+		if settings.PSK != "" {
+			server.pskGate = newSOCKSPSKGate(settings.PSK)
+		}
+	}
+	return server, err
 }
 
 // newSOCKS5Server creates a SOCKS5Server. It is used internally.
@@ -122,60 +263,85 @@ func newSOCKS5Server(
 			"simplified SOCKS5 does not support authentication")
 	}
 	return &SOCKS5Server{
-		transport:  transport,
-		addr:       addr,
-		simplified: simplified,
-		checkUser:  checkUser,
-		log:        logger,
-		hsTimeout:  hsTimeout,
+		transport:    transport,
+		addr:         addr,
+		simplified:   simplified,
+		checkUser:    checkUser,
+		log:          logger,
+		hsTimeout:    hsTimeout,
+		maxDomainLen: DefaultMaxDomainNameLen,
+		scope:        socks5Scope,
+		acceptLoops:  1,
 	}, nil
 }
 
 // Start fires up the SOCKS5Server and returns a channel of client requests.
+// If the address contains a port range, all the ports in it are listened on
+// and the accepted connections are sent to the same channel.
 func (s *SOCKS5Server) Start() (<-chan ProxyRequest, error) {
-	s.reqCh = make(chan ProxyRequest, 1)
+	s.reqCh = make(chan ProxyRequest, s.acceptLoops)
 
 	var err error
-	if s.listener, err = s.transport.Listen(s.addr); err != nil {
+	if s.listeners, err = ListenAll(s.transport, s.addr); err != nil {
 		s.log.Errorw(
 			"failed to start SOCKS5 server", "addr", s.addr, "error", err)
 		return nil, errors.WithMessage(err, "failed to start SOCKS5 server")
 	}
 	s.log.Infow(
-		"SOCKS5 server started", "addr", s.addr, "simplified", s.simplified)
+		"SOCKS5 server started", "addr", s.addr, "simplified", s.simplified,
+		"acceptLoops", s.acceptLoops)
 
 	atomic.StoreUint32(&s.isRunning, 1)
-	go func() {
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil {
-				if atomic.LoadUint32(&s.isRunning) > 0 { // still running
-					s.log.Warnw("accept error", "error", err)
-				}
-				break
-			}
+	for _, l := range s.listeners {
+		go s.serve(l)
+	}
 
-			reqID := GetNextRequestID()
-			cliLogger := s.log.With("reqID", reqID).Named("client")
-			cliLogger.Debugw(
-				"client connection accepted", "addr", conn.RemoteAddr())
-			req := &socks5Request{id: reqID, conn: conn, log: cliLogger}
+	return s.reqCh, nil
+}
 
-			go s.handshake(req)
+func (s *SOCKS5Server) serve(listener net.Listener) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.acceptLoops; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(listener)
+		}()
+	}
+	wg.Wait()
+	s.log.Infow("SOCKS5 server exited", "addr", listener.Addr())
+}
+
+func (s *SOCKS5Server) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if atomic.LoadUint32(&s.isRunning) > 0 { // still running
+				s.log.Warnw("accept error", "error", err)
+			}
+			break
 		}
-		s.log.Infow("SOCKS5 server exited")
-	}()
 
-	return s.reqCh, nil
+		reqID := GetNextRequestID()
+		cliLogger := s.log.With("reqID", reqID).Named("client")
+		cliLogger.Debugw(
+			"client connection accepted", "addr", conn.RemoteAddr())
+		req := &socks5Request{id: reqID, conn: conn, log: cliLogger,
+			scope: s.scope, overloadDelay: s.overloadDelay,
+			fakeBoundAddr: s.fakeBoundAddr}
+
+		go s.handshake(req)
+	}
 }
 
 // Stop kill the server.
 func (s *SOCKS5Server) Stop() {
 	s.log.Infow("stopping SOCKS5 server")
 	atomic.StoreUint32(&s.isRunning, 0)
-	err := s.listener.Close()
-	if err != nil {
-		s.log.Warnw("error occurred when closing listener", "error", err)
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			s.log.Warnw("error occurred when closing listener", "error", err)
+		}
 	}
 }
 
@@ -183,10 +349,22 @@ func (s *SOCKS5Server) handshake(cli *socks5Request) {
 	_ = cli.conn.SetDeadline(time.Now().Add(s.hsTimeout))
 	defer cli.conn.SetDeadline(time.Time{}) // nolint: errcheck
 	var err error
+	if s.pskGate != nil {
+		if received, err := s.pskGate.check(cli.conn); err != nil {
+			s.resistProbe(cli, received, err)
+			return
+		}
+	}
 	if !s.simplified {
 		// authenticate
 		helloPkt := &socksHello{}
-		err = helloPkt.ReadPacket(cli.conn)
+		received := new(bytes.Buffer)
+		err = helloPkt.ReadPacket(io.TeeReader(cli.conn, received))
+		if b := received.Bytes(); err != nil && s.probeResist != "" &&
+			len(b) > 0 && b[0] != 0x05 && b[0] != 0x04 {
+			s.resistProbe(cli, b, err)
+			return
+		}
 		if err == nil {
 			if s.checkUser != nil {
 				if bytes.IndexByte(helloPkt.Methods, socksUserPass) >= 0 {
@@ -211,6 +389,15 @@ func (s *SOCKS5Server) handshake(cli *socks5Request) {
 	if err == nil {
 		err = reqPkt.ReadPacket(cli.conn)
 	}
+	if a, ok := reqPkt.Addr.(*DomainNameAddr); ok && err == nil {
+		var name string
+		if name, err = NormalizeDomainName(
+			a.DomainName, s.maxDomainLen); err == nil {
+			a.DomainName = name
+		} else {
+			err = addrError{err}
+		}
+	}
 
 	if err == nil {
 		if reqPkt.Type == socksConnect {
@@ -244,6 +431,46 @@ func (s *SOCKS5Server) handshake(cli *socks5Request) {
 	}
 }
 
+// resistProbe handles a client sending a malformed hello or PSK token,
+// which has been received, according to the probeResist mode.
+func (s *SOCKS5Server) resistProbe(
+	cli *socks5Request, received []byte, err error) {
+	cli.log.Warnw(
+		"malformed SOCKS5 handshake, resisting probe", "error", err,
+		"clientAddr", cli.PeerAddr(), "mode", s.probeResist)
+	defer cli.conn.Close() // nolint: errcheck
+
+	// both are bounded by the handshake timeout, keeping scanners cheap
+	deadline := time.Now().Add(s.hsTimeout)
+	switch s.probeResist {
+	case "hold":
+		delay := time.Duration(rand.Int63n(int64(s.hsTimeout)))
+		_ = cli.conn.SetDeadline(time.Now().Add(delay))
+		_, _ = io.Copy(ioutil.Discard, cli.conn)
+	case "decoy":
+		dialer := net.Dialer{Deadline: deadline}
+		decoy, err := dialer.Dial("tcp", s.decoyAddr)
+		if err != nil {
+			cli.log.Warnw("failed to connect to the decoy", "error", err)
+			return
+		}
+		defer decoy.Close() // nolint: errcheck
+		_ = cli.conn.SetDeadline(deadline)
+		_ = decoy.SetDeadline(deadline)
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(cli.conn, decoy)
+			_ = closeWrite(cli.conn)
+			close(done)
+		}()
+		if _, err = decoy.Write(received); err == nil {
+			_, _ = io.Copy(decoy, cli.conn)
+		}
+		_ = closeWrite(decoy)
+		<-done
+	}
+}
+
 func (s *SOCKS5Server) authUser(cli *socks5Request) (user string, err error) {
 	cli.log.Debugw("start user/pass authentication")
 	err = (&socksSelect{socksUserPass}).WritePacket(cli.conn)
@@ -253,25 +480,41 @@ func (s *SOCKS5Server) authUser(cli *socks5Request) (user string, err error) {
 		err = authPkt.ReadPacket(cli.conn)
 	}
 
+	user = authPkt.Username
+	if s.hintDelim != "" {
+		if i := strings.Index(user, s.hintDelim); i >= 0 {
+			cli.upstreamHint = user[i+len(s.hintDelim):]
+			user = user[:i]
+		}
+	}
 	if err == nil {
-		if s.checkUser(authPkt.Username, authPkt.Password) {
+		if s.checkUser(user, authPkt.Password) {
 			err = (&socksUserPassResp{true}).WritePacket(cli.conn)
 		} else {
-			cli.log.Warnw("user authentication failed", "user", authPkt.Username)
+			cli.log.Warnw("user authentication failed", "user", user)
 			err = errors.New("checkUser returned false")
 			_ = (&socksUserPassResp{false}).WritePacket(cli.conn)
 		}
 	}
 
-	return authPkt.Username, errors.WithMessage(err, "user auth failed")
+	return user, errors.WithMessage(err, "user auth failed")
 }
 
 type socks5Request struct {
-	id         string
-	log        *zap.SugaredLogger
-	conn       net.Conn
-	user       string
-	targetAddr Address
+	id            string
+	log           *zap.SugaredLogger
+	conn          net.Conn
+	scope         string // of the user
+	user          string
+	upstreamHint  string
+	targetAddr    Address
+	overloadDelay time.Duration
+	fakeBoundAddr Address // reported instead of the real one if set
+}
+
+// UpstreamHint returns the upstream preferred by the client, if any.
+func (r *socks5Request) UpstreamHint() string {
+	return r.upstreamHint
 }
 
 // GetPeerIdentifiers returns a list of peer identifiers of this client.
@@ -279,7 +522,7 @@ func (r *socks5Request) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
 	var ids []*PeerIdentifier
 	if r.user != "" {
 		ids = append(ids, &PeerIdentifier{
-			Scope:    socks5Scope,
+			Scope:    r.scope,
 			UniqueID: r.user,
 			Name:     r.user,
 		})
@@ -306,6 +549,9 @@ func (r *socks5Request) TargetAddr() Address {
 
 // Success notifies the client that the connection is established.
 func (r *socks5Request) Success(addr Address) io.ReadWriteCloser {
+	if r.fakeBoundAddr != nil {
+		addr = r.fakeBoundAddr
+	}
 	respPkt := &socksReqResp{Type: socksSuccess, Addr: addr}
 	if err := respPkt.WritePacket(r.conn); err != nil {
 		// if it is actually a fatal error, the upper level code
@@ -317,6 +563,11 @@ func (r *socks5Request) Success(addr Address) io.ReadWriteCloser {
 
 // Fail notifies the client that the connection is not able to be established.
 func (r *socks5Request) Fail(proxyErr *ProxyError) {
+	if proxyErr.Overloaded() {
+		r.log.Warnw("rejecting request due to overloading",
+			"error", proxyErr.Error, "delay", r.overloadDelay)
+		time.Sleep(r.overloadDelay)
+	}
 	respPkt := &socksReqResp{
 		Type: byte(proxyErr.ErrType), Addr: &TCP4Addr{net.IPv4zero, 0}}
 	if err := respPkt.WritePacket(r.conn); err != nil {
@@ -344,26 +595,21 @@ type SOCKS5Client struct {
 	Simplified bool
 	Username   string
 	Password   string
+	pskKey     []byte // derived from 'psk', nil if not set
 }
 
 // NewSOCKS5Client creates a SOCKS5 client from the given configuration.
 func NewSOCKS5Client(config ProxyConfig) (*SOCKS5Client, error) {
-	address, simplified, _, err := parseSOCKS5Config(config)
-	if err != nil {
+	var settings socks5ClientSettings
+	if _, err := parseSOCKS5Config(config, &settings); err != nil {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 client")
 	}
-	var username, password string
-	if u, ok := config.Settings["username"]; ok {
-		if username, ok = u.(string); !ok {
-			return nil, errors.New("a string is required for 'username'")
-		}
-	}
-	if p, ok := config.Settings["password"]; ok {
-		if password, ok = p.(string); !ok {
-			return nil, errors.New("a string is required for 'password'")
-		}
+	if addrs, err := ExpandAddressRange(settings.Address); err != nil {
+		return nil, errors.WithMessage(err, "failed to create SOCKS5 client")
+	} else if len(addrs) != 1 {
+		return nil, errors.New("port range is not allowed for SOCKS5 client")
 	}
-	if username == "" && password != "" {
+	if settings.Username == "" && settings.Password != "" {
 		return nil, errors.New("a password must be used with a username")
 	}
 
@@ -372,10 +618,17 @@ func NewSOCKS5Client(config ProxyConfig) (*SOCKS5Client, error) {
 		return nil, errors.WithMessage(err, "failed to create SOCKS5 client")
 	}
 
-	return &SOCKS5Client{
-		Transport: transport, Addr: address, Simplified: simplified,
-		Username: username, Password: password,
-	}, nil
+	cli := &SOCKS5Client{
+		Transport:  transport,
+		Addr:       settings.Address,
+		Simplified: settings.Simplified,
+		Username:   settings.Username,
+		Password:   settings.Password,
+	}
+	if settings.PSK != "" {
+		cli.pskKey = socksPSKKey(settings.PSK)
+	}
+	return cli, nil
 }
 
 // Request send a connection request to the proxy server.
@@ -392,35 +645,60 @@ func (c *SOCKS5Client) Request(ctx context.Context, addr Address) (
 		_ = conn.SetDeadline(ddl.Add(-time.Millisecond))
 	}
 
-	var boundAddr Address
-	errCh := make(chan *ProxyError, 1)
+	// The deadline may not be supported by the conn (e.g. a proxied one), so
+	// a watchdog closes the conn on cancellation to unblock doRequest.
+	// The state is 0 while requesting, 1 if closed by the watchdog and 2 if
+	// the request has finished.
+	var state int32
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
 	go func() {
-		bAddr, pErr := c.doRequest(conn, addr)
-		boundAddr = bAddr
-		errCh <- pErr
+		select {
+		case <-ctx.Done():
+			if atomic.CompareAndSwapInt32(&state, 0, 1) {
+				_ = conn.Close()
+			}
+		case <-stopWatchdog:
+		}
 	}()
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			_ = conn.Close()
-			return nil, nil, err
-		}
-		_ = conn.SetDeadline(time.Time{})
-		return conn, boundAddr, nil
-	case <-ctx.Done():
-		_ = conn.Close()
+	boundAddr, pErr := c.doRequest(conn, addr)
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
 		return nil, nil, wrapAsProxyError(
 			errors.WithStack(ctx.Err()), ProxyGeneralErr)
 	}
+	if pErr != nil {
+		_ = conn.Close()
+		return nil, nil, pErr
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, boundAddr, nil
+}
+
+// UpdatePreConn implements WithPreConnPool, for the connections to the
+// server. The pool is only drained if the server seems unreachable.
+func (c *SOCKS5Client) UpdatePreConn(target Address, pErr *ProxyError) {
+	pool, ok := c.Transport.(*PreConnTransWrapper)
+	if !ok {
+		return
+	}
+	if pErr == nil {
+		pool.Warm(c.Addr)
+	} else if pErr.UpstreamFault() {
+		pool.Drain(c.Addr)
+	}
 }
 
 func (c *SOCKS5Client) doRequest(
 	conn io.ReadWriter, addr Address) (Address, *ProxyError) {
 	var err error
 	errType := ProxyGeneralErr
-	if !c.Simplified {
-		err = c.authenticate(conn)
+	reason := ""
+	if c.pskKey != nil {
+		err = writeSOCKSPSKToken(conn, c.pskKey)
+	}
+	if err == nil && !c.Simplified {
+		reason, err = c.authenticate(conn)
 	}
 
 	// send connect request
@@ -439,20 +717,28 @@ func (c *SOCKS5Client) doRequest(
 				// socks error codes are identical to those of ProxyError
 				errType = ProxyErrorType(respPkt.Type)
 				err = errors.Errorf("SOCKS server replies %s", errType)
+				reason = ReasonProxyRejected
 			}
 		}
 	}
 
-	return respPkt.Addr, wrapAsProxyError(
+	pErr := wrapAsProxyError(
 		errors.WithMessage(err, "failed to establish SOCKS connection"),
 		errType)
+	if pErr != nil && reason != "" {
+		pErr.Reason = reason
+	}
+	return respPkt.Addr, pErr
 }
 
-func (c *SOCKS5Client) authenticate(conn io.ReadWriter) (err error) {
+// authenticate returns a non-empty reason if the failure is not caused by
+// an IO error, which should be examined by errorReason instead.
+func (c *SOCKS5Client) authenticate(
+	conn io.ReadWriter) (reason string, err error) {
 	// send HELLO and authenticate if required
 	helloPkt := &socksHello{[]byte{socksNoAuth}}
 	selectPkt := &socksSelect{}
-	if len(c.Username) > 0 && len(c.Password) > 0 {
+	if len(c.Username) > 0 { // the password may be empty
 		helloPkt.Methods = append(helloPkt.Methods, socksUserPass)
 	}
 	if err = helloPkt.WritePacket(conn); err != nil {
@@ -471,13 +757,16 @@ func (c *SOCKS5Client) authenticate(conn io.ReadWriter) (err error) {
 		}
 		if err == nil && !authRespPkt.Status {
 			err = errors.New("authentication to SOCKS server failed")
+			reason = ReasonAuthFailed
 		}
 	case socksNoAuth: // no-op
 	case socksNoValidAuth:
 		err = errors.New("no valid authentication supported by the server")
+		reason = ReasonAuthFailed
 	default:
 		err = errors.Errorf("SOCKS server require unknown authentication: %v",
 			selectPkt.Method)
+		reason = ReasonProtocolError
 	}
 	return
 }
@@ -499,6 +788,23 @@ type socksPacket interface { // nolint: deadcode
 	ReadPacket(reader io.Reader) error
 }
 
+// writeFull writes the whole buffer even if the writer doesn't conform to the
+// io.Writer contract and returns short writes without any error, which would
+// otherwise corrupt the framing of the packets silently.
+func writeFull(writer io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := writer.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n <= 0 || n > len(buf) {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
 type socksHello struct {
 	Methods []byte
 }
@@ -508,10 +814,8 @@ func (p *socksHello) WritePacket(writer io.Writer) error {
 	if n <= 0 || n > 255 {
 		return errors.Errorf("invalid number of methods: %d", n)
 	}
-	_, err := writer.Write([]byte{socksVersion, byte(n)})
-	if err == nil {
-		_, err = writer.Write(p.Methods)
-	}
+	buf := append([]byte{socksVersion, byte(n)}, p.Methods...)
+	err := writeFull(writer, buf)
 	return errors.Wrap(err, "failed to write socksHello")
 }
 
@@ -523,6 +827,9 @@ func (p *socksHello) ReadPacket(reader io.Reader) error {
 			return errors.Errorf("unknown SOCKS version: %d", buf[0])
 		}
 		n := int(buf[1])
+		if n == 0 {
+			return errors.New("no authentication method in socksHello")
+		}
 		p.Methods = make([]byte, n)
 		_, err = io.ReadFull(reader, p.Methods)
 	}
@@ -534,7 +841,7 @@ type socksSelect struct {
 }
 
 func (p *socksSelect) WritePacket(writer io.Writer) error {
-	_, err := writer.Write([]byte{socksVersion, p.Method})
+	err := writeFull(writer, []byte{socksVersion, p.Method})
 	return errors.Wrap(err, "failed to write socksSelect")
 }
 
@@ -561,7 +868,9 @@ func (p *socksUserPassReq) WritePacket(writer io.Writer) error {
 	if lenUser <= 0 || lenUser > 255 {
 		return errors.Errorf("invalid username length: %d", lenUser)
 	}
-	if lenPass <= 0 || lenPass > 255 {
+	// RFC 1929 requires a password of at least one byte, but an empty one is
+	// widely accepted, e.g. when only the username is meaningful
+	if lenPass > 255 {
 		return errors.Errorf("invalid password length: %d", lenPass)
 	}
 
@@ -572,7 +881,7 @@ func (p *socksUserPassReq) WritePacket(writer io.Writer) error {
 	buf[2+lenUser] = byte(lenPass)
 	copy(buf[3+lenUser:], p.Password)
 
-	_, err := writer.Write(buf)
+	err := writeFull(writer, buf)
 	return errors.Wrap(err, "failed to write socksUserPassReq")
 }
 
@@ -584,7 +893,9 @@ func (p *socksUserPassReq) ReadPacket(reader io.Reader) error {
 		if buf[0] != 0x01 {
 			return errors.Errorf("unknown negotiation version: %d", buf[0])
 		}
-		n = int(buf[1])
+		if n = int(buf[1]); n == 0 {
+			return errors.New("empty username in socksUserPassReq")
+		}
 		_, err = io.ReadFull(reader, buf[:n])
 	}
 	if err == nil {
@@ -610,7 +921,7 @@ func (p *socksUserPassResp) WritePacket(writer io.Writer) error {
 	if p.Status {
 		buf[1] = 0x00 // success
 	}
-	_, err := writer.Write(buf)
+	err := writeFull(writer, buf)
 	return errors.Wrap(err, "failed to write socksUserPassResp")
 }
 
@@ -667,7 +978,7 @@ func (p *socksReqResp) WritePacket(writer io.Writer) error {
 
 	buf = append(buf, byte(port>>8), byte(port))
 
-	_, err := writer.Write(buf)
+	err := writeFull(writer, buf)
 	return errors.Wrap(err, "failed to write socksReqResp")
 }
 
@@ -691,9 +1002,13 @@ func (p *socksReqResp) ReadPacket(reader io.Reader) error {
 			}
 		case socksIPv6:
 			_, err = io.ReadFull(reader, buf[:18])
-			if err == nil {
-				p.Addr = &TCP6Addr{
-					IP: buf[:16], Port: getPortFromBytes(buf[16:18])}
+			port := getPortFromBytes(buf[16:18])
+			// IPv4-mapped addresses are taken as IPv4, or they would be
+			// dialed as IPv6 ones, which fails on IPv4-only hosts
+			if ip := net.IP(buf[:16]); err == nil && ip.To4() != nil {
+				p.Addr = &TCP4Addr{IP: ip.To4(), Port: port}
+			} else if err == nil {
+				p.Addr = &TCP6Addr{IP: ip, Port: port}
 			}
 		case socksDomainName:
 			_, err = io.ReadFull(reader, buf[:1])
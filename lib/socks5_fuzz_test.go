@@ -0,0 +1,70 @@
+// +build go1.18
+
+package lib
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fuzzSOCKSPacket feeds random bytes to the parser of a packet, which should
+// never consume more than maxLen bytes, and checks that whatever it accepts
+// is written and parsed back into the same packet.
+func fuzzSOCKSPacket(
+	f *testing.F, newPkt func() socksPacket, maxLen int, seeds ...[]byte) {
+	for _, c := range packetTestCases {
+		if c.bytes != nil {
+			f.Add(c.bytes)
+		}
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bytes.NewReader(data)
+		pkt := newPkt()
+		if pkt.ReadPacket(reader) != nil {
+			return
+		}
+		consumed := len(data) - reader.Len()
+		require.True(t, consumed <= maxLen, "%d bytes consumed", consumed)
+
+		var buf bytes.Buffer
+		require.NoError(t, pkt.WritePacket(&buf))
+		pkt2 := newPkt()
+		require.NoError(t, pkt2.ReadPacket(&buf))
+		assert.Equal(t, pkt, pkt2)
+		assert.Zero(t, buf.Len())
+	})
+}
+
+func FuzzSocksHelloRead(f *testing.F) {
+	fuzzSOCKSPacket(f, func() socksPacket { return &socksHello{} }, 2+255,
+		[]byte{0x05, 0x00}, []byte{0x04, 0xff})
+}
+
+func FuzzSocksSelectRead(f *testing.F) {
+	fuzzSOCKSPacket(f, func() socksPacket { return &socksSelect{} }, 2)
+}
+
+func FuzzSocksUserPassReqRead(f *testing.F) {
+	fuzzSOCKSPacket(
+		f, func() socksPacket { return &socksUserPassReq{} }, 3+255+255,
+		[]byte{0x01, 0x00, 0x00}, []byte{0x01, 0xff, 0x75})
+}
+
+func FuzzSocksUserPassRespRead(f *testing.F) {
+	fuzzSOCKSPacket(f, func() socksPacket { return &socksUserPassResp{} }, 2)
+}
+
+func FuzzSocksReqRespRead(f *testing.F) {
+	fuzzSOCKSPacket(f, func() socksPacket { return &socksReqResp{} }, 7+255,
+		[]byte{0x05, 0x01, 0x00, 0x03, 0xff, 0x77},
+		[]byte{0x05, 0x01, 0x00, 0x03, 0x00, 0x00, 0x50},
+		[]byte{0x05, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x7f, 0x00, 0x00, 0x01,
+			0x00, 0x50})
+}
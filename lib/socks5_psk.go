@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A SOCKS5 client holding the PSK sends a token before the hello, which
+// consists of the timestamp in seconds (8 bytes, big endian), a random nonce
+// and the HMAC of both. The server drops the clients without a valid one.
+const (
+	socksPSKIterations = 4096
+	socksPSKNonceSize  = 16
+	socksPSKTokenSize  = 8 + socksPSKNonceSize + sha256.Size
+)
+
+// socksPSKWindow is how far the timestamp of a token may be from the clock
+// of the server. This is a variable so that it can be altered in tests.
+var socksPSKWindow = time.Minute * 2
+
+func socksPSKKey(psk string) []byte {
+	return pbkdf2.Key([]byte(psk), []byte("thestral2-socks5-psk"),
+		socksPSKIterations, 32, sha256.New)
+}
+
+func socksPSKMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// writeSOCKSPSKToken writes a fresh token signed by the key.
+func writeSOCKSPSKToken(writer io.Writer, key []byte) error {
+	token := make([]byte, socksPSKTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Unix()))
+	if _, err := rand.Read(token[8 : 8+socksPSKNonceSize]); err != nil {
+		return errors.WithStack(err)
+	}
+	copy(token[8+socksPSKNonceSize:], socksPSKMAC(
+		key, token[:8+socksPSKNonceSize]))
+	return errors.Wrap(writeFull(writer, token), "failed to write PSK token")
+}
+
+// socksPSKGate validates the tokens from the clients, rejecting those
+// forged, out of the time window or replayed.
+//
+// The nonces seen are kept in two generations, which are rotated every two
+// windows, so that a nonce is remembered as long as its token is valid.
+type socksPSKGate struct {
+	key       []byte
+	mtx       sync.Mutex
+	seen      map[[socksPSKNonceSize]byte]bool
+	prevSeen  map[[socksPSKNonceSize]byte]bool
+	rotatedAt time.Time
+}
+
+func newSOCKSPSKGate(psk string) *socksPSKGate {
+	return &socksPSKGate{
+		key:       socksPSKKey(psk),
+		seen:      make(map[[socksPSKNonceSize]byte]bool),
+		rotatedAt: time.Now(),
+	}
+}
+
+// check reads a token and validates it. The bytes received are returned so
+// that they can be replayed to a decoy.
+func (g *socksPSKGate) check(reader io.Reader) ([]byte, error) {
+	token := make([]byte, socksPSKTokenSize)
+	n, err := io.ReadFull(reader, token)
+	if err != nil {
+		return token[:n], errors.Wrap(err, "failed to read PSK token")
+	}
+	msg := token[:8+socksPSKNonceSize]
+	if !hmac.Equal(token[len(msg):], socksPSKMAC(g.key, msg)) {
+		return token, errors.New("invalid PSK token")
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(token)), 0)
+	now := time.Now()
+	if ts.Before(now.Add(-socksPSKWindow)) || ts.After(now.Add(socksPSKWindow)) {
+		return token, errors.Errorf("PSK token out of the window: %v", ts)
+	}
+
+	var nonce [socksPSKNonceSize]byte
+	copy(nonce[:], token[8:])
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if now.Sub(g.rotatedAt) >= socksPSKWindow*2 {
+		g.prevSeen, g.seen = g.seen, make(map[[socksPSKNonceSize]byte]bool)
+		g.rotatedAt = now
+	}
+	if g.seen[nonce] || g.prevSeen[nonce] {
+		return token, errors.New("replayed PSK token")
+	}
+	g.seen[nonce] = true
+	return token, nil
+}
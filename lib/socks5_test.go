@@ -5,9 +5,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -42,6 +46,11 @@ var packetTestCases = []struct {
 		&socksUserPassReq{},
 		[]byte{0x01, 0x04, 0x75, 0x73, 0x65, 0x72, 0x04, 0x70, 0x61, 0x73, 0x73},
 	},
+	{
+		&socksUserPassReq{"user", ""},
+		&socksUserPassReq{},
+		[]byte{0x01, 0x04, 0x75, 0x73, 0x65, 0x72, 0x00},
+	},
 	{
 		&socksUserPassReq{"", "pass"},
 		&socksUserPassReq{},
@@ -121,6 +130,56 @@ func TestSOCKS5Packets(t *testing.T) {
 	}
 }
 
+func TestSOCKS5IPv4MappedAddr(t *testing.T) {
+	mapped := []byte{0x05, 0x01, 0x00, 0x04,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4, 0x00, 0x50}
+	pkt := &socksReqResp{}
+	require.NoError(t, pkt.ReadPacket(bytes.NewReader(mapped)))
+	addr := &TCP4Addr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 80}
+	assert.Equal(t, addr, pkt.Addr)
+
+	// written back as a plain IPv4 address
+	buf := new(bytes.Buffer)
+	require.NoError(t, pkt.WritePacket(buf))
+	assert.Equal(t, []byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0x00, 0x50},
+		buf.Bytes())
+
+	// the others are kept as IPv6
+	unmapped := append([]byte{}, mapped...)
+	unmapped[14] = 0x00
+	require.NoError(t, pkt.ReadPacket(bytes.NewReader(unmapped)))
+	assert.IsType(t, &TCP6Addr{}, pkt.Addr)
+}
+
+// shortWriter violates the io.Writer contract by writing at most limit bytes
+// at a time without any error.
+type shortWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		b = b[:w.limit]
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestSOCKS5PacketsShortWrite(t *testing.T) {
+	for i, c := range packetTestCases {
+		if c.bytes == nil {
+			continue
+		}
+		w := &shortWriter{limit: 1}
+		require.NoError(t, c.packet.WritePacket(w), "case %d", i)
+		assert.Equal(t, c.bytes, w.Bytes(), "case %d", i)
+
+		w = &shortWriter{limit: 0} // no progress at all
+		err := c.packet.WritePacket(w)
+		assert.Equal(t, io.ErrShortWrite, errors.Cause(err), "case %d", i)
+	}
+}
+
 func doTestSOCKS5Request(
 	t *testing.T, addr Address, simplified bool,
 	checkUserFunc CheckUserFunc, provideUser, shouldFail bool) {
@@ -220,3 +279,675 @@ func TestSOCKS5RequestSimplifiedProtocol(t *testing.T) {
 	addr := &DomainNameAddr{DomainName: "www.gov.cn", Port: 12345}
 	doTestSOCKS5Request(t, addr, true, nil, false, false)
 }
+
+func TestSOCKS5RequestEmptyPassword(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false,
+		func(user, pass string) bool {
+			return user == "USERNAME" && pass == ""
+		}, time.Second*10)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			_ = req.Success(&TCP4Addr{net.IPv4zero.To4(), 0}).Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cli := &SOCKS5Client{Transport: trans, Addr: address, Username: "USERNAME"}
+	conn, _, pErr := cli.Request(
+		ctx, &DomainNameAddr{DomainName: "www.gov.cn", Port: 80})
+	require.Nil(t, pErr)
+	_ = conn.Close()
+}
+
+func TestSOCKS5UpstreamHint(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false,
+		func(user, pass string) bool {
+			return user == "USERNAME" && pass == "PASSWORD"
+		}, time.Second*10)
+	require.NoError(t, err)
+	svr.hintDelim = "+"
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	target := &DomainNameAddr{DomainName: "www.gov.cn", Port: 80}
+	for user, hint := range map[string]string{
+		"USERNAME": "", "USERNAME+proxy": "proxy", "USERNAME+a+b": "a+b",
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		go func(user string) {
+			_, _, _ = (&SOCKS5Client{Transport: trans, Addr: address,
+				Username: user, Password: "PASSWORD"}).Request(ctx, target)
+		}(user)
+		select {
+		case req := <-reqCh:
+			assert.Equal(t, hint, req.(WithUpstreamHint).UpstreamHint(), user)
+			req.Fail(&ProxyError{ErrType: ProxyNotAllowed})
+		case <-ctx.Done():
+			assert.Fail(t, "no request received", user)
+		}
+		cancel()
+	}
+
+	_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{
+			"address": address, "upstream_hint_delimiter": "+"},
+	})
+	assert.Error(t, err, "check_users should be required")
+}
+
+func TestSOCKS5Scope(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false,
+		func(user, pass string) bool { return true }, time.Second*10)
+	require.NoError(t, err)
+	assert.Equal(t, socks5Scope, svr.scope)
+	svr.scope = "tenant"
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		_, _, _ = (&SOCKS5Client{Transport: trans, Addr: address,
+			Username: "user", Password: "pass"}).Request(
+			ctx, &DomainNameAddr{DomainName: "www.gov.cn", Port: 80})
+	}()
+	select {
+	case req := <-reqCh:
+		ids, err := req.GetPeerIdentifiers()
+		require.NoError(t, err)
+		assert.Equal(t, []*PeerIdentifier{
+			{Scope: "tenant", UniqueID: "user", Name: "user"}}, ids)
+		req.Fail(&ProxyError{ErrType: ProxyNotAllowed})
+	case <-ctx.Done():
+		assert.Fail(t, "no request received")
+	}
+
+	for _, scope := range []interface{}{"tenant", "", "a/b"} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": address, "scope": scope}})
+		assert.Error(t, err, "%v", scope)
+	}
+}
+
+func TestSOCKS5AcceptLoops(t *testing.T) {
+	trans := &TCPTransport{}
+	svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": "127.0.0.1:0", "accept_loops": 4}})
+	require.NoError(t, err)
+	assert.Equal(t, 4, svr.acceptLoops)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			go req.Fail(&ProxyError{ErrType: ProxyNotAllowed})
+		}
+	}()
+
+	address := svr.listeners[0].Addr().String()
+	target := &DomainNameAddr{DomainName: "www.gov.cn", Port: 80}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, _, pErr := (&SOCKS5Client{Transport: trans, Addr: address}).
+				Request(ctx, target)
+			if assert.NotNil(t, pErr) {
+				assert.Equal(t, ProxyNotAllowed, pErr.ErrType)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, n := range []interface{}{0, -1, "2"} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": "127.0.0.1:0", "accept_loops": n}})
+		assert.Error(t, err, "%v", n)
+	}
+}
+
+func TestSOCKS5OverloadRejectDelay(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false, nil, time.Second*10)
+	require.NoError(t, err)
+	svr.overloadDelay = time.Millisecond * 300
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			req.Fail(NewOverloadedError(errors.New("overloaded")))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	startTime := time.Now()
+	cli := &SOCKS5Client{Transport: trans, Addr: address}
+	_, _, pErr := cli.Request(
+		ctx, &DomainNameAddr{DomainName: "www.gov.cn", Port: 80})
+	require.NotNil(t, pErr)
+	assert.Equal(t, ProxyGeneralErr, pErr.ErrType)
+	assert.True(t, time.Since(startTime) >= svr.overloadDelay)
+}
+
+func TestSOCKS5ProbeResist(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer decoy.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := decoy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				line := make([]byte, 16)
+				n, _ := conn.Read(line)
+				_, _ = conn.Write(append([]byte("decoy: "), line[:n]...))
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false, nil,
+		time.Millisecond*500)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			req.Fail(&ProxyError{ErrType: ProxyGeneralErr})
+		}
+	}()
+	probe := func() (string, time.Duration) {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		defer conn.Close() // nolint: errcheck
+		startTime := time.Now()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+		require.NoError(t, err)
+		resp, _ := ioutil.ReadAll(conn)
+		return string(resp), time.Since(startTime)
+	}
+
+	svr.probeResist, svr.decoyAddr = "decoy", decoy.Addr().String()
+	resp, _ := probe()
+	assert.Equal(t, "decoy: GET / HTTP/1.1\r\n", resp)
+
+	svr.probeResist = "hold"
+	resp, elapsed := probe()
+	assert.Empty(t, resp)
+	assert.True(t, elapsed < svr.hsTimeout+time.Millisecond*200)
+
+	// SOCKS clients are not affected
+	cli := &SOCKS5Client{Transport: trans, Addr: address}
+	_, _, pErr := cli.Request(
+		context.Background(), &DomainNameAddr{DomainName: "x.com", Port: 80})
+	require.NotNil(t, pErr)
+	assert.Equal(t, ProxyGeneralErr, pErr.ErrType)
+
+	for _, v := range []interface{}{"close", "hold", "decoy 127.0.0.1:80"} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": address, "probe_resist": v}})
+		assert.NoError(t, err, "%v", v)
+	}
+	for _, v := range []interface{}{"", "decoy", "hold 1s", "drop", 1} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": address, "probe_resist": v}})
+		assert.Error(t, err, "%v", v)
+	}
+}
+
+func TestSOCKS5PSK(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, false, nil,
+		time.Millisecond*300)
+	require.NoError(t, err)
+	svr.pskGate = newSOCKSPSKGate("secret")
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	go func() {
+		for req := range reqCh {
+			req.Fail(&ProxyError{ErrType: ProxyConnectFailed})
+		}
+	}()
+
+	target := &DomainNameAddr{DomainName: "x.com", Port: 80}
+	for _, c := range []struct {
+		pskKey  []byte
+		errType ProxyErrorType
+	}{
+		{socksPSKKey("secret"), ProxyConnectFailed}, // reaches the server
+		{socksPSKKey("wrong"), ProxyGeneralErr},
+		{nil, ProxyGeneralErr},
+	} {
+		cli := &SOCKS5Client{Transport: trans, Addr: address, pskKey: c.pskKey}
+		_, _, pErr := cli.Request(context.Background(), target)
+		require.NotNil(t, pErr)
+		assert.Equal(t, c.errType, pErr.ErrType)
+	}
+
+	svr2, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": address, "psk": "secret"}})
+	require.NoError(t, err)
+	assert.NotNil(t, svr2.pskGate)
+	cli, err := NewSOCKS5Client(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": address, "psk": "secret"}})
+	require.NoError(t, err)
+	assert.Equal(t, socksPSKKey("secret"), cli.pskKey)
+}
+
+func TestSOCKS5PSKGate(t *testing.T) {
+	gate := newSOCKSPSKGate("secret")
+	var buf bytes.Buffer
+	require.NoError(t, writeSOCKSPSKToken(&buf, gate.key))
+	token := append([]byte(nil), buf.Bytes()...)
+	_, err := gate.check(&buf)
+	assert.NoError(t, err)
+	_, err = gate.check(bytes.NewReader(token))
+	assert.EqualError(t, err, "replayed PSK token")
+
+	// the nonce is still remembered after a rotation
+	gate.rotatedAt = gate.rotatedAt.Add(-socksPSKWindow * 2)
+	_, err = gate.check(bytes.NewReader(token))
+	assert.EqualError(t, err, "replayed PSK token")
+
+	// tampered
+	require.NoError(t, writeSOCKSPSKToken(&buf, gate.key))
+	buf.Bytes()[8] ^= 1
+	received, err := gate.check(&buf)
+	assert.EqualError(t, err, "invalid PSK token")
+	assert.Len(t, received, socksPSKTokenSize)
+
+	// out of the window
+	defer func(window time.Duration) { socksPSKWindow = window }(
+		socksPSKWindow)
+	socksPSKWindow = -time.Second
+	require.NoError(t, writeSOCKSPSKToken(&buf, gate.key))
+	_, err = gate.check(&buf)
+	assert.Error(t, err)
+
+	// too short
+	received, err = gate.check(bytes.NewReader([]byte("GET")))
+	assert.Error(t, err)
+	assert.Equal(t, []byte("GET"), received)
+}
+
+func TestExpandAddressRange(t *testing.T) {
+	addrs, err := ExpandAddressRange("127.0.0.1:8000-8002")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"}, addrs)
+	addrs, err = ExpandAddressRange("[::1]:80")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[::1]:80"}, addrs)
+	for _, addr := range []string{
+		"127.0.0.1", "127.0.0.1:8002-8000", "127.0.0.1:0-1",
+		"127.0.0.1:1-x", "127.0.0.1:1-65536",
+	} {
+		_, err = ExpandAddressRange(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestNormalizeDomainName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"www.Example.COM":       "www.example.com",
+		"www.example.com.":      "www.example.com.",
+		"_dmarc.example.com":    "_dmarc.example.com",
+		"Bücher.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"Bu\u0308cher.example":  "xn--bcher-kva.example", // NFD
+		"ｅｘａｍｐｌｅ．com":           "example.com",
+		"例子。测试":                 "xn--fsqu00a.xn--0zwm56d",
+		"1.2.3.4":               "1.2.3.4",
+		"::1":                   "::1",
+	} {
+		actual, err := NormalizeDomainName(name, DefaultMaxDomainNameLen)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, expected, actual, name)
+		}
+	}
+	for _, name := range []string{
+		"", ".", "a..b", "bad host.com", "ex\u200bample.com", "evil.com/x",
+		"a\x00b.com",
+		strings.Repeat("a", 64) + ".com", strings.Repeat("a.", 127) + "com",
+	} {
+		_, err := NormalizeDomainName(name, DefaultMaxDomainNameLen)
+		assert.Error(t, err, name)
+	}
+	_, err := NormalizeDomainName("www.example.com", 10)
+	assert.Error(t, err)
+}
+
+func TestSOCKS5ServerDomainNameGuard(t *testing.T) {
+	address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+	trans := &TCPTransport{}
+	svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": address, "simplified": true, "max_domain_length": 32}})
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	defer svr.Stop()
+	targets := make(chan string, 1)
+	go func() {
+		for req := range reqCh {
+			targets <- req.TargetAddr().String()
+			_ = req.Success(&TCP4Addr{net.IPv4zero.To4(), 0}).Close()
+		}
+	}()
+
+	cli := &SOCKS5Client{Transport: trans, Addr: address, Simplified: true}
+	request := func(name string) *ProxyError {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, _, pErr := cli.Request(
+			ctx, &DomainNameAddr{DomainName: name, Port: 80})
+		if pErr == nil {
+			_ = conn.Close()
+		}
+		return pErr
+	}
+	require.Nil(t, request("Bücher.Example"))
+	assert.Equal(t, "xn--bcher-kva.example:80", <-targets)
+	for _, name := range []string{
+		"bad host.com", strings.Repeat("a", 30) + ".com"} {
+		pErr := request(name)
+		if assert.NotNil(t, pErr, name) {
+			assert.Equal(t, ProxyAddrUnsupported, pErr.ErrType, name)
+		}
+	}
+	assert.Empty(t, targets)
+
+	for _, v := range []interface{}{0, 256, "32"} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": address, "max_domain_length": v}})
+		assert.Error(t, err, "%v", v)
+	}
+}
+
+func TestSOCKS5ServerFakeBoundAddr(t *testing.T) {
+	trans := &TCPTransport{}
+	realAddr := &TCP4Addr{IP: net.ParseIP("123.45.67.89").To4(), Port: 2333}
+	for setting, expected := range map[string]Address{
+		"":               realAddr,
+		"zero":           &TCP4Addr{IP: net.IPv4zero.To4()},
+		"10.0.0.1:1080":  &TCP4Addr{IP: net.ParseIP("10.0.0.1").To4(), Port: 1080},
+		"[fe80::1]:1080": &TCP6Addr{IP: net.ParseIP("fe80::1"), Port: 1080},
+	} {
+		address := "127.0.0.1:" + strconv.Itoa(52048+(rand.Intn(2048)))
+		settings := map[string]interface{}{
+			"address": address, "simplified": true}
+		if setting != "" {
+			settings["reply_bound_addr"] = setting
+		}
+		svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: settings})
+		require.NoError(t, err)
+		reqCh, err := svr.Start()
+		require.NoError(t, err)
+		go func() {
+			for req := range reqCh {
+				_ = req.Success(realAddr).Close()
+			}
+		}()
+
+		cli := &SOCKS5Client{Transport: trans, Addr: address, Simplified: true}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, boundAddr, pErr := cli.Request(
+			ctx, &DomainNameAddr{DomainName: "example.com", Port: 80})
+		cancel()
+		if assert.Nil(t, pErr, setting) {
+			_ = conn.Close()
+			assert.Equal(t, expected, boundAddr, setting)
+		}
+		svr.Stop()
+	}
+
+	for _, v := range []interface{}{"", "none", "1.2.3.4", 0} {
+		_, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: map[string]interface{}{
+				"address": "127.0.0.1:1080", "reply_bound_addr": v}})
+		assert.Error(t, err, "%v", v)
+	}
+}
+
+func TestSOCKS5ServerPortRange(t *testing.T) {
+	base := 52048 + rand.Intn(2048)
+	address := "127.0.0.1:" +
+		strconv.Itoa(base) + "-" + strconv.Itoa(base+2)
+	trans := &TCPTransport{}
+	svr, err := newSOCKS5Server(
+		zap.NewNop().Sugar(), trans, address, true, nil, time.Second*10)
+	require.NoError(t, err)
+	reqCh, err := svr.Start()
+	require.NoError(t, err)
+	go func() {
+		for req := range reqCh {
+			_ = req.Success(&TCP4Addr{net.IPv4zero.To4(), 0}).Close()
+		}
+	}()
+
+	target := &DomainNameAddr{DomainName: "www.gov.cn", Port: 80}
+	for port := base; port <= base+2; port++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		cli := &SOCKS5Client{Transport: trans,
+			Addr: "127.0.0.1:" + strconv.Itoa(port), Simplified: true}
+		conn, _, pErr := cli.Request(ctx, target)
+		cancel()
+		require.Nil(t, pErr, "port %d", port)
+		_ = conn.Close()
+	}
+
+	svr.Stop()
+	for port := base; port <= base+2; port++ {
+		_, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		assert.Error(t, err, "port %d is still open", port)
+	}
+
+	_, err = NewSOCKS5Client(ProxyConfig{
+		Protocol: "socks5",
+		Settings: map[string]interface{}{"address": address},
+	})
+	assert.Error(t, err)
+}
+
+// stalledRWC blocks all the IO until it is closed.
+type stalledRWC struct {
+	closed chan struct{}
+}
+
+func (c *stalledRWC) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stalledRWC) Write([]byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stalledRWC) Close() error {
+	close(c.closed)
+	return nil
+}
+
+type stalledTransport struct {
+	rwc *stalledRWC
+}
+
+func (t stalledTransport) Dial(context.Context, string) (net.Conn, error) {
+	return &proxiedConn{t.rwc}, nil
+}
+
+func (stalledTransport) Listen(string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSOCKS5ClientStalledTransport(t *testing.T) {
+	rwc := &stalledRWC{make(chan struct{})}
+	cli := &SOCKS5Client{Transport: stalledTransport{rwc}, Addr: "proxy:1080"}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 100*time.Millisecond)
+	defer cancel()
+	addr := &DomainNameAddr{DomainName: "www.example.com", Port: 80}
+
+	start := time.Now()
+	conn, _, pErr := cli.Request(ctx, addr)
+	assert.Nil(t, conn)
+	require.NotNil(t, pErr)
+	assert.Equal(t, ReasonTimeout, pErr.Reason)
+	assert.True(t, time.Since(start) < time.Second)
+	select {
+	case <-rwc.closed:
+	default:
+		assert.Fail(t, "the stalled conn should be closed")
+	}
+}
+
+// pipeTransport dials to an in-memory server reading all the data without
+// replying anything.
+type pipeTransport struct{}
+
+func (pipeTransport) Dial(context.Context, string) (net.Conn, error) {
+	cli, svr := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, svr)
+	}()
+	return cli, nil
+}
+
+func (pipeTransport) Listen(string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSOCKS5ClientHelloTimeout(t *testing.T) {
+	cli := &SOCKS5Client{Transport: pipeTransport{}, Addr: "proxy:1080",
+		Username: "user", Password: "password"}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 100*time.Millisecond)
+	defer cancel()
+	addr := &DomainNameAddr{DomainName: "www.example.com", Port: 80}
+	_, _, pErr := cli.Request(ctx, addr)
+	require.NotNil(t, pErr)
+	assert.Equal(t, ReasonTimeout, pErr.Reason)
+}
+
+func TestSOCKS5ClientCancelNoLeak(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { // the server reads the HELLO but never replies
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	// without a deadline, only the cancellation can unblock the handshake
+	cli := &SOCKS5Client{Transport: TCPTransport{}, Addr: l.Addr().String()}
+	addr := &DomainNameAddr{DomainName: "www.example.com", Port: 80}
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, _, pErr := cli.Request(ctx, addr)
+		require.NotNil(t, pErr)
+		cancel()
+	}
+	require.NoError(t, l.Close())
+
+	for i := 0; runtime.NumGoroutine() > baseline; i++ {
+		if i == 100 {
+			assert.Fail(t, "goroutines leaked",
+				"%d running, %d expected", runtime.NumGoroutine(), baseline)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSOCKS5Settings(t *testing.T) {
+	svr, err := NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": "127.0.0.1:1080", "simplified": true,
+			"handshake_timeout": "1s", "check_users": false,
+			"overload_reject_delay": "100ms"}})
+	require.NoError(t, err)
+	assert.True(t, svr.simplified)
+	assert.Equal(t, time.Second, svr.hsTimeout)
+	assert.Equal(t, 100*time.Millisecond, svr.overloadDelay)
+	cli, err := NewSOCKS5Client(ProxyConfig{
+		Protocol: "socks5", Settings: map[string]interface{}{
+			"address": "127.0.0.1:1080", "handshake_timeout": "1s",
+			"username": "user", "password": "password"}})
+	require.NoError(t, err)
+	assert.Equal(t, "user", cli.Username)
+	assert.Equal(t, "password", cli.Password)
+
+	for _, settings := range []map[string]interface{}{
+		{"address": "127.0.0.1:1080", "unknown": 1},
+		{"address": "127.0.0.1:1080", "simplified": "yes"},
+		{"address": []string{"127.0.0.1:1080"}},
+		{"address": "127.0.0.1:1080", "handshake_timeout": "0s"},
+		{"address": "127.0.0.1:1080", "overload_reject_delay": ""},
+		{"address": "127.0.0.1:1080", "username": "user"},
+	} {
+		_, err = NewSOCKS5Server(zap.NewNop().Sugar(), ProxyConfig{
+			Protocol: "socks5", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+	for _, settings := range []map[string]interface{}{
+		{"address": "127.0.0.1:1080", "check_users": true},
+		{"address": "127.0.0.1:1080", "username": []int{1}},
+		{"address": "127.0.0.1:1080", "password": "password"},
+	} {
+		_, err = NewSOCKS5Client(ProxyConfig{
+			Protocol: "socks5", Settings: settings})
+		assert.Error(t, err, "%v", settings)
+	}
+}
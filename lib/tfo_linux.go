@@ -0,0 +1,30 @@
+// +build linux
+
+package lib
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tfoQueueLen is the maximum number of pending TFO connections of a listener.
+const tfoQueueLen = 256
+
+// setTFOControl sets TCP_FASTOPEN on a listening socket, or
+// TCP_FASTOPEN_CONNECT on a connecting one, which defers the SYN until the
+// first write.
+var setTFOControl = func(c syscall.RawConn, listen bool) error {
+	opt, value := unix.TCP_FASTOPEN_CONNECT, 1
+	if listen {
+		opt, value = unix.TCP_FASTOPEN, tfoQueueLen
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,77 @@
+// +build linux
+
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func getTCPSockOpt(t *testing.T, conn syscall.Conn, opt int) int {
+	c, err := conn.SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var sockErr error
+	require.NoError(t, c.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, opt)
+	}))
+	require.NoError(t, sockErr)
+	return value
+}
+
+func TestTCPTransportTFO(t *testing.T) {
+	trans, err := CreateTransport(&TransportConfig{TCP: &TCPConfig{TFO: true}})
+	require.NoError(t, err)
+	listener, err := trans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	assert.Equal(t, tfoQueueLen, getTCPSockOpt(
+		t, listener.(tcpListener).TCPListener, unix.TCP_FASTOPEN))
+
+	echo := func(conn net.Conn) {
+		defer conn.Close() // nolint: errcheck
+		assert.Equal(t, 1, getTCPSockOpt(
+			t, conn.(*net.TCPConn), unix.TCP_FASTOPEN_CONNECT))
+		_, err := conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	}
+	conn, err := trans.Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	echo(conn)
+
+	cli, err := CreateProxyClient(ProxyConfig{
+		Protocol: "direct", Settings: map[string]interface{}{"tfo": true}})
+	require.NoError(t, err)
+	addr, err := FromNetAddr(listener.Addr())
+	require.NoError(t, err)
+	rwc, _, pErr := cli.Request(context.Background(), addr)
+	require.Nil(t, pErr)
+	echo(rwc.(net.Conn))
+
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol: "direct", Settings: map[string]interface{}{"tfo": "yes"}})
+	assert.Error(t, err)
+}
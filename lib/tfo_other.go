@@ -0,0 +1,8 @@
+// +build !linux
+
+package lib
+
+import "syscall"
+
+// setTFOControl is not supported on this platform.
+var setTFOControl func(c syscall.RawConn, listen bool) error
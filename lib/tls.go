@@ -3,16 +3,21 @@ package lib
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const defaultTLSHandshakeTimeout = time.Minute * 1
@@ -22,6 +27,13 @@ type TLSTransport struct {
 	inner            Transport
 	tlsConfig        tls.Config
 	handshakeTimeout time.Duration
+	connectTimeout   time.Duration // of the inner dial, 0 for unbounded
+	acmeHTTPAddr     string
+	acmeManager      *autocert.Manager // nil if ACME is not used
+	acmeHTTPStarted  sync.Once
+	clientCerts      []tls.Certificate // alternatives to the main certificate
+	// pins are the digests of the server public keys accepted, if any
+	pins [][sha256.Size]byte
 }
 
 // NewTLSTransport create a TLSTransport on top of a given inner Transport.
@@ -29,11 +41,32 @@ func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
 	transport := &TLSTransport{inner: inner}
 	tc := &transport.tlsConfig
 
-	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to load key pair")
+	var err error
+	if config.ACME != nil {
+		if config.Cert != "" || config.Key != "" {
+			return nil, errors.New("'acme' cannot be used with 'cert' or 'key'")
+		}
+		if err = transport.setupACME(*config.ACME); err != nil {
+			return nil, err
+		}
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load key pair")
+		}
+		tc.Certificates = append(tc.Certificates, cert)
+	}
+
+	for _, pair := range config.ClientCerts {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client key pair")
+		}
+		transport.clientCerts = append(transport.clientCerts, cert)
+	}
+	if len(transport.clientCerts) > 0 {
+		tc.GetClientCertificate = transport.getClientCertificate
 	}
-	tc.Certificates = append(tc.Certificates, cert)
 
 	if len(config.CAs) == 0 {
 		if runtime.GOOS == "windows" {
@@ -58,6 +91,15 @@ func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
 		}
 	}
 
+	for _, pin := range config.PinSHA256 {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.Errorf("invalid pin_sha256: %q", pin)
+		}
+		transport.pins = append(transport.pins, [sha256.Size]byte{})
+		copy(transport.pins[len(transport.pins)-1][:], digest)
+	}
+
 	if config.VerifyClient {
 		tc.ClientAuth = tls.RequireAndVerifyClientCert
 	}
@@ -101,15 +143,98 @@ func NewTLSTransport(config TLSConfig, inner Transport) (*TLSTransport, error) {
 	} else {
 		transport.handshakeTimeout = defaultTLSHandshakeTimeout
 	}
+	if config.ConnectTimeout != "" {
+		t, err := time.ParseDuration(config.ConnectTimeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid connect_timeout")
+		}
+		if t <= 0 {
+			return nil, errors.New("connect_timeout should be > 0")
+		}
+		transport.connectTimeout = t
+	}
 
 	return transport, nil
 }
 
+func (t *TLSTransport) setupACME(config ACMEConfig) error {
+	if len(config.Hosts) == 0 || config.CacheDir == "" {
+		return errors.New("'hosts' and 'cache_dir' are required for 'acme'")
+	}
+	t.acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Hosts...),
+		Email:      config.Email,
+	}
+	if config.DirectoryURL != "" {
+		t.acmeManager.Client = &acme.Client{DirectoryURL: config.DirectoryURL}
+	}
+	t.acmeHTTPAddr = config.HTTPAddr
+	t.tlsConfig.GetCertificate = t.acmeManager.GetCertificate
+	t.tlsConfig.NextProtos = append(t.tlsConfig.NextProtos, acme.ALPNProto)
+	return nil
+}
+
+// getClientCertificate presents the first certificate, the main one first,
+// that is acceptable to the server, or none if there is no such one.
+func (t *TLSTransport) getClientCertificate(
+	cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	for _, certs := range [][]tls.Certificate{
+		t.tlsConfig.Certificates, t.clientCerts} {
+		for i := range certs {
+			if cri.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+	}
+	return &tls.Certificate{}, nil
+}
+
+// verifyPin checks the public key of the server certificate against the
+// pins after the chain is verified, so that a certificate issued by a
+// compromised CA is still rejected.
+func (t *TLSTransport) verifyPin(
+	rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate from the server")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the server certificate")
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range t.pins {
+		if pin == digest {
+			return nil
+		}
+	}
+	return errors.Errorf("server certificate matches no pin: %s",
+		base64.StdEncoding.EncodeToString(digest[:]))
+}
+
+// serveACMEHTTP serves the HTTP-01 challenges until the process exits.
+func (t *TLSTransport) serveACMEHTTP() {
+	t.acmeHTTPStarted.Do(func() {
+		go func() {
+			err := http.ListenAndServe(
+				t.acmeHTTPAddr, t.acmeManager.HTTPHandler(nil))
+			transportLog.Errorw("ACME HTTP challenge server exited",
+				"addr", t.acmeHTTPAddr, "error", err)
+		}()
+	})
+}
+
 // Dial creates a TLS connection to the given address. The hostname part
 // of the address will be verified against the peer certificate.
 func (t *TLSTransport) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
-	inner, err := t.inner.Dial(ctx, address)
+	dialCtx, cancel := ctx, context.CancelFunc(func() {})
+	if t.connectTimeout > 0 {
+		dialCtx, cancel = context.WithTimeout(ctx, t.connectTimeout)
+	}
+	inner, err := t.inner.Dial(dialCtx, address)
+	cancel()
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to dial to TLS host")
 	}
@@ -120,6 +245,9 @@ func (t *TLSTransport) Dial(
 		return nil, errors.Wrap(err, "invalid address for TLS: "+address)
 	}
 	cfg.ServerName = host
+	if len(t.pins) > 0 {
+		cfg.VerifyPeerCertificate = t.verifyPin
+	}
 	tlsConn := tls.Client(inner, cfg)
 
 	// the channel must be buffered to prevent the hanshaking goroutine from
@@ -138,19 +266,32 @@ func (t *TLSTransport) Dial(
 			// the conn still need to be wrapped to retrieve the peer identifier
 			_ = tlsConn.Close()
 		}
-		return wrapTLSConn(tlsConn, t.handshakeTimeout), errors.WithStack(err)
+		return wrapTLSConn(tlsConn, inner, t.handshakeTimeout), errors.WithStack(err)
 	case <-ctx.Done():
 		_ = tlsConn.Close()
 		return nil, errors.WithStack(ctx.Err())
 	}
 }
 
+// ServerConfig returns a copy of the configuration used by the TLS servers,
+// so that other servers, e.g. an http.Server, can share it. The ACME
+// challenges are served as by Listen.
+func (t *TLSTransport) ServerConfig() *tls.Config {
+	if t.acmeManager != nil && t.acmeHTTPAddr != "" {
+		t.serveACMEHTTP()
+	}
+	return t.tlsConfig.Clone()
+}
+
 // Listen creates a TLS server listening on the given address.
 func (t *TLSTransport) Listen(address string) (net.Listener, error) {
 	innerListener, err := t.inner.Listen(address)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to accept client")
 	}
+	if t.acmeManager != nil && t.acmeHTTPAddr != "" {
+		t.serveACMEHTTP()
+	}
 	return &tlsListener{
 		innerListener, t.tlsConfig.Clone(), t.handshakeTimeout}, nil
 }
@@ -167,40 +308,77 @@ func (l *tlsListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 	tlsConn := tls.Server(conn, l.config)
-	return wrapTLSConn(tlsConn, l.handshakeTimeout), err
+	return wrapTLSConn(tlsConn, conn, l.handshakeTimeout), err
 }
 
 type tlsConnWrapper struct {
 	*tls.Conn
+	inner            net.Conn
 	inited           sync.Once
+	initErr          error
 	peerID           *PeerIdentifier
+	serverName       string
 	handshakeTimeout time.Duration
 }
 
-func wrapTLSConn(
-	conn *tls.Conn, handshakeTimeout time.Duration) *tlsConnWrapper {
-	return &tlsConnWrapper{Conn: conn, handshakeTimeout: handshakeTimeout}
+func wrapTLSConn(conn *tls.Conn, inner net.Conn,
+	handshakeTimeout time.Duration) *tlsConnWrapper {
+	return &tlsConnWrapper{
+		Conn: conn, inner: inner, handshakeTimeout: handshakeTimeout}
 }
 
-func (c *tlsConnWrapper) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
-	var err error
+// TransportStats forwards the statistics of the inner connection.
+func (c *tlsConnWrapper) TransportStats() map[string]interface{} {
+	if ts, ok := c.inner.(TransportStats); ok {
+		return ts.TransportStats()
+	}
+	return nil
+}
+
+// CompressionStats forwards the statistics of the inner connection, if it
+// is compressed.
+func (c *tlsConnWrapper) CompressionStats() (raw, compressed uint64) {
+	if cs, ok := c.inner.(CompressionStats); ok {
+		return cs.CompressionStats()
+	}
+	return 0, 0
+}
+
+func (c *tlsConnWrapper) init() error {
 	c.inited.Do(func() {
 		state := c.ConnectionState()
 		if !state.HandshakeComplete {
 			_ = c.SetDeadline(time.Now().Add(c.handshakeTimeout))
-			err = c.Handshake()
+			c.initErr = errors.WithStack(c.Handshake())
 			_ = c.SetDeadline(time.Time{})
 			state = c.ConnectionState()
 		}
 		c.peerID = makePeerIdentifier(state)
+		c.serverName = state.ServerName
 	})
-	return []*PeerIdentifier{c.peerID}, errors.WithStack(err)
+	return c.initErr
+}
+
+func (c *tlsConnWrapper) GetPeerIdentifiers() ([]*PeerIdentifier, error) {
+	err := c.init()
+	return []*PeerIdentifier{c.peerID}, err
+}
+
+// ServerName returns the SNI sent by the client, performing the handshake
+// if it has not been done. It is empty on the client side.
+func (c *tlsConnWrapper) ServerName() (string, error) {
+	err := c.init()
+	return c.serverName, err
 }
 
 func makePeerIdentifier(connState tls.ConnectionState) *PeerIdentifier {
 	if len(connState.PeerCertificates) > 0 {
 		cert := connState.PeerCertificates[0]
 		fingerprint := sha1.Sum(cert.Raw)
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
 		return &PeerIdentifier{
 			Scope:    "transport.tls",
 			UniqueID: hex.EncodeToString(fingerprint[:]),
@@ -210,6 +388,10 @@ func makePeerIdentifier(connState tls.ConnectionState) *PeerIdentifier {
 				"validFrom":  cert.NotBefore,
 				"validUntil": cert.NotAfter,
 				"resume":     connState.DidResume,
+				// matched by 'client_attrs' of the rules
+				"organizations":       cert.Subject.Organization,
+				"organizationalUnits": cert.Subject.OrganizationalUnit,
+				"uris":                uris,
 			},
 		}
 	}
@@ -2,11 +2,25 @@ package lib
 
 import (
 	"context"
+	"math"
 	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
+// transportLog is used by the transports to report problems that don't fail
+// any connection, e.g. ignored socket options.
+var transportLog = zap.NewNop().Sugar()
+
+// SetTransportLogger sets the logger used by the transports.
+func SetTransportLogger(logger *zap.SugaredLogger) {
+	transportLog = logger
+}
+
 // Transport provides the server and client sides operation on some
 // stream-oriented transport layer protocol.
 type Transport interface {
@@ -16,39 +30,200 @@ type Transport interface {
 	Listen(address string) (net.Listener, error)
 }
 
-// TCPTransport is a Transport on the TCP protocol.
-type TCPTransport struct{}
+// TCPTransport is a Transport on the TCP protocol. RecvBuf and SendBuf set
+// the socket buffer sizes of the connections if they are not 0. TFO enables
+// TCP Fast Open where supported. Backlog sets the listen backlog if it is
+// not 0.
+type TCPTransport struct {
+	RecvBuf int
+	SendBuf int
+	TFO     bool
+	Backlog int
+}
+
+// sockBufClamped is set once a clamped socket buffer size is logged, so that
+// it is logged only once, used atomically.
+var sockBufClamped uint32
+
+// tfoUnavailable is set once the failure to enable TCP Fast Open is logged,
+// used atomically.
+var tfoUnavailable uint32
 
 type tcpListener struct {
 	*net.TCPListener
+	transport TCPTransport
+}
+
+// NewTCPTransport creates a TCPTransport from the given configuration.
+func NewTCPTransport(config TCPConfig) (*TCPTransport, error) {
+	t := &TCPTransport{}
+	for _, opt := range []struct {
+		name, value string
+		size        *int
+	}{
+		{"so_rcvbuf", config.RecvBuf, &t.RecvBuf},
+		{"so_sndbuf", config.SendBuf, &t.SendBuf},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		size, err := ParseBytes(opt.value)
+		if err != nil || size == 0 || size > math.MaxInt32 {
+			return nil, errors.Errorf(
+				"invalid '%s': %q", opt.name, opt.value)
+		}
+		*opt.size = int(size)
+	}
+	t.TFO = config.TFO
+	if config.Backlog < 0 {
+		return nil, errors.Errorf("invalid 'backlog': %d", config.Backlog)
+	} else if config.Backlog > 0 && setListenBacklog == nil {
+		return nil, errors.New("'backlog' is not supported on this platform")
+	}
+	t.Backlog = config.Backlog
+	return t, nil
 }
 
 // Dial creates a connection to a TCP server.
-func (TCPTransport) Dial(
+func (t TCPTransport) Dial(
 	ctx context.Context, address string) (net.Conn, error) {
-	conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+	dialer := net.Dialer{Control: dialControl(ctx, t.TFO)}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err == nil {
+		if err = t.setSockBufs(conn.(*net.TCPConn)); err != nil {
+			_ = conn.Close()
+			conn = nil
+		}
+	}
 	return conn, errors.WithStack(err)
 }
 
 // Listen creates a TCP listener on a given address.
-func (TCPTransport) Listen(address string) (net.Listener, error) {
-	if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+func (t TCPTransport) Listen(address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if t.TFO {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			enableTFO(network, c, true)
+			return nil
+		}
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
 		return nil, errors.WithStack(err)
-	} else {
-		listener, err := net.ListenTCP("tcp", addr)
-		return tcpListener{listener}, errors.WithStack(err)
 	}
+	if t.Backlog > 0 {
+		if err = setListenBacklog(
+			listener.(*net.TCPListener), t.Backlog); err != nil {
+			_ = listener.Close()
+			return nil, errors.Wrap(err, "failed to set the listen backlog")
+		}
+	}
+	return tcpListener{listener.(*net.TCPListener), t}, nil
 }
 
 func (l tcpListener) Accept() (net.Conn, error) {
-	if conn, err := l.AcceptTCP(); err != nil {
+	conn, err := l.AcceptTCP()
+	if err != nil {
 		return nil, errors.WithStack(err)
-	} else if err = conn.SetKeepAlive(true); err != nil {
+	}
+	if err = conn.SetKeepAlive(true); err == nil {
+		err = l.transport.setSockBufs(conn)
+	}
+	if err != nil {
 		_ = conn.Close()
 		return nil, errors.WithStack(err)
-	} else {
-		return conn, nil
 	}
+	return conn, nil
+}
+
+// dialControl returns the Control function of a net.Dialer that applies the
+// DSCP value in the context and enables TCP Fast Open if tfo is set, or nil
+// if there is nothing to do.
+func dialControl(ctx context.Context, tfo bool) func(
+	network, address string, c syscall.RawConn) error {
+	dscp, hasDSCP := dscpFromContext(ctx)
+	hasDSCP = hasDSCP && setDSCPControl != nil
+	if !hasDSCP && !tfo {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if hasDSCP {
+			if err := setDSCPControl(network, c, dscp); err != nil {
+				return err
+			}
+		}
+		if tfo {
+			enableTFO(network, c, false)
+		}
+		return nil
+	}
+}
+
+// enableTFO enables TCP Fast Open on a TCP socket before it connects or
+// listens. A dialed connection then sends its first data along with the SYN,
+// so connecting errors are reported by the first I/O instead. It falls back to
+// the normal handshake if TFO is not supported, which is logged once.
+func enableTFO(network string, c syscall.RawConn, listen bool) {
+	if !strings.HasPrefix(network, "tcp") {
+		return
+	}
+	err := errors.New("not supported on this platform")
+	if setTFOControl != nil {
+		err = setTFOControl(c, listen)
+	}
+	if err != nil && atomic.CompareAndSwapUint32(&tfoUnavailable, 0, 1) {
+		transportLog.Warnw(
+			"failed to enable TCP Fast Open, ignored", "error", err)
+	}
+}
+
+// setSockBufs sets the socket buffer sizes of the connection. The OS may
+// clamp the sizes silently, which is logged if it can be detected.
+func (t TCPTransport) setSockBufs(conn *net.TCPConn) error {
+	if t.RecvBuf > 0 {
+		if err := conn.SetReadBuffer(t.RecvBuf); err != nil {
+			return err
+		}
+	}
+	if t.SendBuf > 0 {
+		if err := conn.SetWriteBuffer(t.SendBuf); err != nil {
+			return err
+		}
+	}
+	if (t.RecvBuf > 0 || t.SendBuf > 0) && getSockBufs != nil &&
+		atomic.LoadUint32(&sockBufClamped) == 0 {
+		recvBuf, sendBuf, err := getSockBufs(conn)
+		if err == nil && (recvBuf < t.RecvBuf || sendBuf < t.SendBuf) &&
+			atomic.CompareAndSwapUint32(&sockBufClamped, 0, 1) {
+			transportLog.Warnw("TCP socket buffer sizes are clamped by the OS",
+				"so_rcvbuf", t.RecvBuf, "actualRcvBuf", recvBuf,
+				"so_sndbuf", t.SendBuf, "actualSndBuf", sendBuf)
+		}
+	}
+	return nil
+}
+
+// ListenAll creates listeners on all the addresses expanded from the given
+// address, which may contain a port range. Either all or none of the
+// listeners are created.
+func ListenAll(
+	transport Transport, address string) ([]net.Listener, error) {
+	addrs, err := ExpandAddressRange(address)
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := transport.Listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, errors.WithMessage(err, "failed to listen on "+addr)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
 }
 
 // CreateTransport creates a Transport according to the given configuration.
@@ -59,26 +234,81 @@ func CreateTransport(
 		return TCPTransport{}, nil
 	}
 
-	// Proxied/KCP/TCP is should be the inner most layer
+	// Proxied/KCP/Exec/TCP/Custom is should be the inner most layer
 	if config.KCP != nil && config.Proxied != nil {
 		err = errors.New("'kcp' cannot be used along with 'proxied'")
+	} else if config.TCP != nil && (config.KCP != nil || config.Proxied != nil) {
+		err = errors.New("'tcp' cannot be used along with 'kcp' or 'proxied'")
+	} else if config.Exec != nil &&
+		(config.KCP != nil || config.Proxied != nil || config.TCP != nil) {
+		err = errors.New(
+			"'exec' cannot be used along with 'kcp', 'proxied' or 'tcp'")
+	} else if config.Custom != nil && (config.KCP != nil ||
+		config.Proxied != nil || config.TCP != nil || config.Exec != nil) {
+		err = errors.New(
+			"'custom' cannot be used along with 'kcp', 'proxied', 'tcp' or 'exec'")
+	} else if config.Custom != nil {
+		transport, err = newCustomTransport(*config.Custom)
+	} else if config.Exec != nil {
+		transport, err = NewExecTransport(*config.Exec)
 	} else if config.KCP != nil {
 		transport, err = NewKCPTransport(*config.KCP)
 	} else if config.Proxied != nil {
 		transport, err = NewProxiedTransport(*config.Proxied)
+	} else if config.TCP != nil {
+		var tcp *TCPTransport
+		if tcp, err = NewTCPTransport(*config.TCP); err == nil {
+			transport = *tcp
+		}
 	} else {
 		transport = TCPTransport{}
 	}
 
-	// encryption wraps around the inner
-	if err == nil && config.TLS != nil {
-		transport, err = NewTLSTransport(*config.TLS, transport)
+	// the preferred family applies to the inner most layer, which is the
+	// one that resolves the address of the upstream
+	if err == nil && config.FamilyPreference != "" {
+		if config.Proxied != nil || config.Exec != nil || config.Custom != nil {
+			err = errors.New(
+				"'family_preference' can only be used with TCP or KCP")
+		} else {
+			transport, err = WrapTransFamilyPreference(
+				transport, config.FamilyPreference)
+		}
+	}
+
+	// the PROXY protocol header comes first on the wire, so it must be
+	// parsed before anything else on the server side
+	if err == nil && config.ProxyProtocol {
+		if config.KCP != nil || config.Proxied != nil || config.Exec != nil ||
+			config.Custom != nil {
+			err = errors.New("'proxy_protocol' can only be used with TCP")
+		} else {
+			transport = WrapTransProxyProtocol(transport)
+		}
 	}
 
-	// compression & pre_conn should be the outer most layer
-	if err == nil && config.Compression != "" {
-		transport, err = WrapTransCompression(transport, config.Compression)
+	if err == nil && config.CompressionDict != "" && config.Compression == "" {
+		err = errors.New("'compression_dict' requires 'compression'")
 	}
+
+	// encryption and compression are stacked in the configured order
+	var layers []string
+	if err == nil {
+		layers, err = transportLayers(config)
+	}
+	for _, layer := range layers {
+		if err != nil {
+			break
+		}
+		switch layer {
+		case "tls":
+			transport, err = NewTLSTransport(*config.TLS, transport)
+		case "compression":
+			transport, err = wrapTransCompressionConfig(transport, *config)
+		}
+	}
+
+	// pre_conn should be the outer most layer
 	if err == nil && config.PreConn != nil {
 		transport, err = WrapAsPreConnTransport(transport, *config.PreConn)
 	}
@@ -86,3 +316,66 @@ func CreateTransport(
 	err = errors.WithMessage(err, "failed to create transport")
 	return
 }
+
+func newCustomTransport(config CustomTransportConfig) (Transport, error) {
+	if config.Name == "" {
+		return nil, errors.New("'name' is required for 'custom'")
+	}
+	factory, ok := lookupTransport(config.Name)
+	if !ok {
+		return nil, errors.New("unknown custom transport: " + config.Name)
+	}
+	return factory(config.Settings)
+}
+
+// transportLayers returns the wrapping layers on top of the inner most one,
+// from the inner to the outer. By default, TLS wraps around the inner layer
+// and compression is the outer most.
+func transportLayers(config *TransportConfig) ([]string, error) {
+	enabled := map[string]bool{
+		"tls": config.TLS != nil, "compression": config.Compression != ""}
+	if len(config.Layers) == 0 {
+		var layers []string
+		for _, layer := range []string{"tls", "compression"} {
+			if enabled[layer] {
+				layers = append(layers, layer)
+			}
+		}
+		return layers, nil
+	}
+
+	base := "tcp"
+	if config.KCP != nil {
+		base = "kcp"
+	} else if config.Proxied != nil {
+		base = "proxied"
+	} else if config.Exec != nil {
+		base = "exec"
+	} else if config.Custom != nil {
+		base = config.Custom.Name
+	}
+	if config.Layers[0] != base {
+		return nil, errors.Errorf(
+			"the first of 'layers' should be the inner most one: %s", base)
+	}
+	layers := config.Layers[1:]
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		used, known := enabled[layer]
+		switch {
+		case !known:
+			return nil, errors.New("invalid layer in 'layers': " + layer)
+		case !used:
+			return nil, errors.New("layer not configured: " + layer)
+		case seen[layer]:
+			return nil, errors.New("duplicated layer in 'layers': " + layer)
+		}
+		seen[layer] = true
+	}
+	for layer, used := range enabled {
+		if used && !seen[layer] {
+			return nil, errors.New("layer missing from 'layers': " + layer)
+		}
+	}
+	return layers, nil
+}
@@ -3,16 +3,32 @@ package lib
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -78,6 +94,30 @@ func TestTransport(t *testing.T) {
 	}
 }
 
+func TestTransportLayers(t *testing.T) {
+	layers := []string{"tcp", "compression", "tls"}
+	svrConfig := &TransportConfig{
+		Compression: "snappy", TLS: gTLSServerConfig, Layers: layers}
+	cliConfig := &TransportConfig{
+		Compression: "snappy", TLS: gTLSClientConfig, Layers: layers}
+	doTestWithTransConf(t, svrConfig, cliConfig)
+
+	for _, layers := range [][]string{
+		{"tls", "compression"},                // not starting from the inner
+		{"kcp", "tls", "compression"},         // inner not configured
+		{"tcp", "tls"},                        // compression missing
+		{"tcp", "tls", "compression", "tls"},  // duplicated
+		{"tcp", "tls", "compression", "gzip"}, // unknown
+	} {
+		_, err := CreateTransport(&TransportConfig{
+			Compression: "snappy", TLS: gTLSClientConfig, Layers: layers})
+		assert.Error(t, err, "%v", layers)
+	}
+	_, err := CreateTransport(&TransportConfig{
+		TLS: gTLSClientConfig, Layers: []string{"tcp", "compression", "tls"}})
+	assert.Error(t, err, "layer not configured")
+}
+
 func doTestWithTransConf(t *testing.T, svrConfig, cliConfig *TransportConfig) {
 	svrTrans, err := CreateTransport(svrConfig)
 	require.NoError(t, err)
@@ -105,8 +145,9 @@ func doTestWithTransConf(t *testing.T, svrConfig, cliConfig *TransportConfig) {
 			_ = client.SetDeadline(time.Now().Add(30 * time.Second))
 
 			for _, data := range getRandomData(16) {
-				_, err := client.Write(data)
+				n, err := client.Write(data)
 				require.NoError(t, err)
+				require.Equal(t, len(data), n)
 
 				buf := make([]byte, len(data))
 				_, err = io.ReadFull(client, buf)
@@ -114,6 +155,15 @@ func doTestWithTransConf(t *testing.T, svrConfig, cliConfig *TransportConfig) {
 
 				assert.True(t, bytes.Equal(buf, data))
 			}
+
+			// the echoed data can still be read after half-closing
+			require.Implements(t, (*CloseWriter)(nil), client)
+			_, err = client.Write([]byte("bye"))
+			require.NoError(t, err)
+			require.NoError(t, client.(CloseWriter).CloseWrite())
+			rest, err := ioutil.ReadAll(client)
+			require.NoError(t, err)
+			assert.Equal(t, "bye", string(rest))
 		}()
 	}
 
@@ -207,12 +257,15 @@ func (s *KCPKeepAliveTestSuite) SetupTest() {
 
 func (s *KCPKeepAliveTestSuite) TearDownTest() {
 	// check if the connection lists are correctly emptied
-	s.svrTrans.connsMtx.Lock()
-	defer s.svrTrans.connsMtx.Unlock()
-	s.Equal(0, s.svrTrans.conns.Len())
-	s.cliTrans.connsMtx.Lock()
-	defer s.cliTrans.connsMtx.Unlock()
-	s.Equal(0, s.cliTrans.conns.Len())
+	s.Equal(0, s.countConns(s.svrTrans))
+	s.Equal(0, s.countConns(s.cliTrans))
+}
+
+func (s *KCPKeepAliveTestSuite) countConns(trans *KCPTransport) int {
+	s.Require().NotNil(trans.keepAliveQueue)
+	trans.keepAliveQueue.mtx.Lock()
+	defer trans.keepAliveQueue.mtx.Unlock()
+	return trans.keepAliveQueue.items.Len()
 }
 
 func (s *KCPKeepAliveTestSuite) startServer(
@@ -374,3 +427,593 @@ func (s *KCPKeepAliveTestSuite) TestClientConnLost() {
 func TestKCPTestSuite(t *testing.T) {
 	suite.Run(t, new(KCPKeepAliveTestSuite))
 }
+
+func TestKCPPSK(t *testing.T) {
+	newTrans := func(psk string) *KCPTransport {
+		trans, err := NewKCPTransport(KCPConfig{PSK: psk})
+		require.NoError(t, err)
+		return trans
+	}
+	listener, err := newTrans("secret").Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	addr := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli, err := newTrans("secret").Dial(ctx, addr)
+	require.NoError(t, err)
+	_, err = cli.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(cli, buf)
+	require.NoError(t, err)
+	assert.EqualValues(t, "hello", buf)
+	require.Implements(t, (*TransportStats)(nil), cli)
+	assert.Contains(t, cli.(TransportStats).TransportStats(), "kcp.conv")
+	assert.Len(t, cli.(TransportStats).TransportStats(), 2) // per session
+	assert.NotNil(t, GetKCPGlobalStats())
+	_ = cli.Close()
+
+	for _, psk := range []string{"wrong", ""} {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 500*time.Millisecond)
+		cli, err = newTrans(psk).Dial(ctx, addr)
+		cancel()
+		if err == nil { // no handshake without PSK, but no response either
+			_ = cli.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, _ = cli.Write([]byte("hello"))
+			_, err = cli.Read(buf)
+			_ = cli.Close()
+		}
+		assert.Error(t, err, "psk: %s", psk)
+	}
+}
+
+func TestKCPLocalAddr(t *testing.T) {
+	if reuseAddrControl == nil {
+		t.Skip("reuse_local_addr is not supported")
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	localAddr := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	svrTrans, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		listener, err := svrTrans.Listen("127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close() // nolint: errcheck
+		addrs = append(addrs, listener.Addr().String())
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(conn, conn)
+					_ = conn.Close()
+				}()
+			}
+		}()
+	}
+
+	cliTrans, err := NewKCPTransport(
+		KCPConfig{LocalAddr: localAddr, ReuseLocalAddr: true})
+	require.NoError(t, err)
+	for _, addr := range addrs {
+		cli, err := cliTrans.Dial(context.Background(), addr)
+		require.NoError(t, err)
+		defer cli.Close() // nolint: errcheck
+		assert.Equal(t, localAddr, cli.LocalAddr().String())
+		_, err = cli.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(cli, buf)
+		require.NoError(t, err)
+		assert.EqualValues(t, "hello", buf)
+	}
+
+	_, err = NewKCPTransport(KCPConfig{ReuseLocalAddr: true})
+	assert.Error(t, err)
+	_, err = NewKCPTransport(KCPConfig{LocalAddr: "invalid"})
+	assert.Error(t, err)
+	_, err = CreateProxyClient(ProxyConfig{
+		Protocol:  "socks5",
+		Settings:  map[string]interface{}{"address": addrs[0]},
+		Transport: &TransportConfig{KCP: &KCPConfig{LocalAddr: localAddr}}})
+	assert.Error(t, err)
+}
+
+func TestKCPLocalAddrSameRemote(t *testing.T) {
+	origLinger := kcpCloseLingerTimeout
+	kcpCloseLingerTimeout = 500 * time.Millisecond
+	defer func() { kcpCloseLingerTimeout = origLinger }()
+
+	svrTrans, err := NewKCPTransport(KCPConfig{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	configs := []KCPConfig{{}}
+	if reuseAddrControl != nil {
+		configs = append(configs, KCPConfig{ReuseLocalAddr: true})
+	}
+	for _, config := range configs {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		config.LocalAddr = pc.LocalAddr().String()
+		require.NoError(t, pc.Close())
+		cliTrans, err := NewKCPTransport(config)
+		require.NoError(t, err)
+
+		cli, err := cliTrans.Dial(context.Background(), listener.Addr().String())
+		require.NoError(t, err)
+		_, err = cli.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(cli, buf)
+		require.NoError(t, err)
+
+		// the second session to the same server is refused at once
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = cliTrans.Dial(ctx, listener.Addr().String())
+		cancel()
+		require.Error(t, err, "%+v", config)
+		assert.Contains(t, err.Error(), "still open")
+
+		// even while the first one lingers after being closed
+		require.NoError(t, cli.Close())
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		_, err = cliTrans.Dial(ctx, listener.Addr().String())
+		cancel()
+		require.Error(t, err, "%+v", config)
+		assert.Contains(t, err.Error(), "still open")
+
+		// but can be dialed once the first one is gone
+		time.Sleep(800 * time.Millisecond)
+		cli, err = cliTrans.Dial(context.Background(), listener.Addr().String())
+		require.NoError(t, err, "%+v", config)
+		_ = cli.Close()
+		time.Sleep(800 * time.Millisecond)
+	}
+}
+
+func TestTLSACME(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "thestral2-acme")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir) // nolint: errcheck
+	httpAddr := "127.0.0.1:" + strconv.Itoa(50000+(rand.Intn(2048)))
+	acmeConfig := &ACMEConfig{
+		Hosts: []string{"example.com"}, CacheDir: cacheDir,
+		HTTPAddr: httpAddr, DirectoryURL: "http://127.0.0.1:1/directory"}
+
+	for _, config := range []TLSConfig{
+		{ACME: &ACMEConfig{CacheDir: cacheDir}},
+		{ACME: &ACMEConfig{Hosts: []string{"example.com"}}},
+		{ACME: acmeConfig, Cert: gTLSServerConfig.Cert},
+	} {
+		_, err = NewTLSTransport(config, TCPTransport{})
+		assert.Error(t, err, "%+v", config)
+	}
+
+	svrTrans, err := CreateTransport(
+		&TransportConfig{TLS: &TLSConfig{ACME: acmeConfig}})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_, _ = conn.Read(make([]byte, 1)) // handshake
+			_ = conn.Close()
+		}
+	}()
+
+	// the host is rejected before contacting the CA
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cliTrans, err := NewTLSTransport(*gTLSClientConfig, TCPTransport{})
+	require.NoError(t, err)
+	_, err = cliTrans.Dial(ctx, listener.Addr().String())
+	assert.Error(t, err)
+	assert.NoError(t, ctx.Err())
+
+	// the HTTP-01 challenges are served, only for the allowed hosts
+	get := func(host string) (int, error) {
+		req, err := http.NewRequest(http.MethodGet,
+			"http://"+httpAddr+"/.well-known/acme-challenge/x", nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	var status int
+	for i := 0; i < 50; i++ {
+		if status, err = get("example.com"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status) // no such token
+	status, err = get("example.org")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+// writeTestCert writes a certificate and its key into dir, signed by the
+// given CA or self-signed as a CA if it is nil.
+func writeTestCert(
+	t *testing.T, dir, name string, ca *x509.Certificate,
+	caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(rand.Int63()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(
+		crand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestTLSClientCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thestral2-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+	ca, caKey := writeTestCert(t, dir, "ca2", nil, nil)
+	writeTestCert(t, dir, "client2", ca, caKey)
+
+	svrConfig := *gTLSServerConfig
+	svrConfig.ClientCAs = []string{filepath.Join(dir, "ca2.pem")}
+	svrTrans, err := NewTLSTransport(svrConfig, TCPTransport{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	echo := func(config TLSConfig) error {
+		trans, err := NewTLSTransport(config, TCPTransport{})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		conn, err := trans.Dial(ctx, listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close() // nolint: errcheck
+		if _, err = conn.Write([]byte("x")); err == nil {
+			_, err = io.ReadFull(conn, make([]byte, 1))
+		}
+		return err
+	}
+
+	// the main certificate is not issued by ca2
+	assert.Error(t, echo(*gTLSClientConfig))
+	cliConfig := *gTLSClientConfig
+	cliConfig.ClientCerts = []CertKeyPair{{
+		Cert: filepath.Join(dir, "client2.pem"),
+		Key:  filepath.Join(dir, "client2.key.pem"),
+	}}
+	assert.NoError(t, echo(cliConfig))
+
+	cliConfig.ClientCerts[0].Key = gTLSClientConfig.Key
+	_, err = NewTLSTransport(cliConfig, TCPTransport{})
+	assert.Error(t, err)
+}
+
+// spkiPin returns the pin of the public key in the certificate file.
+func spkiPin(t *testing.T, certFile string) string {
+	data, err := ioutil.ReadFile(certFile)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestTLSPinSHA256(t *testing.T) {
+	svrTrans, err := NewTLSTransport(*gTLSServerConfig, TCPTransport{})
+	require.NoError(t, err)
+	listener, err := svrTrans.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(pins ...string) error {
+		config := *gTLSClientConfig
+		config.PinSHA256 = pins
+		trans, err := NewTLSTransport(config, TCPTransport{})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		conn, err := trans.Dial(ctx, listener.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+
+	svrPin := spkiPin(t, gTLSServerConfig.Cert)
+	otherPin := spkiPin(t, gTLSClientConfig.Cert)
+	assert.NoError(t, dial())
+	assert.NoError(t, dial(svrPin))
+	assert.NoError(t, dial(otherPin, svrPin))
+	// the chain is valid but the key is unexpected
+	assert.Error(t, dial(otherPin))
+
+	for _, pin := range []string{"x", base64.StdEncoding.EncodeToString(
+		[]byte("too short"))} {
+		config := *gTLSClientConfig
+		config.PinSHA256 = []string{pin}
+		_, err = NewTLSTransport(config, TCPTransport{})
+		assert.Error(t, err, pin)
+	}
+}
+
+// blockingTransport dials forever until the context is done.
+type blockingTransport struct{}
+
+func (blockingTransport) Dial(ctx context.Context, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingTransport) Listen(string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestTLSConnectTimeout(t *testing.T) {
+	config := *gTLSClientConfig
+	config.ConnectTimeout = "100ms"
+	trans, err := NewTLSTransport(config, blockingTransport{})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = trans.Dial(context.Background(), "127.0.0.1:1")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	for _, v := range []string{"0s", "-1s", "x"} {
+		config.ConnectTimeout = v
+		_, err = NewTLSTransport(config, blockingTransport{})
+		assert.Error(t, err, v)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	for _, method := range []string{"snappy", "deflate"} {
+		cliInner, svrInner := net.Pipe()
+		cli, err := compWrapConn(cliInner, method, nil)
+		require.NoError(t, err)
+		svr, err := compWrapConn(svrInner, method, nil)
+		require.NoError(t, err)
+
+		data := bytes.Repeat([]byte("thestral"), 1024)
+		written := make(chan struct{})
+		go func() {
+			_, _ = cli.Write(data)
+			close(written)
+		}()
+		_, err = io.ReadFull(svr, make([]byte, len(data)))
+		require.NoError(t, err)
+		<-written
+		for _, conn := range []net.Conn{cli, svr} {
+			raw, compressed := conn.(CompressionStats).CompressionStats()
+			assert.EqualValues(t, len(data), raw, method)
+			assert.True(t, compressed > 0 && compressed < raw/10, method)
+		}
+		_ = cliInner.Close() // or closing the compressors would block
+		_ = svrInner.Close()
+	}
+}
+
+func TestCompressionDict(t *testing.T) {
+	msg := []byte("GET /api/v1/tunnels HTTP/1.1\r\nHost: example.com\r\n" +
+		"User-Agent: thestral2\r\nAccept: application/json\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\nConnection: keep-alive\r\n" +
+		"Cookie: session=abcdef0123456789; lang=en-US\r\n\r\n")
+	dict := append([]byte("POST /api/v1/users"), msg...)
+	// send returns the error on the receiving side, or the bytes sent
+	send := func(cliDict, svrDict []byte) (uint64, error) {
+		cliInner, svrInner := net.Pipe()
+		// or closing the compressors would block
+		defer cliInner.Close() // nolint: errcheck
+		defer svrInner.Close() // nolint: errcheck
+		cli, err := compWrapConn(cliInner, "deflate", cliDict)
+		require.NoError(t, err)
+		svr, err := compWrapConn(svrInner, "deflate", svrDict)
+		require.NoError(t, err)
+
+		written := make(chan struct{})
+		go func() {
+			_, _ = cli.Write(msg)
+			close(written)
+		}()
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(svr, buf); err != nil {
+			return 0, err
+		}
+		<-written
+		assert.Equal(t, msg, buf)
+		_, compressed := cli.(CompressionStats).CompressionStats()
+		return compressed, nil
+	}
+
+	withDict, err := send(dict, dict)
+	assert.NoError(t, err)
+	withoutDict, err := send(nil, nil)
+	assert.NoError(t, err)
+	// the dictionary makes the small messages smaller, even with the digest
+	assert.True(t, withDict < withoutDict, "%d vs %d", withDict, withoutDict)
+
+	_, err = send(dict, append([]byte("x"), dict...))
+	assert.EqualError(t, err, "compression dictionary mismatch")
+	_, err = send(nil, dict)
+	assert.Error(t, err)
+
+	_, err = WrapTransCompressionDict(TCPTransport{}, "snappy", dict)
+	assert.Error(t, err)
+	_, err = wrapTransCompressionConfig(TCPTransport{}, TransportConfig{
+		Compression: "deflate", CompressionDict: "/nonexistent/dict"})
+	assert.Error(t, err)
+}
+
+func TestTLSPeerIdentifierAttrs(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.com/ops/agent")
+	require.NoError(t, err)
+	id := makePeerIdentifier(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{
+			Raw: []byte("cert"),
+			Subject: pkix.Name{CommonName: "agent",
+				Organization:       []string{"Example"},
+				OrganizationalUnit: []string{"ops", "infra"}},
+			URIs: []*url.URL{uri},
+		}}})
+	require.NotNil(t, id)
+	assert.Equal(t, "agent", id.Name)
+	assert.Equal(t, []string{"Example"}, id.ExtraInfo["organizations"])
+	assert.Equal(t,
+		[]string{"ops", "infra"}, id.ExtraInfo["organizationalUnits"])
+	assert.Equal(t,
+		[]string{"spiffe://example.com/ops/agent"}, id.ExtraInfo["uris"])
+}
+
+// recordingTransport records the addresses dialed and fails them all.
+type recordingTransport struct {
+	dialed []string
+}
+
+func (t *recordingTransport) Dial(
+	_ context.Context, addr string) (net.Conn, error) {
+	t.dialed = append(t.dialed, addr)
+	return nil, errors.New("unreachable")
+}
+
+func (*recordingTransport) Listen(string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestFamilyPreference(t *testing.T) {
+	lookup := func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host != "upstream.test" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IPAddr{
+			{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")},
+			{IP: net.ParseIP("192.0.2.2")}, {IP: net.ParseIP("2001:db8::2")},
+		}, nil
+	}
+	for family, exp := range map[string][]string{
+		"ipv4": {"192.0.2.1:80", "192.0.2.2:80",
+			"[2001:db8::1]:80", "[2001:db8::2]:80"},
+		"ipv6": {"[2001:db8::1]:80", "[2001:db8::2]:80",
+			"192.0.2.1:80", "192.0.2.2:80"},
+	} {
+		inner := &recordingTransport{}
+		trans, err := WrapTransFamilyPreference(inner, family)
+		require.NoError(t, err)
+		trans.(*familyTransWrapper).lookup = lookup
+
+		_, err = trans.Dial(context.Background(), "upstream.test:80")
+		assert.Error(t, err)
+		assert.Equal(t, exp, inner.dialed, family)
+
+		// literal addresses are dialed as is
+		inner.dialed = nil
+		_, err = trans.Dial(context.Background(), "192.0.2.3:80")
+		assert.Error(t, err)
+		assert.Equal(t, []string{"192.0.2.3:80"}, inner.dialed)
+
+		inner.dialed = nil
+		_, err = trans.Dial(context.Background(), "unknown.test:80")
+		assert.Error(t, err)
+		assert.Empty(t, inner.dialed)
+	}
+
+	_, err := WrapTransFamilyPreference(TCPTransport{}, "ipv5")
+	assert.Error(t, err)
+	_, err = CreateTransport(&TransportConfig{
+		FamilyPreference: "ipv6", Proxied: &ProxyConfig{}})
+	assert.Error(t, err)
+	trans, err := CreateTransport(&TransportConfig{FamilyPreference: "ipv4"})
+	require.NoError(t, err)
+	assert.IsType(t, &familyTransWrapper{}, trans)
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/richardtsai/thestral2/lib"
 	"github.com/richardtsai/thestral2/tools"
 )
@@ -53,6 +54,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	app.configFile = *configFile
 
 	if config.Misc.PProfAddr != "" {
 		fmt.Fprintf(os.Stderr, "Warning: misc.pprof_addr "+
@@ -62,15 +64,45 @@ func main() {
 		}
 	}
 	if config.Misc.DebugAddr != "" {
+		http.HandleFunc("/readyz", app.monitor.HandleReadiness)
+		server, err := newDebugServer(
+			config.Misc.DebugAddr, config.Misc.DebugTLS)
+		if err != nil {
+			panic(err)
+		}
 		go func() {
-			e := http.ListenAndServe(config.Misc.DebugAddr, nil)
+			var e error
+			if server.TLSConfig != nil {
+				e = server.ListenAndServeTLS("", "") // certs in TLSConfig
+			} else {
+				e = server.ListenAndServe()
+			}
 			if e != nil {
 				panic(e)
 			}
 		}()
+	} else if config.Misc.DebugTLS != nil {
+		panic("misc.debug_tls requires misc.debug_addr")
 	}
 
+	watchMaintenanceSignal(app)
 	if err = app.Run(context.Background()); err != nil {
 		panic(err)
 	}
 }
+
+// newDebugServer creates the server of the monitor, pprof and the readiness
+// probe, which are registered on http.DefaultServeMux. It serves over TLS if
+// tlsConfig is not nil.
+func newDebugServer(
+	addr string, tlsConfig *lib.TLSConfig) (*http.Server, error) {
+	server := &http.Server{Addr: addr}
+	if tlsConfig != nil {
+		transport, err := lib.NewTLSTransport(*tlsConfig, lib.TCPTransport{})
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid misc.debug_tls")
+		}
+		server.TLSConfig = transport.ServerConfig()
+	}
+	return server, nil
+}
@@ -0,0 +1,6 @@
+// +build windows plan9
+
+package main
+
+// watchMaintenanceSignal is a no-op as SIGUSR2 is not available.
+func watchMaintenanceSignal(app *Thestral) {}
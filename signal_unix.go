@@ -0,0 +1,22 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchMaintenanceSignal toggles the maintenance mode on SIGUSR2.
+func watchMaintenanceSignal(app *Thestral) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+	go func() {
+		for range sigCh {
+			on := !app.monitor.InMaintenance()
+			app.monitor.SetMaintenance(on, false)
+			app.log.Infow("maintenance mode toggled", "on", on)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/richardtsai/thestral2/lib"
+)
+
+func init() {
+	allTools = append(allTools, benchTool{})
+}
+
+type benchTool struct{}
+
+func (benchTool) Name() string {
+	return "bench"
+}
+
+func (benchTool) Description() string {
+	return "Drive synthetic load through a SOCKS5 proxy to an echo server"
+}
+
+// benchResult is what a worker has measured.
+type benchResult struct {
+	tunnels      int
+	errors       int
+	bytes        uint64 // echoed back
+	connLats     []time.Duration
+	roundTripLat []time.Duration
+}
+
+func (t benchTool) Run(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	proxy := fs.String(
+		"proxy", "127.0.0.1:1080", "address of the SOCKS5 proxy.")
+	target := fs.String(
+		"target", "", "HOST:PORT of an echo server reachable from the proxy.")
+	conns := fs.Int("conns", 10, "number of concurrent tunnels.")
+	duration := fs.Duration("duration", 10*time.Second, "duration of the test.")
+	size := fs.Int("size", 16*1024, "bytes sent in each round trip.")
+	user := fs.String("user", "", "username for the proxy, if required.")
+	password := fs.String("password", "", "password for the proxy.")
+	_ = fs.Parse(args)
+	if *target == "" || *conns <= 0 || *size <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	targetAddr, err := lib.ParseAddress(*target)
+	if err != nil {
+		panic(err)
+	}
+	cli := &lib.SOCKS5Client{
+		Transport: lib.TCPTransport{}, Addr: *proxy,
+		Username: *user, Password: *password}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	results := make([]benchResult, *conns)
+	var wg sync.WaitGroup
+	startTime := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(r *benchResult) {
+			defer wg.Done()
+			t.work(ctx, cli, targetAddr, *size, r)
+		}(&results[i])
+	}
+	wg.Wait()
+	t.report(results, time.Since(startTime))
+}
+
+// work keeps echoing random data through tunnels until the context is done,
+// opening a new tunnel whenever the current one fails.
+func (benchTool) work(
+	ctx context.Context, cli *lib.SOCKS5Client, target lib.Address,
+	size int, r *benchResult) {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	buf := make([]byte, size)
+	for ctx.Err() == nil {
+		startTime := time.Now()
+		rwc, _, pErr := cli.Request(ctx, target)
+		if pErr != nil {
+			if ctx.Err() == nil {
+				r.errors++
+			}
+			continue
+		}
+		r.tunnels++
+		r.connLats = append(r.connLats, time.Since(startTime))
+		go func() { // unblock the I/O when the time is up
+			<-ctx.Done()
+			_ = rwc.Close()
+		}()
+
+		for ctx.Err() == nil {
+			startTime = time.Now()
+			_, err := rwc.Write(data)
+			if err == nil {
+				_, err = io.ReadFull(rwc, buf)
+			}
+			if err == nil && !bytes.Equal(data, buf) {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					r.errors++
+				}
+				break
+			}
+			r.bytes += uint64(size)
+			r.roundTripLat = append(r.roundTripLat, time.Since(startTime))
+		}
+		_ = rwc.Close()
+	}
+}
+
+func (benchTool) report(results []benchResult, elapsed time.Duration) {
+	var total benchResult
+	for _, r := range results {
+		total.tunnels += r.tunnels
+		total.errors += r.errors
+		total.bytes += r.bytes
+		total.connLats = append(total.connLats, r.connLats...)
+		total.roundTripLat = append(total.roundTripLat, r.roundTripLat...)
+	}
+	percentile := func(lats []time.Duration, p float64) time.Duration {
+		if len(lats) == 0 {
+			return 0
+		}
+		return lats[int(float64(len(lats)-1)*p)]
+	}
+	for _, lats := range [][]time.Duration{total.connLats, total.roundTripLat} {
+		sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	}
+	errorRate := 0.0
+	if attempts := total.tunnels + total.errors; attempts > 0 {
+		errorRate = float64(total.errors) / float64(attempts) * 100
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 2, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Duration:\t%s\t\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Tunnels:\t%d\t\n", total.tunnels)
+	fmt.Fprintf(w, "Errors:\t%d\t(%.2f%%)\t\n", total.errors, errorRate)
+	fmt.Fprintf(w, "Throughput:\t%s/s\t(each direction)\t\n",
+		lib.BytesHumanized(uint64(float64(total.bytes)/elapsed.Seconds())))
+	fmt.Fprintln(w, "\tp50\tp99\t")
+	fmt.Fprintf(w, "ConnLatency:\t%s\t%s\t\n",
+		percentile(total.connLats, 0.5), percentile(total.connLats, 0.99))
+	fmt.Fprintf(w, "RoundTrip:\t%s\t%s\t\n",
+		percentile(total.roundTripLat, 0.5),
+		percentile(total.roundTripLat, 0.99))
+	_ = w.Flush()
+}
@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/richardtsai/thestral2/lib"
+)
+
+func init() {
+	allTools = append(allTools, configTool{})
+}
+
+// redactedKeys are the keys whose values are hidden by 'dump -redact'.
+var redactedKeys = map[string]bool{"password": true, "psk": true, "dsn": true}
+
+const redactedValue = "<redacted>"
+
+type configTool struct{}
+
+func (configTool) Name() string {
+	return "config"
+}
+
+func (configTool) Description() string {
+	return "Print the effective configuration with the defaults applied"
+}
+
+func (t configTool) Run(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		_, _ = fmt.Fprintln(os.Stderr, "Usage: config dump [options]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config dump", flag.ExitOnError)
+	configFile := fs.String("c", "", "thestral2 configuration file.")
+	redact := fs.Bool(
+		"redact", false, "hide the passwords, PSKs and database sources.")
+	_ = fs.Parse(args[1:])
+
+	config, err := lib.ParseConfigFile(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	if err = t.applyDefaults(config); err != nil {
+		panic(err)
+	}
+	data, err := yaml.Marshal(config)
+	if err == nil && *redact {
+		var tree yaml.MapSlice
+		if err = yaml.Unmarshal(data, &tree); err == nil {
+			data, err = yaml.Marshal(t.redact(tree))
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	_, _ = os.Stdout.Write(data)
+}
+
+// applyDefaults fills in what the service assumes for the settings left
+// empty, and expands the jump chains of the upstreams.
+func (configTool) applyDefaults(config *lib.Config) error {
+	upstreams, err := lib.ExpandJumpChains(config.Upstreams)
+	if err != nil {
+		return err
+	}
+	config.Upstreams = upstreams
+
+	misc := &config.Misc
+	if misc.ConnectTimeout == "" {
+		misc.ConnectTimeout = lib.DefaultConnectTimeout.String()
+	}
+	if misc.MonitorInterval == "" {
+		misc.MonitorInterval = lib.DefaultMonitorUpdateInterval.String()
+	}
+	if misc.DefaultAction == "" {
+		misc.DefaultAction = "allow"
+	}
+	if misc.Stats != nil {
+		if misc.Stats.FlushInterval == "" {
+			misc.Stats.FlushInterval = lib.DefaultStatsFlushInterval.String()
+		}
+		if misc.Stats.Bucket == "" {
+			misc.Stats.Bucket = lib.DefaultStatsBucket.String()
+		}
+	}
+	return nil
+}
+
+// redact replaces the non-empty values of redactedKeys in the tree
+// recursively.
+func (t configTool) redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key, _ := item.Key.(string)
+			if redactedKeys[key] && item.Value != nil && item.Value != "" {
+				v[i].Value = redactedValue
+			} else {
+				v[i].Value = t.redact(item.Value)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = t.redact(item)
+		}
+	}
+	return v
+}
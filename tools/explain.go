@@ -0,0 +1,121 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/richardtsai/thestral2/lib"
+)
+
+func init() {
+	allTools = append(allTools, explainTool{})
+}
+
+type explainTool struct{}
+
+func (explainTool) Name() string {
+	return "explain"
+}
+
+func (explainTool) Description() string {
+	return "Show how a request would be routed without sending any traffic"
+}
+
+func (t explainTool) Run(args []string) {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	configFile := fs.String("c", "", "thestral2 configuration file.")
+	downstream := fs.String(
+		"downstream", "", "name of the downstream receiving the request.")
+	clientAddr := fs.String("client", "", "address of the client.")
+	clientUser := fs.String(
+		"user", "", "user of the client, either SCOPE/NAME or just NAME.")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr,
+			"Usage: explain [options] HOST[:PORT]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	target := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443") // the port is never matched
+	}
+	targetAddr, err := lib.ParseAddress(target)
+	if err != nil {
+		panic(err)
+	}
+	client := lib.ClientInfo{Addr: *clientAddr}
+	if *clientUser != "" {
+		id := &lib.PeerIdentifier{Name: *clientUser}
+		if idx := strings.IndexByte(*clientUser, '/'); idx >= 0 {
+			id.Scope, id.Name = (*clientUser)[:idx], (*clientUser)[idx+1:]
+		}
+		client.IDs = []*lib.PeerIdentifier{id}
+	}
+
+	config, err := lib.ParseConfigFile(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	rule, groups := t.route(config, *downstream, targetAddr, client)
+
+	if rule == "" {
+		fmt.Println("Rule: (none)")
+	} else {
+		fmt.Printf("Rule: %s\n", rule)
+		c := config.Rules[rule]
+		if c.Description != "" {
+			fmt.Printf("  Description: %s\n", c.Description)
+		}
+		if len(c.Tags) > 0 {
+			fmt.Printf("  Tags: %s\n", strings.Join(c.Tags, ", "))
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Println("Action: deny")
+		return
+	}
+	fmt.Println("Action: allow")
+	for i, group := range groups {
+		fmt.Printf("Upstreams #%d: %s\n", i, strings.Join(group, ", "))
+	}
+}
+
+// route mirrors how the service decides the upstreams of a request.
+func (explainTool) route(
+	config *lib.Config, downstream string, target lib.Address,
+	client lib.ClientInfo) (string, [][]string) {
+	var dsDefaults []string
+	if downstream != "" {
+		ds, ok := config.Downstreams[downstream]
+		if !ok {
+			panic("undefined downstream: " + downstream)
+		}
+		dsDefaults = ds.DefaultUpstreams
+	}
+	denyUnmatched, err := config.Misc.DenyUnmatched()
+	if err != nil {
+		panic(err)
+	}
+	var unmatched []string
+	if !denyUnmatched {
+		for name := range config.Upstreams {
+			unmatched = append(unmatched, name)
+		}
+		sort.Strings(unmatched) // in random order in the service
+	}
+
+	matcher, err := lib.NewRuleMatcher(config.Rules)
+	if err != nil {
+		panic(err)
+	}
+	return matcher.Route(target, client, dsDefaults, unmatched)
+}
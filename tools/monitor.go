@@ -2,13 +2,18 @@ package tools
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -42,6 +47,7 @@ func (t *monitorTool) Run(args []string) {
 		"base address to the service monitor.")
 	cert := fs.String("cert", "", "optional TLS client certificate.")
 	key := fs.String("key", "", "private key file for the client certificate.")
+	ca := fs.String("ca", "", "optional CA to verify the service certificate.")
 	_ = fs.Parse(args)
 	if t.addr == "" {
 		panic("-addr must be specified")
@@ -61,13 +67,24 @@ func (t *monitorTool) Run(args []string) {
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
+	if *cert != "" || *ca != "" {
+		transport.TLSClientConfig = &tls.Config{}
+	}
 	if *cert != "" {
 		if c, err := tls.LoadX509KeyPair(*cert, *key); err != nil {
 			panic("Failed to load certificate: " + err.Error())
 		} else {
-			transport.TLSClientConfig = &tls.Config{
-				Certificates: []tls.Certificate{c},
-			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{c}
+		}
+	}
+	if *ca != "" {
+		pem, err := ioutil.ReadFile(*ca)
+		if err != nil {
+			panic("Failed to load CA: " + err.Error())
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			panic("No certificate found in " + *ca)
 		}
 	}
 	t.client.Transport = transport
@@ -75,28 +92,44 @@ func (t *monitorTool) Run(args []string) {
 	if err := t.setupConsole("monitor> "); err != nil {
 		panic(err)
 	}
-	t.addCmd("ls", "ls", t.ls)
+	t.addCmd("ls", "ls [PAGE]", t.ls)
 	t.addCmd("show", "show INDEX_IN_LAST_LS", t.show)
 	t.addCmd("showreq", "showreq REQUEST_ID", t.showreq)
+	t.addCmd("history", "history [COUNT]", t.history)
 	t.addCmd("kill", "kill INDEX_IN_LAST_LS", t.kill)
 	t.addCmd("killreq", "killreq REQUEST_ID", t.killreq)
+	t.addCmd("probe", "probe UPSTREAM HOST:PORT", t.probe)
+	t.addCmd("maintenance", "maintenance [on|drain|off]", t.maintenance)
+	t.addCmd("reload-rules", "reload-rules", t.reloadRules)
+	t.addCmd("reset", "reset", t.reset)
 	defer t.teardownConsole()
 	t.runLoop()
 }
 
+// lsPageSize is the number of tunnels listed by each page of 'ls'.
+const lsPageSize = 100
+
 func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
-	if len(args) != 0 {
-		fmt.Fprintln(term, "'ls' doesn't take any argument")
+	page := 0
+	if len(args) > 1 {
+		fmt.Fprintln(term, "Usage: ls [PAGE]")
 		return true
+	} else if len(args) == 1 {
+		var err error
+		if page, err = strconv.Atoi(args[0]); err != nil || page < 0 {
+			fmt.Fprintln(term, "Invalid page: "+args[0])
+			return true
+		}
 	}
 	var report lib.AppMonitorReport
-	if err := t.request(http.MethodGet, "/", &report); err != nil {
+	uri := fmt.Sprintf("/?offset=%d&limit=%d", page*lsPageSize, lsPageSize)
+	if err := t.request(http.MethodGet, uri, nil, &report); err != nil {
 		fmt.Fprintln(term, err.Error())
 		return true
 	}
 
 	w := tabwriter.NewWriter(term, 2, 0, 2, ' ', tabwriter.AlignRight)
-	fmt.Fprintln(w, "Tunnels")
+	fmt.Fprintf(w, "Tunnels (page %d, %d in total)\n", page, report.TunnelCount)
 	fmt.Fprintln(w,
 		"#\tReqID\tClient\tTarget\tUpstream\tUpload\tDownload\tElapsed\t")
 	t.lastListedReqIDs = make([]string, len(report.Tunnels))
@@ -112,15 +145,21 @@ func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
 	}
 	fmt.Fprintln(w, "Upstreams")
 	fmt.Fprintln(w,
-		"Name\tTunnels\t\tUpload\t\tDownload\tLatencyMs\tErrors\t")
+		"Name\tTunnels\t\tUpload\t\tDownload\tLatencyMs\tErrors\tDialing\t"+
+			"Compression\t")
 	for _, r := range report.Upstreams {
-		fmt.Fprintf(w, "%s\t%d\t%s/s\t(%s)\t%s/s\t(%s)\t%.2f ms\t%d\t\n",
+		compRatio := "-"
+		if r.CompressionRatio > 0 {
+			compRatio = fmt.Sprintf("%.2f", r.CompressionRatio)
+		}
+		fmt.Fprintf(w,
+			"%s\t%d\t%s/s\t(%s)\t%s/s\t(%s)\t%.2f ms\t%d\t%d\t%s\t\n",
 			r.Name, upstreamTunnelCount[r.Name],
 			lib.BytesHumanized(uint64(r.UploadSpeed)),
 			lib.BytesHumanized(r.BytesUploaded),
 			lib.BytesHumanized(uint64(r.DownloadSpeed)),
 			lib.BytesHumanized(r.BytesDownloaded),
-			r.AvgConnLatencyMs, r.ErrorCount,
+			r.AvgConnLatencyMs, r.ErrorCount, r.DialsInFlight, compRatio,
 		)
 	}
 	_ = w.Flush()
@@ -128,14 +167,85 @@ func (t *monitorTool) ls(term *terminal.Terminal, args []string) bool {
 	w = tabwriter.NewWriter(term, 2, 0, 2, ' ', 0)
 	fmt.Fprintf(w, "\nServer:\tThestral2 %s\t%s\t\n",
 		report.ThestralVersion, report.Runtime)
+	if report.Draining {
+		fmt.Fprintln(w, "Maintenance:\ton, draining")
+	} else if report.Maintenance {
+		fmt.Fprintln(w, "Maintenance:\ton")
+	}
 	fmt.Fprintf(w, "AvgConnLatencyMs:\t%.2f ms\n", report.AvgConnLatencyMs)
 	fmt.Fprintf(w, "ErrorCount:\t%d\n", report.ErrorCount)
+	reasons := make([]string, 0, len(report.ErrorReasons))
+	for reason := range report.ErrorReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %s:\t%d\n", reason, report.ErrorReasons[reason])
+	}
+	if report.DroppedTunnelSummaries > 0 {
+		fmt.Fprintf(w, "DroppedTunnelSummaries:\t%d\n",
+			report.DroppedTunnelSummaries)
+	}
 	fmt.Fprintf(w, "Upload:\t%s/s\t(%s)\t\n",
 		lib.BytesHumanized(uint64(report.UploadSpeed)),
 		lib.BytesHumanized(report.BytesUploaded))
 	fmt.Fprintf(w, "Download:\t%s/s\t(%s)\t\n",
 		lib.BytesHumanized(uint64(report.DownloadSpeed)),
 		lib.BytesHumanized(report.BytesDownloaded))
+	if kcp := report.KCP; kcp != nil {
+		fmt.Fprintf(w, "KCP:\tretrans %d\tfast retrans %d\tlost %d\t\n",
+			kcp.RetransSegs, kcp.FastRetransSegs, kcp.LostSegs)
+		fmt.Fprintf(w, "\tFEC recovered %d\tFEC errors %d\t\n",
+			kcp.FECRecovered, kcp.FECErrs)
+	}
+	if p := report.Process; p != nil {
+		fds := "-"
+		if p.OpenFDs >= 0 {
+			fds = strconv.Itoa(p.OpenFDs)
+		}
+		fmt.Fprintf(w, "Process:	goroutines %d	heap %s	FDs %s	\n",
+			p.Goroutines, lib.BytesHumanized(p.HeapAlloc), fds)
+		fmt.Fprintf(w, "	GC %d	pause %.2f ms	last %.2f ms	\n",
+			p.NumGC, p.GCPauseTotalMs, p.LastGCPauseMs)
+	}
+	_ = w.Flush()
+	return true
+}
+
+func (t *monitorTool) history(term *terminal.Terminal, args []string) bool {
+	count := -1
+	if len(args) > 1 {
+		fmt.Fprintln(term, "Usage: history [COUNT]")
+		return true
+	} else if len(args) == 1 {
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count <= 0 {
+			fmt.Fprintln(term, "Invalid count: "+args[0])
+			return true
+		}
+	}
+	var history []*lib.TunnelSummary
+	if err := t.request(http.MethodGet, "/history", nil, &history); err != nil {
+		fmt.Fprintln(term, err.Error())
+		return true
+	}
+	if count >= 0 && count < len(history) {
+		history = history[:count]
+	}
+
+	w := tabwriter.NewWriter(term, 2, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Closed tunnels (%d, the newest first)\n", len(history))
+	fmt.Fprintln(w,
+		"ClosedAt\tReqID\tClient\tTarget\tUpstream\tUploaded\tDownloaded"+
+			"\tElapsed\tTerminatedBy\t")
+	for _, r := range history {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			r.ClosedAt.Local().Format("15:04:05"), r.RequestID,
+			r.ClientAddr, r.TargetAddr, r.Upstream,
+			lib.BytesHumanized(r.BytesUploaded),
+			lib.BytesHumanized(r.BytesDownloaded),
+			t.formatSeconds(r.ElapsedTimeSecs), r.TerminatedBy)
+	}
 	_ = w.Flush()
 	return true
 }
@@ -181,7 +291,7 @@ func (t *monitorTool) showreq(term *terminal.Terminal, args []string) bool {
 	}
 	var report lib.TunnelMonitorReport
 	if err := t.request(
-		http.MethodGet, "/tunnel/"+args[0], &report); err != nil {
+		http.MethodGet, "/tunnel/"+args[0], nil, &report); err != nil {
 		fmt.Fprintln(term, err.Error())
 		return true
 	}
@@ -195,7 +305,98 @@ func (t *monitorTool) killreq(term *terminal.Terminal, args []string) bool {
 		return true
 	}
 	if err := t.request(
-		http.MethodDelete, "/tunnel/"+args[0], nil); err != nil {
+		http.MethodDelete, "/tunnel/"+args[0], nil, nil); err != nil {
+		fmt.Fprintln(term, err.Error())
+		return true
+	}
+	fmt.Fprintln(term, "Done")
+	return true
+}
+
+func (t *monitorTool) probe(term *terminal.Terminal, args []string) bool {
+	if len(args) != 2 {
+		fmt.Fprintln(term, "'probe' takes exactly two arguments")
+		return true
+	}
+	query := url.Values{"upstream": {args[0]}, "target": {args[1]}}
+	var report lib.ProbeReport
+	if err := t.request(
+		http.MethodGet, "/probe?"+query.Encode(), nil, &report); err != nil {
+		fmt.Fprintln(term, err.Error())
+		return true
+	}
+	if report.Success {
+		fmt.Fprintf(term, "%s via %s: OK in %.2f ms\n",
+			report.Target, report.Upstream, report.LatencyMs)
+	} else {
+		fmt.Fprintf(term, "%s via %s: failed in %.2f ms (%s): %s\n",
+			report.Target, report.Upstream, report.LatencyMs,
+			report.Reason, report.Error)
+	}
+	return true
+}
+
+func (t *monitorTool) maintenance(
+	term *terminal.Terminal, args []string) bool {
+	method, body := http.MethodGet, ""
+	if len(args) > 1 {
+		fmt.Fprintln(term, "'maintenance' takes at most one argument")
+		return true
+	} else if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			body = `{"on":true}`
+		case "drain":
+			body = `{"on":true,"drain":true}`
+		case "off":
+			body = `{"on":false}`
+		default:
+			fmt.Fprintln(
+				term, "'maintenance' takes either 'on', 'drain' or 'off'")
+			return true
+		}
+		method = http.MethodPost
+	}
+	var state struct {
+		On    bool `json:"on"`
+		Drain bool `json:"drain"`
+	}
+	if err := t.request(method, "/maintenance",
+		strings.NewReader(body), &state); err != nil {
+		fmt.Fprintln(term, err.Error())
+		return true
+	}
+	if state.Drain {
+		fmt.Fprintln(term, "Maintenance mode: on, draining")
+	} else if state.On {
+		fmt.Fprintln(term, "Maintenance mode: on")
+	} else {
+		fmt.Fprintln(term, "Maintenance mode: off")
+	}
+	return true
+}
+
+func (t *monitorTool) reloadRules(
+	term *terminal.Terminal, args []string) bool {
+	if len(args) != 0 {
+		fmt.Fprintln(term, "'reload-rules' doesn't take any argument")
+		return true
+	}
+	if err := t.request(
+		http.MethodPost, "/reload-rules", nil, nil); err != nil {
+		fmt.Fprintln(term, err.Error())
+		return true
+	}
+	fmt.Fprintln(term, "Done")
+	return true
+}
+
+func (t *monitorTool) reset(term *terminal.Terminal, args []string) bool {
+	if len(args) != 0 {
+		fmt.Fprintln(term, "'reset' doesn't take any argument")
+		return true
+	}
+	if err := t.request(http.MethodPost, "/reset", nil, nil); err != nil {
 		fmt.Fprintln(term, err.Error())
 		return true
 	}
@@ -204,8 +405,8 @@ func (t *monitorTool) killreq(term *terminal.Terminal, args []string) bool {
 }
 
 func (t *monitorTool) request(
-	method, uri string, optPtrResp interface{}) error {
-	req, err := http.NewRequest(method, t.addr+uri, nil)
+	method, uri string, body io.Reader, optPtrResp interface{}) error {
+	req, err := http.NewRequest(method, t.addr+uri, body)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/richardtsai/thestral2/lib"
+)
+
+func init() {
+	allTools = append(allTools, protocolsTool{})
+}
+
+type protocolsTool struct{}
+
+func (protocolsTool) Name() string {
+	return "protocols"
+}
+
+func (protocolsTool) Description() string {
+	return "List the available proxy protocols, their settings and transports"
+}
+
+func (t protocolsTool) Run(args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 2, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Protocol\tRole\tSettings\t")
+	for _, info := range lib.ListProxyProtocols() {
+		if info.Client {
+			fmt.Fprintf(w, "%s\tupstream\t%s\t\n",
+				info.Name, t.formatSettings(info.ClientSettings))
+		}
+		if info.Server {
+			fmt.Fprintf(w, "%s\tdownstream\t%s\t\n",
+				info.Name, t.formatSettings(info.ServerSettings))
+		}
+	}
+	_ = w.Flush()
+
+	var builtin, custom []string
+	for _, info := range lib.ListTransports() {
+		if info.Custom {
+			custom = append(custom, info.Name)
+		} else {
+			builtin = append(builtin, info.Name)
+		}
+	}
+	fmt.Printf("\nTransports: %s\n", strings.Join(builtin, ", "))
+	if len(custom) > 0 {
+		fmt.Printf("Custom transports: %s\n", strings.Join(custom, ", "))
+	}
+}
+
+// formatSettings lists the settings like "address (string, required)".
+func (protocolsTool) formatSettings(settings []lib.SettingInfo) string {
+	if settings == nil {
+		return "-"
+	}
+	items := make([]string, len(settings))
+	for i, s := range settings {
+		items[i] = fmt.Sprintf("%s (%s)", s.Name, s.Type)
+		if s.Required {
+			items[i] = fmt.Sprintf("%s (%s, required)", s.Name, s.Type)
+		}
+	}
+	return strings.Join(items, ", ")
+}
@@ -1,12 +1,18 @@
 package tools
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/pkg/errors"
@@ -72,6 +78,9 @@ func (t *usersTool) Run(args []string) {
 	t.addCmd("delete", "delete SCOPE/NAME", t.deleteUser)
 	t.addCmd("list", "list [SCOPE]", t.listUsers)
 	t.addCmd("passwd", "passwd SCOPE/NAME", t.changePasswd)
+	t.addCmd("import", "import FILE.{csv,json}", t.importUsers)
+	t.addCmd("export",
+		"export [-hashes] FILE.{csv,json} [SCOPE]", t.exportUsers)
 	t.runLoop()
 }
 
@@ -142,11 +151,16 @@ func (t *usersTool) listUsers(term *terminal.Terminal, args []string) bool {
 		return true
 	}
 	w := tabwriter.NewWriter(term, 4, 0, 2, ' ', 0)
-	_, _ = fmt.Fprintln(w, "ID\tScope\tName\tPassword\tCreated At")
+	_, _ = fmt.Fprintln(
+		w, "ID\tScope\tName\tPassword\tCreated At\tExpires At")
 	for _, user := range users {
-		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\n",
+		expiresAt := "-"
+		if user.ExpiresAt != nil {
+			expiresAt = user.ExpiresAt.Format(time.RFC822)
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\t%s\n",
 			user.ID, user.Scope, user.Name, user.PWHash != nil,
-			user.CreatedAt.Format(time.RFC822))
+			user.CreatedAt.Format(time.RFC822), expiresAt)
 	}
 	_ = w.Flush()
 	return true
@@ -190,6 +204,87 @@ func (t *usersTool) changePasswd(term *terminal.Terminal, args []string) bool {
 	return true
 }
 
+func (t *usersTool) importUsers(term *terminal.Terminal, args []string) bool {
+	if len(args) != 1 {
+		_, _ = fmt.Fprintln(term, "exactly one argument is required")
+		return true
+	}
+	records, err := readUserRecords(args[0])
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to read '%s': %v\n", args[0], err)
+		return true
+	}
+
+	added := 0
+	for start := 0; start < len(records); start += userImportBatchSize {
+		end := start + userImportBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		var users []*db.User
+		var indices []int
+		for i := start; i < end; i++ {
+			if user, err := records[i].ToUser(); err != nil {
+				_, _ = fmt.Fprintf(term, "record %d: %v\n", i+1, err)
+			} else {
+				users = append(users, user)
+				indices = append(indices, i)
+			}
+		}
+		for i, err := range t.dao.AddBatch(users) {
+			if err != nil {
+				_, _ = fmt.Fprintf(term, "record %d: %v\n", indices[i]+1, err)
+			} else {
+				added++
+			}
+		}
+	}
+	_, _ = fmt.Fprintf(term, "%d of %d users imported\n", added, len(records))
+	return true
+}
+
+func (t *usersTool) exportUsers(term *terminal.Terminal, args []string) bool {
+	withHashes := len(args) > 0 && args[0] == "-hashes"
+	if withHashes {
+		args = args[1:]
+	}
+	var users []*db.User
+	var err error
+	switch len(args) {
+	case 1:
+		users, err = t.dao.ListAll()
+	case 2:
+		users, err = t.dao.List(args[1])
+	default:
+		_, _ = fmt.Fprintln(term, "one or two arguments are required")
+		return true
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(term, "failed to list users: %v\n", err)
+		return true
+	}
+
+	records := make([]userRecord, len(users))
+	for i, user := range users {
+		records[i] = userRecord{Scope: user.Scope, Name: user.Name}
+		if user.PWHash != nil && withHashes {
+			records[i].PWHash = string(*user.PWHash)
+		} else if user.PWHash != nil {
+			records[i].PWHash = maskedPWHash
+		}
+		if user.ExpiresAt != nil {
+			records[i].ExpiresAt = user.ExpiresAt.Format(time.RFC3339)
+		}
+	}
+	if err = writeUserRecords(args[0], records); err != nil {
+		_, _ = fmt.Fprintf(term, "failed to write '%s': %v\n", args[0], err)
+	} else {
+		_, _ = fmt.Fprintf(
+			term, "%d users exported to '%s'\n", len(records), args[0])
+	}
+	return true
+}
+
 type userSpec struct {
 	Scope string
 	Name  string
@@ -208,3 +303,156 @@ func (u *userSpec) FromString(s string) error {
 	u.Name = parts[1]
 	return nil
 }
+
+const (
+	userImportBatchSize = 100
+	// maskedPWHash is exported instead of the password hashes by default.
+	maskedPWHash = "*"
+)
+
+// userCSVHeader is the header of the CSV files, where only the scope and the
+// name are required for importing.
+var userCSVHeader = []string{"scope", "name", "pwhash", "expires_at"}
+
+// userRecord is a user in the files imported or exported. PWHash is a bcrypt
+// hash, and ExpiresAt is in RFC 3339.
+type userRecord struct {
+	Scope     string `json:"scope"`
+	Name      string `json:"name"`
+	PWHash    string `json:"pwhash,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	err       error  // the record is malformed if set
+}
+
+func (r userRecord) ToUser() (*db.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	us := userSpec{}
+	if err := us.FromString(r.Scope + "/" + r.Name); err != nil {
+		return nil, err
+	}
+	u := &db.User{Scope: us.Scope, Name: us.Name}
+	switch r.PWHash {
+	case "":
+	case maskedPWHash:
+		return nil, errors.Errorf("password hash of '%s' is masked", us)
+	default:
+		if _, err := bcrypt.Cost([]byte(r.PWHash)); err != nil {
+			return nil, errors.Wrapf(err, "invalid password hash of '%s'", us)
+		}
+		hash := []byte(r.PWHash)
+		u.PWHash = &hash
+	}
+	if r.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, r.ExpiresAt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid expiry of '%s'", us)
+		}
+		u.ExpiresAt = &expiresAt
+	}
+	return u, nil
+}
+
+// readUserRecords reads the users from a CSV or JSON file. The malformed
+// records in a CSV file are reported by ToUser.
+func readUserRecords(path string) ([]userRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	var records []userRecord
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&records)
+		return records, errors.WithStack(err)
+	case ".csv":
+	default:
+		return nil, errors.New("unknown file type, .csv or .json expected")
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the header")
+	}
+	columns := make(map[string]int)
+	for i, col := range header {
+		found := false
+		for _, c := range userCSVHeader {
+			found = found || c == col
+		}
+		if _, dup := columns[col]; !found || dup {
+			return nil, errors.Errorf("unknown or duplicated column '%s'", col)
+		}
+		columns[col] = i
+	}
+	for _, col := range []string{"scope", "name"} {
+		if _, ok := columns[col]; !ok {
+			return nil, errors.Errorf("column '%s' is required", col)
+		}
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		} else if _, ok := err.(*csv.ParseError); !ok && err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var record userRecord
+		if err != nil {
+			record.err = err
+		} else if len(row) != len(header) {
+			record.err = errors.Errorf(
+				"%d fields expected, got %d", len(header), len(row))
+		} else {
+			get := func(col string) string {
+				if i, ok := columns[col]; ok {
+					return row[i]
+				}
+				return ""
+			}
+			record = userRecord{
+				Scope:     get("scope"),
+				Name:      get("name"),
+				PWHash:    get("pwhash"),
+				ExpiresAt: get("expires_at"),
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+// writeUserRecords writes the users to a CSV or JSON file, which is only
+// readable by the owner as it may contain the password hashes.
+func writeUserRecords(path string, records []userRecord) (err error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".json" && ext != ".csv" {
+		return errors.New("unknown file type, .csv or .json expected")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if cErr := f.Close(); err == nil {
+			err = errors.WithStack(cErr)
+		}
+	}()
+
+	if ext == ".json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(records))
+	}
+	w := csv.NewWriter(f)
+	_ = w.Write(userCSVHeader)
+	for _, r := range records {
+		_ = w.Write([]string{r.Scope, r.Name, r.PWHash, r.ExpiresAt})
+	}
+	w.Flush()
+	return errors.WithStack(w.Error())
+}